@@ -2,6 +2,7 @@ import gc
 import json
 import logging
 import os
+import time
 from pathlib import Path
 
 import numpy as np
@@ -17,6 +18,10 @@ IMAGE_SIZE = 224
 HIDDEN_DIM = 512
 
 
+class PredictionCancelled(Exception):
+    """Raised by Autotagger.predict when should_stop asks it to abort."""
+
+
 def _get_env_int(name: str, default: int, minimum: int | None = None) -> int:
     raw = os.getenv(name, str(default)).strip()
     try:
@@ -166,15 +171,30 @@ class Autotagger:
             raise ValueError("expected RGB image input")
         return torch.from_numpy(np.transpose(array, (2, 0, 1)))
 
-    def _prepare_batch(self, items):
-        tensors = [self._prepare_image(item) for item in items]
+    def _prepare_batch(self, items, skip_errors=False, load_seconds=None):
+        """With skip_errors, images that fail to load are replaced by a blank
+        image and returned as {offset: error} instead of failing the batch.
+        If load_seconds is a list, each image's loading time is appended."""
+        tensors = []
+        errors = {}
+        for offset, item in enumerate(items):
+            started = time.perf_counter()
+            try:
+                tensors.append(self._prepare_image(item))
+            except (OSError, ValueError, TypeError, Image.DecompressionBombError) as err:
+                if not skip_errors:
+                    raise
+                errors[offset] = err
+                tensors.append(torch.zeros(3, IMAGE_SIZE, IMAGE_SIZE))
+            if load_seconds is not None:
+                load_seconds.append(time.perf_counter() - started)
         batch = torch.stack(tensors, dim=0)
         if self.device.type == "cuda":
             batch = batch.pin_memory()
             batch = batch.to(self.device, non_blocking=True)
         else:
             batch = batch.to(self.device)
-        return batch
+        return batch, errors
 
     def _run_inference(self, batch):
         with torch.inference_mode():
@@ -213,7 +233,15 @@ class Autotagger:
             return next_bs
         raise err
 
-    def predict(self, files, threshold=0.01, limit=50, bs=None):
+    def predict(self, files, threshold=0.01, limit=50, bs=None, on_result=None, on_error=None, timings=None, should_stop=None):
+        """Tag files in batches. on_result, if given, is called with
+        (index, tags) for each file as soon as its batch finishes. If on_error
+        is given, a file that cannot be loaded is reported as (index, error),
+        gets None in the returned list, and does not fail the other files.
+        If timings is a dict, it is filled with index -> seconds spent on each
+        file before on_result is called: the file's own loading time plus an
+        even share of its batch's inference. should_stop, if given, is checked
+        before each batch; once it returns true, PredictionCancelled is raised."""
         if not files:
             return []
 
@@ -226,16 +254,30 @@ class Autotagger:
         try:
             start = 0
             while start < len(files):
+                if should_stop is not None and should_stop():
+                    raise PredictionCancelled(f"canceled after {start} of {len(files)} files")
                 current_bs = min(bs, len(files) - start)
                 while True:
                     try:
                         batch_items = files[start : start + current_bs]
-                        batch = self._prepare_batch(batch_items)
+                        load_seconds = []
+                        batch, errors = self._prepare_batch(batch_items, skip_errors=on_error is not None, load_seconds=load_seconds)
+                        started = time.perf_counter()
                         scores = self._run_inference(batch).detach().cpu().numpy()
-                        outputs.extend(
-                            _process_scores(score_row, self.vocab, threshold=threshold, limit=limit)
-                            for score_row in scores
-                        )
+                        if timings is not None:
+                            share = (time.perf_counter() - started) / len(batch_items)
+                            for offset, seconds in enumerate(load_seconds):
+                                timings[start + offset] = seconds + share
+                        batch_outputs = [
+                            None if offset in errors else _process_scores(score_row, self.vocab, threshold=threshold, limit=limit)
+                            for offset, score_row in enumerate(scores)
+                        ]
+                        outputs.extend(batch_outputs)
+                        for offset, tags in enumerate(batch_outputs):
+                            if offset in errors:
+                                on_error(start + offset, errors[offset])
+                            elif on_result is not None:
+                                on_result(start + offset, tags)
                         start += current_bs
                         break
                     except RuntimeError as err:
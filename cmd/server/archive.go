@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxArchiveEntries = 500
+	defaultMaxArchiveMB      = 512
+)
+
+// isArchiveUpload reports whether an uploaded part should be unpacked as a
+// ZIP archive rather than tagged as an image.
+func isArchiveUpload(fh *multipart.FileHeader) bool {
+	mediaType, _, _ := mime.ParseMediaType(fh.Header.Get("Content-Type"))
+	switch strings.ToLower(mediaType) {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.EqualFold(path.Ext(fh.Filename), ".zip")
+}
+
+// archiveEntryName normalizes the path of a ZIP entry and reports whether it
+// should be tagged. Directories and metadata such as __MACOSX/ and dotfiles
+// are skipped.
+func archiveEntryName(name string) (string, bool) {
+	name = path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "__MACOSX" || (strings.HasPrefix(part, ".") && part != "..") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func unsafeArchivePath(name string) bool {
+	return path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../")
+}
+
+// extractArchive stores the entries of a ZIP upload in tmpDir and returns one
+// input per entry, named by its path inside the archive. Entries are written
+// under generated names, never their archive paths, and both the entry count
+// and the total uncompressed size are capped before anything is trusted.
+func (s *server) extractArchive(f io.ReaderAt, size int64, archiveName, tmpDir string, firstIndex int) ([]evalInput, error) {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("file %q is not a valid zip archive", archiveName))
+	}
+
+	entries := make([]*zip.File, 0, len(zr.File))
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if _, ok := archiveEntryName(zf.Name); ok {
+			entries = append(entries, zf)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, badRequest(fmt.Sprintf("archive %q contains no files", archiveName))
+	}
+	if len(entries) > s.maxArchiveEntries {
+		return nil, badRequest(fmt.Sprintf("archive %q has too many files; maximum is %d", archiveName, s.maxArchiveEntries))
+	}
+
+	var total int64
+	inputs := make([]evalInput, 0, len(entries))
+	for i, zf := range entries {
+		name, _ := archiveEntryName(zf.Name)
+		if unsafeArchivePath(name) {
+			inputs = append(inputs, evalInput{name: name, err: fmt.Errorf("archive entry %q has an unsafe path", name)})
+			continue
+		}
+		if s.maxFileBytes > 0 && zf.UncompressedSize64 > uint64(s.maxFileBytes) {
+			inputs = append(inputs, evalInput{name: name, err: fmt.Errorf("file %q exceeds the per-file size limit", name)})
+			continue
+		}
+
+		// The copy stops just past whichever is smaller: MAX_FILE_MB or what
+		// is left of MAX_ARCHIVE_MB, so no entry inflates past either.
+		limit := s.maxArchiveBytes - total
+		if s.maxFileBytes > 0 && s.maxFileBytes < limit {
+			limit = s.maxFileBytes
+		}
+		dstPath := filepath.Join(tmpDir, tempFilename(name, firstIndex+i))
+		hash, n, err := extractEntry(zf, dstPath, limit)
+		total += n
+		if total > s.maxArchiveBytes {
+			return nil, badRequest(fmt.Sprintf("archive %q exceeds the uncompressed size limit", archiveName))
+		}
+		if err == nil {
+			if err = s.checkImage(dstPath, name); err != nil {
+				_ = os.Remove(dstPath)
+			}
+		}
+		if errors.Is(err, errDiskFull) {
+			return nil, err
+		}
+		if err != nil {
+			inputs = append(inputs, evalInput{name: name, err: err})
+			continue
+		}
+		inputs = append(inputs, evalInput{name: name, path: dstPath, hash: hash})
+	}
+	return inputs, nil
+}
+
+// extractEntry copies one entry to dstPath, stopping one byte past maxBytes
+// so a header that understates the size cannot be used to inflate past the
+// limit. It returns the hex SHA-256 and the number of bytes written.
+func extractEntry(zf *zip.File, dstPath string, maxBytes int64) (string, int64, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return "", 0, fmt.Errorf("archive entry %q could not be read", zf.Name)
+	}
+	defer rc.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", 0, storeError(err)
+	}
+	hasher := sha256.New()
+	n, copyErr := io.Copy(io.MultiWriter(dst, hasher), io.LimitReader(rc, maxBytes+1))
+	closeErr := dst.Close()
+	switch {
+	case isNoSpace(copyErr):
+		err = storeError(copyErr)
+	case copyErr != nil:
+		err = fmt.Errorf("archive entry %q could not be read", zf.Name)
+	case closeErr != nil:
+		err = storeError(closeErr)
+	case n > maxBytes:
+		err = fmt.Errorf("file %q exceeds the per-file size limit", zf.Name)
+	case n == 0:
+		err = fmt.Errorf("file %q is empty", zf.Name)
+	}
+	if err != nil {
+		_ = os.Remove(dstPath)
+		return "", n, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func buildZip(t *testing.T, files map[string][]byte) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) error = %v", name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Write(%q) error = %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestArchiveEntryName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name: "a.png", want: "a.png", wantOK: true},
+		{name: `dir\b.png`, want: "dir/b.png", wantOK: true},
+		{name: "dir/../c.png", want: "c.png", wantOK: true},
+		{name: "../evil.png", want: "../evil.png", wantOK: true},
+		{name: "__MACOSX/._a.png", wantOK: false},
+		{name: "dir/.DS_Store", wantOK: false},
+	}
+	for _, tc := range tests {
+		got, ok := archiveEntryName(tc.name)
+		if ok != tc.wantOK || (ok && got != tc.want) {
+			t.Fatalf("archiveEntryName(%q) = %q, %v, want %q, %v", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	t.Parallel()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	zr := buildZip(t, map[string][]byte{
+		"set/one.png":      img.Bytes(),
+		"../escape.png":    img.Bytes(),
+		"notes.txt":        []byte("hello, world"),
+		"__MACOSX/._x.png": []byte("junk"),
+	})
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	dir := t.TempDir()
+	inputs, err := s.extractArchive(zr, zr.Size(), "batch.zip", dir, 3)
+	if err != nil {
+		t.Fatalf("extractArchive() error = %v", err)
+	}
+	if len(inputs) != 3 {
+		t.Fatalf("len(inputs) = %d, want 3", len(inputs))
+	}
+	byName := make(map[string]evalInput, len(inputs))
+	for _, in := range inputs {
+		byName[in.name] = in
+	}
+	if in := byName["set/one.png"]; in.err != nil || in.hash == "" {
+		t.Fatalf("set/one.png = %+v, want a stored input", in)
+	}
+	if in := byName["../escape.png"]; in.err == nil || in.path != "" {
+		t.Fatalf("../escape.png = %+v, want an unsafe path error", in)
+	}
+	if in := byName["notes.txt"]; in.err == nil {
+		t.Fatal("notes.txt was accepted as an image")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temp dir has %d files, want only the extracted image", len(entries))
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.maxArchiveEntries = 1
+	zr := buildZip(t, map[string][]byte{"a.png": {1}, "b.png": {2}})
+	_, err := s.extractArchive(zr, zr.Size(), "many.zip", t.TempDir(), 0)
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("too many entries: error = %v, want requestError", err)
+	}
+
+	s = newServer(nil, 1, 32, 16, 8, 200)
+	s.maxArchiveBytes = 1024
+	zr = buildZip(t, map[string][]byte{"big.png": bytes.Repeat([]byte{0}, 4096)})
+	if _, err := s.extractArchive(zr, zr.Size(), "bomb.zip", t.TempDir(), 0); !errors.As(err, &reqErr) {
+		t.Fatalf("oversized archive: error = %v, want requestError", err)
+	}
+
+	// Without MAX_FILE_MB the archive limit still stops the copy.
+	s = newServer(nil, 1, 32, 16, 8, 200)
+	s.maxFileBytes = 0
+	s.maxArchiveBytes = 1024
+	dir := t.TempDir()
+	zr = buildZip(t, map[string][]byte{"big.png": bytes.Repeat([]byte{0}, 4096)})
+	if _, err := s.extractArchive(zr, zr.Size(), "bomb.zip", dir, 0); !errors.As(err, &reqErr) {
+		t.Fatalf("oversized archive without a file limit: error = %v, want requestError", err)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Fatalf("%d files left after the archive limit was hit, want none", len(left))
+	}
+}
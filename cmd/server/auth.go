@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authExemptPaths stay reachable without a key so probes keep working and
+// browsers can fetch the favicon.
+var authExemptPaths = map[string]bool{
+	"/healthz":     true,
+	"/readyz":      true,
+	"/favicon.ico": true,
+}
+
+// parseAPIKeys turns a comma-separated API_KEYS value into key digests.
+// Keys are compared as SHA-256 digests so comparison time does not depend on
+// key length either.
+func parseAPIKeys(raw string) [][sha256.Size]byte {
+	var keys [][sha256.Size]byte
+	for _, key := range strings.Split(raw, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		keys = append(keys, sha256.Sum256([]byte(key)))
+	}
+	return keys
+}
+
+// requestAPIKey returns the key from an "Authorization: Bearer" header,
+// falling back to X-API-Key.
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// validAPIKey checks key against every configured key without returning
+// early, so timing does not reveal which key or how much of it matched.
+func validAPIKey(keys [][sha256.Size]byte, key string) bool {
+	if key == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(key))
+	match := 0
+	for i := range keys {
+		match |= subtle.ConstantTimeCompare(sum[:], keys[i][:])
+	}
+	return match == 1
+}
+
+// authMiddleware rejects requests without a valid API key. Shared result
+// pages carry their own token and are let through, as are embedded static
+// assets, which are public anyway. It is a no-op
+// when no keys are configured.
+func (s *server) authMiddleware(next http.Handler) http.Handler {
+	if len(s.apiKeys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authExemptPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/static/") ||
+			validAPIKey(s.apiKeys, requestAPIKey(r)) ||
+			(s.shared != nil && strings.HasPrefix(r.URL.Path, "/results/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="autotagger"`)
+		s.writeError(w, "json", http.StatusUnauthorized, codeUnauthorized, "missing or invalid API key")
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.apiKeys = parseAPIKeys(" alpha ,,beta")
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "no key", path: "/evaluate", wantStatus: http.StatusUnauthorized},
+		{name: "bearer", path: "/evaluate", header: "Authorization", value: "Bearer beta", wantStatus: http.StatusNoContent},
+		{name: "lowercase scheme", path: "/evaluate", header: "Authorization", value: "bearer alpha", wantStatus: http.StatusNoContent},
+		{name: "x-api-key", path: "/", header: "X-API-Key", value: "alpha", wantStatus: http.StatusNoContent},
+		{name: "wrong key", path: "/evaluate", header: "Authorization", value: "Bearer gamma", wantStatus: http.StatusUnauthorized},
+		{name: "basic scheme", path: "/evaluate", header: "Authorization", value: "Basic alpha", wantStatus: http.StatusUnauthorized},
+		{name: "key prefix", path: "/evaluate", header: "X-API-Key", value: "alph", wantStatus: http.StatusUnauthorized},
+		{name: "healthz open", path: "/healthz", wantStatus: http.StatusNoContent},
+		{name: "favicon open", path: "/favicon.ico", wantStatus: http.StatusNoContent},
+		{name: "static open", path: "/static/app.css", wantStatus: http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: Content-Type = %q, want application/json", tc.name, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestAuthDisabledWithoutKeys(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET / without API_KEYS: status = %d, want 200", rr.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultWorkerBatchSize = 64
+
+// chunkFiles splits files into consecutive chunks of at most size files. A
+// size below 1 keeps them in one chunk.
+func chunkFiles(files []string, size int) [][]string {
+	if size < 1 || len(files) <= size {
+		return [][]string{files}
+	}
+	chunks := make([][]string, 0, (len(files)+size-1)/size)
+	for start := 0; start < len(files); start += size {
+		chunks = append(chunks, files[start:min(start+size, len(files))])
+	}
+	return chunks
+}
+
+// predictChunks predicts files in chunks of the pool's batch size, running
+// at most one chunk per worker at a time, and returns the predictions in the
+// order of files. The first chunk to fail cancels the others.
+// onPrediction is never called concurrently.
+func (wp *workerPool) predictChunks(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	chunks := chunkFiles(files, wp.batchSize)
+	if len(chunks) == 1 {
+		return wp.predictChunk(ctx, files, params, onPrediction)
+	}
+	if onPrediction != nil {
+		var mu sync.Mutex
+		inner := onPrediction
+		onPrediction = func(pred prediction) {
+			mu.Lock()
+			defer mu.Unlock()
+			inner(pred)
+		}
+	}
+
+	wp.mu.RLock()
+	parallel := max(len(wp.workers), 1)
+	wp.mu.RUnlock()
+	chunkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sem := make(chan struct{}, parallel)
+	results := make([][]prediction, len(chunks))
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+dispatch:
+	for i, chunk := range chunks {
+		select {
+		case sem <- struct{}{}:
+		case <-chunkCtx.Done():
+			break dispatch
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			predictions, err := wp.predictChunk(chunkCtx, chunk, params, onPrediction)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = predictions
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	merged := make([]prediction, 0, len(files))
+	for _, predictions := range results {
+		merged = append(merged, predictions...)
+	}
+	return merged, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunkFiles(t *testing.T) {
+	t.Parallel()
+
+	files := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		size int
+		want [][]string
+	}{
+		{0, [][]string{files}},
+		{5, [][]string{files}},
+		{10, [][]string{files}},
+		{2, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{1, [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}}},
+	}
+	for _, tc := range tests {
+		if got := chunkFiles(files, tc.size); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("chunkFiles(%d) = %v, want %v", tc.size, got, tc.want)
+		}
+	}
+}
+
+// echoWorker answers with a prediction tagging every file it is sent with
+// its own name, streamed when the request asks for it, and counts the
+// requests it receives.
+func echoWorker(t *testing.T, requests *atomic.Int64) *workerClient {
+	t.Helper()
+	return newFakeWorker(t, func(line []byte, w io.Writer) {
+		var req workerRequest
+		_ = json.Unmarshal(line, &req)
+		requests.Add(1)
+		done := workerResponse{ID: req.ID, Done: true}
+		for _, file := range req.Files {
+			name := filepath.Base(file)
+			pred := prediction{Filename: name, Tags: map[string]float64{name: 1}}
+			if !req.Stream {
+				done.Predictions = append(done.Predictions, pred)
+				continue
+			}
+			data, _ := json.Marshal(workerResponse{ID: req.ID, Prediction: &pred})
+			fmt.Fprintf(w, "%s\n", data)
+		}
+		data, _ := json.Marshal(done)
+		fmt.Fprintf(w, "%s\n", data)
+	})
+}
+
+func TestWorkerPoolPredictChunks(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	pool := &workerPool{
+		workers:   []*workerClient{echoWorker(t, &requests), echoWorker(t, &requests)},
+		batchSize: 2,
+	}
+	var files []string
+	for i := range 7 {
+		files = append(files, fmt.Sprintf("/t/%d.png", i))
+	}
+	streamed := 0
+	preds, err := pool.predictStream(context.Background(), files, predictParams{}, func(prediction) { streamed++ })
+	if err != nil {
+		t.Fatalf("predictStream() error = %v", err)
+	}
+	if len(preds) != len(files) {
+		t.Fatalf("predictStream() returned %d predictions, want %d", len(preds), len(files))
+	}
+	for i, pred := range preds {
+		if want := filepath.Base(files[i]); pred.Filename != want || pred.Tags[want] != 1 {
+			t.Fatalf("prediction %d = %+v, want %s", i, pred, want)
+		}
+	}
+	if streamed != len(files) {
+		t.Fatalf("onPrediction called %d times, want %d", streamed, len(files))
+	}
+	if got := requests.Load(); got != 4 {
+		t.Fatalf("workers saw %d requests, want 4", got)
+	}
+}
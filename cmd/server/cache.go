@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// predictionCache is an LRU of worker predictions keyed by image hash and the
+// request parameters that affect the tag set. A nil cache is valid and never hits.
+type predictionCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type cacheEntry struct {
+	key  string
+	pred prediction
+}
+
+func newPredictionCache(capacity int) *predictionCache {
+	if capacity < 1 {
+		return nil
+	}
+	return &predictionCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (c *predictionCache) get(key string) (prediction, bool) {
+	if c == nil {
+		return prediction{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return prediction{}, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return clonePrediction(el.Value.(*cacheEntry).pred), true
+}
+
+func (c *predictionCache) put(key string, pred prediction) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).pred = clonePrediction(pred)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, pred: clonePrediction(pred)})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// reset drops every entry, for when the model behind them has changed. The
+// hit and miss counters keep counting.
+func (c *predictionCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.items)
+}
+
+func (c *predictionCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *predictionCache) hitCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hits.Load()
+}
+
+func (c *predictionCache) missCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.misses.Load()
+}
+
+func clonePrediction(pred prediction) prediction {
+	pred.Tags = maps.Clone(pred.Tags)
+	pred.Categories = maps.Clone(pred.Categories)
+	return pred
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestPredictionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	c := newPredictionCache(2)
+	c.put("a", prediction{Tags: map[string]float64{"cat": 0.9}})
+	c.put("b", prediction{Tags: map[string]float64{"dog": 0.8}})
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("get(a) missed, want hit")
+	}
+	c.put("c", prediction{Tags: map[string]float64{"bird": 0.7}})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("get(b) hit, want it evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("get(%s) missed, want hit", key)
+		}
+	}
+	if c.len() != 2 || c.hitCount() != 3 || c.missCount() != 1 {
+		t.Fatalf("len=%d hits=%d misses=%d, want 2/3/1", c.len(), c.hitCount(), c.missCount())
+	}
+}
+
+func TestPredictionCacheReturnsCopies(t *testing.T) {
+	t.Parallel()
+
+	c := newPredictionCache(1)
+	c.put("a", prediction{Tags: map[string]float64{"cat": 0.9}})
+	got, _ := c.get("a")
+	got.Tags["cat"] = 0
+
+	again, _ := c.get("a")
+	if again.Tags["cat"] != 0.9 {
+		t.Fatalf("cached score = %v, want 0.9", again.Tags["cat"])
+	}
+}
+
+func TestNilPredictionCache(t *testing.T) {
+	t.Parallel()
+
+	c := newPredictionCache(0)
+	if c != nil {
+		t.Fatal("newPredictionCache(0) != nil")
+	}
+	c.put("a", prediction{})
+	if _, ok := c.get("a"); ok || c.len() != 0 || c.missCount() != 0 {
+		t.Fatal("nil cache should never hit or count")
+	}
+}
+
+func TestPredictionCacheReset(t *testing.T) {
+	t.Parallel()
+
+	c := newPredictionCache(2)
+	c.put("a", prediction{Tags: map[string]float64{"cat": 0.9}})
+	c.reset()
+	if _, ok := c.get("a"); ok || c.len() != 0 {
+		t.Fatalf("get(a) hit or len = %d after reset, want empty", c.len())
+	}
+	c.put("b", prediction{Tags: map[string]float64{"dog": 0.8}})
+	if _, ok := c.get("b"); !ok {
+		t.Fatal("get(b) missed after reset, want the cache usable again")
+	}
+	newPredictionCache(0).reset()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultCallbackAttempts = 5
+	callbackTimeout         = 10 * time.Second
+	callbackBackoff         = time.Second
+	maxCallbackBackoff      = time.Minute
+)
+
+// callbackPayload is the JSON body POSTed to a request's callback_url once
+// inference has finished, successfully or not.
+type callbackPayload struct {
+	RequestID string       `json:"request_id,omitempty"`
+	JobID     string       `json:"job_id,omitempty"`
+	Status    string       `json:"status"`
+	Message   string       `json:"message,omitempty"`
+	Results   []prediction `json:"results"`
+	Errors    []fileError  `json:"errors"`
+}
+
+// callbackSender delivers callback payloads, signing each body with
+// HMAC-SHA256 when a secret is configured.
+type callbackSender struct {
+	client   *http.Client
+	secret   []byte
+	attempts int
+	backoff  time.Duration
+}
+
+// newCallbackSender builds a sender that only reaches public addresses
+// unless allowPrivate is set, since callback URLs come from clients.
+func newCallbackSender(secret string, attempts int, allowPrivate bool) *callbackSender {
+	if attempts < 1 {
+		attempts = defaultCallbackAttempts
+	}
+	dialer := publicDialer()
+	if allowPrivate {
+		dialer = &net.Dialer{Timeout: 10 * time.Second}
+	}
+	return &callbackSender{
+		client: &http.Client{
+			Timeout:   callbackTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+			// A redirected POST turns into a GET; treat it as a failure.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		secret:   []byte(secret),
+		attempts: attempts,
+		backoff:  callbackBackoff,
+	}
+}
+
+// parseCallbackURL validates a client-supplied callback_url.
+func parseCallbackURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", badRequest("callback_url must be an absolute http or https URL")
+	}
+	return u.String(), nil
+}
+
+// signPayload returns the X-Signature value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of the body under secret.
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs payload to rawURL, retrying failed attempts and non-2xx
+// answers with exponential backoff up to the configured number of attempts.
+func (cs *callbackSender) deliver(ctx context.Context, rawURL string, payload callbackPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal callback: %w", err)
+	}
+	log := requestLogger(ctx).With("callback_url", rawURL)
+	backoff := cs.backoff
+	for attempt := 1; ; attempt++ {
+		err = cs.post(ctx, rawURL, body)
+		if err == nil {
+			log.Info("callback delivered", "attempt", attempt)
+			return nil
+		}
+		if attempt >= cs.attempts {
+			log.Error("callback failed", "attempts", attempt, "error", err)
+			return err
+		}
+		log.Warn("callback attempt failed", "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxCallbackBackoff)
+	}
+}
+
+func (cs *callbackSender) post(ctx context.Context, rawURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(cs.secret) > 0 {
+		req.Header.Set("X-Signature", signPayload(cs.secret, body))
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifyCallback sends the outcome of req to its callback_url, if any, in
+// the background. err is the inference failure, if there was one.
+func (s *server) notifyCallback(ctx context.Context, req *evalRequest, jobID string, results []prediction, err error) {
+	if req.callbackURL == "" {
+		return
+	}
+	payload := callbackPayload{RequestID: requestIDFrom(ctx), JobID: jobID, Status: jobDone}
+	if err != nil {
+		payload.Status = jobError
+		payload.Message = err.Error()
+		payload.Results, payload.Errors = []prediction{}, []fileError{}
+	} else {
+		resp := newEvaluateResponse(results)
+		payload.Results, payload.Errors = resp.Results, resp.Errors
+	}
+	go func() {
+		_ = s.callbacks.deliver(context.WithoutCancel(ctx), req.callbackURL, payload)
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbackSenderDeliver(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	var got callbackPayload
+	var signature string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Signature")
+		if signature != signPayload([]byte("secret"), body) {
+			t.Errorf("X-Signature = %q does not match the body", signature)
+		}
+		_ = json.Unmarshal(body, &got)
+	}))
+	defer ts.Close()
+
+	cs := newCallbackSender("secret", 3, true)
+	cs.backoff = time.Millisecond
+	payload := callbackPayload{JobID: "j1", Status: jobDone, Results: []prediction{{Filename: "a.png"}}, Errors: []fileError{}}
+	if err := cs.deliver(context.Background(), ts.URL, payload); err != nil {
+		t.Fatalf("deliver() error = %v", err)
+	}
+	if calls.Load() != 3 || got.JobID != "j1" || len(got.Results) != 1 {
+		t.Fatalf("calls = %d, payload = %+v; want delivery on the third attempt", calls.Load(), got)
+	}
+
+	var failing atomic.Int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	if err := cs.deliver(context.Background(), down.URL, payload); err == nil {
+		t.Fatal("deliver() error = nil, want failure after the last attempt")
+	}
+	if failing.Load() != 3 {
+		t.Fatalf("attempts = %d, want 3", failing.Load())
+	}
+}
+
+func TestCallbackSenderRefusesPrivateAddresses(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("callback reached a loopback server")
+	}))
+	defer ts.Close()
+
+	cs := newCallbackSender("", 1, false)
+	if err := cs.deliver(context.Background(), ts.URL, callbackPayload{Status: jobDone}); err == nil {
+		t.Fatal("deliver() to loopback error = nil, want refusal")
+	}
+}
+
+func TestParseCallbackURL(t *testing.T) {
+	t.Parallel()
+
+	for raw, wantErr := range map[string]bool{
+		"":                         false,
+		"https://example.com/hook": false,
+		"ftp://example.com/hook":   true,
+		"/relative":                true,
+		"http://":                  true,
+	} {
+		if _, err := parseCallbackURL(raw); (err != nil) != wantErr {
+			t.Fatalf("parseCallbackURL(%q) error = %v, wantErr %v", raw, err, wantErr)
+		}
+	}
+}
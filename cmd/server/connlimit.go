@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// limitListener caps the open connections accepted from the wrapped
+// listener. Unlike netutil.LimitListener it does not stop accepting at the
+// limit: a connection beyond it is accepted and closed at once, so clients
+// get a quick refusal instead of piling up in the kernel backlog. It guards
+// file descriptors against floods of idle or slow uploads, which hold a
+// connection long before they reach the inflight limit.
+type limitListener struct {
+	net.Listener
+	sem     chan struct{}
+	refused atomic.Uint64
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			l.refused.Add(1)
+			_ = c.Close()
+		}
+	}
+}
+
+// open returns how many accepted connections are still open.
+func (l *limitListener) open() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.sem)
+}
+
+// refusedCount returns how many connections were closed for exceeding the
+// limit.
+func (l *limitListener) refusedCount() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.refused.Load()
+}
+
+// limitConn frees its slot once, however many times it is closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, Idempotency-Key, X-API-Key, X-Request-ID"
+	corsExposeHeaders = "Idempotent-Replayed, Retry-After, X-Request-ID"
+	corsMaxAge        = "600"
+)
+
+// corsPolicy is the set of origins allowed to call the API from a browser.
+// A nil policy disables CORS, which is the default.
+type corsPolicy struct {
+	allowAll bool
+	origins  map[string]bool
+}
+
+// parseCORSOrigins reads CORS_ALLOW_ORIGINS: "*" or a comma-separated list
+// of origins such as https://app.example.com.
+func parseCORSOrigins(raw string) *corsPolicy {
+	p := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			p.allowAll = true
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	if !p.allowAll && len(p.origins) == 0 {
+		return nil
+	}
+	return p
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if it is not allowed.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if p.allowAll {
+		return "*"
+	}
+	if p.origins[strings.ToLower(origin)] {
+		return origin
+	}
+	return ""
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers preflight
+// requests itself, ahead of auth, since browsers never send credentials on a
+// preflight.
+func (s *server) corsMiddleware(next http.Handler) http.Handler {
+	if s.cors == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cors.allowAll {
+			w.Header().Add("Vary", "Origin")
+		}
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		if origin != "" {
+			allowed = s.cors.allowOrigin(origin)
+		}
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
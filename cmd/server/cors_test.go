@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	t.Parallel()
+
+	if p := parseCORSOrigins(" , "); p != nil {
+		t.Fatalf("parseCORSOrigins(empty) = %+v, want nil", p)
+	}
+	p := parseCORSOrigins("https://App.example.com/, https://other.example")
+	if got := p.allowOrigin("https://app.example.com"); got != "https://app.example.com" {
+		t.Fatalf("allowOrigin(listed) = %q", got)
+	}
+	if got := p.allowOrigin("https://evil.example"); got != "" {
+		t.Fatalf("allowOrigin(unlisted) = %q, want empty", got)
+	}
+	if got := parseCORSOrigins("*").allowOrigin("https://any.example"); got != "*" {
+		t.Fatalf("allowOrigin(wildcard) = %q, want *", got)
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.cors = parseCORSOrigins("https://app.example.com")
+	s.apiKeys = parseAPIKeys("secret")
+	handler := s.routes()
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/evaluate", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, preflight)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("preflight status = %d, want 204", rr.Code)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Fatalf("preflight Allow-Origin = %q", got)
+	}
+	if rr.Header().Get("Access-Control-Allow-Methods") == "" || rr.Header().Get("Vary") != "Origin" {
+		t.Fatalf("preflight headers = %v", rr.Header())
+	}
+
+	denied := httptest.NewRequest(http.MethodPost, "/evaluate", nil)
+	denied.Header.Set("Origin", "https://evil.example")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, denied)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("unlisted origin got Allow-Origin %q", got)
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("Allow-Origin = %q without CORS_ALLOW_ORIGINS", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// preprocessInputs extracts frames, orients and downscales the stored inputs
+// before they are tagged, and hashes them when phash is set. Files are
+// processed in parallel, but decodeSem bounds how many images are being
+// decoded at once across every request, so a large batch cannot take all the
+// CPU and memory. It is independent of inflightSem, which only gates calls to
+// the workers.
+func (s *server) preprocessInputs(ctx context.Context, inputs []evalInput, phash bool) {
+	var wg sync.WaitGroup
+	for i := range inputs {
+		if inputs[i].err != nil {
+			continue
+		}
+		select {
+		case s.decodeSem <- struct{}{}:
+		case <-ctx.Done():
+			// The request is gone; leave the rest untouched.
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(in *evalInput) {
+			defer func() {
+				<-s.decodeSem
+				wg.Done()
+			}()
+			s.preprocessInput(ctx, in, phash)
+		}(&inputs[i])
+	}
+	wg.Wait()
+}
+
+func (s *server) preprocessInput(ctx context.Context, in *evalInput, phash bool) {
+	s.extractFrame(ctx, in)
+	if in.err != nil {
+		return
+	}
+	// Orient first: downscaling re-encodes the image and drops its EXIF.
+	if s.autoOrient {
+		s.orientInput(ctx, in)
+	}
+	if s.maxImageDim > 0 {
+		s.downscaleInput(ctx, in)
+	}
+	if phash {
+		hashInput(ctx, in)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreprocessInputs(t *testing.T) {
+	t.Parallel()
+
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for range 2 {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	dir := t.TempDir()
+	inputs := make([]evalInput, 6)
+	for i := range inputs {
+		path := filepath.Join(dir, string(rune('a'+i))+".gif")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if err := gif.EncodeAll(f, anim); err != nil {
+			t.Fatalf("gif.EncodeAll() error = %v", err)
+		}
+		f.Close()
+		inputs[i] = evalInput{name: filepath.Base(path), path: path}
+	}
+	failed := errors.New("upload failed")
+	inputs[2].err = failed
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.decodeSem = make(chan struct{}, 2)
+	s.preprocessInputs(context.Background(), inputs, false)
+	for i, in := range inputs {
+		if i == 2 {
+			if in.frame != nil || in.err != failed {
+				t.Fatalf("inputs[2] = %+v, want it skipped", in)
+			}
+			continue
+		}
+		if in.frame == nil || *in.frame != 0 {
+			t.Fatalf("inputs[%d].frame = %v, want 0", i, in.frame)
+		}
+	}
+	if len(s.decodeSem) != 0 {
+		t.Fatalf("decode slots held after preprocessing = %d, want 0", len(s.decodeSem))
+	}
+
+	// With every slot taken and the request gone, nothing is processed.
+	for i := range inputs {
+		inputs[i].frame = nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.decodeSem <- struct{}{}
+	s.decodeSem <- struct{}{}
+	s.preprocessInputs(ctx, inputs, false)
+	for i, in := range inputs {
+		if in.frame != nil {
+			t.Fatalf("inputs[%d] processed after cancellation", i)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// workerStderrLines is how many of its last stderr lines each worker keeps
+	// for /debug/worker.
+	workerStderrLines = 50
+	// maxStderrLineBytes truncates long lines, such as a dumped tensor.
+	maxStderrLineBytes = 1000
+)
+
+// lineRing keeps the last lines written to it. The zero value keeps
+// nothing; a nil ring is valid and keeps nothing either.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+func (lr *lineRing) add(line string) {
+	if lr == nil || len(lr.lines) == 0 {
+		return
+	}
+	if len(line) > maxStderrLineBytes {
+		line = line[:maxStderrLineBytes]
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.lines[lr.next] = line
+	lr.next = (lr.next + 1) % len(lr.lines)
+	if lr.next == 0 {
+		lr.full = true
+	}
+}
+
+// snapshot returns the kept lines, oldest first.
+func (lr *lineRing) snapshot() []string {
+	if lr == nil {
+		return []string{}
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if !lr.full {
+		return append([]string{}, lr.lines[:lr.next]...)
+	}
+	return append(append([]string{}, lr.lines[lr.next:]...), lr.lines[:lr.next]...)
+}
+
+// workerDiagnostics describes one worker slot for /debug/worker.
+type workerDiagnostics struct {
+	Index      int        `json:"index"`
+	Alive      bool       `json:"alive"`
+	Restarting bool       `json:"restarting"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	Stderr     []string   `json:"stderr"`
+}
+
+// diagnostics reports the state and recent stderr of every worker slot. A
+// worker that exited stays in its slot until its replacement starts, so its
+// stderr explains the failure.
+func (wp *workerPool) diagnostics() []workerDiagnostics {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	out := make([]workerDiagnostics, 0, len(wp.workers))
+	for i, w := range wp.workers {
+		d := workerDiagnostics{
+			Index:  i,
+			Alive:  !w.closed.Load(),
+			Stderr: w.stderr.snapshot(),
+		}
+		if i < len(wp.restarting) {
+			d.Restarting = wp.restarting[i].Load()
+		}
+		if !w.started.IsZero() {
+			started := w.started
+			d.StartedAt = &started
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// handleDebugWorker shows each worker's state and last stderr lines, so an
+// operator can see why a worker is down without searching the logs. Worker
+// output may include file paths and tracebacks, so like the admin endpoints
+// it is only available when API_KEYS is set.
+func (s *server) handleDebugWorker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.apiKeys) == 0 {
+		s.writeError(w, "json", http.StatusForbidden, codeForbidden, "debug endpoints require API_KEYS to be set")
+		return
+	}
+	if s.workers == nil {
+		s.writeError(w, "json", http.StatusServiceUnavailable, codeWorkerUnavailable, "no worker pool")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]workerDiagnostics{"workers": s.workers.diagnostics()})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLineRing(t *testing.T) {
+	t.Parallel()
+
+	lr := newLineRing(3)
+	if got := lr.snapshot(); len(got) != 0 {
+		t.Fatalf("snapshot() of an empty ring = %v", got)
+	}
+	lr.add("a")
+	lr.add("b")
+	if got, want := lr.snapshot(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot() = %v, want %v", got, want)
+	}
+	for i := range 4 {
+		lr.add(fmt.Sprint(i))
+	}
+	if got, want := lr.snapshot(), []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot() after wrapping = %v, want %v", got, want)
+	}
+	lr.add(strings.Repeat("x", maxStderrLineBytes+10))
+	if got := lr.snapshot(); len(got[2]) != maxStderrLineBytes {
+		t.Fatalf("long line kept %d bytes, want %d", len(got[2]), maxStderrLineBytes)
+	}
+
+	var nilRing *lineRing
+	nilRing.add("ignored")
+	if got := nilRing.snapshot(); len(got) != 0 {
+		t.Fatalf("snapshot() of a nil ring = %v", got)
+	}
+}
+
+func TestWorkerClientKeepsStderr(t *testing.T) {
+	t.Parallel()
+
+	wc := &workerClient{stderr: newLineRing(2)}
+	wc.readStderr(strings.NewReader("loading model\nFileNotFoundError: model.onnx\nexiting\n"))
+	if got, want := wc.stderr.snapshot(), []string{"FileNotFoundError: model.onnx", "exiting"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stderr = %v, want %v", got, want)
+	}
+}
+
+func TestHandleDebugWorker(t *testing.T) {
+	t.Parallel()
+
+	dead := &workerClient{stderr: newLineRing(workerStderrLines)}
+	dead.closed.Store(true)
+	dead.stderr.add("CUDA error: out of memory")
+	s := newServer(&workerPool{workers: []*workerClient{dead}, restarting: make([]atomic.Bool, 1)}, 1, 32, 16, 8, 200)
+
+	rr := httptest.NewRecorder()
+	s.handleDebugWorker(rr, httptest.NewRequest(http.MethodGet, "/debug/worker", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status without API_KEYS = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	s.apiKeys = parseAPIKeys("secret")
+	rr = httptest.NewRecorder()
+	s.handleDebugWorker(rr, httptest.NewRequest(http.MethodGet, "/debug/worker", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var got struct {
+		Workers []workerDiagnostics `json:"workers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body, err)
+	}
+	if len(got.Workers) != 1 || got.Workers[0].Alive || !reflect.DeepEqual(got.Workers[0].Stderr, []string{"CUDA error: out of memory"}) {
+		t.Fatalf("workers = %+v, want the dead worker and its stderr", got.Workers)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"syscall"
+)
+
+// errDiskFull fails a request whose uploads could not be stored because the
+// temp dir's disk is full. It is answered with 507 and, unlike worker
+// failures, never trips EXIT_ON_FATAL: a restart does not free the disk and
+// would only put the container in a crash loop.
+var errDiskFull = errors.New("server is out of disk space for uploads; retry later")
+
+// isNoSpace reports whether err is ENOSPC, or a worker error carrying its
+// message, which loses the errno on the way.
+func isNoSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(strings.ToLower(err.Error()), "no space left on device")
+}
+
+// storeError is the error for a failure to write an upload to the temp dir.
+func storeError(err error) error {
+	if isNoSpace(err) {
+		logDiskFull(err)
+		return errDiskFull
+	}
+	return errors.New("failed to store upload")
+}
+
+// logDiskFull logs a full disk under its own message so it can be alerted
+// on apart from other errors.
+func logDiskFull(err error) {
+	slog.Error("disk full", "alert", "disk_full", "error", err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsNoSpace(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}, true},
+		{fmt.Errorf("store %q: %w", "u", &os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}), true},
+		{errors.New("OSError: [Errno 28] No space left on device"), true},
+		{&os.PathError{Op: "open", Path: "/tmp/x", Err: syscall.EACCES}, false},
+	}
+	for _, tc := range tests {
+		if got := isNoSpace(tc.err); got != tc.want {
+			t.Fatalf("isNoSpace(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if err := storeError(syscall.ENOSPC); !errors.Is(err, errDiskFull) {
+		t.Fatalf("storeError(ENOSPC) = %v, want errDiskFull", err)
+	}
+	if err := storeError(syscall.EACCES); errors.Is(err, errDiskFull) {
+		t.Fatalf("storeError(EACCES) = %v, want a generic error", err)
+	}
+}
+
+func TestDiskFullIsNotFatal(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.exitOnFatal = true
+	s.evaluateOK.Store(true)
+	s.predictor = &mockPredictor{err: errors.New("OSError: [Errno 28] No space left on device")}
+
+	rr := httptest.NewRecorder()
+	s.handleEvaluate(rr, evaluateJSONRequest(t, ""))
+	var got errorBody
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || rr.Code != http.StatusInsufficientStorage || got.Code != codeInsufficientStorage {
+		t.Fatalf("status = %d, body %s; want 507 InsufficientStorage", rr.Code, rr.Body)
+	}
+	if !s.evaluateOK.Load() {
+		t.Fatal("a full disk failed the health check")
+	}
+
+	rr = httptest.NewRecorder()
+	s.writeRequestError(rr, "json", storeError(syscall.ENOSPC))
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("writeRequestError(disk full) status = %d, want 507", rr.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// echoVocab is the tag list echoPredictor scores.
+var echoVocab = []string{
+	"1girl", "solo", "long_hair", "short_hair", "smile", "blush", "open_mouth",
+	"blue_eyes", "brown_hair", "hat", "outdoors", "simple_background",
+}
+
+// echoPredictor stands in for the worker under PREDICTOR=echo. It never
+// looks at the image: each tag's score is a hash of the file's upload name
+// and the tag, so the same name always gets the same tags. That is enough
+// to run the HTTP server in client tests and CI without Python or a GPU.
+type echoPredictor struct{}
+
+func (echoPredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	preds := make([]prediction, 0, len(files))
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pred := echoPrediction(filepath.Base(file), params)
+		if onPrediction != nil {
+			onPrediction(pred)
+		}
+		preds = append(preds, pred)
+	}
+	return preds, nil
+}
+
+func (echoPredictor) alive() bool { return true }
+
+func (echoPredictor) close() {}
+
+// echoPrediction scores echoVocab for the file the worker knows as name and
+// keeps the tags params select, as the worker would.
+func echoPrediction(name string, params predictParams) prediction {
+	// Stored inputs are named <index>-<upload name>; the index depends on the
+	// request, not the file.
+	upload := name
+	if prefix, rest, ok := strings.Cut(name, "-"); ok && prefix != "" && strings.Trim(prefix, "0123456789") == "" {
+		upload = rest
+	}
+	tags := make([]tagScore, 0, len(echoVocab))
+	for _, tag := range echoVocab {
+		h := fnv.New64a()
+		h.Write([]byte(upload + "\x00" + tag))
+		tags = append(tags, tagScore{Name: tag, Score: float64(h.Sum64()%1000) / 1000})
+	}
+	sort.Slice(tags, func(a, b int) bool {
+		if tags[a].Score != tags[b].Score {
+			return tags[a].Score > tags[b].Score
+		}
+		return tags[a].Name < tags[b].Name
+	})
+
+	threshold := params.threshold
+	if t, ok := params.categoryThresholds[defaultTagCategory]; ok {
+		threshold = t
+	}
+	pred := prediction{Filename: name, Tags: map[string]float64{}, Categories: map[string]string{}}
+	for _, tag := range tags {
+		if params.mode != modeAll {
+			if params.limit > 0 && len(pred.Tags) >= params.limit {
+				break
+			}
+			if params.mode != modeTopK && tag.Score < threshold {
+				break
+			}
+		}
+		pred.Tags[tag.Name] = tag.Score
+		pred.Categories[tag.Name] = defaultTagCategory
+	}
+	return pred
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWorkerMode(t *testing.T) {
+	t.Parallel()
+
+	for raw, want := range map[string]string{"": workerModeProcess, "process": workerModeProcess, " Echo ": workerModeEcho, "http": workerModeHTTP} {
+		if got, err := parseWorkerMode(raw); err != nil || got != want {
+			t.Fatalf("parseWorkerMode(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	if _, err := parseWorkerMode("gpu"); err == nil {
+		t.Fatal("parseWorkerMode(gpu) error = nil, want an error")
+	}
+}
+
+func TestEchoPrediction(t *testing.T) {
+	t.Parallel()
+
+	all := echoPrediction("0-cat.png", predictParams{mode: modeAll})
+	if len(all.Tags) != len(echoVocab) {
+		t.Fatalf("modeAll returned %d tags, want %d", len(all.Tags), len(echoVocab))
+	}
+	if again := echoPrediction("3-cat.png", predictParams{mode: modeAll}); !reflect.DeepEqual(again.Tags, all.Tags) {
+		t.Fatalf("tags for cat.png changed with its index: %v, want %v", again.Tags, all.Tags)
+	}
+	if other := echoPrediction("0-dog.png", predictParams{mode: modeAll}); reflect.DeepEqual(other.Tags, all.Tags) {
+		t.Fatal("dog.png got the same scores as cat.png")
+	}
+
+	if got := echoPrediction("0-cat.png", predictParams{mode: modeTopK, limit: 3}); len(got.Tags) != 3 {
+		t.Fatalf("topk returned %d tags, want 3", len(got.Tags))
+	}
+	got := echoPrediction("0-cat.png", predictParams{threshold: 0.5, limit: 50})
+	for tag, score := range all.Tags {
+		if _, kept := got.Tags[tag]; kept != (score >= 0.5) {
+			t.Fatalf("threshold 0.5: tag %s with score %v kept = %v", tag, score, kept)
+		}
+		if kept := got.Categories[tag] != ""; kept != (score >= 0.5) {
+			t.Fatalf("threshold 0.5: category of %s present = %v", tag, kept)
+		}
+	}
+}
+
+func TestEchoPredictorServesEvaluate(t *testing.T) {
+	t.Parallel()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = echoPredictor{}
+
+	rr := httptest.NewRecorder()
+	s.handleHealth(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("healthz status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	body := `{"images":[{"name":"cat.png","data":"` + base64.StdEncoding.EncodeToString(img.Bytes()) + `"}],"mode":"topk","limit":4}`
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	s.handleEvaluate(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rr.Code, rr.Body)
+	}
+	var resp evaluateResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body, err)
+	}
+	want, _ := echoPredictor{}.predictStream(context.Background(), []string{"0-cat.png"}, predictParams{mode: modeTopK, limit: 4}, nil)
+	if len(resp.Results) != 1 || !reflect.DeepEqual(resp.Results[0].Tags, want[0].Tags) {
+		t.Fatalf("results = %+v, want the echo tags %v", resp.Results, want[0].Tags)
+	}
+}
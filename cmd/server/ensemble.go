@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Ways an ensemble combines the scores its models give one tag.
+const (
+	combineMean = "mean"
+	combineMax  = "max"
+)
+
+// parseCombine validates ensemble_combine; empty means combineMean.
+func parseCombine(raw string) (string, error) {
+	switch combine := strings.ToLower(strings.TrimSpace(raw)); combine {
+	case "", combineMean:
+		return combineMean, nil
+	case combineMax:
+		return combine, nil
+	default:
+		return "", paramError("ensemble_combine", "ensemble_combine must be mean or max")
+	}
+}
+
+// parseEnsemble resolves the comma-separated model names of the ensemble
+// parameter as resolveModel does. An ensemble needs at least two distinct
+// models; none at all means the request is not an ensemble.
+func (s *server) parseEnsemble(raw string) ([]string, error) {
+	var models []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		model, err := s.resolveModel(name)
+		if err != nil {
+			return nil, paramError("ensemble", fmt.Sprintf("unknown model %q; available: %s", strings.TrimSpace(name), strings.Join(s.modelNames(), ", ")))
+		}
+		if seen[model] {
+			return nil, paramError("ensemble", fmt.Sprintf("model %q is listed twice", strings.TrimSpace(name)))
+		}
+		seen[model] = true
+		models = append(models, model)
+	}
+	if len(models) == 1 {
+		return nil, paramError("ensemble", "ensemble needs at least two models")
+	}
+	return models, nil
+}
+
+// applyEnsemble sets req's ensemble and combine strategy, rejecting an
+// ensemble alongside the model parameter.
+func (s *server) applyEnsemble(req *evalRequest, ensemble, combine string) error {
+	var err error
+	if req.ensemble, err = s.parseEnsemble(ensemble); err != nil {
+		return err
+	}
+	if req.combine, err = parseCombine(combine); err != nil {
+		return err
+	}
+	if len(req.ensemble) > 0 && req.model != "" {
+		return paramError("ensemble", "ensemble and model cannot be combined; list the model in ensemble instead")
+	}
+	return nil
+}
+
+// predictorForRequest returns the predictor that tags req: its model's, or
+// an ensemblePredictor over the models it lists.
+func (s *server) predictorForRequest(req *evalRequest) predictor {
+	if len(req.ensemble) == 0 {
+		return s.predictorFor(req.model)
+	}
+	e := ensemblePredictor{combine: req.combine}
+	for _, model := range req.ensemble {
+		p := s.predictorFor(model)
+		if p == nil {
+			return nil
+		}
+		if model == "" {
+			model = s.defaultModel
+		}
+		e.names = append(e.names, model)
+		e.members = append(e.members, p)
+	}
+	return e
+}
+
+// ensemblePredictor runs every member on the same files at once and merges
+// their scores per tag. Ensemble requests ask for every score (see
+// fullScores), so the merge sees each model's whole vocabulary and the
+// request's threshold and limit are applied to the merged scores by
+// trimScores afterwards. Results are only reported once every member is
+// done with the whole batch.
+type ensemblePredictor struct {
+	names   []string
+	members []predictor
+	combine string
+}
+
+var _ predictor = ensemblePredictor{}
+
+func (e ensemblePredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([][]prediction, len(e.members))
+	errs := make([]error, len(e.members))
+	var wg sync.WaitGroup
+	for i, member := range e.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = member.predictStream(ctx, files, params, nil)
+			if errs[i] != nil {
+				// The others' scores are useless without this model's.
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	// Report the error that sank the ensemble, not the cancellations it
+	// caused in the other members.
+	for _, canceled := range []bool{false, true} {
+		for i, err := range errs {
+			if err != nil && errors.Is(err, context.Canceled) == canceled {
+				return nil, fmt.Errorf("model %s: %w", e.names[i], err)
+			}
+		}
+	}
+
+	merged := make([]prediction, len(files))
+	for j := range files {
+		preds := make([]prediction, len(e.members))
+		for i := range e.members {
+			if len(results[i]) != len(files) {
+				return nil, fmt.Errorf("model %s returned %d predictions for %d files", e.names[i], len(results[i]), len(files))
+			}
+			preds[i] = results[i][j]
+		}
+		merged[j] = mergePredictions(e.names, preds, e.combine)
+		if onPrediction != nil {
+			onPrediction(merged[j])
+		}
+	}
+	return merged, nil
+}
+
+func (e ensemblePredictor) alive() bool {
+	for _, member := range e.members {
+		if !member.alive() {
+			return false
+		}
+	}
+	return true
+}
+
+// close is a no-op: the members belong to the server, not the ensemble.
+func (e ensemblePredictor) close() {}
+
+// mergePredictions combines the predictions of one file by several models.
+// Models with different vocabularies report different tags, so a tag is
+// combined over the models that scored it: under mean, a tag only one
+// model knows keeps that model's score instead of being dragged down by
+// models that cannot see it. A file any model failed on fails as a whole.
+func mergePredictions(names []string, preds []prediction, combine string) prediction {
+	merged := prediction{Filename: preds[0].Filename, Tags: map[string]float64{}}
+	counts := map[string]int{}
+	for i, pred := range preds {
+		if pred.Error != "" {
+			return prediction{Filename: pred.Filename, Tags: map[string]float64{}, Error: fmt.Sprintf("model %s: %s", names[i], pred.Error)}
+		}
+		merged.DurationMS = max(merged.DurationMS, pred.DurationMS)
+		for tag, score := range pred.Tags {
+			counts[tag]++
+			if combine == combineMax {
+				merged.Tags[tag] = max(merged.Tags[tag], score)
+			} else {
+				merged.Tags[tag] += score
+			}
+		}
+		for tag, category := range pred.Categories {
+			if merged.Categories == nil {
+				merged.Categories = map[string]string{}
+			}
+			if _, ok := merged.Categories[tag]; !ok {
+				merged.Categories[tag] = category
+			}
+		}
+	}
+	if combine == combineMean {
+		for tag, n := range counts {
+			merged.Tags[tag] /= float64(n)
+		}
+	}
+	return merged
+}
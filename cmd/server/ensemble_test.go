@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scorePredictor tags every file with the same scores and remembers the
+// params it was called with.
+type scorePredictor struct {
+	tags   map[string]float64
+	err    error
+	params chan predictParams
+}
+
+func (p *scorePredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	select {
+	case p.params <- params:
+	default:
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	preds := make([]prediction, 0, len(files))
+	for _, file := range files {
+		preds = append(preds, prediction{Filename: filepath.Base(file), Tags: p.tags, DurationMS: 10})
+	}
+	return preds, nil
+}
+
+func (p *scorePredictor) alive() bool { return true }
+
+func (p *scorePredictor) close() {}
+
+func TestMergePredictions(t *testing.T) {
+	t.Parallel()
+
+	names := []string{"general", "anime"}
+	preds := []prediction{
+		{Filename: "a.png", Tags: map[string]float64{"shared": 0.8, "only_general": 0.6}, Categories: map[string]string{"shared": "general"}, DurationMS: 30},
+		{Filename: "a.png", Tags: map[string]float64{"shared": 0.4, "only_anime": 0.7}, Categories: map[string]string{"shared": "meta", "only_anime": "character"}, DurationMS: 50},
+	}
+	tests := []struct {
+		combine string
+		want    map[string]float64
+	}{
+		{combine: combineMean, want: map[string]float64{"shared": 0.6, "only_general": 0.6, "only_anime": 0.7}},
+		{combine: combineMax, want: map[string]float64{"shared": 0.8, "only_general": 0.6, "only_anime": 0.7}},
+	}
+	for _, tc := range tests {
+		got := mergePredictions(names, preds, tc.combine)
+		if len(got.Tags) != len(tc.want) {
+			t.Fatalf("%s: tags = %v, want %v", tc.combine, got.Tags, tc.want)
+		}
+		for tag, score := range tc.want {
+			if math.Abs(got.Tags[tag]-score) > 1e-9 {
+				t.Fatalf("%s: %s = %g, want %g", tc.combine, tag, got.Tags[tag], score)
+			}
+		}
+		if want := map[string]string{"shared": "general", "only_anime": "character"}; !reflect.DeepEqual(got.Categories, want) {
+			t.Fatalf("%s: categories = %v, want %v", tc.combine, got.Categories, want)
+		}
+		if got.DurationMS != 50 {
+			t.Fatalf("%s: duration_ms = %g, want the slowest model's 50", tc.combine, got.DurationMS)
+		}
+	}
+
+	failed := mergePredictions(names, []prediction{preds[0], {Filename: "a.png", Error: "decode failed"}}, combineMean)
+	if failed.Error != "model anime: decode failed" || len(failed.Tags) != 0 {
+		t.Fatalf("merge with a failed model = %+v, want the file failed", failed)
+	}
+}
+
+func TestHandleEvaluateEnsemble(t *testing.T) {
+	t.Parallel()
+
+	general := &scorePredictor{tags: map[string]float64{"shared": 0.8, "low": 0.3, "only_general": 0.6}, params: make(chan predictParams, 16)}
+	anime := &scorePredictor{tags: map[string]float64{"shared": 0.4, "low": 0.5, "only_anime": 0.7}, params: make(chan predictParams, 16)}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = general
+	s.defaultModel = "general"
+	s.addModel("anime", anime)
+
+	tests := []struct {
+		extra string
+		want  []string
+	}{
+		{extra: `,"ensemble":"general,anime","threshold":0.5`, want: []string{"only_anime", "only_general", "shared"}},
+		{extra: `,"ensemble":"general,anime","ensemble_combine":"max","threshold":0.5`, want: []string{"low", "only_anime", "only_general", "shared"}},
+		{extra: `,"ensemble":"anime,general","mode":"topk","limit":1`, want: []string{"only_anime"}},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		s.handleEvaluate(rr, evaluateJSONRequest(t, tc.extra))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", tc.extra, rr.Code, rr.Body)
+		}
+		var resp evaluateResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+			t.Fatalf("%s: body %s", tc.extra, rr.Body)
+		}
+		var got []string
+		for tag := range resp.Results[0].Tags {
+			got = append(got, tag)
+		}
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: tags = %v, want %v", tc.extra, got, tc.want)
+		}
+		for _, p := range []*scorePredictor{general, anime} {
+			if params := <-p.params; params.mode != modeAll {
+				t.Fatalf("%s: member params = %+v, want every score", tc.extra, params)
+			}
+		}
+	}
+}
+
+func TestEnsembleValidation(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = &mockPredictor{}
+	s.addModel("anime", &mockPredictor{})
+	for _, extra := range []string{
+		`,"ensemble":"default"`,
+		`,"ensemble":"default,photo"`,
+		`,"ensemble":"anime,Anime"`,
+		`,"ensemble":"default,anime","model":"anime"`,
+		`,"ensemble":"default,anime","ensemble_combine":"median"`,
+	} {
+		rr := httptest.NewRecorder()
+		s.handleEvaluate(rr, evaluateJSONRequest(t, extra))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400; body %s", extra, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestEnsembleMemberFailure(t *testing.T) {
+	t.Parallel()
+
+	e := ensemblePredictor{
+		names:   []string{"general", "anime"},
+		members: []predictor{&scorePredictor{tags: map[string]float64{"a": 1}}, &scorePredictor{err: errWorkerNotRunning}},
+		combine: combineMean,
+	}
+	_, err := e.predictStream(context.Background(), []string{"/t/a.png"}, predictParams{mode: modeAll}, nil)
+	if !errors.Is(err, errWorkerNotRunning) || !strings.Contains(err.Error(), "anime") {
+		t.Fatalf("predictStream() error = %v, want the anime model's worker error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// errorCode identifies the kind of failure in an error response. Codes are
+// part of the API: clients branch on them, so existing values must not
+// change. Add new codes to errorCodes and to the Error schema in openapi.json.
+type errorCode string
+
+const (
+	codeBadRequest          errorCode = "BadRequest"
+	codeInvalidParameter    errorCode = "InvalidParameter"
+	codeFileTooLarge        errorCode = "FileTooLarge"
+	codeUnsupportedFile     errorCode = "UnsupportedFile"
+	codeEmptyFile           errorCode = "EmptyFile"
+	codeCorruptFile         errorCode = "CorruptFile"
+	codeUnauthorized        errorCode = "Unauthorized"
+	codeForbidden           errorCode = "Forbidden"
+	codeNotFound            errorCode = "NotFound"
+	codeConflict            errorCode = "Conflict"
+	codeRateLimited         errorCode = "RateLimited"
+	codeTooManyJobs         errorCode = "TooManyJobs"
+	codeServerBusy          errorCode = "ServerBusy"
+	codeClientClosedRequest errorCode = "ClientClosedRequest"
+	codeGatewayTimeout      errorCode = "GatewayTimeout"
+	codeWorkerRestarting    errorCode = "WorkerRestarting"
+	codeWorkerUnavailable   errorCode = "WorkerUnavailable"
+	codeInferenceError      errorCode = "InferenceError"
+	codeReloadFailed        errorCode = "ReloadFailed"
+	codeNotImplemented      errorCode = "NotImplemented"
+	codeInsufficientStorage errorCode = "InsufficientStorage"
+	codeInternalError       errorCode = "InternalError"
+)
+
+// errorCodes lists every code the server can return.
+var errorCodes = []errorCode{
+	codeBadRequest,
+	codeInvalidParameter,
+	codeFileTooLarge,
+	codeUnsupportedFile,
+	codeEmptyFile,
+	codeCorruptFile,
+	codeUnauthorized,
+	codeForbidden,
+	codeNotFound,
+	codeConflict,
+	codeRateLimited,
+	codeTooManyJobs,
+	codeServerBusy,
+	codeClientClosedRequest,
+	codeGatewayTimeout,
+	codeWorkerRestarting,
+	codeWorkerUnavailable,
+	codeInferenceError,
+	codeReloadFailed,
+	codeNotImplemented,
+	codeInsufficientStorage,
+	codeInternalError,
+}
+
+// legacyErrorNames maps the codes that split up a broader error into the
+// value the error field carried for it before codes were introduced. Clients
+// already match on those values, so they keep getting them.
+var legacyErrorNames = map[errorCode]string{
+	codeInvalidParameter:  "BadRequest",
+	codeFileTooLarge:      "BadRequest",
+	codeUnsupportedFile:   "BadRequest",
+	codeEmptyFile:         "BadRequest",
+	codeCorruptFile:       "BadRequest",
+	codeRateLimited:       "TooManyRequests",
+	codeTooManyJobs:       "TooManyRequests",
+	codeServerBusy:        "ServiceUnavailable",
+	codeWorkerRestarting:  "ServiceUnavailable",
+	codeWorkerUnavailable: "ServiceUnavailable",
+}
+
+// legacyName returns the value of the error field for code.
+func (code errorCode) legacyName() string {
+	if name, ok := legacyErrorNames[code]; ok {
+		return name
+	}
+	return string(code)
+}
+
+// errorBody is the JSON error object. Error keeps the values clients matched
+// on before codes were introduced; Code tells apart the cases it lumps
+// together.
+type errorBody struct {
+	Error   string            `json:"error"`
+	Code    errorCode         `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func newErrorBody(code errorCode, message string, details map[string]string) errorBody {
+	return errorBody{Error: code.legacyName(), Code: code, Message: message, Details: details}
+}
+
+func (s *server) writeError(w http.ResponseWriter, format string, status int, code errorCode, message string) {
+	s.writeErrorDetails(w, format, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with extra details, such as the offending
+// file or parameter, in the JSON payload. The HTML and text forms ignore them.
+func (s *server) writeErrorDetails(w http.ResponseWriter, format string, status int, code errorCode, message string, details map[string]string) {
+	if format == "json" || format == "ndjson" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(newErrorBody(code, message, details))
+	} else if format == "text" || format == "csv" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s: %s\n", code.legacyName(), message)
+	} else {
+		w.WriteHeader(status)
+		_ = s.errorTmpl.Execute(w, map[string]string{"Error": code.legacyName(), "Message": message})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestErrorCodesMatchOpenAPI(t *testing.T) {
+	t.Parallel()
+
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	var codes, names []string
+	for _, code := range errorCodes {
+		codes = append(codes, string(code))
+		if !slices.Contains(names, code.legacyName()) {
+			names = append(names, code.legacyName())
+		}
+	}
+	if got := spec.Components.Schemas["ErrorCode"].Enum; !reflect.DeepEqual(got, codes) {
+		t.Fatalf("ErrorCode enum = %v, want %v", got, codes)
+	}
+	if got := spec.Components.Schemas["ErrorName"].Enum; !reflect.DeepEqual(got, names) {
+		t.Fatalf("ErrorName enum = %v, want %v", got, names)
+	}
+}
+
+func TestErrorBodyKeepsLegacyNames(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		code errorCode
+		want string
+	}{
+		{codeBadRequest, "BadRequest"},
+		{codeFileTooLarge, "BadRequest"},
+		{codeRateLimited, "TooManyRequests"},
+		{codeTooManyJobs, "TooManyRequests"},
+		{codeWorkerRestarting, "ServiceUnavailable"},
+		{codeWorkerUnavailable, "ServiceUnavailable"},
+		{codeServerBusy, "ServiceUnavailable"},
+		{codeGatewayTimeout, "GatewayTimeout"},
+		{codeInsufficientStorage, "InsufficientStorage"},
+	}
+	for _, tc := range tests {
+		body := newErrorBody(tc.code, "message", nil)
+		if body.Error != tc.want || body.Code != tc.code {
+			t.Errorf("newErrorBody(%s) = error %q, code %q; want error %q", tc.code, body.Error, body.Code, tc.want)
+		}
+	}
+}
+
+func TestWriteErrorDetails(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	details := map[string]string{"parameter": "limit"}
+	tests := []struct {
+		format      string
+		contentType string
+		want        string
+	}{
+		{"json", "application/json", `{"error":"BadRequest","code":"InvalidParameter","message":"limit must be positive","details":{"parameter":"limit"}}` + "\n"},
+		{"ndjson", "application/json", `{"error":"BadRequest","code":"InvalidParameter","message":"limit must be positive","details":{"parameter":"limit"}}` + "\n"},
+		{"text", "text/plain; charset=utf-8", "BadRequest: limit must be positive\n"},
+		{"csv", "text/plain; charset=utf-8", "BadRequest: limit must be positive\n"},
+		{"html", "", "<h1>BadRequest</h1>"},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		s.writeErrorDetails(rr, tc.format, http.StatusBadRequest, codeInvalidParameter, "limit must be positive", details)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want %d", tc.format, rr.Code, http.StatusBadRequest)
+		}
+		if tc.contentType != "" && rr.Header().Get("Content-Type") != tc.contentType {
+			t.Fatalf("%s: Content-Type = %q, want %q", tc.format, rr.Header().Get("Content-Type"), tc.contentType)
+		}
+		if tc.format == "html" {
+			if !strings.Contains(rr.Body.String(), tc.want) {
+				t.Fatalf("%s: body = %q, want it to contain %q", tc.format, rr.Body, tc.want)
+			}
+		} else if rr.Body.String() != tc.want {
+			t.Fatalf("%s: body = %q, want %q", tc.format, rr.Body, tc.want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	s.writeError(rr, "json", http.StatusNotFound, codeNotFound, "job not found or expired")
+	if strings.Contains(rr.Body.String(), "details") {
+		t.Fatalf("body = %s, want no details", rr.Body)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultFetchTimeout     = 30 * time.Second
+	defaultFetchConcurrency = 4
+	maxFetchRedirects       = 5
+)
+
+var errPrivateAddress = errors.New("destination address is not allowed")
+
+// errFetchBudget stops a download once the request's downloads together
+// exceed the upload size limit.
+var errFetchBudget = errors.New("downloads exceed the request size limit")
+
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// urlFetcher downloads images passed by URL. maxBytes bounds each download
+// and, in fetchAll, a request's downloads and upload together; concurrency
+// bounds how many of a request's downloads run at once.
+type urlFetcher struct {
+	client      *http.Client
+	maxBytes    int64
+	concurrency int
+}
+
+func newURLFetcher(timeout time.Duration, maxBytes int64, concurrency int) *urlFetcher {
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	if concurrency < 1 {
+		concurrency = defaultFetchConcurrency
+	}
+	dialer := publicDialer()
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   concurrency,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+	return &urlFetcher{client: client, maxBytes: maxBytes, concurrency: concurrency}
+}
+
+// fetchResult is the outcome of one download of fetchAll.
+type fetchResult struct {
+	hash string
+	err  error
+}
+
+// fetchAll downloads urls[i] into dstPaths[i], up to f.concurrency at a
+// time, and returns the results in input order. Each download keeps its own
+// timeout and error; a shared byte budget, seeded with the used bytes the
+// request already stored from its upload, fails the downloads that would
+// push the total past maxBytes and is given back by those that fail.
+func (f *urlFetcher) fetchAll(ctx context.Context, urls, dstPaths []string, used int64) []fetchResult {
+	results := make([]fetchResult, len(urls))
+	budget := &fetchBudget{max: f.maxBytes}
+	budget.used.Store(used)
+	sem := make(chan struct{}, max(f.concurrency, 1))
+	var wg sync.WaitGroup
+	for i := range urls {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			hash, err := f.fetchInto(ctx, urls[i], dstPaths[i], budget)
+			results[i] = fetchResult{hash: hash, err: err}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// fetchBudget counts the bytes stored by concurrent downloads.
+type fetchBudget struct {
+	used atomic.Int64
+	max  int64
+}
+
+// reserve charges n bytes to the budget, or reports false and charges
+// nothing when that would take it past the maximum.
+func (b *fetchBudget) reserve(n int64) bool {
+	if b.max <= 0 {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release gives back n bytes reserved by a download that failed.
+func (b *fetchBudget) release(n int64) {
+	if b.max > 0 {
+		b.used.Add(-n)
+	}
+}
+
+// budgetWriter fails a write that would take its budget past the maximum
+// and counts the bytes it reserved, so a failed download can give them back.
+type budgetWriter struct {
+	w        io.Writer
+	budget   *fetchBudget
+	reserved int64
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if !bw.budget.reserve(int64(len(p))) {
+		return 0, errFetchBudget
+	}
+	bw.reserved += int64(len(p))
+	return bw.w.Write(p)
+}
+
+// fetch downloads rawURL into dstPath and returns the hex SHA-256 of the body.
+// The body must be an image and no larger than maxBytes; the partially written
+// file is removed on failure.
+func (f *urlFetcher) fetch(ctx context.Context, rawURL, dstPath string) (string, error) {
+	return f.fetchInto(ctx, rawURL, dstPath, nil)
+}
+
+// fetchInto is fetch, charging the body to budget when it is not nil.
+func (f *urlFetcher) fetchInto(ctx context.Context, rawURL, dstPath string, budget *fetchBudget) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid url %q", rawURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q", rawURL)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return "", fmt.Errorf("url %q resolves to a private address", rawURL)
+		}
+		return "", fmt.Errorf("fetch %q failed: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %q failed: unexpected status %d", rawURL, resp.StatusCode)
+	}
+	if f.maxBytes > 0 && resp.ContentLength > f.maxBytes {
+		return "", fmt.Errorf("url %q exceeds the size limit", rawURL)
+	}
+
+	var body io.Reader = resp.Body
+	if f.maxBytes > 0 {
+		body = io.LimitReader(resp.Body, f.maxBytes+1)
+	}
+	br := bufio.NewReader(body)
+	head, _ := br.Peek(512)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = sniffImageType(head)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("url %q is not an image (content type %s)", rawURL, mediaType)
+	}
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", fmt.Errorf("store %q: %w", rawURL, err)
+	}
+	hasher := sha256.New()
+	var w io.Writer = io.MultiWriter(dst, hasher)
+	var bw *budgetWriter
+	if budget != nil {
+		bw = &budgetWriter{w: w, budget: budget}
+		w = bw
+	}
+	n, copyErr := io.Copy(w, br)
+	closeErr := dst.Close()
+	switch {
+	case errors.Is(copyErr, errFetchBudget):
+		err = fmt.Errorf("url %q: %w", rawURL, copyErr)
+	case copyErr != nil:
+		err = fmt.Errorf("fetch %q failed: %w", rawURL, copyErr)
+	case closeErr != nil:
+		err = fmt.Errorf("store %q: %w", rawURL, closeErr)
+	case f.maxBytes > 0 && n > f.maxBytes:
+		err = fmt.Errorf("url %q exceeds the size limit", rawURL)
+	case n == 0:
+		err = fmt.Errorf("url %q returned an empty body", rawURL)
+	}
+	if err != nil {
+		_ = os.Remove(dstPath)
+		if bw != nil {
+			budget.release(bw.reserved)
+		}
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func urlFilename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+// publicDialer refuses connections to loopback, private and other
+// non-public addresses. The check runs on the resolved address, so DNS names
+// pointing inside the network are caught too.
+func publicDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	return !cgnatRange.Contains(ip)
+}
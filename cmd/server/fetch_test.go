@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "8.8.8.8", want: true},
+		{ip: "2606:4700:4700::1111", want: true},
+		{ip: "127.0.0.1", want: false},
+		{ip: "10.1.2.3", want: false},
+		{ip: "172.16.0.1", want: false},
+		{ip: "192.168.1.1", want: false},
+		{ip: "169.254.169.254", want: false},
+		{ip: "100.64.0.1", want: false},
+		{ip: "0.0.0.0", want: false},
+		{ip: "::1", want: false},
+		{ip: "fd00::1", want: false},
+	}
+	for _, tc := range tests {
+		if got := isPublicIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Fatalf("isPublicIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestURLFetcherRejectsPrivateAddress(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer ts.Close()
+
+	f := newURLFetcher(time.Second, 1024, 1)
+	_, err := f.fetch(context.Background(), ts.URL+"/a.png", filepath.Join(t.TempDir(), "a.png"))
+	if err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Fatalf("fetch() error = %v, want private address error", err)
+	}
+}
+
+func TestURLFetcherRejectsInvalidURL(t *testing.T) {
+	t.Parallel()
+
+	f := newURLFetcher(time.Second, 1024, 1)
+	for _, raw := range []string{"ftp://example.com/a.png", "not a url", "file:///etc/passwd"} {
+		if _, err := f.fetch(context.Background(), raw, filepath.Join(t.TempDir(), "a")); err == nil {
+			t.Fatalf("fetch(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestURLFetcherFetchAll(t *testing.T) {
+	t.Parallel()
+
+	var running, peak atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(append([]byte("\x89PNG\r\n\x1a\n"), r.URL.Path...))
+	}))
+	defer ts.Close()
+
+	f := newURLFetcher(time.Second, 1024, 2)
+	// The test server is on loopback, which the public dialer refuses.
+	f.client = ts.Client()
+	dir := t.TempDir()
+	names := []string{"a.png", "missing.png", "c.png", "d.png", "e.png"}
+	urls := make([]string, len(names))
+	dstPaths := make([]string, len(names))
+	for i, name := range names {
+		urls[i] = ts.URL + "/" + name
+		dstPaths[i] = filepath.Join(dir, name)
+	}
+	results := f.fetchAll(context.Background(), urls, dstPaths, 0)
+	if peak.Load() > 2 {
+		t.Fatalf("%d downloads ran at once, want at most 2", peak.Load())
+	}
+	for i, res := range results {
+		if names[i] == "missing.png" {
+			if res.err == nil || !strings.Contains(res.err.Error(), "404") {
+				t.Fatalf("results[%d].err = %v, want the 404", i, res.err)
+			}
+			continue
+		}
+		data, err := os.ReadFile(dstPaths[i])
+		if res.err != nil || err != nil || !strings.HasSuffix(string(data), "/"+names[i]) {
+			t.Fatalf("results[%d] = %+v, file %q; want %s in place", i, res, data, names[i])
+		}
+	}
+
+	// Of three 14-byte downloads, two fit in 40 bytes; the last one fails.
+	f.maxBytes = 40
+	results = f.fetchAll(context.Background(), urls[2:], dstPaths[2:], 0)
+	failed := 0
+	for _, res := range results {
+		if errors.Is(res.err, errFetchBudget) {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d downloads over the budget failed, want 1: %+v", failed, results)
+	}
+
+	// 26 bytes already stored from the upload leave room for one more.
+	results = f.fetchAll(context.Background(), urls[2:4], dstPaths[2:4], 26)
+	failed = 0
+	for _, res := range results {
+		if errors.Is(res.err, errFetchBudget) {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d downloads over the seeded budget failed, want 1: %+v", failed, results)
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	t.Parallel()
+
+	b := &fetchBudget{max: 10}
+	if !b.reserve(6) {
+		t.Fatal("reserve(6) of 10 failed")
+	}
+	if b.reserve(5) {
+		t.Fatal("reserve(5) past the maximum succeeded")
+	}
+	if got := b.used.Load(); got != 6 {
+		t.Fatalf("used = %d after a refused reserve, want 6", got)
+	}
+	b.release(6)
+	if !b.reserve(10) {
+		t.Fatal("reserve(10) after release failed")
+	}
+
+	unlimited := &fetchBudget{}
+	if !unlimited.reserve(1 << 40) {
+		t.Fatal("reserve on an unlimited budget failed")
+	}
+}
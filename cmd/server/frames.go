@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	frameFirst  = "first"
+	frameMiddle = "middle"
+
+	ffmpegTimeout = 30 * time.Second
+)
+
+// parseAnimationFrame validates ANIMATION_FRAME.
+func parseAnimationFrame(raw string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(raw)); v {
+	case "", frameFirst:
+		return frameFirst, nil
+	case frameMiddle:
+		return frameMiddle, nil
+	default:
+		return "", fmt.Errorf("must be %s or %s, got %q", frameFirst, frameMiddle, raw)
+	}
+}
+
+func pickFrame(count int, mode string) int {
+	if mode == frameMiddle && count > 1 {
+		return count / 2
+	}
+	return 0
+}
+
+// defaultVideoTypes join the default ALLOWED_IMAGE_TYPES when FFMPEG_PATH
+// is set. They are the types videoType sniffs.
+var defaultVideoTypes = []string{"video/mp4", "video/webm", "video/avi", "video/quicktime"}
+
+// videoType returns the MIME type of the file at path if it sniffs as a
+// video container, or "" otherwise.
+func videoType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if mimeType := http.DetectContentType(head); strings.HasPrefix(mimeType, "video/") {
+		return mimeType, nil
+	}
+	// QuickTime movies are not sniffed by net/http.
+	if len(head) >= 12 && bytes.Equal(head[4:12], []byte("ftypqt  ")) {
+		return "video/quicktime", nil
+	}
+	return "", nil
+}
+
+// isVideo reports whether the file at path sniffs as a video container.
+func isVideo(path string) (bool, error) {
+	mimeType, err := videoType(path)
+	return mimeType != "", err
+}
+
+// acceptVideoUpload lets a video through checkImage when FFMPEG_PATH is
+// set and ALLOWED_IMAGE_TYPES allows its type; its frame is extracted, and
+// checked like an upload, once the request is parsed. Other videos are
+// rejected with a 400.
+func (s *server) acceptVideoUpload(path, name string) (bool, error) {
+	mimeType, err := videoType(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read upload: %w", err)
+	}
+	if mimeType == "" {
+		return false, nil
+	}
+	if s.ffmpegPath == "" {
+		return true, unsupportedImage(name, mimeType, fmt.Sprintf("file %q is a video, which is not supported; upload a still image instead", name))
+	}
+	if !s.imageTypes[mimeType] {
+		return true, unsupportedImage(name, mimeType, fmt.Sprintf("file %q has unsupported type %s; allowed types are %s", name, mimeType, strings.Join(imageTypeList(s.imageTypes), ", ")))
+	}
+	return true, nil
+}
+
+// gifSection is the byte range of one GIF frame: its graphic control
+// extension, if any, through the end of its image data.
+type gifSection struct {
+	start, end int64
+}
+
+// gifLayout locates the frames of a GIF without decoding them.
+type gifLayout struct {
+	width, height int
+	// header is the length of the signature, screen descriptor and global
+	// color table that every frame is decoded against.
+	header int64
+	frames []gifSection
+}
+
+// scanGIF walks the block structure of a GIF, skipping over the compressed
+// image data, to find its frames.
+func scanGIF(r io.Reader) (gifLayout, error) {
+	br := &countingReader{r: bufio.NewReader(r)}
+	var head [13]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return gifLayout{}, err
+	}
+	layout := gifLayout{
+		width:  int(binary.LittleEndian.Uint16(head[6:8])),
+		height: int(binary.LittleEndian.Uint16(head[8:10])),
+	}
+	if err := skipColorTable(br, head[10]); err != nil {
+		return gifLayout{}, err
+	}
+	layout.header = br.n
+	start := int64(-1)
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return gifLayout{}, err
+		}
+		switch block {
+		case 0x21: // extension
+			label, err := br.ReadByte()
+			if err != nil {
+				return gifLayout{}, err
+			}
+			if label == 0xF9 && start < 0 {
+				start = br.n - 2
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return gifLayout{}, err
+			}
+		case 0x2C: // image descriptor
+			if start < 0 {
+				start = br.n - 1
+			}
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return gifLayout{}, err
+			}
+			if err := skipColorTable(br, desc[8]); err != nil {
+				return gifLayout{}, err
+			}
+			// The LZW minimum code size precedes the data sub-blocks.
+			if _, err := br.ReadByte(); err != nil {
+				return gifLayout{}, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return gifLayout{}, err
+			}
+			layout.frames = append(layout.frames, gifSection{start: start, end: br.n})
+			start = -1
+		case 0x3B: // trailer
+			return layout, nil
+		default:
+			return gifLayout{}, fmt.Errorf("gif: unknown block type 0x%02x", block)
+		}
+	}
+}
+
+// skipColorTable skips the color table a descriptor's packed fields
+// announce, if any.
+func skipColorTable(br *countingReader, packed byte) error {
+	if packed&0x80 == 0 {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, br, 3<<((packed&7)+1))
+	return err
+}
+
+func skipSubBlocks(br *countingReader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// countingReader tracks the offset of a buffered reader.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// decodeFrame decodes frame i of the GIF in f on its own, as a one-frame
+// GIF made of the file's header, the frame and a trailer.
+func (l gifLayout) decodeFrame(f io.ReaderAt, i int) (*image.Paletted, byte, error) {
+	section := l.frames[i]
+	g, err := gif.DecodeAll(io.MultiReader(
+		io.NewSectionReader(f, 0, l.header),
+		io.NewSectionReader(f, section.start, section.end-section.start),
+		bytes.NewReader([]byte{0x3B}),
+	))
+	if err != nil {
+		return nil, 0, fmt.Errorf("frame %d: %w", i, err)
+	}
+	var disposal byte
+	if len(g.Disposal) > 0 {
+		disposal = g.Disposal[0]
+	}
+	return g.Image[0], disposal, nil
+}
+
+// gifFrame composites frames 0 through index of the GIF in f, honoring each
+// frame's disposal method, to get frame index as a viewer would show it.
+// Frames are decoded one at a time, so only one is held in memory at once.
+func gifFrame(f io.ReaderAt, layout gifLayout, index int) (image.Image, error) {
+	canvas := image.NewRGBA(image.Rect(0, 0, layout.width, layout.height))
+	for i := 0; i <= index; i++ {
+		frame, disposal, err := layout.decodeFrame(f, i)
+		if err != nil {
+			return nil, err
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i == index {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return canvas, nil
+}
+
+var errGIFTooLarge = errors.New("decoding the frames up to the chosen one exceeds MAX_PIXELS")
+
+// extractGIFFrame replaces an animated GIF at path with the chosen frame
+// and returns its index. ok is false for files that are not animated GIFs.
+// Only the frames up to the chosen one are decoded, and only while their
+// pixels add up to at most maxPixels; a non-positive maxPixels lifts that
+// cap.
+func extractGIFFrame(path, mode string, maxPixels int64) (index int, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(f, head); err != nil || !bytes.HasPrefix(head, []byte("GIF8")) {
+		return 0, false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	layout, err := scanGIF(f)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(layout.frames) < 2 {
+		return 0, false, nil
+	}
+	index = pickFrame(len(layout.frames), mode)
+	// The worker reads the first frame of a GIF by itself.
+	if index == 0 {
+		return 0, true, nil
+	}
+	if maxPixels > 0 && int64(index+1)*int64(layout.width)*int64(layout.height) > maxPixels {
+		return 0, false, errGIFTooLarge
+	}
+	frame, err := gifFrame(f, layout, index)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := replaceWithJPEG(path, frame); err != nil {
+		return 0, false, err
+	}
+	return index, true, nil
+}
+
+var ffmpegFrameCount = regexp.MustCompile(`frame=\s*(\d+)`)
+
+// parseFFmpegFrameCount returns the last frame count ffmpeg reported in its
+// progress output.
+func parseFFmpegFrameCount(output string) (int, bool) {
+	matches := ffmpegFrameCount.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(matches[len(matches)-1][1])
+	return n, err == nil
+}
+
+// extractVideoFrame replaces the video at path with one of its frames as
+// JPEG and returns the frame index. The middle frame needs a frame count,
+// which ffmpeg gets by copying the stream without decoding it.
+func extractVideoFrame(ctx context.Context, ffmpeg, path, mode string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, ffmpegTimeout)
+	defer cancel()
+
+	index := 0
+	if mode == frameMiddle {
+		cmd := exec.CommandContext(ctx, ffmpeg, "-nostdin", "-hide_banner", "-i", path, "-map", "0:v:0", "-c", "copy", "-f", "null", "-")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return 0, ffmpegError(err, output)
+		}
+		count, ok := parseFFmpegFrameCount(string(output))
+		if !ok {
+			return 0, errors.New("ffmpeg did not report a frame count")
+		}
+		index = pickFrame(count, mode)
+	}
+
+	out := path + ".frame.jpg"
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-i", path, "-map", "0:v:0"}
+	if index > 0 {
+		args = append(args, "-vf", fmt.Sprintf(`select=eq(n\,%d)`, index))
+	}
+	args = append(args, "-frames:v", "1", "-q:v", "2", "-y", out)
+	if output, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput(); err != nil {
+		_ = os.Remove(out)
+		return 0, ffmpegError(err, output)
+	}
+	if _, err := os.Stat(out); err != nil {
+		return 0, errors.New("ffmpeg produced no frame")
+	}
+	return index, os.Rename(out, path)
+}
+
+func ffmpegError(err error, output []byte) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("ffmpeg is not available: %w", err)
+	}
+	return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+}
+
+// extractFrame turns an animated GIF or video into a single frame and
+// records which one on the input. A video whose frame cannot be extracted
+// fails the input; a GIF that fails is tagged as it is.
+func (s *server) extractFrame(ctx context.Context, in *evalInput) {
+	log := requestLogger(ctx)
+	if s.ffmpegPath != "" {
+		video, err := isVideo(in.path)
+		if err != nil {
+			log.Warn("read input failed", "filename", in.name, "error", err)
+			return
+		}
+		if video {
+			index, err := extractVideoFrame(ctx, s.ffmpegPath, in.path, s.animationFrame)
+			if err != nil {
+				log.Warn("video frame extraction failed", "filename", in.name, "error", err)
+				in.err = badRequest(fmt.Sprintf("file %q is a video whose frame could not be extracted", in.name))
+				return
+			}
+			// The frame skipped checkImage along with the video.
+			if err := checkPixels(in.path, in.name, s.maxPixels); err != nil {
+				in.err = err
+				return
+			}
+			in.frame = &index
+			return
+		}
+	}
+	index, ok, err := extractGIFFrame(in.path, s.animationFrame, s.maxPixels)
+	if err != nil {
+		log.Warn("gif frame extraction failed", "filename", in.name, "error", err)
+		if !errors.Is(err, errGIFTooLarge) {
+			return
+		}
+		// The worker tags the first frame.
+		index, ok = 0, true
+	}
+	if ok {
+		in.frame = &index
+	}
+}
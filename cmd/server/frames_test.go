@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFFmpegFrameCount(t *testing.T) {
+	t.Parallel()
+
+	output := "Input #0, mov,mp4...\nframe=   60 fps=0.0 q=-1.0 size=N/A\rframe=  121 fps=0.0 q=-1.0 Lsize=N/A time=00:00:05.04\n"
+	if n, ok := parseFFmpegFrameCount(output); !ok || n != 121 {
+		t.Fatalf("parseFFmpegFrameCount() = %d, %v; want 121, true", n, ok)
+	}
+	if _, ok := parseFFmpegFrameCount("Invalid data found when processing input"); ok {
+		t.Fatal("parseFFmpegFrameCount() found a count in an error")
+	}
+}
+
+func TestExtractGIFFrame(t *testing.T) {
+	t.Parallel()
+
+	palette := color.Palette{color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	anim := &gif.GIF{}
+	for i := range palette {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, g *gif.GIF) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		defer f.Close()
+		if err := gif.EncodeAll(f, g); err != nil {
+			t.Fatalf("gif.EncodeAll() error = %v", err)
+		}
+		return path
+	}
+
+	first := write("first.gif", anim)
+	before, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if index, ok, err := extractGIFFrame(first, frameFirst, 1); err != nil || !ok || index != 0 {
+		t.Fatalf("extractGIFFrame(first) = %d, %v, %v; want 0, true, nil", index, ok, err)
+	}
+	if after, _ := os.ReadFile(first); !bytes.Equal(after, before) {
+		t.Fatal("extractGIFFrame(first) rewrote the GIF")
+	}
+
+	// The middle frame needs two 8x8 frames decoded.
+	middle := write("middle.gif", anim)
+	if _, _, err := extractGIFFrame(middle, frameMiddle, 2*8*8-1); !errors.Is(err, errGIFTooLarge) {
+		t.Fatalf("extractGIFFrame(middle) over MAX_PIXELS error = %v, want errGIFTooLarge", err)
+	}
+	index, ok, err := extractGIFFrame(middle, frameMiddle, 2*8*8)
+	if err != nil || !ok || index != 1 {
+		t.Fatalf("extractGIFFrame(middle) = %d, %v, %v; want 1, true, nil", index, ok, err)
+	}
+	f, err := os.Open(middle)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("middle frame is not a JPEG: %v", err)
+	}
+	if r, g, b, _ := img.At(4, 4).RGBA(); g < r || g < b {
+		t.Fatalf("middle frame is not green: %d %d %d", r, g, b)
+	}
+
+	still := write("still.gif", &gif.GIF{Image: anim.Image[:1], Delay: anim.Delay[:1]})
+	if _, ok, err := extractGIFFrame(still, frameMiddle, 0); err != nil || ok {
+		t.Fatalf("extractGIFFrame(still) ok = %v, err = %v; want false, nil", ok, err)
+	}
+}
+
+func TestAcceptVideoUpload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "clip.webm")
+	if err := os.WriteFile(path, []byte("\x1A\x45\xDF\xA3\x9F\x42\x86\x81\x01"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	if video, err := s.acceptVideoUpload(path, "clip.webm"); !video || !isRequestError(err) {
+		t.Fatalf("acceptVideoUpload() without ffmpeg = %v, %v; want true and a request error", video, err)
+	}
+	s.ffmpegPath = "ffmpeg"
+	var reqErr *requestError
+	if video, err := s.acceptVideoUpload(path, "clip.webm"); !video || !errors.As(err, &reqErr) || reqErr.details["mime_type"] != "video/webm" {
+		t.Fatalf("acceptVideoUpload() with ffmpeg but webm not allowed = %v, %v; want true and a request error", video, err)
+	}
+	s.imageTypes = parseImageTypes("png,video/webm")
+	if video, err := s.acceptVideoUpload(path, "clip.webm"); !video || err != nil {
+		t.Fatalf("acceptVideoUpload() with ffmpeg = %v, %v; want true, nil", video, err)
+	}
+}
+
+func TestScanGIF(t *testing.T) {
+	t.Parallel()
+
+	// Frames with a local color table, a graphic control extension and an
+	// application extension in between, as encoders write them.
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{LoopCount: 1, Config: image.Config{Width: 6, Height: 4}}
+	for i := range 3 {
+		frame := image.NewPaletted(image.Rect(i, 0, i+2, 2), palette)
+		frame.Pix[0] = uint8(i % 2)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 5)
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("gif.EncodeAll() error = %v", err)
+	}
+
+	layout, err := scanGIF(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("scanGIF() error = %v", err)
+	}
+	if layout.width != 6 || layout.height != 4 || len(layout.frames) != 3 {
+		t.Fatalf("scanGIF() = %dx%d with %d frames, want 6x4 with 3", layout.width, layout.height, len(layout.frames))
+	}
+	for i := range anim.Image {
+		frame, disposal, err := layout.decodeFrame(bytes.NewReader(buf.Bytes()), i)
+		if err != nil {
+			t.Fatalf("decodeFrame(%d) error = %v", i, err)
+		}
+		if frame.Bounds() != anim.Image[i].Bounds() || disposal != gif.DisposalBackground {
+			t.Fatalf("decodeFrame(%d) = %v disposal %d, want %v disposal %d", i, frame.Bounds(), disposal, anim.Image[i].Bounds(), gif.DisposalBackground)
+		}
+	}
+
+	if _, err := scanGIF(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); err == nil {
+		t.Fatal("scanGIF() of a truncated GIF succeeded")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const heicConvertTimeout = 30 * time.Second
+
+// heifBrands are the ISO-BMFF major brands used by HEIC and HEIF images.
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "hevm", "hevs", "mif1", "msf1"}
+
+// isHEIF reports whether the file at path starts with a HEIC/HEIF ftyp box.
+func isHEIF(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false, nil
+	}
+	if !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return false, nil
+	}
+	brand := string(head[8:12])
+	for _, b := range heifBrands {
+		if brand == b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// convertHEIF runs converter as "converter <input> <output.jpg>", which both
+// heif-convert and ImageMagick accept, and replaces path with the JPEG.
+func convertHEIF(converter, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), heicConvertTimeout)
+	defer cancel()
+
+	out := path + ".jpg"
+	cmd := exec.CommandContext(ctx, converter, path, out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(out)
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(out, path)
+}
+
+// convertHEIFUpload converts a HEIC/HEIF upload to JPEG in place so the
+// worker can read it. Without HEIC_CONVERTER, or when conversion fails, the
+// upload is rejected with a 400 instead of failing later in the worker.
+func (s *server) convertHEIFUpload(path, name string) error {
+	heif, err := isHEIF(path)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	if !heif {
+		return nil
+	}
+	if s.heicConverter == "" {
+		return heifError(name, fmt.Sprintf("file %q is a HEIC/HEIF image, which is not supported; convert it to JPEG or PNG first", name))
+	}
+	if err := convertHEIF(s.heicConverter, path); err != nil {
+		slog.Warn("heic conversion failed", "filename", name, "error", err)
+		return heifError(name, fmt.Sprintf("file %q is a HEIC/HEIF image that could not be converted", name))
+	}
+	return nil
+}
+
+func heifError(name, message string) error {
+	reqErr := badRequest(message)
+	reqErr.code = codeUnsupportedFile
+	reqErr.details = map[string]string{"filename": name, "mime_type": "image/heic"}
+	return reqErr
+}
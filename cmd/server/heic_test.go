@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertHEIFUpload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	heicPath := filepath.Join(dir, "photo.heic")
+	pngPath := filepath.Join(dir, "photo.png")
+	heic := append([]byte{0, 0, 0, 0x18}, []byte("ftypheic\x00\x00\x00\x00mif1heic")...)
+	if err := os.WriteFile(heicPath, heic, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(pngPath, []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if ok, err := isHEIF(heicPath); err != nil || !ok {
+		t.Fatalf("isHEIF(heic) = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := isHEIF(pngPath); err != nil || ok {
+		t.Fatalf("isHEIF(png) = %v, %v; want false, nil", ok, err)
+	}
+
+	tests := []struct {
+		name      string
+		converter string
+	}{
+		{name: "no converter", converter: ""},
+		{name: "converter fails", converter: "false"},
+	}
+	for _, tc := range tests {
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.heicConverter = tc.converter
+		err := s.convertHEIFUpload(heicPath, "photo.heic")
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.status != http.StatusBadRequest {
+			t.Fatalf("%s: convertHEIFUpload() error = %v, want 400", tc.name, err)
+		}
+		if reqErr.details["mime_type"] != "image/heic" {
+			t.Fatalf("%s: mime_type = %q, want image/heic", tc.name, reqErr.details["mime_type"])
+		}
+		if err := s.convertHEIFUpload(pngPath, "photo.png"); err != nil {
+			t.Fatalf("%s: convertHEIFUpload(png) error = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// maxRemoteResponseBytes bounds a remote predictor's answer; a modeAll dump
+// of a full batch stays well below it.
+const maxRemoteResponseBytes = 64 << 20
+
+// errPredictorUnavailable marks a remote predictor that could not be reached
+// or answered that it is overloaded. Such requests are worth retrying.
+var errPredictorUnavailable = errors.New("remote predictor unavailable")
+
+// remotePredictRequest is the body POSTed to PREDICTOR_URL: the images
+// themselves, base64-encoded, since the remote service cannot read our temp
+// files, plus the worker's inference settings.
+type remotePredictRequest struct {
+	RequestID          string             `json:"request_id,omitempty"`
+	Images             []remoteImage      `json:"images"`
+	Threshold          float64            `json:"threshold"`
+	Limit              int                `json:"limit"`
+	CategoryThresholds map[string]float64 `json:"category_thresholds,omitempty"`
+	Mode               string             `json:"mode,omitempty"`
+}
+
+// remoteImage is one image of a remotePredictRequest. Name is the temp
+// filename the prediction must come back under.
+type remoteImage struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// httpPredictor runs inference on a separate server. The service answers
+// with the same JSON the worker sends, {"predictions": [...]} or
+// {"error": "..."}, so the web tier and the GPU tier can scale apart.
+// Connections are pooled per host; transient failures are retried under
+// the same policy as worker errors.
+type httpPredictor struct {
+	url    string
+	client *http.Client
+	retry  retryPolicy
+	closed atomic.Bool
+}
+
+// newHTTPPredictor checks rawURL and prepares a client that keeps up to
+// conns idle connections to it.
+func newHTTPPredictor(rawURL string, conns int, retry retryPolicy) (*httpPredictor, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("PREDICTOR_URL %q must be an http or https URL", rawURL)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        max(conns, 1),
+		MaxIdleConnsPerHost: max(conns, 1),
+		IdleConnTimeout:     90 * time.Second,
+	}
+	// The request context carries the predict timeout, so the client sets
+	// none of its own.
+	return &httpPredictor{url: u.String(), client: &http.Client{Transport: transport}, retry: retry}, nil
+}
+
+func (hp *httpPredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	if hp.closed.Load() {
+		return nil, errWorkerNotRunning
+	}
+	body, err := remoteRequestBody(ctx, files, params)
+	if err != nil {
+		return nil, err
+	}
+	return hp.retry.do(ctx, files, onPrediction, func(onPrediction func(prediction)) ([]prediction, error) {
+		predictions, err := hp.post(ctx, files, body)
+		if err != nil {
+			return nil, err
+		}
+		// The service answers all at once; report each file as the worker
+		// would have streamed it.
+		if onPrediction != nil {
+			for _, pred := range predictions {
+				if pred.Error == "" {
+					onPrediction(pred)
+				}
+			}
+		}
+		return predictions, nil
+	})
+}
+
+// remoteRequestBody reads files into the JSON body sent for them.
+func remoteRequestBody(ctx context.Context, files []string, params predictParams) ([]byte, error) {
+	req := remotePredictRequest{
+		RequestID:          requestIDFrom(ctx),
+		Images:             make([]remoteImage, 0, len(files)),
+		Threshold:          params.threshold,
+		Limit:              params.limit,
+		CategoryThresholds: params.categoryThresholds,
+		Mode:               params.mode,
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", filepath.Base(file), err)
+		}
+		req.Images = append(req.Images, remoteImage{Name: filepath.Base(file), Data: base64.StdEncoding.EncodeToString(data)})
+	}
+	return json.Marshal(req)
+}
+
+// post sends one attempt and aligns the answer with files.
+func (hp *httpPredictor) post(ctx context.Context, files []string, body []byte) ([]prediction, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hp.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%w: %v", errPredictorUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var answer workerResponse
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteResponseBytes)).Decode(&answer)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout:
+		return nil, fmt.Errorf("%w: status %d", errPredictorUnavailable, resp.StatusCode)
+	case answer.Error != "":
+		// Keep the service's message as is, so PREDICT_RETRY_ERRORS
+		// matches it like a worker error.
+		return nil, errors.New(answer.Error)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("remote predictor answered status %d", resp.StatusCode)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("decode remote predictor response: %w", decodeErr)
+	}
+	predictions, unexpected := alignPredictions(files, answer.Predictions)
+	if len(unexpected) > 0 {
+		requestLogger(ctx).Warn("remote predictor returned predictions for unknown files", "filenames", unexpected)
+	}
+	return predictions, nil
+}
+
+// alive reports whether the predictor is open. Whether the service is up is
+// only known per request; failures surface there as 503s.
+func (hp *httpPredictor) alive() bool { return !hp.closed.Load() }
+
+func (hp *httpPredictor) close() {
+	hp.closed.Store(true)
+	hp.client.CloseIdleConnections()
+}
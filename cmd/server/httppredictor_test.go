@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPPredictorRejectsBadURL(t *testing.T) {
+	t.Parallel()
+
+	for _, raw := range []string{"", "ftp://gpu/predict", "gpu:8000", "http://"} {
+		if _, err := newHTTPPredictor(raw, 1, retryPolicy{}); err == nil {
+			t.Fatalf("newHTTPPredictor(%q) error = nil, want an error", raw)
+		}
+	}
+}
+
+func TestHTTPPredictor(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "0-a.png"), filepath.Join(dir, "1-b.png")}
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte("image "+filepath.Base(file)), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt finds the service overloaded.
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req remotePredictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Decode() error = %v", err)
+		}
+		if req.Threshold != 0.3 || req.Limit != 5 || r.Header.Get("X-Request-ID") != "req-1" {
+			t.Errorf("request = %+v, X-Request-ID %q; want threshold 0.3, limit 5, req-1", req, r.Header.Get("X-Request-ID"))
+		}
+		var resp workerResponse
+		// Answer in reverse order: predictions are matched by name.
+		for i := len(req.Images) - 1; i >= 0; i-- {
+			data, _ := base64.StdEncoding.DecodeString(req.Images[i].Data)
+			resp.Predictions = append(resp.Predictions, prediction{Filename: req.Images[i].Name, Tags: map[string]float64{string(data): 1}})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	hp, err := newHTTPPredictor(srv.URL, 2, retryPolicy{attempts: 1, backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("newHTTPPredictor() error = %v", err)
+	}
+	defer hp.close()
+
+	var streamed []string
+	ctx := withRequestID(context.Background(), "req-1")
+	preds, err := hp.predictStream(ctx, files, predictParams{threshold: 0.3, limit: 5}, func(pred prediction) { streamed = append(streamed, pred.Filename) })
+	if err != nil {
+		t.Fatalf("predictStream() error = %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("service called %d times, want a retry after the 503", calls.Load())
+	}
+	for i, file := range files {
+		name := filepath.Base(file)
+		if preds[i].Filename != name || preds[i].Tags["image "+name] != 1 {
+			t.Fatalf("prediction %d = %+v, want %s's own tags", i, preds[i], name)
+		}
+	}
+	if len(streamed) != len(files) {
+		t.Fatalf("streamed %v, want every file once", streamed)
+	}
+
+	hp.close()
+	if hp.alive() {
+		t.Fatal("alive() after close = true")
+	}
+	if _, err := hp.predictStream(ctx, files, predictParams{}, nil); !errors.Is(err, errWorkerNotRunning) {
+		t.Fatalf("predictStream() after close error = %v, want errWorkerNotRunning", err)
+	}
+}
+
+func TestHTTPPredictorErrors(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "0-a.png")
+	if err := os.WriteFile(file, []byte("image"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	tests := []struct {
+		name            string
+		status          int
+		body            string
+		wantUnavailable bool
+		wantMessage     string
+	}{
+		{name: "overloaded", status: http.StatusTooManyRequests, wantUnavailable: true},
+		{name: "worker error", status: http.StatusInternalServerError, body: `{"error":"CUDA error: device-side assert"}`, wantMessage: "CUDA error: device-side assert"},
+		{name: "bad status", status: http.StatusNotFound, body: "not found", wantMessage: "remote predictor answered status 404"},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			_, _ = w.Write([]byte(tc.body))
+		}))
+		hp, err := newHTTPPredictor(srv.URL, 1, retryPolicy{})
+		if err != nil {
+			t.Fatalf("%s: newHTTPPredictor() error = %v", tc.name, err)
+		}
+		_, err = hp.predictStream(context.Background(), []string{file}, predictParams{}, nil)
+		srv.Close()
+		if errors.Is(err, errPredictorUnavailable) != tc.wantUnavailable {
+			t.Fatalf("%s: error = %v, want unavailable %v", tc.name, err, tc.wantUnavailable)
+		}
+		if tc.wantMessage != "" && (err == nil || err.Error() != tc.wantMessage) {
+			t.Fatalf("%s: error = %v, want %q", tc.name, err, tc.wantMessage)
+		}
+	}
+
+	// Nothing listens on a closed server's address.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	hp, _ := newHTTPPredictor(srv.URL, 1, retryPolicy{})
+	if _, err := hp.predictStream(context.Background(), []string{file}, predictParams{}, nil); !errors.Is(err, errPredictorUnavailable) {
+		t.Fatalf("unreachable service error = %v, want errPredictorUnavailable", err)
+	}
+}
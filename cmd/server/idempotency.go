@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyEntries = 1000
+	defaultIdempotencyTTL     = time.Hour
+	maxIdempotencyKeyLen      = 255
+	// maxIdempotentBody bounds the size of a response kept for replay;
+	// larger ones, such as HTML pages with inline previews, are not kept.
+	maxIdempotentBody = 1 << 20
+)
+
+// replayedHeaders are the response headers stored with a replayable response.
+var replayedHeaders = []string{"Content-Type", "Content-Disposition", "Location"}
+
+// idempotencyStore keeps successful responses by client Idempotency-Key so
+// a retried POST is answered without running inference again. It is an LRU
+// bounded by entry count whose entries also expire after ttl. A nil store
+// is valid and keeps nothing.
+type idempotencyStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	items    map[string]*list.Element
+	pending  map[string]bool
+	now      func() time.Time
+}
+
+type idempotentResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyStore(capacity int, ttl time.Duration) *idempotencyStore {
+	if capacity < 1 || ttl <= 0 {
+		return nil
+	}
+	return &idempotencyStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+		pending:  make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// begin looks key up. It returns the stored response if there is one;
+// otherwise it reports whether the caller may run the request, which is
+// false while another request with the same key is still running.
+func (st *idempotencyStore) begin(key string) (*idempotentResponse, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if el, ok := st.items[key]; ok {
+		resp := el.Value.(*idempotentResponse)
+		if st.now().Before(resp.expires) {
+			st.order.MoveToFront(el)
+			return resp, false
+		}
+		st.order.Remove(el)
+		delete(st.items, key)
+	}
+	if st.pending[key] {
+		return nil, false
+	}
+	st.pending[key] = true
+	return nil, true
+}
+
+// finish stores resp for key, or only releases the key when resp is nil.
+func (st *idempotencyStore) finish(key string, resp *idempotentResponse) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.pending, key)
+	if resp == nil {
+		return
+	}
+	resp.key = key
+	resp.expires = st.now().Add(st.ttl)
+	st.items[key] = st.order.PushFront(resp)
+	for st.order.Len() > st.capacity {
+		oldest := st.order.Back()
+		st.order.Remove(oldest)
+		delete(st.items, oldest.Value.(*idempotentResponse).key)
+	}
+}
+
+func (st *idempotencyStore) len() int {
+	if st == nil {
+		return 0
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.order.Len()
+}
+
+// idempotencyRecorder passes a response through while keeping a copy of it,
+// up to maxIdempotentBody bytes.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (ir *idempotencyRecorder) WriteHeader(status int) {
+	if ir.status == 0 {
+		ir.status = status
+	}
+	ir.ResponseWriter.WriteHeader(status)
+}
+
+func (ir *idempotencyRecorder) Write(b []byte) (int, error) {
+	if ir.status == 0 {
+		ir.status = http.StatusOK
+	}
+	if !ir.overflow {
+		if ir.body.Len()+len(b) > maxIdempotentBody {
+			ir.overflow = true
+			ir.body = bytes.Buffer{}
+		} else {
+			ir.body.Write(b)
+		}
+	}
+	return ir.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (ir *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return ir.ResponseWriter
+}
+
+// idempotent replays the stored response for a POST carrying an
+// Idempotency-Key the client already used, and otherwise stores the
+// response when it is a 2xx. Keys are scoped to the path and the caller's
+// API key, so clients cannot read each other's results.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if s.idempotency == nil || key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			s.writeError(w, requestFormat(r), http.StatusBadRequest, codeBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		sum := sha256.Sum256([]byte(requestAPIKey(r) + "\x00" + r.URL.Path + "\x00" + key))
+		scoped := hex.EncodeToString(sum[:])
+
+		stored, ok := s.idempotency.begin(scoped)
+		if stored != nil {
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			_, _ = w.Write(stored.body)
+			return
+		}
+		if !ok {
+			s.writeError(w, requestFormat(r), http.StatusConflict, codeConflict, "a request with this Idempotency-Key is still in progress")
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		var resp *idempotentResponse
+		defer func() { s.idempotency.finish(scoped, resp) }()
+		next(rec, r)
+		if rec.status < 200 || rec.status > 299 || rec.overflow {
+			return
+		}
+		header := make(http.Header)
+		for _, name := range replayedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		resp = &idempotentResponse{status: rec.status, header: header, body: bytes.Clone(rec.body.Bytes())}
+	}
+}
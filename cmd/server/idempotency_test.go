@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	t.Parallel()
+
+	if newIdempotencyStore(0, time.Hour) != nil || newIdempotencyStore(10, 0) != nil {
+		t.Fatal("newIdempotencyStore() with no capacity or TTL is not nil")
+	}
+	now := time.Unix(0, 0)
+	st := newIdempotencyStore(2, time.Minute)
+	st.now = func() time.Time { return now }
+
+	if _, ok := st.begin("a"); !ok {
+		t.Fatal("begin(a) on an empty store did not allow the request")
+	}
+	if resp, ok := st.begin("a"); resp != nil || ok {
+		t.Fatal("begin(a) while a is in progress allowed a second request")
+	}
+	st.finish("a", &idempotentResponse{status: http.StatusOK, body: []byte("A")})
+	if resp, _ := st.begin("a"); resp == nil || string(resp.body) != "A" {
+		t.Fatalf("begin(a) after finish = %v, want the stored response", resp)
+	}
+
+	// A failed request releases its key without storing anything.
+	st.begin("b")
+	st.finish("b", nil)
+	if resp, ok := st.begin("b"); resp != nil || !ok {
+		t.Fatal("begin(b) after a failed request did not allow a retry")
+	}
+	st.finish("b", &idempotentResponse{status: http.StatusOK})
+	st.begin("c")
+	st.finish("c", &idempotentResponse{status: http.StatusOK})
+	if st.len() != 2 {
+		t.Fatalf("len() = %d, want 2", st.len())
+	}
+	if resp, _ := st.begin("a"); resp != nil {
+		t.Fatal("least recently used entry a was not evicted")
+	}
+	st.finish("a", nil)
+
+	now = now.Add(2 * time.Minute)
+	if resp, ok := st.begin("c"); resp != nil || !ok {
+		t.Fatal("expired entry c was replayed")
+	}
+}
+
+func TestIdempotentHandler(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.idempotency = newIdempotencyStore(10, time.Minute)
+	calls := 0
+	handler := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("fail") == "1" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Other", "dropped")
+		fmt.Fprintf(w, `{"call":%d}`, calls)
+	})
+	post := func(target, key, apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader("body"))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, r)
+		return rr
+	}
+
+	first := post("/evaluate", "k1", "")
+	replay := post("/evaluate", "k1", "")
+	if calls != 1 || replay.Body.String() != first.Body.String() || replay.Code != http.StatusOK {
+		t.Fatalf("replay = %d %q after %d calls, want the first response %q", replay.Code, replay.Body, calls, first.Body)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || replay.Header().Get("Content-Type") != "application/json" || replay.Header().Get("X-Other") != "" {
+		t.Fatalf("replay headers = %v", replay.Header())
+	}
+
+	tests := []struct {
+		name      string
+		target    string
+		key       string
+		apiKey    string
+		wantCalls int
+	}{
+		{"no key", "/evaluate", "", "", 2},
+		{"other key", "/evaluate", "k2", "", 3},
+		{"other path", "/jobs", "k1", "", 4},
+		{"other client", "/evaluate", "k1", "someone-else", 5},
+		{"failure not stored", "/evaluate?fail=1", "k3", "", 6},
+		{"failure retried", "/evaluate?fail=1", "k3", "", 7},
+	}
+	for _, tc := range tests {
+		post(tc.target, tc.key, tc.apiKey)
+		if calls != tc.wantCalls {
+			t.Fatalf("%s: handler calls = %d, want %d", tc.name, calls, tc.wantCalls)
+		}
+	}
+
+	if rr := post("/evaluate", strings.Repeat("k", maxIdempotencyKeyLen+1), ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("long key status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var defaultImageTypes = []string{"image/jpeg", "image/png", "image/webp", "image/gif", "image/tiff", "image/bmp"}
+
+// imageError reports an input that is not an acceptable image, along with
+// the MIME type sniffed from its contents.
+type imageError struct {
+	mimeType string
+	message  string
+}
+
+func (e *imageError) Error() string {
+	return e.message
+}
+
+// parseImageTypes turns a comma-separated list such as "jpeg,image/png" into
+// a set of MIME types.
+func parseImageTypes(raw string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.Contains(t, "/") {
+			t = "image/" + t
+		}
+		switch t {
+		case "image/jpg":
+			t = "image/jpeg"
+		case "image/tif":
+			t = "image/tiff"
+		}
+		types[t] = true
+	}
+	return types
+}
+
+func imageTypeList(types map[string]bool) []string {
+	list := make([]string, 0, len(types))
+	for t := range types {
+		list = append(list, t)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// validateImageFile sniffs the file at path and checks that its type is in
+// allowed and that its header decodes. It returns the detected MIME type.
+func validateImageFile(path, name string, allowed map[string]bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	mimeType := sniffImageType(head[:n])
+	if !allowed[mimeType] {
+		return mimeType, &imageError{
+			mimeType: mimeType,
+			message:  fmt.Sprintf("file %q has unsupported type %s; allowed types are %s", name, mimeType, strings.Join(imageTypeList(allowed), ", ")),
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return mimeType, err
+	}
+	if _, _, err := image.DecodeConfig(f); err != nil {
+		return mimeType, &imageError{
+			mimeType: mimeType,
+			message:  fmt.Sprintf("file %q is not a decodable image", name),
+		}
+	}
+	return mimeType, nil
+}
+
+// defaultMaxPixels is the default for MAX_PIXELS: 100 megapixels, which
+// take about 400 MB once decoded.
+const defaultMaxPixels = 100_000_000
+
+// checkPixels rejects an image whose header declares more than maxPixels
+// pixels. Only the header is read, so a decompression bomb, a small file
+// that expands to something like 50000x50000, is turned away before
+// anything decodes it. A header that does not decode is left for
+// validateImageFile to report. A non-positive maxPixels disables the check.
+func checkPixels(path, name string, maxPixels int64) error {
+	if maxPixels < 1 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil || int64(cfg.Width)*int64(cfg.Height) <= maxPixels {
+		return nil
+	}
+	reqErr := badRequest(fmt.Sprintf("file %q is %dx%d pixels, more than the limit of %d", name, cfg.Width, cfg.Height, maxPixels))
+	reqErr.code = codeFileTooLarge
+	reqErr.details = map[string]string{"filename": name, "width": strconv.Itoa(cfg.Width), "height": strconv.Itoa(cfg.Height)}
+	return reqErr
+}
+
+// decodeImageFile fully decodes the image at path. DecodeConfig only reads
+// the header, so a truncated upload passes validateImageFile and fails in
+// the worker instead.
+func decodeImageFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = image.Decode(f)
+	return err
+}
+
+// checkDecodes rejects an image that cannot be decoded to the end, naming
+// the file and how many bytes arrived so a client can spot a cut-off
+// upload. Decoding is bounded by decodeSem like the other preprocessing.
+func (s *server) checkDecodes(path, name string) error {
+	s.decodeSem <- struct{}{}
+	err := decodeImageFile(path)
+	<-s.decodeSem
+	if err == nil {
+		return nil
+	}
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return statErr
+	}
+	size := strconv.FormatInt(info.Size(), 10)
+	reqErr := badRequest(fmt.Sprintf("file %q is truncated or corrupt (%s bytes)", name, size))
+	reqErr.code = codeCorruptFile
+	reqErr.details = map[string]string{"filename": name, "bytes": size}
+	return reqErr
+}
+
+// downscaleImage shrinks the image at path so that its longer side is at
+// most maxDim, preserving the aspect ratio, and rewrites it as JPEG in place.
+// It reports whether the file was changed.
+func downscaleImage(path string, maxDim int) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false, err
+	}
+	if maxDim < 1 || (cfg.Width <= maxDim && cfg.Height <= maxDim) {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return false, err
+	}
+	w, h := scaledSize(cfg.Width, cfg.Height, maxDim)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	if err := replaceWithJPEG(path, dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceWithJPEG encodes img as JPEG next to path and renames it over path,
+// so the worker never sees a half-written file.
+func replaceWithJPEG(path string, img image.Image) error {
+	tmp := path + ".rewritten"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	encErr := jpeg.Encode(out, img, &jpeg.Options{Quality: 90})
+	closeErr := out.Close()
+	if encErr == nil {
+		encErr = closeErr
+	}
+	if encErr != nil {
+		_ = os.Remove(tmp)
+		return encErr
+	}
+	return os.Rename(tmp, path)
+}
+
+// previewSize reports the size of a thumbnail of the image at path whose
+// longer side is at most maxDim. ok is false when the image already fits or
+// is not one Go can decode, in which case the original is previewed.
+func previewSize(path string, maxDim int) (w, h int, ok bool) {
+	if maxDim < 1 {
+		return 0, 0, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil || (cfg.Width <= maxDim && cfg.Height <= maxDim) {
+		return 0, 0, false
+	}
+	w, h = scaledSize(cfg.Width, cfg.Height, maxDim)
+	return w, h, true
+}
+
+// writeThumbnail encodes the image at path scaled to w x h as JPEG into out.
+func writeThumbnail(out io.Writer, path string, w, h int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return jpeg.Encode(out, dst, &jpeg.Options{Quality: 80})
+}
+
+func scaledSize(width, height, maxDim int) (int, int) {
+	if width >= height {
+		return maxDim, max(1, height*maxDim/width)
+	}
+	return max(1, width*maxDim/height), maxDim
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseImageTypes(t *testing.T) {
+	t.Parallel()
+
+	got := parseImageTypes(" jpg, image/PNG ,webp,,")
+	for _, want := range []string{"image/jpeg", "image/png", "image/webp"} {
+		if !got[want] {
+			t.Fatalf("parseImageTypes() missing %s: %v", want, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("len(parseImageTypes()) = %d, want 3", len(got))
+	}
+}
+
+func TestValidateImageFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	pngPath := filepath.Join(dir, "ok.png")
+	textPath := filepath.Join(dir, "notes.txt")
+	brokenPath := filepath.Join(dir, "broken.png")
+	for path, data := range map[string][]byte{
+		pngPath:    buf.Bytes(),
+		textPath:   []byte("hello, world"),
+		brokenPath: buf.Bytes()[:12],
+	} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	allowed := parseImageTypes("jpeg,png")
+	if mimeType, err := validateImageFile(pngPath, "ok.png", allowed); err != nil || mimeType != "image/png" {
+		t.Fatalf("validateImageFile(png) = %q, %v; want image/png, nil", mimeType, err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		allowed  map[string]bool
+		wantMIME string
+	}{
+		{name: "text", path: textPath, allowed: allowed, wantMIME: "text/plain; charset=utf-8"},
+		{name: "truncated header", path: brokenPath, allowed: allowed, wantMIME: "image/png"},
+		{name: "type not allowed", path: pngPath, allowed: parseImageTypes("jpeg"), wantMIME: "image/png"},
+	}
+	for _, tc := range tests {
+		mimeType, err := validateImageFile(tc.path, tc.name, tc.allowed)
+		var imgErr *imageError
+		if !errors.As(err, &imgErr) {
+			t.Fatalf("%s: validateImageFile() error = %v, want *imageError", tc.name, err)
+		}
+		if mimeType != tc.wantMIME || imgErr.mimeType != tc.wantMIME {
+			t.Fatalf("%s: mime type = %q, want %q", tc.name, mimeType, tc.wantMIME)
+		}
+	}
+}
+
+func TestCheckImageTruncated(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	// Keep the header so DecodeConfig succeeds but cut the pixel data.
+	path := filepath.Join(t.TempDir(), "cut.png")
+	truncated := buf.Bytes()[:buf.Len()-20]
+	if err := os.WriteFile(path, truncated, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	if err := s.checkImage(path, "cut.png"); err != nil {
+		t.Fatalf("checkImage() without VALIDATE_DECODE error = %v, want nil", err)
+	}
+	s.validateDecode = true
+	err := s.checkImage(path, "cut.png")
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.code != codeCorruptFile {
+		t.Fatalf("checkImage() error = %v, want CorruptFile", err)
+	}
+	if want := strconv.Itoa(len(truncated)); reqErr.details["bytes"] != want || reqErr.details["filename"] != "cut.png" {
+		t.Fatalf("details = %v, want cut.png with %s bytes", reqErr.details, want)
+	}
+}
+
+// pngHeader returns the signature and IHDR chunk of an 8-bit RGB PNG of
+// the given size, with no pixel data: enough for DecodeConfig.
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0)
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = binary.BigEndian.AppendUint32(out, uint32(len(ihdr)-4))
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestCheckImageMaxPixels(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	bombPath := filepath.Join(dir, "bomb.png")
+	if err := os.WriteFile(bombPath, pngHeader(50000, 50000), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 20, 10))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	smallPath := filepath.Join(dir, "small.png")
+	if err := os.WriteFile(smallPath, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		maxPixels int64
+		wantErr   bool
+	}{
+		// Decoding would fail with CorruptFile; the header check comes first.
+		{name: "bomb.png", path: bombPath, maxPixels: defaultMaxPixels, wantErr: true},
+		{name: "small.png", path: smallPath, maxPixels: 200},
+		{name: "small.png", path: smallPath, maxPixels: 199, wantErr: true},
+		{name: "small.png", path: smallPath, maxPixels: 0},
+	}
+	for _, tc := range tests {
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.validateDecode = true
+		s.maxPixels = tc.maxPixels
+		err := s.checkImage(tc.path, tc.name)
+		if !tc.wantErr {
+			if err != nil {
+				t.Fatalf("checkImage(%s, max %d) error = %v, want nil", tc.name, tc.maxPixels, err)
+			}
+			continue
+		}
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.code != codeFileTooLarge || reqErr.status != http.StatusBadRequest {
+			t.Fatalf("checkImage(%s, max %d) error = %v, want a 400 FileTooLarge", tc.name, tc.maxPixels, err)
+		}
+		if reqErr.details["filename"] != tc.name || reqErr.details["width"] == "" || reqErr.details["height"] == "" {
+			t.Fatalf("details = %v, want %s with its dimensions", reqErr.details, tc.name)
+		}
+	}
+}
+
+func TestDownscaleImage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 100))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	path := filepath.Join(dir, "wide.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if changed, err := downscaleImage(path, 400); err != nil || changed {
+		t.Fatalf("downscaleImage(400) = %v, %v; want false, nil", changed, err)
+	}
+	if changed, err := downscaleImage(path, 200); err != nil || !changed {
+		t.Fatalf("downscaleImage(200) = %v, %v; want true, nil", changed, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("DecodeConfig() error = %v", err)
+	}
+	if format != "jpeg" || cfg.Width != 200 || cfg.Height != 50 {
+		t.Fatalf("resized image = %s %dx%d, want jpeg 200x50", format, cfg.Width, cfg.Height)
+	}
+}
+
+func TestHTMLPreviewThumbnail(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 100))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	path := filepath.Join(dir, "wide.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	pred := []prediction{{Filename: "wide.png", Tags: map[string]float64{"1girl": 0.9}}}
+
+	for _, maxDim := range []int{0, 400} {
+		results, err := buildHTMLResults([]string{path}, pred, maxDim)
+		if err != nil {
+			t.Fatalf("buildHTMLResults(%d) error = %v", maxDim, err)
+		}
+		data, err := results[0].ImageData()
+		if err != nil || results[0].MimeType != "image/png" || data != base64.StdEncoding.EncodeToString(buf.Bytes()) {
+			t.Fatalf("buildHTMLResults(%d) preview = %s, %v; want the original PNG", maxDim, results[0].MimeType, err)
+		}
+	}
+
+	results, err := buildHTMLResults([]string{path}, pred, 200)
+	if err != nil {
+		t.Fatalf("buildHTMLResults(200) error = %v", err)
+	}
+	data, err := results[0].ImageData()
+	if err != nil {
+		t.Fatalf("ImageData() error = %v", err)
+	}
+	thumb, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("DecodeConfig() error = %v", err)
+	}
+	if results[0].MimeType != "image/jpeg" || format != "jpeg" || cfg.Width != 200 || cfg.Height != 50 {
+		t.Fatalf("preview = %s (%s %dx%d), want a 200x50 jpeg", results[0].MimeType, format, cfg.Width, cfg.Height)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(buf.Len()) {
+		t.Fatalf("stored image changed: %v, %v", info, err)
+	}
+}
+
+func TestScaledSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		w, h, max    int
+		wantW, wantH int
+	}{
+		{w: 4000, h: 3000, max: 1000, wantW: 1000, wantH: 750},
+		{w: 3000, h: 4000, max: 1000, wantW: 750, wantH: 1000},
+		{w: 5000, h: 1, max: 100, wantW: 100, wantH: 1},
+	}
+	for _, tc := range tests {
+		if w, h := scaledSize(tc.w, tc.h, tc.max); w != tc.wantW || h != tc.wantH {
+			t.Fatalf("scaledSize(%d, %d, %d) = %d, %d; want %d, %d", tc.w, tc.h, tc.max, w, h, tc.wantW, tc.wantH)
+		}
+	}
+}
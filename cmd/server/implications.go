@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// tagImplications maps a tag to the tags it implies, as loaded from
+// TAG_IMPLICATIONS:
+//
+//	{"cat_ears": ["animal_ears"], "hatsune_miku": ["vocaloid"]}
+type tagImplications map[string][]string
+
+// loadTagImplications reads the TAG_IMPLICATIONS file. An empty path loads
+// nothing.
+func loadTagImplications(path string) (tagImplications, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t tagImplications
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// expand returns the tags implied by tags, directly or through other
+// implied tags, that are not in tags already. Each implied tag scores the
+// highest score among the predicted tags that imply it. Cycles in the table
+// are harmless.
+func (t tagImplications) expand(tags map[string]float64) map[string]float64 {
+	if len(t) == 0 {
+		return nil
+	}
+	implied := make(map[string]float64)
+	for tag, score := range tags {
+		seen := map[string]bool{tag: true}
+		queue := []string{tag}
+		for len(queue) > 0 {
+			next := queue[0]
+			queue = queue[1:]
+			for _, consequent := range t[next] {
+				if seen[consequent] {
+					continue
+				}
+				seen[consequent] = true
+				queue = append(queue, consequent)
+				if _, predicted := tags[consequent]; predicted {
+					continue
+				}
+				if best, ok := implied[consequent]; !ok || score > best {
+					implied[consequent] = score
+				}
+			}
+		}
+	}
+	return implied
+}
+
+// expandImplications adds the tags implied by pred's tags to it and lists
+// them, sorted, in pred.Implied. Implied tags the tag filter rejects are
+// left out.
+func expandImplications(pred *prediction, t tagImplications, f *tagFilter) {
+	var implied []string
+	for tag, score := range t.expand(pred.Tags) {
+		if !f.keep(tag) {
+			continue
+		}
+		pred.Tags[tag] = score
+		implied = append(implied, tag)
+	}
+	sort.Strings(implied)
+	pred.Implied = implied
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTagImplications(t *testing.T) {
+	t.Parallel()
+
+	if got, err := loadTagImplications(""); got != nil || err != nil {
+		t.Fatalf("loadTagImplications(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "implications.json")
+	if err := os.WriteFile(path, []byte(`{"cat_ears": ["animal_ears"]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	got, err := loadTagImplications(path)
+	if err != nil {
+		t.Fatalf("loadTagImplications() error = %v", err)
+	}
+	if want := (tagImplications{"cat_ears": {"animal_ears"}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loadTagImplications() = %v, want %v", got, want)
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"cat_ears": "animal_ears"}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := loadTagImplications(broken); err == nil {
+		t.Fatal("loadTagImplications() accepted a string consequent")
+	}
+}
+
+func TestTagImplicationsExpand(t *testing.T) {
+	t.Parallel()
+
+	table := tagImplications{
+		"cat_ears":      {"animal_ears"},
+		"fox_ears":      {"animal_ears"},
+		"hatsune_miku":  {"vocaloid"},
+		"animal_ears":   {"cat_ears"},
+		"thighhighs":    {"legwear"},
+		"black_legwear": {"legwear"},
+	}
+	tests := []struct {
+		name string
+		tags map[string]float64
+		want map[string]float64
+	}{
+		{"none", map[string]float64{"solo": 0.9}, map[string]float64{}},
+		{"direct", map[string]float64{"hatsune_miku": 0.8}, map[string]float64{"vocaloid": 0.8}},
+		{"best antecedent", map[string]float64{"cat_ears": 0.4, "fox_ears": 0.7}, map[string]float64{"animal_ears": 0.7}},
+		{"already predicted", map[string]float64{"thighhighs": 0.9, "legwear": 0.2}, map[string]float64{}},
+		{"cycle", map[string]float64{"animal_ears": 0.5}, map[string]float64{"cat_ears": 0.5}},
+	}
+	for _, tc := range tests {
+		if got := table.expand(tc.tags); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expand(%v) = %v, want %v", tc.name, tc.tags, got, tc.want)
+		}
+	}
+	if got := tagImplications(nil).expand(map[string]float64{"cat_ears": 1}); got != nil {
+		t.Fatalf("expand() without implications = %v, want nil", got)
+	}
+
+	chain := tagImplications{"a": {"b"}, "b": {"c"}}
+	if got, want := chain.expand(map[string]float64{"a": 0.6}), map[string]float64{"b": 0.6, "c": 0.6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expand() of a chain = %v, want %v", got, want)
+	}
+}
+
+func TestExpandImplications(t *testing.T) {
+	t.Parallel()
+
+	table := tagImplications{"cat_ears": {"animal_ears", "nsfw_thing"}}
+	pred := prediction{Tags: map[string]float64{"cat_ears": 0.9}}
+	expandImplications(&pred, table, newTagFilter(nil, []string{"nsfw_*"}))
+	if want := map[string]float64{"cat_ears": 0.9, "animal_ears": 0.9}; !reflect.DeepEqual(pred.Tags, want) {
+		t.Fatalf("tags = %v, want %v", pred.Tags, want)
+	}
+	if !reflect.DeepEqual(pred.Implied, []string{"animal_ears"}) {
+		t.Fatalf("implied = %v, want [animal_ears]", pred.Implied)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// inflightLimiter bounds concurrent evaluate requests. Unlike a channel
+// semaphore its limit can change at runtime: lowering it lets current
+// holders finish while new requests wait or are turned away until the count
+// falls below the new limit.
+type inflightLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inUse    int
+	draining bool
+	// waiting holds when each request now blocked in acquire started
+	// waiting, keyed by a per-call ID.
+	waiting    map[uint64]time.Time
+	nextWaiter uint64
+}
+
+func newInflightLimiter(limit int) *inflightLimiter {
+	l := &inflightLimiter{limit: max(limit, 1), waiting: make(map[uint64]time.Time)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// tryAcquire takes a slot if one is free.
+func (l *inflightLimiter) tryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining || l.inUse >= l.limit {
+		return false
+	}
+	l.inUse++
+	return true
+}
+
+// acquire waits for a free slot until ctx is done. While it waits it
+// counts towards queued.
+func (l *inflightLimiter) acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining || l.inUse >= l.limit {
+		id := l.nextWaiter
+		l.nextWaiter++
+		l.waiting[id] = time.Now()
+		defer delete(l.waiting, id)
+	}
+	for l.draining || l.inUse >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	l.inUse++
+	return nil
+}
+
+// queued returns how many requests are waiting for a slot and how long the
+// one that has waited longest has been waiting at now.
+func (l *inflightLimiter) queued(now time.Time) (count int, oldest time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, since := range l.waiting {
+		oldest = max(oldest, now.Sub(since))
+	}
+	return len(l.waiting), oldest
+}
+
+func (l *inflightLimiter) release() {
+	l.mu.Lock()
+	l.inUse--
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// setLimit changes the number of slots. Requests already holding a slot
+// keep it.
+func (l *inflightLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = max(limit, 1)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// stats returns the slots in use and the current limit.
+func (l *inflightLimiter) stats() (inUse, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inUse, l.limit
+}
+
+func (l *inflightLimiter) full() bool {
+	inUse, limit := l.stats()
+	return inUse >= limit
+}
+
+// drain stops handing out slots and waits until every held one is released
+// or ctx is done.
+func (l *inflightLimiter) drain(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.draining = true
+	for l.inUse > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	return nil
+}
+
+// acquireSlot takes an inflight slot for r, waiting at most acquireTimeout
+// for one to free up. When none does it answers 503 with Retry-After so
+// clients back off instead of stalling, and returns false.
+func (s *server) acquireSlot(w http.ResponseWriter, r *http.Request) bool {
+	if s.inflight.tryAcquire() {
+		s.observeQueueWait(r.Context(), 0)
+		return true
+	}
+	if s.acquireTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.acquireTimeout)
+		start := time.Now()
+		err := s.inflight.acquire(ctx)
+		cancel()
+		s.observeQueueWait(r.Context(), time.Since(start))
+		if err == nil {
+			return true
+		}
+	}
+	if r.Context().Err() != nil {
+		s.writeError(w, "json", statusClientClosedRequest, codeClientClosedRequest, "request canceled before processing")
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(s.acquireTimeout.Seconds())), 1)))
+	s.writeError(w, "json", http.StatusServiceUnavailable, codeServerBusy, "server is busy; retry later")
+	return false
+}
+
+// defaultQueueWaitWarn is the QUEUE_WAIT_WARN default.
+const defaultQueueWaitWarn = time.Second
+
+// observeQueueWait records how long a request waited for an inflight slot,
+// whether or not it got one, and warns when the wait reached
+// QUEUE_WAIT_WARN: requests queueing that long mean the server is short of
+// capacity well before clients start timing out.
+func (s *server) observeQueueWait(ctx context.Context, wait time.Duration) {
+	s.metrics.observeQueueWait(wait)
+	if s.queueWaitWarn <= 0 || wait < s.queueWaitWarn {
+		return
+	}
+	inUse, limit := s.inflight.stats()
+	queued, _ := s.inflight.queued(time.Now())
+	requestLogger(ctx).Warn("slow queue wait",
+		"wait_ms", wait.Milliseconds(),
+		"inflight", inUse,
+		"max_inflight", limit,
+		"queued", queued,
+	)
+}
+
+// runtimeConfig is the part of the configuration /admin/config can change.
+type runtimeConfig struct {
+	MaxInflight int `json:"max_inflight"`
+	Inflight    int `json:"inflight"`
+}
+
+// handleAdminConfig reports the effective runtime configuration on GET and
+// changes it on POST with a JSON body such as {"max_inflight": 4}. Like
+// every admin endpoint it is only available when API_KEYS is set.
+func (s *server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.apiKeys) == 0 {
+		s.writeError(w, "json", http.StatusForbidden, codeForbidden, "admin endpoints require API_KEYS to be set")
+		return
+	}
+	if r.Method == http.MethodPost {
+		var body struct {
+			MaxInflight *int `json:"max_inflight"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			s.writeError(w, "json", http.StatusBadRequest, codeBadRequest, "invalid config: "+err.Error())
+			return
+		}
+		if body.MaxInflight != nil {
+			if *body.MaxInflight < 1 {
+				s.writeRequestError(w, "json", paramError("max_inflight", "max_inflight must be at least 1"))
+				return
+			}
+			_, old := s.inflight.stats()
+			s.inflight.setLimit(*body.MaxInflight)
+			requestLogger(r.Context()).Warn("max_inflight changed", "old", old, "new", *body.MaxInflight)
+		}
+	}
+
+	inUse, limit := s.inflight.stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(runtimeConfig{MaxInflight: limit, Inflight: inUse})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInflightLimiterSetLimit(t *testing.T) {
+	t.Parallel()
+
+	l := newInflightLimiter(2)
+	if !l.tryAcquire() || !l.tryAcquire() {
+		t.Fatal("tryAcquire() failed below the limit")
+	}
+	if l.tryAcquire() {
+		t.Fatal("tryAcquire() succeeded at the limit")
+	}
+
+	l.setLimit(1)
+	l.release()
+	if l.tryAcquire() {
+		t.Fatal("tryAcquire() succeeded above a lowered limit")
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire() returned %v while the limit was reached", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.setLimit(3)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire() still waiting after the limit was raised")
+	}
+	if inUse, limit := l.stats(); inUse != 2 || limit != 3 {
+		t.Fatalf("stats() = %d, %d; want 2, 3", inUse, limit)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	l.setLimit(2)
+	if err := l.acquire(ctx); err == nil {
+		t.Fatal("acquire() at the limit returned before its context ended")
+	}
+}
+
+func TestHandleAdminConfig(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 4, 32, 16, 8, 200)
+	rr := httptest.NewRecorder()
+	s.handleAdminConfig(rr, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status without API_KEYS = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	s.apiKeys = parseAPIKeys("secret")
+	tests := []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantLimit  int
+	}{
+		{http.MethodGet, "", http.StatusOK, 4},
+		{http.MethodPost, `{"max_inflight":2}`, http.StatusOK, 2},
+		{http.MethodPost, `{"max_inflight":0}`, http.StatusBadRequest, 2},
+		{http.MethodPost, `{"max_inflight":"many"}`, http.StatusBadRequest, 2},
+		{http.MethodPost, `{"timeout":"1s"}`, http.StatusBadRequest, 2},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed, 2},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		s.handleAdminConfig(rr, httptest.NewRequest(tc.method, "/admin/config", strings.NewReader(tc.body)))
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s %s status = %d, want %d; body %s", tc.method, tc.body, rr.Code, tc.wantStatus, rr.Body)
+		}
+		if _, limit := s.inflight.stats(); limit != tc.wantLimit {
+			t.Fatalf("%s %s limit = %d, want %d", tc.method, tc.body, limit, tc.wantLimit)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var got runtimeConfig
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if got.MaxInflight != tc.wantLimit {
+			t.Fatalf("max_inflight = %d, want %d", got.MaxInflight, tc.wantLimit)
+		}
+	}
+}
+
+func TestHandleEvaluateBusy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		acquireTimeout time.Duration
+		release        bool
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "no wait", wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+		{name: "timed out", acquireTimeout: 50 * time.Millisecond, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+		{name: "slot freed", acquireTimeout: 5 * time.Second, release: true, wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			s := newServer(nil, 1, 32, 16, 8, 200)
+			s.acquireTimeout = tc.acquireTimeout
+			s.inflight.tryAcquire()
+			if tc.release {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					s.inflight.release()
+				}()
+			}
+			rr := httptest.NewRecorder()
+			s.handleEvaluate(rr, httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader("not a form")))
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rr.Code, tc.wantStatus, rr.Body)
+			}
+			if got := rr.Header().Get("Retry-After"); got != tc.wantRetryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tc.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestInflightLimiterQueued(t *testing.T) {
+	t.Parallel()
+
+	l := newInflightLimiter(1)
+	if !l.tryAcquire() {
+		t.Fatal("tryAcquire() failed on an idle limiter")
+	}
+	if count, oldest := l.queued(time.Now()); count != 0 || oldest != 0 {
+		t.Fatalf("queued() = %d, %v before anyone waits; want 0, 0", count, oldest)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if count, _ := l.queued(time.Now()); count == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting acquire() never showed up in queued()")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, oldest := l.queued(time.Now().Add(time.Minute)); oldest < time.Minute {
+		t.Fatalf("queued() oldest = %v a minute later, want at least 1m", oldest)
+	}
+
+	l.release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if count, _ := l.queued(time.Now()); count != 0 {
+		t.Fatalf("queued() = %d after the waiter got its slot, want 0", count)
+	}
+}
+
+func TestAcquireSlotRecordsQueueWait(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 2, 32, 16, 8, 200)
+	s.metrics = newMetrics(s)
+	s.acquireTimeout = 10 * time.Millisecond
+	s.queueWaitWarn = 5 * time.Millisecond
+	acquire := func() (bool, int) {
+		rr := httptest.NewRecorder()
+		ok := s.acquireSlot(rr, httptest.NewRequest(http.MethodPost, "/evaluate", nil))
+		return ok, rr.Code
+	}
+	for range 2 {
+		if ok, _ := acquire(); !ok {
+			t.Fatal("acquireSlot() failed below the limit")
+		}
+	}
+	if ok, code := acquire(); ok || code != http.StatusServiceUnavailable {
+		t.Fatalf("acquireSlot() on a full server = %v, %d; want false, 503", ok, code)
+	}
+
+	rr := httptest.NewRecorder()
+	s.metrics.handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`autotagger_queue_wait_seconds_bucket{le="0.001"} 2`,
+		`autotagger_queue_wait_seconds_count 3`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Fatalf("metrics output missing %q", want)
+		}
+	}
+}
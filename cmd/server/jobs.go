@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxJobs    = 16
+	defaultJobTTL     = time.Hour
+	defaultJobTimeout = time.Hour
+)
+
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobError   = "error"
+)
+
+var errTooManyJobs = errors.New("too many unfinished jobs")
+
+// job is one asynchronous evaluate request. Its fields are guarded by the
+// owning jobStore's mutex.
+type job struct {
+	id       string
+	status   string
+	total    int
+	done     int
+	message  string
+	response *evaluateResponse
+	created  time.Time
+	finished time.Time
+}
+
+// jobStatus is the JSON view of a job returned by GET /jobs/{id}.
+type jobStatus struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"`
+	Total      int          `json:"total"`
+	Done       int          `json:"done"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Message    string       `json:"message,omitempty"`
+	Results    []prediction `json:"results,omitempty"`
+	Errors     []fileError  `json:"errors,omitempty"`
+}
+
+// jobStore keeps jobs in memory. Finished jobs are dropped ttl after they
+// finish; at most maxActive jobs may be pending or running at once.
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	maxActive int
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+func newJobStore(maxActive int, ttl time.Duration) *jobStore {
+	if maxActive < 1 {
+		maxActive = defaultMaxJobs
+	}
+	if ttl <= 0 {
+		ttl = defaultJobTTL
+	}
+	return &jobStore{
+		jobs:      make(map[string]*job),
+		maxActive: maxActive,
+		ttl:       ttl,
+		now:       time.Now,
+	}
+}
+
+func newJobID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// create registers a pending job for total inputs.
+func (js *jobStore) create(total int) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	now := js.now()
+	js.evictLocked(now)
+	active := 0
+	for _, j := range js.jobs {
+		if j.finished.IsZero() {
+			active++
+		}
+	}
+	if active >= js.maxActive {
+		return nil, errTooManyJobs
+	}
+	j := &job{id: id, status: jobPending, total: total, created: now}
+	js.jobs[id] = j
+	return j, nil
+}
+
+func (js *jobStore) evictLocked(now time.Time) {
+	for id, j := range js.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) >= js.ttl {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+func (js *jobStore) get(id string) (jobStatus, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.evictLocked(js.now())
+	j, ok := js.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	st := jobStatus{
+		ID:        j.id,
+		Status:    j.status,
+		Total:     j.total,
+		Done:      j.done,
+		CreatedAt: j.created,
+		Message:   j.message,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.FinishedAt = &finished
+	}
+	if j.response != nil {
+		st.Results = j.response.Results
+		st.Errors = j.response.Errors
+	}
+	return st, true
+}
+
+func (js *jobStore) update(j *job, fn func(*job)) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	fn(j)
+}
+
+// handleCreateJob accepts the same inputs as /evaluate, stores them and
+// answers 202 with the job ID right away. Inference runs in the background
+// once an inflight slot is free.
+func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, wait := s.limiter.allow(clientIP(r, s.trustProxy)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.writeError(w, "json", http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded; retry later")
+		return
+	}
+
+	req, _, err := s.parseEvaluate(w, r)
+	if err != nil {
+		s.writeRequestError(w, "json", err)
+		return
+	}
+	if countFailed(req.inputs) == len(req.inputs) {
+		_ = os.RemoveAll(req.dir)
+		s.writeRequestError(w, "json", req.inputs[0].err)
+		return
+	}
+
+	j, err := s.jobs.create(len(req.inputs))
+	if err != nil {
+		_ = os.RemoveAll(req.dir)
+		if errors.Is(err, errTooManyJobs) {
+			s.writeError(w, "json", http.StatusTooManyRequests, codeTooManyJobs, "too many jobs in progress; retry later")
+			return
+		}
+		s.writeError(w, "json", http.StatusInternalServerError, codeInternalError, "failed to create job")
+		return
+	}
+	requestLogger(r.Context()).Info("job created", "job_id", j.id, "files", len(req.inputs))
+
+	// The job outlives the request but keeps its request ID for logging.
+	go s.runJob(context.WithoutCancel(r.Context()), j, req, r.URL.Query().Get("nocache") != "1")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.id)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{"id": j.id, "status": jobPending})
+}
+
+// runJob waits for an inflight slot, tags the job's inputs and records the
+// results, counting progress as each file finishes.
+func (s *server) runJob(ctx context.Context, j *job, req *evalRequest, useCache bool) {
+	defer os.RemoveAll(req.dir)
+	log := requestLogger(ctx).With("job_id", j.id)
+
+	waitStart := time.Now()
+	err := s.inflight.acquire(ctx)
+	s.observeQueueWait(ctx, time.Since(waitStart))
+	if err != nil {
+		log.Error("job failed", "error", err)
+		s.jobs.update(j, func(j *job) {
+			j.status = jobError
+			j.message = err.Error()
+			j.finished = s.jobs.now()
+		})
+		return
+	}
+	defer s.inflight.release()
+	s.jobs.update(j, func(j *job) {
+		j.status = jobRunning
+		j.done = countFailed(req.inputs)
+	})
+
+	unique, tempNameByHash := uniqueInputs(req.inputs)
+	inputsByTempName := make(map[string]int, len(unique))
+	for _, in := range req.inputs {
+		if in.err == nil {
+			inputsByTempName[tempNameByHash[in.dedupKey()]]++
+		}
+	}
+
+	// Jobs exist for batches that outlast a synchronous request, so they get
+	// JOB_TIMEOUT rather than the request's PREDICT_TIMEOUT.
+	ctx, cancel := context.WithTimeout(ctx, s.jobTimeout)
+	defer cancel()
+	start := time.Now()
+	byTempName, err := s.predictInputs(ctx, req, unique, useCache, func(tempName string, pred prediction) {
+		s.jobs.update(j, func(j *job) { j.done += inputsByTempName[tempName] })
+	})
+	if err != nil {
+		log.Error("job failed", "error", err)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			s.inferenceFailed(err)
+		}
+		s.notifyCallback(ctx, req, j.id, nil, err)
+		s.jobs.update(j, func(j *job) {
+			j.status = jobError
+			j.message = err.Error()
+			j.finished = s.jobs.now()
+		})
+		return
+	}
+
+	results, _ := s.collectResults(req, byTempName, tempNameByHash)
+	resp := newEvaluateResponse(results)
+	s.evaluateOK.Store(true)
+	s.jobs.update(j, func(j *job) {
+		j.status = jobDone
+		j.done = j.total
+		j.response = &resp
+		j.finished = s.jobs.now()
+	})
+	log.Info("job done", "files", j.total, "errors", len(resp.Errors))
+	s.notifyCallback(ctx, req, j.id, results, nil)
+	s.recordResults(ctx, j.id, results)
+	logTagStats(log, req, results, time.Since(start))
+}
+
+// handleGetJob reports a job's status and progress, with its results once
+// it is done.
+func (s *server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.jobs.get(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if !ok {
+		s.writeError(w, "json", http.StatusNotFound, codeNotFound, "job not found or expired")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// deadlinePredictor records the deadline of each prediction's context.
+type deadlinePredictor struct {
+	mockPredictor
+	deadlines chan time.Time
+}
+
+func (d *deadlinePredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	deadline, _ := ctx.Deadline()
+	d.deadlines <- deadline
+	return d.mockPredictor.predictStream(ctx, files, params, onPrediction)
+}
+
+func TestJobStore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	js := newJobStore(2, time.Minute)
+	js.now = func() time.Time { return now }
+
+	first, err := js.create(3)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	if _, err := js.create(1); err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	if _, err := js.create(1); !errors.Is(err, errTooManyJobs) {
+		t.Fatalf("create() over the cap error = %v, want errTooManyJobs", err)
+	}
+
+	js.update(first, func(j *job) {
+		j.status = jobDone
+		j.done = j.total
+		j.response = &evaluateResponse{Results: []prediction{{Filename: "a.png"}}, Errors: []fileError{}}
+		j.finished = now
+	})
+	if _, err := js.create(1); err != nil {
+		t.Fatalf("create() after a job finished error = %v", err)
+	}
+
+	st, ok := js.get(first.id)
+	if !ok || st.Status != jobDone || st.Done != 3 || len(st.Results) != 1 || st.FinishedAt == nil {
+		t.Fatalf("get() = %+v, %v; want the finished job", st, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := js.get(first.id); ok {
+		t.Fatal("get() found a job past its TTL")
+	}
+}
+
+func TestHandleGetJobNotFound(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/nope", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestJobUsesJobTimeout(t *testing.T) {
+	t.Parallel()
+
+	pred := &deadlinePredictor{deadlines: make(chan time.Time, 1)}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = pred
+	s.setPredictTimeout(time.Second, time.Second)
+	s.jobTimeout = time.Hour
+
+	req := evaluateJSONRequest(t, "")
+	req.URL.Path = "/jobs"
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	var created map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	select {
+	case deadline := <-pred.deadlines:
+		if left := time.Until(deadline); left < 30*time.Minute {
+			t.Fatalf("job deadline in %v, want about JOB_TIMEOUT rather than the 1s request timeout", left)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never reached the predictor")
+	}
+	for range 100 {
+		if st, _ := s.jobs.get(created["id"]); st.Status == jobDone {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job did not finish")
+}
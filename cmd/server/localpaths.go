@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseLocalRoot resolves LOCAL_PATHS_ROOT to an absolute path without
+// symlinks, so resolved request paths can be compared against it. An empty
+// value disables server-side paths.
+func parseLocalRoot(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	abs, err := filepath.Abs(raw)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+	return root, nil
+}
+
+// resolveLocalPath maps a client path, absolute or relative to root, to the
+// file it names. The path is rejected unless it stays under root once every
+// symlink is followed.
+func resolveLocalPath(root, raw string) (string, error) {
+	if raw == "" || strings.ContainsRune(raw, 0) {
+		return "", fmt.Errorf("path %q is invalid", raw)
+	}
+	path := raw
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	if !underRoot(root, filepath.Clean(path)) {
+		return "", fmt.Errorf("path %q is outside the allowed root", raw)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", os.ErrNotExist
+		}
+		return "", err
+	}
+	if !underRoot(root, resolved) {
+		return "", fmt.Errorf("path %q is outside the allowed root", raw)
+	}
+	return resolved, nil
+}
+
+func underRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// storeLocalPath links a server-side file into tmpDir under a unique name,
+// so the worker reads it without a copy and preprocessing, which replaces
+// files by renaming over them, never touches the original. A path outside
+// LOCAL_PATHS_ROOT fails the request; a missing or unreadable file only
+// fails its own input.
+func (s *server) storeLocalPath(tmpDir, raw string, index int) (evalInput, error) {
+	name := strings.TrimSpace(raw)
+	resolved, err := resolveLocalPath(s.localRoot, name)
+	switch {
+	case os.IsNotExist(err):
+		return evalInput{name: name, err: badRequest(fmt.Sprintf("%s: file not found", name))}, nil
+	case err != nil:
+		reqErr := badRequest(err.Error())
+		reqErr.details = map[string]string{"filename": name}
+		return evalInput{}, reqErr
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return evalInput{name: name, err: badRequest(fmt.Sprintf("%s: cannot be read", name))}, nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return evalInput{name: name, err: badRequest(fmt.Sprintf("%s: not a regular file", name))}, nil
+	}
+	if s.maxFileBytes > 0 && info.Size() > s.maxFileBytes {
+		return evalInput{}, fileTooLarge(name, s.maxFileBytes)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return evalInput{name: name, err: badRequest(fmt.Sprintf("%s: cannot be read", name))}, nil
+	}
+
+	dstPath := filepath.Join(tmpDir, tempFilename(name, index))
+	if err := os.Symlink(resolved, dstPath); err != nil {
+		return evalInput{}, fmt.Errorf("link %s: %w", name, err)
+	}
+	if err := s.checkImage(dstPath, name); err != nil {
+		if !isRequestError(err) || isFileTooLarge(err) {
+			return evalInput{}, err
+		}
+		_ = os.Remove(dstPath)
+		return evalInput{name: name, err: err}, nil
+	}
+	return evalInput{name: name, path: dstPath, hash: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// localPathsAllowed rejects server-side paths unless LOCAL_PATHS_ROOT is set
+// and, like the admin endpoints, API_KEYS guards the server.
+func (s *server) localPathsAllowed() error {
+	if s.localRoot == "" || len(s.apiKeys) == 0 {
+		return &requestError{
+			status:  http.StatusForbidden,
+			code:    codeForbidden,
+			message: "paths require LOCAL_PATHS_ROOT and API_KEYS to be set",
+		}
+	}
+	return nil
+}
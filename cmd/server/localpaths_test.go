@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveLocalPath(t *testing.T) {
+	t.Parallel()
+
+	root, err := parseLocalRoot(t.TempDir())
+	if err != nil {
+		t.Fatalf("parseLocalRoot() error = %v", err)
+	}
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o700); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	for _, f := range []string{filepath.Join(root, "sub", "a.png"), filepath.Join(outside, "secret.png")} {
+		if err := os.WriteFile(f, []byte("x"), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.png"), filepath.Join(root, "escape.png")); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub", "a.png"), filepath.Join(root, "inside.png")); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"sub/a.png", filepath.Join(root, "sub", "a.png"), false},
+		{filepath.Join(root, "sub", "a.png"), filepath.Join(root, "sub", "a.png"), false},
+		{"sub/../sub/a.png", filepath.Join(root, "sub", "a.png"), false},
+		{"inside.png", filepath.Join(root, "sub", "a.png"), false},
+		{"../" + filepath.Base(outside) + "/secret.png", "", true},
+		{filepath.Join(outside, "secret.png"), "", true},
+		{"escape.png", "", true},
+		{"missing.png", "", true},
+		{"", "", true},
+	}
+	for _, tc := range tests {
+		got, err := resolveLocalPath(root, tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("resolveLocalPath(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+	if _, err := resolveLocalPath(root, "missing.png"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("resolveLocalPath(missing) error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestParseJSONEvaluatePaths(t *testing.T) {
+	t.Parallel()
+
+	root, err := parseLocalRoot(t.TempDir())
+	if err != nil {
+		t.Fatalf("parseLocalRoot() error = %v", err)
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	original := filepath.Join(root, "a.png")
+	if err := os.WriteFile(original, img.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	parse := func(s *server, body string) (*evalRequest, error) {
+		r := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return s.parseJSONEvaluate(httptest.NewRecorder(), r, t.TempDir())
+	}
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	var reqErr *requestError
+	if _, err := parse(s, `{"paths":["a.png"]}`); !errors.As(err, &reqErr) || reqErr.status != http.StatusForbidden {
+		t.Fatalf("paths without LOCAL_PATHS_ROOT error = %v, want 403", err)
+	}
+	s.localRoot = root
+	if _, err := parse(s, `{"paths":["a.png"]}`); !errors.As(err, &reqErr) || reqErr.status != http.StatusForbidden {
+		t.Fatalf("paths without API_KEYS error = %v, want 403", err)
+	}
+
+	s.apiKeys = parseAPIKeys("secret")
+	if _, err := parse(s, `{"paths":["../etc/passwd"]}`); !errors.As(err, &reqErr) || reqErr.status != http.StatusBadRequest {
+		t.Fatalf("path outside the root error = %v, want 400", err)
+	}
+	req, err := parse(s, `{"paths":["a.png", "missing.png"]}`)
+	if err != nil {
+		t.Fatalf("parseJSONEvaluate() error = %v", err)
+	}
+	if len(req.inputs) != 2 || req.inputs[0].err != nil || req.inputs[1].err == nil {
+		t.Fatalf("inputs = %+v, want a.png stored and missing.png failed", req.inputs)
+	}
+	if target, err := os.Readlink(req.inputs[0].path); err != nil || target != original {
+		t.Fatalf("stored input links to %q, %v; want %q", target, err, original)
+	}
+	if req.inputs[0].name != "a.png" || req.inputs[0].hash == "" {
+		t.Fatalf("input = %+v", req.inputs[0])
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{format: "", want: `"msg":"hello"`},
+		{format: "JSON", want: `"msg":"hello"`},
+		{format: "text", want: "msg=hello"},
+		{format: "logfmt", wantErr: true},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		h, err := newLogHandler(tc.format, &buf, slog.LevelInfo)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("newLogHandler(%q) error = %v, wantErr %v", tc.format, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		slog.New(h).Info("hello")
+		if !strings.Contains(buf.String(), tc.want) {
+			t.Fatalf("%q: log = %q, want %s", tc.format, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	lf, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile() error = %v", err)
+	}
+	defer lf.Close()
+	_, _ = lf.Write([]byte("before\n"))
+
+	// logrotate moves the file away, then signals.
+	rotated := filepath.Join(dir, "server.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	_, _ = lf.Write([]byte("still old\n"))
+	if err := lf.reopen(); err != nil {
+		t.Fatalf("reopen() error = %v", err)
+	}
+	_, _ = lf.Write([]byte("after\n"))
+
+	for file, want := range map[string]string{rotated: "before\nstill old\n", path: "after\n"} {
+		data, err := os.ReadFile(file)
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v; want %q", filepath.Base(file), data, err, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// logSampler thins the per-request log at high request rates. Every rate-th
+// request is logged, and so is every request that failed or took at least
+// slow, so errors and outliers are never dropped. A nil sampler logs
+// everything.
+type logSampler struct {
+	rate uint64
+	slow time.Duration
+	n    atomic.Uint64
+}
+
+// newLogSampler returns nil, logging every request, when rate is at most 1.
+func newLogSampler(rate int, slow time.Duration) *logSampler {
+	if rate <= 1 {
+		return nil
+	}
+	return &logSampler{rate: uint64(rate), slow: slow}
+}
+
+// keep reports whether to log a request that ended with status after
+// latency.
+func (ls *logSampler) keep(status int, latency time.Duration) bool {
+	if ls == nil || status < 200 || status >= 300 {
+		return true
+	}
+	if ls.slow > 0 && latency >= ls.slow {
+		return true
+	}
+	return ls.n.Add(1)%ls.rate == 1
+}
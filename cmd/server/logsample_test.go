@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	t.Parallel()
+
+	if newLogSampler(1, time.Second) != nil {
+		t.Fatal("newLogSampler(1) != nil, want every request logged")
+	}
+	var none *logSampler
+	if !none.keep(http.StatusOK, 0) {
+		t.Fatal("nil sampler dropped a request")
+	}
+
+	ls := newLogSampler(3, 100*time.Millisecond)
+	kept := 0
+	for i := 0; i < 9; i++ {
+		if ls.keep(http.StatusOK, time.Millisecond) {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Fatalf("kept %d of 9 fast 200s at rate 3, want 3", kept)
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		latency time.Duration
+	}{
+		{"server error", http.StatusInternalServerError, 0},
+		{"client error", http.StatusBadRequest, 0},
+		{"slow", http.StatusOK, 100 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		for i := 0; i < 3; i++ {
+			if !ls.keep(tc.status, tc.latency) {
+				t.Fatalf("%s: request %d dropped, want every one logged", tc.name, i)
+			}
+		}
+	}
+}
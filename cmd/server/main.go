@@ -2,21 +2,31 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,38 +36,137 @@ import (
 	"time"
 )
 
+// prediction is one image's result as returned by the worker and echoed to
+// clients. Categories maps each tag to its Danbooru category (general,
+// character, copyright, artist, meta); the worker may omit it or individual
+// tags, which are then reported as general. Rating holds the tags matching
+// RATING_TAGS and is filled in by the server, not the worker, as are ID, the
+// client's id for a /batch item, Translations, the display name of each tag
+// in the requested lang, and Implied, the tags added from TAG_IMPLICATIONS.
 type prediction struct {
-	Filename string             `json:"filename"`
-	Tags     map[string]float64 `json:"tags"`
+	ID           string             `json:"id,omitempty"`
+	Filename     string             `json:"filename"`
+	Tags         map[string]float64 `json:"tags"`
+	Rating       map[string]float64 `json:"rating,omitempty"`
+	Categories   map[string]string  `json:"categories,omitempty"`
+	Translations map[string]string  `json:"translations,omitempty"`
+	Implied      []string           `json:"implied,omitempty"`
+	Histogram    []int              `json:"histogram,omitempty"`
+	PHash        string             `json:"phash,omitempty"`
+	Frame        *int               `json:"frame,omitempty"`
+	DurationMS   float64            `json:"duration_ms,omitempty"`
+	Error        string             `json:"error,omitempty"`
+
+	// tagOrder and tagFields are the request's sort and fields
+	// parameters; see MarshalJSON.
+	tagOrder  string
+	tagFields string
 }
 
+const defaultTagCategory = "general"
+
+// fillCategories makes sure every tag in pred has a category.
+func fillCategories(pred *prediction) {
+	if pred.Categories == nil {
+		pred.Categories = make(map[string]string, len(pred.Tags))
+	}
+	for name := range pred.Tags {
+		if pred.Categories[name] == "" {
+			pred.Categories[name] = defaultTagCategory
+		}
+	}
+}
+
+// workerRequest is one line sent to the worker on stdin. With Stream set the
+// worker answers with one Prediction line per file as it is tagged, followed
+// by a final Done line; otherwise it sends a single Predictions line. An Info
+// request is the startup handshake and is answered with the model metadata;
+// a Vocab request is answered with the model's full tag list.
 type workerRequest struct {
-	ID        uint64   `json:"id"`
-	Files     []string `json:"files"`
-	Threshold float64  `json:"threshold"`
-	Limit     int      `json:"limit"`
+	ID                 uint64             `json:"id"`
+	RequestID          string             `json:"request_id,omitempty"`
+	Files              []string           `json:"files"`
+	Threshold          float64            `json:"threshold"`
+	Limit              int                `json:"limit"`
+	CategoryThresholds map[string]float64 `json:"category_thresholds,omitempty"`
+	Mode               string             `json:"mode,omitempty"`
+	Stream             bool               `json:"stream,omitempty"`
+	Info               bool               `json:"info,omitempty"`
+	Vocab              bool               `json:"vocab,omitempty"`
+	Ping               bool               `json:"ping,omitempty"`
+}
+
+// predictParams are the inference settings of one request. Tags whose
+// category has an entry in categoryThresholds use that threshold instead of
+// the global one. In modeTopK the worker ignores both thresholds and returns
+// the limit highest-scoring tags.
+type predictParams struct {
+	threshold          float64
+	limit              int
+	categoryThresholds map[string]float64
+	mode               string
 }
 
+const (
+	modeThreshold = "threshold"
+	modeTopK      = "topk"
+)
+
+// parseMode validates the mode parameter; empty means modeThreshold.
+func parseMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "", modeThreshold:
+		return modeThreshold, nil
+	case modeTopK:
+		return mode, nil
+	default:
+		return "", paramError("mode", "mode must be threshold or topk")
+	}
+}
+
+// workerResponse is one line read from the worker's stdout, matched to its
+// request by ID. Predictions carry per-tag categories when the worker knows them.
 type workerResponse struct {
 	ID          uint64       `json:"id"`
+	RequestID   string       `json:"request_id,omitempty"`
 	Predictions []prediction `json:"predictions,omitempty"`
+	Prediction  *prediction  `json:"prediction,omitempty"`
+	Done        bool         `json:"done,omitempty"`
+	Info        *workerInfo  `json:"info,omitempty"`
+	Vocab       []vocabTag   `json:"vocab,omitempty"`
 	Error       string       `json:"error,omitempty"`
 }
 
+var (
+	errWorkerNotRunning = errors.New("worker is not running")
+	errWorkerRestarting = errors.New("worker restarting")
+	errWorkerDesync     = errors.New("worker response was lost; its output is out of sync")
+)
+
 type workerClient struct {
-	cmd     *exec.Cmd
-	stdin   io.WriteCloser
-	pending map[uint64]chan workerResponse
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	protocol string
+	pending  map[uint64]chan workerResponse
+	started  time.Time
+	done     chan struct{}
+	ready    chan struct{}
+	info     atomic.Pointer[workerInfo]
+	stderr   *lineRing
 
 	pendingMu sync.Mutex
 	writeMu   sync.Mutex
 	nextID    atomic.Uint64
+	inflight  atomic.Int64
 	closed    atomic.Bool
+	pinging   atomic.Bool
+	// lastOutput is when the worker last wrote a line, in Unix nanoseconds.
+	lastOutput atomic.Int64
 }
 
-func newWorkerClient(ctx context.Context, pythonBin, scriptPath string) (*workerClient, error) {
+func newWorkerClient(ctx context.Context, pythonBin, scriptPath, protocol string) (*workerClient, error) {
 	cmd := exec.CommandContext(ctx, pythonBin, scriptPath)
-	cmd.Env = os.Environ()
+	cmd.Env = append(os.Environ(), "WORKER_PROTOCOL="+protocol)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -73,37 +182,62 @@ func newWorkerClient(ctx context.Context, pythonBin, scriptPath string) (*worker
 	}
 
 	wc := &workerClient{
-		cmd:     cmd,
-		stdin:   stdin,
-		pending: make(map[uint64]chan workerResponse),
+		cmd:      cmd,
+		stdin:    stdin,
+		protocol: protocol,
+		pending:  make(map[uint64]chan workerResponse),
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		stderr:   newLineRing(workerStderrLines),
 	}
 
 	if err := cmd.Start(); err != nil {
 		return nil, fmt.Errorf("start worker: %w", err)
 	}
+	wc.started = time.Now()
 
 	go wc.readStdout(stdout)
 	go wc.readStderr(stderr)
 	go wc.waitProcess()
+	go wc.handshake()
 
 	return wc, nil
 }
 
 func (wc *workerClient) readStdout(r io.Reader) {
-	scanner := bufio.NewScanner(r)
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 16*1024*1024)
-
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	next := messageReader(wc.protocol, r)
+	var readErr error
+	for {
+		line, err := next()
+		if err != nil {
+			readErr = err
+			break
+		}
+		wc.lastOutput.Store(time.Now().UnixNano())
 		var resp workerResponse
 		if err := json.Unmarshal(line, &resp); err != nil {
-			slog.Error("worker invalid response", "error", err)
+			if len(line) > 200 {
+				line = line[:200]
+			}
+			slog.Error("worker invalid response", "error", err, "line", string(line))
 			continue
 		}
 
 		wc.pendingMu.Lock()
+		wc.failSkipped(resp.ID)
 		ch, ok := wc.pending[resp.ID]
+		if ok && resp.Prediction != nil {
+			// Partial results keep the request pending. The channel has room
+			// for one per file plus the final line, so a worker that sends
+			// more than that loses the extras rather than stalling the reader.
+			select {
+			case ch <- resp:
+			default:
+				slog.Warn("worker sent more results than files", "id", resp.ID, "request_id", resp.RequestID)
+			}
+			wc.pendingMu.Unlock()
+			continue
+		}
 		if ok {
 			delete(wc.pending, resp.ID)
 		}
@@ -113,8 +247,13 @@ func (wc *workerClient) readStdout(r io.Reader) {
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		slog.Error("worker stdout error", "error", err)
+	if !errors.Is(readErr, io.EOF) && !errors.Is(readErr, os.ErrClosed) {
+		slog.Error("worker stdout error", "error", readErr)
+		// Nothing more can be read from this worker, so stop it and let the
+		// supervisor start a fresh one.
+		if wc.cmd != nil && wc.cmd.Process != nil {
+			_ = wc.cmd.Process.Kill()
+		}
 	}
 	wc.failAll("worker stdout closed")
 }
@@ -123,18 +262,46 @@ func (wc *workerClient) readStderr(r io.Reader) {
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		slog.Info("worker stderr", "line", scanner.Text())
+		wc.stderr.add(scanner.Text())
 	}
-	if err := scanner.Err(); err != nil {
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
 		slog.Error("worker stderr error", "error", err)
 	}
 }
 
 func (wc *workerClient) waitProcess() {
-	if err := wc.cmd.Wait(); err != nil {
+	err := wc.cmd.Wait()
+	switch {
+	case wc.closed.Load():
+		slog.Info("worker stopped")
+	case err != nil:
 		slog.Error("worker exited", "error", err)
 	}
 	wc.closed.Store(true)
 	wc.failAll("worker exited")
+	close(wc.done)
+}
+
+// failSkipped fails the pending requests sent before id. The worker answers
+// requests in the order it reads them, so once it answers id, an earlier
+// request still waiting will never get its response: it was most likely
+// garbled into a line that could not be parsed. Failing it now saves the
+// client from waiting out the whole predict timeout. pendingMu must be held.
+func (wc *workerClient) failSkipped(id uint64) {
+	if id == 0 {
+		return
+	}
+	for pendingID, ch := range wc.pending {
+		if pendingID >= id {
+			continue
+		}
+		delete(wc.pending, pendingID)
+		slog.Error("worker skipped a response", "id", pendingID, "answered_id", id)
+		select {
+		case ch <- workerResponse{ID: pendingID, Error: errWorkerDesync.Error()}:
+		default:
+		}
+	}
 }
 
 func (wc *workerClient) failAll(msg string) {
@@ -146,45 +313,151 @@ func (wc *workerClient) failAll(msg string) {
 	}
 }
 
-func (wc *workerClient) predict(ctx context.Context, files []string, threshold float64, limit int) ([]prediction, error) {
+func (wc *workerClient) predict(ctx context.Context, files []string, params predictParams) ([]prediction, error) {
+	return wc.predictStream(ctx, files, params, nil)
+}
+
+// predictStream is predict with onPrediction called for each file as soon as
+// the worker reports it. The full aligned result is still returned at the
+// end; files the worker never reported only appear there.
+func (wc *workerClient) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
 	if wc.closed.Load() {
-		return nil, errors.New("worker is not running")
+		return nil, errWorkerNotRunning
 	}
+	wc.inflight.Add(1)
+	defer wc.inflight.Add(-1)
 
-	id := wc.nextID.Add(1)
+	stream := onPrediction != nil
 	respCh := make(chan workerResponse, 1)
-	wc.pendingMu.Lock()
-	wc.pending[id] = respCh
-	wc.pendingMu.Unlock()
-
-	req := workerRequest{ID: id, Files: files, Threshold: threshold, Limit: limit}
-	data, err := json.Marshal(req)
+	if stream {
+		respCh = make(chan workerResponse, len(files)+1)
+	}
+	id, err := wc.send(workerRequest{
+		RequestID:          requestIDFrom(ctx),
+		Files:              files,
+		Threshold:          params.threshold,
+		Limit:              params.limit,
+		CategoryThresholds: params.categoryThresholds,
+		Mode:               params.mode,
+		Stream:             stream,
+	}, respCh)
 	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+		return nil, err
+	}
+
+	var streamed []prediction
+	expected := make(map[string]bool, len(files))
+	if stream {
+		for _, file := range files {
+			expected[filepath.Base(file)] = true
+		}
+	}
+	for {
+		select {
+		case resp := <-respCh:
+			if resp.Prediction != nil {
+				if pred := *resp.Prediction; expected[pred.Filename] {
+					delete(expected, pred.Filename)
+					streamed = append(streamed, pred)
+					onPrediction(pred)
+				}
+				continue
+			}
+			if resp.Error != "" {
+				return nil, errors.New(resp.Error)
+			}
+			predictions, unexpected := alignPredictions(files, append(streamed, resp.Predictions...))
+			if len(unexpected) > 0 {
+				requestLogger(ctx).Warn("worker returned predictions for unknown files", "filenames", unexpected)
+			}
+			return predictions, nil
+		case <-ctx.Done():
+			wc.cancel(id)
+			return nil, ctx.Err()
+		}
 	}
+}
 
+// send registers respCh for a fresh ID and writes req to the worker. The ID
+// is taken while holding writeMu, so IDs reach the worker in increasing
+// order; readStdout relies on that to spot responses that were lost.
+func (wc *workerClient) send(req workerRequest, respCh chan workerResponse) (uint64, error) {
 	wc.writeMu.Lock()
-	_, err = wc.stdin.Write(append(data, '\n'))
-	wc.writeMu.Unlock()
+	defer wc.writeMu.Unlock()
+	req.ID = wc.nextID.Add(1)
+	data, err := json.Marshal(req)
 	if err != nil {
-		wc.pendingMu.Lock()
-		delete(wc.pending, id)
-		wc.pendingMu.Unlock()
-		return nil, fmt.Errorf("write request: %w", err)
+		return 0, fmt.Errorf("marshal request: %w", err)
 	}
+	wc.pendingMu.Lock()
+	wc.pending[req.ID] = respCh
+	wc.pendingMu.Unlock()
+	if _, err := wc.stdin.Write(encodeMessage(wc.protocol, data)); err != nil {
+		wc.forget(req.ID)
+		return 0, fmt.Errorf("write request: %w", err)
+	}
+	return req.ID, nil
+}
+
+// forget drops a request whose caller stopped waiting for the answer.
+func (wc *workerClient) forget(id uint64) {
+	wc.pendingMu.Lock()
+	delete(wc.pending, id)
+	wc.pendingMu.Unlock()
+}
 
-	select {
-	case resp := <-respCh:
-		if resp.Error != "" {
-			return nil, errors.New(resp.Error)
+// workerCancel is the message asking the worker to abandon request Cancel.
+type workerCancel struct {
+	Cancel uint64 `json:"cancel"`
+}
+
+// cancel forgets request id and tells the worker to stop tagging it, so a
+// client that went away or timed out does not keep the GPU busy. The worker
+// checks between batches and still answers the request, with an error
+// nobody is waiting for. The message is written in the background: a stuck
+// worker whose stdin is full must not hold up the caller giving up on it.
+func (wc *workerClient) cancel(id uint64) {
+	wc.forget(id)
+	go func() {
+		data, err := json.Marshal(workerCancel{Cancel: id})
+		if err != nil {
+			return
 		}
-		return resp.Predictions, nil
-	case <-ctx.Done():
-		wc.pendingMu.Lock()
-		delete(wc.pending, id)
-		wc.pendingMu.Unlock()
-		return nil, ctx.Err()
+		wc.writeMu.Lock()
+		defer wc.writeMu.Unlock()
+		if wc.closed.Load() {
+			return
+		}
+		if _, err := wc.stdin.Write(encodeMessage(wc.protocol, data)); err != nil {
+			slog.Warn("worker cancel failed", "id", id, "error", err)
+		}
+	}()
+}
+
+// alignPredictions orders predictions to match files using the base filename
+// the worker echoes back. Files without a prediction get an error entry, and
+// predictions that match no file are returned as unexpected.
+func alignPredictions(files []string, predictions []prediction) ([]prediction, []string) {
+	byName := make(map[string]prediction, len(predictions))
+	for _, pred := range predictions {
+		byName[pred.Filename] = pred
+	}
+	aligned := make([]prediction, len(files))
+	for i, file := range files {
+		name := filepath.Base(file)
+		pred, ok := byName[name]
+		if !ok {
+			pred = prediction{Filename: name, Tags: map[string]float64{}, Error: "worker returned no prediction for this file"}
+		}
+		delete(byName, name)
+		aligned[i] = pred
+	}
+	unexpected := make([]string, 0, len(byName))
+	for name := range byName {
+		unexpected = append(unexpected, name)
 	}
+	sort.Strings(unexpected)
+	return aligned, unexpected
 }
 
 func (wc *workerClient) close() {
@@ -197,33 +470,54 @@ func (wc *workerClient) close() {
 	}
 }
 
+const maxWorkerRestartBackoff = 30 * time.Second
+
 type workerPool struct {
-	ctx       context.Context
-	pythonBin string
-	script    string
-	workers   []*workerClient
-	rr        atomic.Uint64
-	mu        sync.RWMutex
+	ctx         context.Context
+	pythonBin   string
+	script      string
+	protocol    string
+	workers     []*workerClient
+	restarting  []atomic.Bool
+	maxRestarts int
+	backoff     time.Duration
+	retry       retryPolicy
+	batchSize   int
+	batcher     *microBatcher
+	rr          atomic.Uint64
+	closing     atomic.Bool
+	mu          sync.RWMutex
+	reloadMu    sync.Mutex
 }
 
-func newWorkerPool(ctx context.Context, pythonBin, scriptPath string, count int) (*workerPool, error) {
+func newWorkerPool(ctx context.Context, pythonBin, scriptPath, protocol string, count, maxRestarts int, backoff time.Duration) (*workerPool, error) {
 	if count < 1 {
 		count = 1
 	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
 	pool := &workerPool{
-		ctx:       ctx,
-		pythonBin: pythonBin,
-		script:    scriptPath,
-		workers:   make([]*workerClient, 0, count),
+		ctx:         ctx,
+		pythonBin:   pythonBin,
+		script:      scriptPath,
+		protocol:    protocol,
+		workers:     make([]*workerClient, 0, count),
+		restarting:  make([]atomic.Bool, count),
+		maxRestarts: maxRestarts,
+		backoff:     backoff,
 	}
 	for i := 0; i < count; i++ {
-		worker, err := newWorkerClient(ctx, pythonBin, scriptPath)
+		worker, err := newWorkerClient(ctx, pythonBin, scriptPath, protocol)
 		if err != nil {
 			pool.close()
 			return nil, fmt.Errorf("start worker %d/%d: %w", i+1, count, err)
 		}
 		pool.workers = append(pool.workers, worker)
 	}
+	for i := 0; i < count; i++ {
+		go pool.supervise(i)
+	}
 	return pool, nil
 }
 
@@ -238,96 +532,241 @@ func (wp *workerPool) anyAlive() bool {
 	return false
 }
 
-func (wp *workerPool) predict(ctx context.Context, files []string, threshold float64, limit int) ([]prediction, error) {
+// anyLoaded reports whether a live worker has finished loading its model.
+func (wp *workerPool) anyLoaded() bool {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	for _, w := range wp.workers {
+		if !w.closed.Load() && w.loaded() {
+			return true
+		}
+	}
+	return false
+}
+
+// waitReady blocks until every worker has answered its startup handshake,
+// so the server does not take requests that would queue behind a model
+// still loading. A worker that exits while loading, or a timeout, fails
+// startup. timeout <= 0 waits as long as ctx allows.
+func (wp *workerPool) waitReady(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	wp.mu.RLock()
+	workers := slices.Clone(wp.workers)
+	wp.mu.RUnlock()
+	for i, w := range workers {
+		if !w.loaded() {
+			select {
+			case <-w.ready:
+			case <-ctx.Done():
+				return fmt.Errorf("worker %d did not load its model within %s: %w", i, timeout, ctx.Err())
+			}
+		}
+		if w.closed.Load() {
+			return fmt.Errorf("worker %d exited while loading its model", i)
+		}
+	}
+	return nil
+}
+
+func (wp *workerPool) aliveCount() int {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	n := 0
+	for _, w := range wp.workers {
+		if !w.closed.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+func (wp *workerPool) anyRestarting() bool {
+	for i := range wp.restarting {
+		if wp.restarting[i].Load() {
+			return true
+		}
+	}
+	return false
+}
+
+func (wp *workerPool) predict(ctx context.Context, files []string, params predictParams) ([]prediction, error) {
+	return wp.predictStream(ctx, files, params, nil)
+}
+
+// predictStream is predict with onPrediction called for each file as soon as
+// a worker reports it. Large requests are split into worker batches. With
+// BATCHING_ENABLED, small requests that are not streamed are merged with
+// concurrent ones first.
+func (wp *workerPool) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	if wp.batcher != nil && onPrediction == nil {
+		return wp.batcher.predictFiles(ctx, files, params)
+	}
+	return wp.predictChunks(ctx, files, params, onPrediction)
+}
+
+// predictChunk dispatches one worker batch, retrying transient worker errors
+// as the pool's retry policy allows.
+func (wp *workerPool) predictChunk(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	return wp.predictWithRetry(ctx, files, onPrediction, func(onPrediction func(prediction)) ([]prediction, error) {
+		return wp.dispatch(ctx, files, params, onPrediction)
+	})
+}
+
+// dispatch sends the request to the least loaded worker. Failover only
+// happens before a worker accepts the request, so onPrediction never sees a
+// file twice.
+func (wp *workerPool) dispatch(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
 	wp.mu.RLock()
 	n := len(wp.workers)
 	wp.mu.RUnlock()
 	if n == 0 {
 		return nil, errors.New("no workers configured")
 	}
-	start := int(wp.rr.Add(1)) % n
+	tried := make(map[int]bool, n)
 	var lastErr error
-	for i := 0; i < n; i++ {
-		idx := (start + i) % n
-		w := wp.get(idx)
-		if w.closed.Load() {
-			lastErr = errors.New("worker is not running")
-			if err := wp.respawn(idx); err != nil {
-				slog.Error("worker respawn failed", "index", idx, "error", err)
-			} else {
-				slog.Warn("worker respawned", "index", idx)
-			}
-			continue
+	for attempt := 0; attempt < n; attempt++ {
+		idx, w := wp.leastLoaded(tried)
+		if w == nil {
+			break
 		}
-		predictions, err := w.predict(ctx, files, threshold, limit)
+		tried[idx] = true
+		predictions, err := w.predictStream(ctx, files, params, onPrediction)
 		if err == nil {
 			return predictions, nil
 		}
 		lastErr = err
-		if strings.Contains(strings.ToLower(err.Error()), "worker is not running") {
-			if respawnErr := wp.respawn(idx); respawnErr != nil {
-				slog.Error("worker respawn failed after predict error", "index", idx, "error", respawnErr)
-			} else {
-				slog.Warn("worker respawned after predict error", "index", idx)
-			}
+		if errors.Is(err, errWorkerNotRunning) {
 			continue
 		}
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 			return nil, err
 		}
 	}
-	if lastErr == nil {
-		lastErr = errors.New("worker is not running")
+	if lastErr == nil || errors.Is(lastErr, errWorkerNotRunning) {
+		if wp.anyRestarting() {
+			return nil, errWorkerRestarting
+		}
+		return nil, errWorkerNotRunning
 	}
 	return nil, lastErr
 }
 
+// leastLoaded returns the live worker with the fewest in-flight requests,
+// skipping dead workers and the indexes in skip. Ties are broken round-robin.
+func (wp *workerPool) leastLoaded(skip map[int]bool) (int, *workerClient) {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	n := len(wp.workers)
+	if n == 0 {
+		return -1, nil
+	}
+	start := int(wp.rr.Add(1) % uint64(n))
+	best := -1
+	var bestLoad int64
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		w := wp.workers[idx]
+		if skip[idx] || w == nil || w.closed.Load() {
+			continue
+		}
+		if load := w.inflight.Load(); best < 0 || load < bestLoad {
+			best, bestLoad = idx, load
+		}
+	}
+	if best < 0 {
+		return -1, nil
+	}
+	return best, wp.workers[best]
+}
+
 func (wp *workerPool) get(idx int) *workerClient {
 	wp.mu.RLock()
 	defer wp.mu.RUnlock()
 	return wp.workers[idx]
 }
 
-func (wp *workerPool) respawn(idx int) error {
-	wp.mu.RLock()
-	cur := wp.workers[idx]
-	wp.mu.RUnlock()
-	if cur != nil && !cur.closed.Load() {
-		return nil
-	}
+// supervise restarts the worker in slot idx whenever it exits. Consecutive
+// failed restarts back off exponentially and stop after maxRestarts (0 means
+// unlimited); a worker that stays up longer than the backoff cap resets the count.
+// A worker that was swapped out of the slot by a reload is not restarted.
+func (wp *workerPool) supervise(idx int) {
+	attempts := 0
+	for {
+		w := wp.get(idx)
+		select {
+		case <-wp.ctx.Done():
+			return
+		case <-w.done:
+		}
+		if wp.closing.Load() || wp.ctx.Err() != nil {
+			return
+		}
+		if wp.get(idx) != w {
+			continue
+		}
+		if time.Since(w.started) > maxWorkerRestartBackoff {
+			attempts = 0
+		}
 
-	newWorker, err := newWorkerClient(wp.ctx, wp.pythonBin, wp.script)
-	if err != nil {
-		return err
-	}
+		wp.restarting[idx].Store(true)
+		for {
+			if wp.maxRestarts > 0 && attempts >= wp.maxRestarts {
+				wp.restarting[idx].Store(false)
+				slog.Error("worker restart limit reached", "index", idx, "max_restarts", wp.maxRestarts)
+				return
+			}
+			attempts++
+			delay := restartBackoff(wp.backoff, attempts)
+			slog.Warn("restarting worker", "index", idx, "attempt", attempts, "backoff_ms", delay.Milliseconds())
+			select {
+			case <-wp.ctx.Done():
+				wp.restarting[idx].Store(false)
+				return
+			case <-time.After(delay):
+			}
 
-	wp.mu.Lock()
-	defer wp.mu.Unlock()
-	cur = wp.workers[idx]
-	if cur != nil && !cur.closed.Load() {
-		newWorker.close()
-		return nil
+			worker, err := newWorkerClient(wp.ctx, wp.pythonBin, wp.script, wp.protocol)
+			if err != nil {
+				slog.Error("worker restart failed", "index", idx, "attempt", attempts, "error", err)
+				continue
+			}
+			wp.mu.Lock()
+			swapped := wp.workers[idx] != w
+			if !swapped {
+				wp.workers[idx] = worker
+			}
+			wp.mu.Unlock()
+			wp.restarting[idx].Store(false)
+			if swapped {
+				worker.close()
+				break
+			}
+			slog.Info("worker restarted", "index", idx, "attempt", attempts)
+			break
+		}
 	}
-	wp.workers[idx] = newWorker
-	return nil
 }
 
-func (wp *workerPool) respawnAny() bool {
-	wp.mu.RLock()
-	n := len(wp.workers)
-	wp.mu.RUnlock()
-	ok := false
-	for i := 0; i < n; i++ {
-		if err := wp.respawn(i); err == nil {
-			if !wp.get(i).closed.Load() {
-				ok = true
-			}
-		}
+func restartBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxWorkerRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWorkerRestartBackoff {
+		delay = maxWorkerRestartBackoff
 	}
-	return ok
+	return delay
 }
 
 func (wp *workerPool) close() {
+	if wp == nil {
+		return
+	}
+	wp.closing.Store(true)
 	wp.mu.RLock()
 	defer wp.mu.RUnlock()
 	for _, w := range wp.workers {
@@ -335,28 +774,214 @@ func (wp *workerPool) close() {
 	}
 }
 
+// wait blocks until every worker process has exited or ctx is done.
+func (wp *workerPool) wait(ctx context.Context) error {
+	if wp == nil {
+		return nil
+	}
+	wp.mu.RLock()
+	workers := slices.Clone(wp.workers)
+	wp.mu.RUnlock()
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 type tagPair struct {
-	Name  string
-	Score float64
+	Name     string
+	Display  string
+	Score    float64
+	Category string
+}
+
+// evaluatePage is the data of the HTML results page. Tag links append the
+// escaped tag name to WikiBaseURL as a path segment and to SearchBaseURL as
+// a query value. Threshold and Limit carry the request's values back to the
+// form. Scores are colored by ScoreBands.
+type evaluatePage struct {
+	Results       []htmlResult
+	WikiBaseURL   string
+	SearchBaseURL string
+	ScoreBands    scoreBands
+	Threshold     float64
+	Limit         int
+}
+
+// indexPage is the data of the upload form, prefilled with the server
+// defaults or the values of the last request.
+type indexPage struct {
+	Threshold float64
+	Limit     int
+	MaxLimit  int
+}
+
+const (
+	defaultWikiBaseURL   = "https://danbooru.donmai.us/wiki_pages/"
+	defaultSearchBaseURL = "https://danbooru.donmai.us/posts?tags="
+)
+
+// parseBaseURL validates a link prefix for the results page; empty means def.
+func parseBaseURL(raw, def string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http or https URL", raw)
+	}
+	return raw, nil
+}
+
+// wikiURL links to the wiki page of tag. The whole URL is built here because
+// html/template would treat a tag like re:zero on its own as a URL scheme.
+func wikiURL(base, tag string) string {
+	return base + url.PathEscape(tag)
+}
+
+// searchURL links to a search for posts with tag.
+func searchURL(base, tag string) string {
+	return base + url.QueryEscape(tag)
 }
 
 type htmlResult struct {
-	ImageData string
-	Tags      []tagPair
-	TagText   string
+	Filename   string
+	MimeType   string
+	DurationMS float64
+	Tags       []tagPair
+	Rating     []tagPair
+	TagText    string
+	Error      string
+	path       string
+	// thumbWidth and thumbHeight are the size of the JPEG thumbnail shown
+	// instead of the stored image, or zero to show the image itself.
+	thumbWidth  int
+	thumbHeight int
+	// imageData is the encoded preview of a page kept after its uploads
+	// are gone; see keepPreviews.
+	imageData string
+}
+
+// ImageData base64-encodes the preview when the template renders it, so
+// only one preview is held in memory at a time however large the batch.
+func (r htmlResult) ImageData() (string, error) {
+	if r.imageData != "" {
+		return r.imageData, nil
+	}
+	var b strings.Builder
+	enc := base64.NewEncoder(base64.StdEncoding, &b)
+	if r.thumbWidth > 0 {
+		if err := writeThumbnail(enc, r.path, r.thumbWidth, r.thumbHeight); err != nil {
+			return "", err
+		}
+	} else {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			b.Grow(base64.StdEncoding.EncodedLen(int(info.Size())))
+		}
+		if _, err := io.Copy(enc, f); err != nil {
+			return "", err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// evalInput is one image of an evaluate request: an uploaded file or a
+// fetched URL. path is empty when the input could not be stored; hash is the
+// hex SHA-256 of the stored bytes.
+type evalInput struct {
+	// id is the client's id for a /batch item, echoed in its result.
+	id   string
+	name string
+	path string
+	hash string
+	err  error
+	// frame is the index of the frame tagged for an animated GIF or video.
+	frame *int
+	// phash is the hex perceptual hash, with include_phash.
+	phash string
 }
 
 type server struct {
-	workers        *workerPool
-	inflightSem    chan struct{}
-	maxUploadBytes int64
-	maxFileBytes   int64
-	maxFiles       int
-	maxLimit       int
-	evaluateOK     atomic.Bool
-	indexTmpl      *template.Template
-	evalTmpl       *template.Template
-	errorTmpl      *template.Template
+	workers           *workerPool
+	predictor         predictor
+	defaultModel      string
+	models            map[string]predictor
+	modelVocab        map[string]*vocabCache
+	fetcher           *urlFetcher
+	imageTypes        map[string]bool
+	metrics           *metrics
+	cache             *predictionCache
+	apiKeys           [][sha256.Size]byte
+	limiter           *rateLimiter
+	trustProxy        bool
+	cors              *corsPolicy
+	tagFilter         *tagFilter
+	translations      tagTranslations
+	implications      tagImplications
+	ratingTags        []string
+	uploadFields      []string
+	jobs              *jobStore
+	jobTimeout        time.Duration
+	callbacks         *callbackSender
+	results           *resultLog
+	vocab             vocabCache
+	inflight          *inflightLimiter
+	acquireTimeout    time.Duration
+	queueWaitWarn     time.Duration
+	decodeSem         chan struct{}
+	maxUploadBytes    int64
+	maxFileBytes      int64
+	maxFiles          int
+	maxArchiveEntries int
+	maxArchiveBytes   int64
+	maxImageDim       int
+	maxPixels         int64
+	previewMaxDim     int
+	validateDecode    bool
+	autoOrient        bool
+	heicConverter     string
+	ffmpegPath        string
+	animationFrame    string
+	wikiBaseURL       string
+	searchBaseURL     string
+	scoreBands        scoreBands
+	localRoot         string
+	idempotency       *idempotencyStore
+	shared            *sharedResults
+	tempDir           string
+	compression       bool
+	pprof             bool
+	maxLimit          int
+	defaultThreshold  float64
+	defaultLimit      int
+	evaluateOK        atomic.Bool
+	workerResponsive  atomic.Bool
+	logSampler        *logSampler
+	conns             *limitListener
+	exitOnFatal       bool
+	exit              func(code int)
+	fatalOnce         sync.Once
+	predictTimeout    time.Duration
+	maxPredictTimeout time.Duration
+	indexTmpl         *template.Template
+	evalTmpl          *template.Template
+	errorTmpl         *template.Template
 }
 
 func newServer(workers *workerPool, maxInflight int, maxUploadMB int64, maxFileMB int64, maxFiles int, maxLimit int) *server {
@@ -376,28 +1001,106 @@ func newServer(workers *workerPool, maxInflight int, maxUploadMB int64, maxFileM
 		maxLimit = 50
 	}
 	s := &server{
-		workers:        workers,
-		inflightSem:    make(chan struct{}, maxInflight),
-		maxUploadBytes: maxUploadMB * 1024 * 1024,
-		maxFileBytes:   maxFileMB * 1024 * 1024,
-		maxFiles:       maxFiles,
-		maxLimit:       maxLimit,
-		indexTmpl:      template.Must(template.New("index").Parse(indexHTML)),
+		workers:           workers,
+		fetcher:           newURLFetcher(defaultFetchTimeout, maxUploadMB*1024*1024, defaultFetchConcurrency),
+		imageTypes:        parseImageTypes(strings.Join(defaultImageTypes, ",")),
+		ratingTags:        defaultRatingTags,
+		uploadFields:      defaultUploadFields,
+		jobs:              newJobStore(defaultMaxJobs, defaultJobTTL),
+		jobTimeout:        defaultJobTimeout,
+		callbacks:         newCallbackSender("", defaultCallbackAttempts, false),
+		inflight:          newInflightLimiter(maxInflight),
+		decodeSem:         make(chan struct{}, runtime.GOMAXPROCS(0)),
+		maxUploadBytes:    maxUploadMB * 1024 * 1024,
+		maxFileBytes:      maxFileMB * 1024 * 1024,
+		maxFiles:          maxFiles,
+		maxArchiveEntries: defaultMaxArchiveEntries,
+		maxArchiveBytes:   defaultMaxArchiveMB * 1024 * 1024,
+		maxLimit:          maxLimit,
+		defaultThreshold:  defaultThreshold,
+		defaultLimit:      min(defaultLimit, maxLimit),
+		animationFrame:    frameFirst,
+		defaultModel:      defaultModelName,
+		wikiBaseURL:       defaultWikiBaseURL,
+		searchBaseURL:     defaultSearchBaseURL,
+		scoreBands:        defaultScoreBands,
+		previewMaxDim:     defaultPreviewMaxDim,
+		exit:              os.Exit,
+		maxPixels:         defaultMaxPixels,
+		indexTmpl:         template.Must(template.New("index").Parse(indexHTML)),
 		evalTmpl: template.Must(template.New("evaluate").Funcs(template.FuncMap{
-			"mul100": func(v float64) float64 { return v * 100 },
+			"mul100":        func(v float64) float64 { return v * 100 },
+			"categoryClass": categoryClass,
+			"scoreClass":    scoreClass,
+			"wikiURL":       wikiURL,
+			"searchURL":     searchURL,
 		}).Parse(evaluateHTML)),
 		errorTmpl: template.Must(template.New("error").Parse(errorHTML)),
 	}
+	if workers != nil {
+		s.predictor = workers
+	}
 	s.evaluateOK.Store(true)
+	s.workerResponsive.Store(true)
+	s.setPredictTimeout(defaultPredictTimeout, defaultPredictTimeout)
 	return s
 }
 
+const defaultPredictTimeout = 5 * time.Minute
+
+// defaultPreviewMaxDim bounds the longer side of HTML previews unless
+// PREVIEW_MAX_DIM says otherwise.
+const defaultPreviewMaxDim = 512
+
+// defaultThreshold and defaultLimit apply when a request leaves threshold or
+// limit out, unless DEFAULT_THRESHOLD or DEFAULT_LIMIT say otherwise.
+const (
+	defaultThreshold = 0.1
+	defaultLimit     = 50
+)
+
+func (s *server) setPredictTimeout(timeout, max time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultPredictTimeout
+	}
+	if max < timeout {
+		max = timeout
+	}
+	s.predictTimeout = timeout
+	s.maxPredictTimeout = max
+}
+
+// drain waits until no evaluate request holds an inflight slot. No slot is
+// handed out afterwards, so nothing new starts.
+func (s *server) drain(ctx context.Context) error {
+	return s.inflight.drain(ctx)
+}
+
 func (s *server) routes() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleIndex)
-	mux.HandleFunc("/evaluate", s.handleEvaluate)
+	mux.HandleFunc("/evaluate", s.idempotent(s.handleEvaluate))
+	mux.HandleFunc("/batch", s.idempotent(s.handleBatch))
+	mux.HandleFunc("/jobs", s.idempotent(s.handleCreateJob))
+	mux.HandleFunc("/jobs/", s.handleGetJob)
+	mux.HandleFunc("/results/", s.handleSharedResult)
 	mux.HandleFunc("/healthz", s.handleHealth)
-	return s.loggingMiddleware(mux)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.HandleFunc("/tags", s.handleTags)
+	mux.HandleFunc("/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("/static/", s.handleStatic)
+	mux.HandleFunc("/favicon.ico", s.handleStatic)
+	mux.HandleFunc("/admin/reload", s.handleReload)
+	mux.HandleFunc("/admin/config", s.handleAdminConfig)
+	mux.HandleFunc("/debug/worker", s.handleDebugWorker)
+	if s.metrics != nil {
+		mux.Handle("/metrics", s.metrics.handler())
+	}
+	if s.pprof {
+		registerPprof(mux)
+	}
+	return s.loggingMiddleware(s.compressMiddleware(s.corsMiddleware(s.authMiddleware(mux))))
 }
 
 type statusRecorder struct {
@@ -420,22 +1123,36 @@ func (sr *statusRecorder) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func (s *server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		requestID := resolveRequestID(r.Header.Get("X-Request-ID"))
+		w.Header().Set("X-Request-ID", requestID)
+		r = r.WithContext(withRequestID(r.Context(), requestID))
 		rec := &statusRecorder{ResponseWriter: w}
 		next.ServeHTTP(rec, r)
 
 		if rec.status == 0 {
 			rec.status = http.StatusOK
 		}
+		latency := time.Since(start)
+		s.metrics.observeRequest(r.URL.Path, r.Method, rec.status, latency)
+		if !s.logSampler.keep(rec.status, latency) {
+			return
+		}
 		slog.Info("http_request",
+			"request_id", requestID,
 			"method", r.Method,
 			"path", r.URL.Path,
 			"query", r.URL.RawQuery,
 			"status", rec.status,
 			"bytes", rec.bytes,
-			"latency_ms", time.Since(start).Milliseconds(),
+			"latency_ms", latency.Milliseconds(),
 			"remote_addr", r.RemoteAddr,
 			"user_agent", r.UserAgent(),
 		)
@@ -443,12 +1160,22 @@ func (s *server) loggingMiddleware(next http.Handler) http.Handler {
 }
 
 func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	if !s.workers.anyAlive() && !s.workers.respawnAny() {
+	if !s.predictorAlive() {
 		w.Header().Set("Content-Type", "application/json")
+		if s.workers != nil && s.workers.anyRestarting() {
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "worker_restarting"})
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"status": "worker_down"})
 		return
 	}
+	if !s.workerResponsive.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "worker_unresponsive"})
+		return
+	}
 	if !s.evaluateOK.Load() {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -459,211 +1186,1346 @@ func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// predictorAlive reports whether the server can currently tag images.
+func (s *server) predictorAlive() bool {
+	return s.predictor != nil && s.predictor.alive()
+}
+
+// handleReady is the readiness probe: it fails while no worker is running,
+// while the running ones are still loading their model or stopped answering
+// pings, or while every inflight slot is taken, so load balancers can shed
+// traffic without the liveness probe restarting the process.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := "ready"
+	switch {
+	case !s.predictorAlive():
+		status = "worker_down"
+	case s.workers != nil && !s.workers.anyLoaded():
+		status = "worker_loading"
+	case !s.workerResponsive.Load():
+		status = "worker_unresponsive"
+	case s.inflight.full():
+		status = "at_capacity"
+	}
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// indexPage prefills the form from the threshold and limit query
+// parameters, falling back to the defaults for missing or invalid values.
+func (s *server) indexPage(query url.Values) indexPage {
+	page := indexPage{Threshold: s.defaultThreshold, Limit: s.defaultLimit, MaxLimit: s.maxLimit}
+	if t, err := parseFloatOrDefault(query.Get("threshold"), page.Threshold); err == nil && validThreshold(t) {
+		page.Threshold = t
+	}
+	if l, err := parseIntOrDefault(query.Get("limit"), page.Limit); err == nil && l >= 1 && l <= s.maxLimit {
+		page.Limit = l
+	}
+	return page
+}
+
 func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if err := s.indexTmpl.Execute(w, nil); err != nil {
+	if err := s.indexTmpl.Execute(w, s.indexPage(r.URL.Query())); err != nil {
 		slog.Error("render index failed", "error", err)
 	}
 }
 
 func (s *server) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.handleIndex(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	s.evaluate(w, r, s.parseEvaluate)
+}
+
+// evaluate tags the inputs parse stores and writes the results in the
+// request's format. It backs both /evaluate and /batch.
+func (s *server) evaluate(w http.ResponseWriter, r *http.Request, parse func(http.ResponseWriter, *http.Request) (*evalRequest, string, error)) {
+	w.Header().Add("Vary", "Accept")
+
+	if ok, wait := s.limiter.allow(clientIP(r, s.trustProxy)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.writeError(w, requestFormat(r), http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded; retry later")
+		return
+	}
+
+	if !s.acquireSlot(w, r) {
+		return
+	}
+	defer s.inflight.release()
+
+	req, format, err := parse(w, r)
+	if err != nil {
+		s.writeRequestError(w, format, err)
+		return
+	}
+	defer os.RemoveAll(req.dir)
 
-	select {
-	case s.inflightSem <- struct{}{}:
-		defer func() { <-s.inflightSem }()
-	case <-r.Context().Done():
-		s.writeError(w, "json", statusClientClosedRequest, "ClientClosedRequest", "request canceled before processing")
+	unique, tempNameByHash := uniqueInputs(req.inputs)
+	if len(unique) == 0 {
+		s.writeRequestError(w, format, req.inputs[0].err)
 		return
+	}
+	if stored := len(req.inputs) - countFailed(req.inputs); stored > len(unique) {
+		requestLogger(r.Context()).Info("deduplicated inputs",
+			"inputs", stored,
+			"unique", len(unique),
+			"dedup_ratio", 1-float64(len(unique))/float64(stored),
+		)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), req.timeout)
+	defer cancel()
+	useCache := r.URL.Query().Get("nocache") != "1"
+	if format == "ndjson" {
+		s.streamEvaluate(ctx, w, req, unique, tempNameByHash, useCache)
+		return
+	}
+	start := time.Now()
+	byTempName, err := s.predictInputs(ctx, req, unique, useCache, nil)
+	if err != nil {
+		s.notifyCallback(r.Context(), req, "", nil, err)
+		s.writePredictError(r.Context(), w, format, err)
+		return
+	}
+
+	results, resultPaths := s.collectResults(req, byTempName, tempNameByHash)
+	s.evaluateOK.Store(true)
+	s.notifyCallback(r.Context(), req, "", results, nil)
+	s.recordResults(r.Context(), "", results)
+	logTagStats(requestLogger(r.Context()), req, results, time.Since(start))
+
+	// A batch with at least one tagged file is a success; failed files are
+	// reported alongside. Only a batch where every file failed is an error.
+	status := http.StatusOK
+	if countSucceeded(results) == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		var body any
+		if req.summaryOnly {
+			body = newSummaryResponse(results)
+		} else {
+			resp := newEvaluateResponse(results)
+			if req.summary {
+				resp.Summary = summarizeTags(results)
+			}
+			body = resp
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			requestLogger(r.Context()).Error("encode json failed", "error", err)
+		}
+	case "html":
+		htmlResults, err := buildHTMLResults(resultPaths, results, s.previewMaxDim)
+		if err != nil {
+			s.writeError(w, format, http.StatusInternalServerError, codeInternalError, "failed to render HTML")
+			return
+		}
+		page := evaluatePage{
+			Results:       htmlResults,
+			WikiBaseURL:   s.wikiBaseURL,
+			SearchBaseURL: s.searchBaseURL,
+			ScoreBands:    s.scoreBands,
+			Threshold:     req.threshold,
+			Limit:         req.limit,
+		}
+		if s.shared != nil {
+			token, err := s.shared.put(page)
+			if err != nil {
+				s.writeError(w, format, http.StatusInternalServerError, codeInternalError, "failed to store shareable result")
+				return
+			}
+			http.Redirect(w, r, "/results/"+token, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(status)
+		if err := s.evalTmpl.Execute(w, page); err != nil {
+			requestLogger(r.Context()).Error("render evaluate failed", "error", err)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if err := writeTextResults(w, results, req.bare); err != nil {
+			requestLogger(r.Context()).Error("write text failed", "error", err)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=tags.csv")
+		w.WriteHeader(status)
+		if err := writeCSVResults(w, results, !req.noHeader); err != nil {
+			requestLogger(r.Context()).Error("write csv failed", "error", err)
+		}
 	default:
-		s.writeError(w, "json", http.StatusTooManyRequests, "TooManyRequests", "server is busy; reduce MAX_INFLIGHT or retry later")
+		s.writeRequestError(w, format, paramError("format", "format must be html, json, ndjson, text or csv"))
+	}
+}
+
+// parseEvaluate checks the content type and stores the request's inputs in a
+// new temp dir, req.dir, which the caller must remove. On error the dir is
+// already gone and format is the best guess for the error response.
+func (s *server) parseEvaluate(w http.ResponseWriter, r *http.Request) (*evalRequest, string, error) {
+	format := requestFormat(r)
+	contentType := r.Header.Get("Content-Type")
+	isJSON := isJSONRequest(contentType)
+	if !isJSON && !isMultipartFormRequest(contentType) {
+		return nil, format, badRequest("content type must be multipart/form-data or application/json")
+	}
+	if isJSON {
+		return s.storeInputs(w, r, format, s.parseJSONEvaluate)
+	}
+	return s.storeInputs(w, r, format, s.parseMultipartEvaluate)
+}
+
+// storeInputs runs parse with a new temp dir for the request's inputs and
+// preprocesses what it stored. format is the error format to use when parse
+// fails before it can tell.
+func (s *server) storeInputs(w http.ResponseWriter, r *http.Request, format string, parse func(http.ResponseWriter, *http.Request, string) (*evalRequest, error)) (*evalRequest, string, error) {
+	tmpDir, err := os.MkdirTemp(s.tempDir, uploadDirPattern)
+	if err != nil {
+		if isNoSpace(err) {
+			return nil, format, storeError(err)
+		}
+		return nil, format, errors.New("failed to create temp dir")
+	}
+
+	req, err := parse(w, r, tmpDir)
+	if req != nil {
+		format = req.format
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, format, err
+	}
+	req.dir = tmpDir
+
+	s.preprocessInputs(r.Context(), req.inputs, req.includePHash)
+	return req, format, nil
+}
+
+// collectResults builds the result for every input, in input order, along
+// with the stored path of each ("" for inputs that failed before inference).
+func (s *server) collectResults(req *evalRequest, byTempName map[string]prediction, tempNameByHash map[string]string) ([]prediction, []string) {
+	results := make([]prediction, 0, len(req.inputs))
+	paths := make([]string, 0, len(req.inputs))
+	for _, in := range req.inputs {
+		pred, ok := byTempName[tempNameByHash[in.dedupKey()]]
+		results = append(results, s.resultFor(req, in, pred, ok))
+		paths = append(paths, in.path)
+	}
+	return results, paths
+}
+
+func countSucceeded(results []prediction) int {
+	n := 0
+	for _, pred := range results {
+		if pred.Error == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// logTagStats records how many tags a finished batch returned and with which
+// settings, apart from the http_request line, so dashboards can chart tag
+// counts and spot clients sending a threshold of 0.
+func logTagStats(log *slog.Logger, req *evalRequest, results []prediction, inference time.Duration) {
+	tags := 0
+	for _, pred := range results {
+		tags += len(pred.Tags) + len(pred.Rating)
+	}
+	log.Info("tag_stats",
+		"files", len(results),
+		"failed", len(results)-countSucceeded(results),
+		"tags", tags,
+		"mode", req.mode,
+		"threshold", req.threshold,
+		"limit", req.limit,
+		"inference_ms", inference.Milliseconds(),
+	)
+}
+
+// streamEvaluate writes one JSON result per line as predictions arrive,
+// flushing after each, instead of buffering the whole batch. Lines follow
+// completion order rather than input order. Failed inputs and files the
+// worker never reported come last. If inference fails after output has
+// started, a final error object is written in place of the missing lines.
+func (s *server) streamEvaluate(ctx context.Context, w http.ResponseWriter, req *evalRequest, unique []evalInput, tempNameByHash map[string]string, useCache bool) {
+	log := requestLogger(ctx)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	started := false
+	emitted := make([]bool, len(req.inputs))
+	emit := func(i int, pred prediction, ok bool) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		emitted[i] = true
+		if err := enc.Encode(s.resultFor(req, req.inputs[i], pred, ok)); err != nil {
+			log.Error("encode ndjson failed", "error", err)
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Warn("flush ndjson failed", "error", err)
+		}
+	}
+
+	inputsByTempName := make(map[string][]int, len(unique))
+	for i, in := range req.inputs {
+		if in.err == nil {
+			name := tempNameByHash[in.dedupKey()]
+			inputsByTempName[name] = append(inputsByTempName[name], i)
+		}
+	}
+	start := time.Now()
+	byTempName, err := s.predictInputs(ctx, req, unique, useCache, func(tempName string, pred prediction) {
+		for _, i := range inputsByTempName[tempName] {
+			if !emitted[i] {
+				emit(i, pred, true)
+			}
+		}
+	})
+	if err != nil {
+		s.notifyCallback(ctx, req, "", nil, err)
+		if !started {
+			s.writePredictError(ctx, w, req.format, err)
+			return
+		}
+		log.Error("predict failed", "error", err)
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			s.inferenceFailed(err)
+		}
+		if encErr := enc.Encode(newErrorBody(codeInferenceError, err.Error(), nil)); encErr != nil {
+			log.Error("encode ndjson failed", "error", encErr)
+		}
 		return
 	}
+	for i, in := range req.inputs {
+		if !emitted[i] {
+			pred, ok := byTempName[tempNameByHash[in.dedupKey()]]
+			emit(i, pred, ok)
+		}
+	}
+	s.evaluateOK.Store(true)
+	results, _ := s.collectResults(req, byTempName, tempNameByHash)
+	s.notifyCallback(ctx, req, "", results, nil)
+	s.recordResults(ctx, "", results)
+	logTagStats(log, req, results, time.Since(start))
+}
+
+// fileError reports one input of a batch that could not be tagged.
+type fileError struct {
+	ID       string `json:"id,omitempty"`
+	Filename string `json:"filename"`
+	Message  string `json:"message"`
+}
+
+// evaluateResponse is the JSON body of a batch: the tagged files in input
+// order and the files that failed, so one bad file does not sink the rest.
+type evaluateResponse struct {
+	Results []prediction `json:"results"`
+	Errors  []fileError  `json:"errors"`
+	Summary []tagSummary `json:"summary,omitempty"`
+}
+
+func newEvaluateResponse(results []prediction) evaluateResponse {
+	resp := evaluateResponse{Results: []prediction{}, Errors: []fileError{}}
+	for _, pred := range results {
+		if pred.Error != "" {
+			resp.Errors = append(resp.Errors, fileError{ID: pred.ID, Filename: pred.Filename, Message: pred.Error})
+			continue
+		}
+		resp.Results = append(resp.Results, pred)
+	}
+	return resp
+}
+
+// resultFor builds the client-facing result for one input from the
+// prediction of the temp file it was deduplicated to.
+func (s *server) resultFor(req *evalRequest, in evalInput, pred prediction, ok bool) prediction {
+	if in.err != nil {
+		return prediction{ID: in.id, Filename: in.name, Tags: map[string]float64{}, Error: in.err.Error(), tagOrder: req.sort, tagFields: req.fields}
+	}
+	if !ok {
+		slog.Warn("no prediction for input", "filename", in.name)
+		return prediction{ID: in.id, Filename: in.name, Tags: map[string]float64{}, Error: "worker returned no prediction for this file", tagOrder: req.sort, tagFields: req.fields}
+	}
+	if pred.Error != "" {
+		return prediction{ID: in.id, Filename: in.name, Tags: map[string]float64{}, Error: pred.Error, tagOrder: req.sort, tagFields: req.fields}
+	}
+	if req.fullScores() {
+		pred = trimScores(pred, req)
+	}
+	// Duplicates share one worker prediction; give each its own maps.
+	if s.tagFilter != nil {
+		pred = filterTags(pred, s.tagFilter)
+	} else {
+		pred.Tags = maps.Clone(pred.Tags)
+		pred.Categories = maps.Clone(pred.Categories)
+	}
+	adjustScores(pred.Tags, req)
+	if req.expandImplications {
+		expandImplications(&pred, s.implications, s.tagFilter)
+	}
+	pred = splitRating(pred, s.ratingTags, req.splitRating)
+	capTags(&pred, req.maxTags)
+	pred.ID = in.id
+	pred.Filename = in.name
+	pred.Frame = in.frame
+	pred.PHash = in.phash
+	pred.tagOrder = req.sort
+	pred.tagFields = req.fields
+	fillCategories(&pred)
+	if req.lang != "" {
+		s.translations.translate(&pred, req.lang)
+	}
+	return pred
+}
+
+// writePredictError maps an inference failure onto the response status.
+func (s *server) writePredictError(ctx context.Context, w http.ResponseWriter, format string, err error) {
+	requestLogger(ctx).Error("predict failed", "error", err)
+	switch {
+	case errors.Is(err, context.Canceled):
+		s.writeError(w, format, statusClientClosedRequest, codeClientClosedRequest, "request canceled by client")
+	case errors.Is(err, context.DeadlineExceeded):
+		s.writeError(w, format, http.StatusGatewayTimeout, codeGatewayTimeout, "inference timed out")
+	case errors.Is(err, errWorkerRestarting):
+		w.Header().Set("Retry-After", "5")
+		s.writeError(w, format, http.StatusServiceUnavailable, codeWorkerRestarting, "inference worker is restarting; retry later")
+	case errors.Is(err, errWorkerNotRunning):
+		s.inferenceFailed(err)
+		s.writeError(w, format, http.StatusServiceUnavailable, codeWorkerUnavailable, "inference worker is not running")
+	case isNoSpace(err):
+		s.inferenceFailed(err)
+		s.writeError(w, format, http.StatusInsufficientStorage, codeInsufficientStorage, "server is out of disk space; retry later")
+	case errors.Is(err, errPredictorUnavailable):
+		s.inferenceFailed(err)
+		w.Header().Set("Retry-After", "5")
+		s.writeError(w, format, http.StatusServiceUnavailable, codeWorkerUnavailable, "remote predictor is unavailable; retry later")
+	default:
+		s.inferenceFailed(err)
+		s.writeError(w, format, http.StatusInternalServerError, codeInferenceError, err.Error())
+	}
+}
+
+// downscaleInput shrinks a stored input larger than MAX_IMAGE_DIM. An image
+// that cannot be resized is tagged at its original size.
+func (s *server) downscaleInput(ctx context.Context, in *evalInput) {
+	if _, err := downscaleImage(in.path, s.maxImageDim); err != nil {
+		requestLogger(ctx).Warn("downscale failed", "filename", in.name, "error", err)
+	}
+}
+
+func (in evalInput) dedupKey() string {
+	if in.hash != "" {
+		return in.hash
+	}
+	return in.path
+}
 
-	format := "html"
+// uniqueInputs returns the stored inputs to tag, one per distinct content
+// hash, and maps each hash to the temp filename whose prediction serves every
+// duplicate of it.
+func uniqueInputs(inputs []evalInput) ([]evalInput, map[string]string) {
+	unique := make([]evalInput, 0, len(inputs))
+	tempNameByHash := make(map[string]string, len(inputs))
+	for _, in := range inputs {
+		if in.err != nil {
+			continue
+		}
+		key := in.dedupKey()
+		if _, seen := tempNameByHash[key]; seen {
+			continue
+		}
+		tempNameByHash[key] = filepath.Base(in.path)
+		unique = append(unique, in)
+	}
+	return unique, tempNameByHash
+}
 
-	if !isMultipartFormRequest(r.Header.Get("Content-Type")) {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "content type must be multipart/form-data")
+// predictInputs tags the unique inputs and returns predictions keyed by temp
+// filename. Inputs found in the cache skip the worker; fresh successful
+// predictions are stored back. useCache=false only bypasses the lookup. A
+// non-nil onPrediction is called with each cache hit and each streamed worker
+// result as soon as it is available.
+func (s *server) predictInputs(ctx context.Context, req *evalRequest, unique []evalInput, useCache bool, onPrediction func(tempName string, pred prediction)) (map[string]prediction, error) {
+	byTempName := make(map[string]prediction, len(unique))
+	keyByTempName := make(map[string]string, len(unique))
+	paths := make([]string, 0, len(unique))
+	for _, in := range unique {
+		name := filepath.Base(in.path)
+		key := req.cacheKey(in.hash)
+		if useCache && in.hash != "" {
+			if pred, ok := s.cache.get(key); ok {
+				// A cached result cost the worker nothing this time.
+				pred.Filename = name
+				pred.DurationMS = 0
+				byTempName[name] = pred
+				if onPrediction != nil {
+					onPrediction(name, pred)
+				}
+				continue
+			}
+		}
+		if in.hash != "" {
+			keyByTempName[name] = key
+		}
+		paths = append(paths, in.path)
+	}
+	if len(paths) == 0 {
+		return byTempName, nil
+	}
+
+	var onWorkerPrediction func(prediction)
+	if onPrediction != nil {
+		onWorkerPrediction = func(pred prediction) { onPrediction(pred.Filename, pred) }
+	}
+	start := time.Now()
+	p := s.predictorForRequest(req)
+	if p == nil {
+		return nil, errWorkerNotRunning
+	}
+	predictions, err := p.predictStream(ctx, paths, req.predictParams(), onWorkerPrediction)
+	if err != nil {
+		return nil, err
+	}
+	tagged := 0
+	for _, pred := range predictions {
+		byTempName[pred.Filename] = pred
+		if pred.Error != "" {
+			continue
+		}
+		tagged++
+		if key, ok := keyByTempName[pred.Filename]; ok {
+			s.cache.put(key, pred)
+		}
+	}
+	s.metrics.observeInference(time.Since(start), tagged)
+	return byTempName, nil
+}
+
+func countFailed(inputs []evalInput) int {
+	n := 0
+	for _, in := range inputs {
+		if in.err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// requestError is a client-facing error produced while parsing an evaluate request.
+type requestError struct {
+	status  int
+	code    errorCode
+	message string
+	details map[string]string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(message string) *requestError {
+	return &requestError{status: http.StatusBadRequest, code: codeBadRequest, message: message}
+}
+
+// isRequestError reports whether err is the client's fault, as opposed to a
+// server-side failure such as a full disk.
+func isRequestError(err error) bool {
+	var reqErr *requestError
+	return errors.As(err, &reqErr)
+}
+
+// writeRequestError writes err with the status, code and details of a
+// requestError, as a 507 for a full disk, or as a 500 otherwise.
+func (s *server) writeRequestError(w http.ResponseWriter, format string, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		s.writeErrorDetails(w, format, reqErr.status, reqErr.code, reqErr.message, reqErr.details)
+		return
+	}
+	if errors.Is(err, errDiskFull) {
+		s.writeError(w, format, http.StatusInsufficientStorage, codeInsufficientStorage, err.Error())
 		return
 	}
+	s.writeError(w, format, http.StatusInternalServerError, codeInternalError, err.Error())
+}
+
+// checkImage validates a stored input against the allowed image types,
+// turning rejections into a 400 that names the file and its detected type.
+// HEIC/HEIF inputs are converted to JPEG and TIFF/BMP inputs to PNG first.
+func (s *server) checkImage(path, name string) error {
+	if err := s.convertHEIFUpload(path, name); err != nil {
+		return err
+	}
+	if video, err := s.acceptVideoUpload(path, name); video || err != nil {
+		return err
+	}
+	if err := checkPixels(path, name, s.maxPixels); err != nil {
+		return err
+	}
+	allowed := s.imageTypes
+	converted, err := s.convertRasterUpload(path, name)
+	if err != nil {
+		return err
+	}
+	if converted {
+		// The allowlist applied to the original type.
+		allowed = map[string]bool{"image/png": true}
+	}
+	mimeType, err := validateImageFile(path, name, allowed)
+	if err == nil && s.validateDecode {
+		err = s.checkDecodes(path, name)
+	}
+	if err == nil {
+		return nil
+	}
+	if isRequestError(err) {
+		return err
+	}
+	var imgErr *imageError
+	if errors.As(err, &imgErr) {
+		reqErr := badRequest(imgErr.message)
+		reqErr.code = codeUnsupportedFile
+		reqErr.details = map[string]string{"filename": name, "mime_type": mimeType}
+		return reqErr
+	}
+	return fmt.Errorf("failed to read upload: %w", err)
+}
+
+type evalRequest struct {
+	format             string
+	threshold          float64
+	limit              int
+	maxTags            int
+	timeout            time.Duration
+	categoryThresholds map[string]float64
+	mode               string
+	model              string
+	ensemble           []string
+	combine            string
+	includeAll         bool
+	includePHash       bool
+	summary            bool
+	summaryOnly        bool
+	histogramBuckets   int
+	splitRating        bool
+	normalize          bool
+	expandImplications bool
+	round              bool
+	roundDigits        int
+	bare               bool
+	noHeader           bool
+	sort               string
+	fields             string
+	inputs             []evalInput
+	dir                string
+	callbackURL        string
+	lang               string
+}
+
+// cacheKey identifies a prediction for the image with the given hash under
+// this request's parameters. Every parameter that changes the tag set the
+// worker returns must be part of the key.
+func (req *evalRequest) cacheKey(hash string) string {
+	p := req.predictParams()
+	key := fmt.Sprintf("%s|%s|%s|%g|%d", hash, req.modelKey(), p.mode, p.threshold, p.limit)
+	categories := make([]string, 0, len(p.categoryThresholds))
+	for category := range p.categoryThresholds {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		key += fmt.Sprintf("|%s=%g", category, p.categoryThresholds[category])
+	}
+	return key
+}
+
+// predictParams are the settings sent to the worker. Requests that need the
+// full score distribution get a modeAll dump and are trimmed by trimScores.
+func (req *evalRequest) predictParams() predictParams {
+	if req.fullScores() {
+		return predictParams{mode: modeAll}
+	}
+	return predictParams{threshold: req.threshold, limit: req.limit, categoryThresholds: req.categoryThresholds, mode: req.mode}
+}
+
+// fullScores reports whether the worker must return every score. An
+// ensemble needs them to merge its models' scores before thresholding.
+func (req *evalRequest) fullScores() bool {
+	return req.includeAll || req.histogramBuckets > 0 || len(req.ensemble) > 0
+}
+
+// modelKey names the model or ensemble that tags the request.
+func (req *evalRequest) modelKey() string {
+	if len(req.ensemble) == 0 {
+		return req.model
+	}
+	return req.combine + "(" + strings.Join(req.ensemble, ",") + ")"
+}
+
+// parseCategoryThresholds collects threshold_<category> form values.
+func parseCategoryThresholds(form map[string][]string) (map[string]float64, error) {
+	var thresholds map[string]float64
+	for key, values := range form {
+		category, ok := strings.CutPrefix(key, "threshold_")
+		if !ok || len(values) == 0 {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+		if err != nil {
+			return nil, paramError(key, fmt.Sprintf("%s must be a float", key))
+		}
+		if thresholds == nil {
+			thresholds = make(map[string]float64)
+		}
+		thresholds[strings.ToLower(category)] = threshold
+	}
+	return thresholds, nil
+}
+
+func validateCategoryThresholds(thresholds map[string]float64) error {
+	for category, threshold := range thresholds {
+		if category == "" {
+			return paramError("category_thresholds", "category threshold is missing a category name")
+		}
+		if !validThreshold(threshold) {
+			return paramError("threshold_"+category, fmt.Sprintf("threshold_%s must be between 0 and 1", category))
+		}
+	}
+	return nil
+}
+
+// resolveTimeout applies a client-supplied timeout, given as a Go duration
+// or a number of seconds, capped at maxPredictTimeout.
+func (s *server) resolveTimeout(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return s.predictTimeout, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		secs, convErr := strconv.ParseFloat(raw, 64)
+		if convErr != nil {
+			return 0, paramError("timeout", "timeout must be a duration such as 30s or a number of seconds")
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, paramError("timeout", "timeout must be positive")
+	}
+	if timeout > s.maxPredictTimeout {
+		timeout = s.maxPredictTimeout
+	}
+	return timeout, nil
+}
+
+func (s *server) validateParams(threshold float64, limit int) error {
+	if !validThreshold(threshold) {
+		return paramError("threshold", "threshold must be between 0 and 1")
+	}
+	if limit < 1 {
+		return paramError("limit", "limit must be a positive integer")
+	}
+	if limit > s.maxLimit {
+		return paramError("limit", fmt.Sprintf("limit must be less than or equal to %d", s.maxLimit))
+	}
+	return nil
+}
+
+// validThreshold reports whether t is in [0, 1]. NaN, which strconv accepts
+// and every comparison lets through, is not.
+func validThreshold(t float64) bool {
+	return t >= 0 && t <= 1
+}
+
+// paramError is an InvalidParameter 400 naming the offending parameter in
+// its "parameter" detail.
+func paramError(name, message string) *requestError {
+	reqErr := badRequest(message)
+	reqErr.code = codeInvalidParameter
+	reqErr.details = map[string]string{"parameter": name}
+	return reqErr
+}
+
+func (s *server) parseMultipartEvaluate(w http.ResponseWriter, r *http.Request, tmpDir string) (*evalRequest, error) {
+	req := &evalRequest{format: negotiateFormat(r.Header.Get("Accept"), "html")}
 
 	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes)
 	if err := r.ParseMultipartForm(8 << 20); err != nil {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "invalid multipart body or request too large")
-		return
+		return req, badRequest("invalid multipart body or request too large")
 	}
 	if f := strings.ToLower(strings.TrimSpace(r.FormValue("format"))); f != "" {
-		format = f
+		req.format = f
+	}
+	// format=zip marks every uploaded file as an archive and answers in JSON.
+	forceArchive := req.format == "zip"
+	if forceArchive {
+		req.format = "json"
+	}
+	// format=summary answers in JSON with the batch summary alone.
+	if req.format == "summary" {
+		req.format = "json"
+		req.summaryOnly = true
 	}
 
-	threshold, err := parseFloatOrDefault(r.FormValue("threshold"), 0.1)
+	var err error
+	req.threshold, err = parseFloatOrDefault(r.FormValue("threshold"), s.defaultThreshold)
 	if err != nil {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "threshold must be a float")
-		return
+		return req, paramError("threshold", "threshold must be a float")
+	}
+	req.limit, err = parseIntOrDefault(r.FormValue("limit"), s.defaultLimit)
+	if err != nil {
+		return req, paramError("limit", "limit must be a positive integer")
+	}
+	if err := s.validateParams(req.threshold, req.limit); err != nil {
+		return req, err
+	}
+	if req.maxTags, err = parseMaxTags(r.FormValue("max_tags")); err != nil {
+		return req, err
+	}
+	if req.categoryThresholds, err = parseCategoryThresholds(r.Form); err != nil {
+		return req, err
+	}
+	if err := validateCategoryThresholds(req.categoryThresholds); err != nil {
+		return req, err
+	}
+	if req.mode, err = parseMode(r.FormValue("mode")); err != nil {
+		return req, err
+	}
+	if req.model, err = s.resolveModel(r.FormValue("model")); err != nil {
+		return req, err
+	}
+	if err := s.applyEnsemble(req, r.FormValue("ensemble"), r.FormValue("ensemble_combine")); err != nil {
+		return req, err
+	}
+	if req.includeAll, err = parseBoolOrDefault(r.FormValue("include_all"), false); err != nil {
+		return req, paramError("include_all", "include_all must be a boolean")
+	}
+	if req.includePHash, err = parseBoolOrDefault(r.FormValue("include_phash"), false); err != nil {
+		return req, paramError("include_phash", "include_phash must be a boolean")
+	}
+	if req.summary, err = parseBoolOrDefault(r.FormValue("summary"), false); err != nil {
+		return req, paramError("summary", "summary must be a boolean")
+	}
+	histogram, err := parseBoolOrDefault(r.FormValue("histogram"), false)
+	if err != nil {
+		return req, paramError("histogram", "histogram must be a boolean")
+	}
+	if req.histogramBuckets, err = parseHistogramBuckets(histogram, r.FormValue("histogram_buckets")); err != nil {
+		return req, err
+	}
+	if req.timeout, err = s.resolveTimeout(r.FormValue("timeout")); err != nil {
+		return req, err
+	}
+	if req.splitRating, err = parseBoolOrDefault(r.FormValue("split_rating"), false); err != nil {
+		return req, paramError("split_rating", "split_rating must be a boolean")
+	}
+	if req.normalize, err = parseBoolOrDefault(r.FormValue("normalize"), false); err != nil {
+		return req, paramError("normalize", "normalize must be a boolean")
+	}
+	if req.expandImplications, err = parseBoolOrDefault(r.FormValue("expand_implications"), false); err != nil {
+		return req, paramError("expand_implications", "expand_implications must be a boolean")
+	}
+	if req.roundDigits, req.round, err = parseRound(r.FormValue("round")); err != nil {
+		return req, err
+	}
+	ordered, err := parseBoolOrDefault(r.FormValue("ordered"), false)
+	if err != nil {
+		return req, paramError("ordered", "ordered must be a boolean")
+	}
+	if req.sort, err = parseSort(r.FormValue("sort"), ordered); err != nil {
+		return req, err
+	}
+	if req.fields, err = parseFields(r.FormValue("fields")); err != nil {
+		return req, err
+	}
+	req.bare = r.FormValue("bare") == "1"
+	req.noHeader = r.FormValue("noheader") == "1"
+	req.lang = normalizeLang(r.FormValue("lang"))
+	if req.callbackURL, err = parseCallbackURL(strings.TrimSpace(r.FormValue("callback_url"))); err != nil {
+		return req, err
+	}
+
+	files := s.uploadedFiles(r.MultipartForm)
+	urls := nonEmptyValues(r.MultipartForm.Value["url"])
+	if len(files) == 0 && len(urls) == 0 {
+		return req, badRequest("at least one file or url is required")
+	}
+	if len(files)+len(urls) > s.maxFiles {
+		return req, badRequest(fmt.Sprintf("too many files; maximum is %d", s.maxFiles))
+	}
+
+	req.inputs = make([]evalInput, 0, len(files)+len(urls))
+	// URL downloads share MAX_UPLOAD_MB with the files stored from the form.
+	var uploaded int64
+	for _, fh := range files {
+		uploaded += fh.Size
+		if forceArchive || isArchiveUpload(fh) {
+			if err := validateUploadedFile(fh, s.maxUploadBytes); err != nil {
+				return req, badRequest(err.Error())
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return req, badRequest("failed to open upload")
+			}
+			inputs, err := s.extractArchive(f, fh.Size, fh.Filename, tmpDir, len(req.inputs))
+			_ = f.Close()
+			if err != nil {
+				return req, err
+			}
+			req.inputs = append(req.inputs, inputs...)
+			continue
+		}
+		if fh.Size == 0 {
+			req.inputs = append(req.inputs, evalInput{name: fh.Filename, err: emptyFile(fh.Filename)})
+			continue
+		}
+		if err := validateUploadedFile(fh, s.maxFileBytes); err != nil {
+			if errors.Is(err, errFileTooLarge) {
+				return req, fileTooLarge(fh.Filename, s.maxFileBytes)
+			}
+			return req, badRequest(err.Error())
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			return req, badRequest("failed to open upload")
+		}
+
+		dstPath := filepath.Join(tmpDir, tempFilename(fh.Filename, len(req.inputs)))
+		dst, err := os.Create(dstPath)
+		if err != nil {
+			_ = f.Close()
+			return req, storeError(err)
+		}
+
+		// The header size is checked above, but the copy is bounded too so a
+		// single file can never exceed MAX_FILE_MB however the form was sent.
+		var src io.Reader = f
+		if s.maxFileBytes > 0 {
+			src = io.LimitReader(f, s.maxFileBytes+1)
+		}
+		hasher := sha256.New()
+		n, copyErr := io.Copy(io.MultiWriter(dst, hasher), src)
+		_ = dst.Close()
+		_ = f.Close()
+		if isNoSpace(copyErr) {
+			return req, storeError(copyErr)
+		}
+		if copyErr != nil {
+			return req, errors.New("failed to read upload")
+		}
+		if s.maxFileBytes > 0 && n > s.maxFileBytes {
+			_ = os.Remove(dstPath)
+			return req, fileTooLarge(fh.Filename, s.maxFileBytes)
+		}
+		if n == 0 {
+			_ = os.Remove(dstPath)
+			req.inputs = append(req.inputs, evalInput{name: fh.Filename, err: emptyFile(fh.Filename)})
+			continue
+		}
+		if err := s.checkImage(dstPath, fh.Filename); err != nil {
+			if !isRequestError(err) || isFileTooLarge(err) {
+				return req, err
+			}
+			_ = os.Remove(dstPath)
+			req.inputs = append(req.inputs, evalInput{name: fh.Filename, err: err})
+			continue
+		}
+
+		req.inputs = append(req.inputs, evalInput{name: fh.Filename, path: dstPath, hash: hex.EncodeToString(hasher.Sum(nil))})
+	}
+	dstPaths := make([]string, len(urls))
+	for i, rawURL := range urls {
+		dstPaths[i] = filepath.Join(tmpDir, tempFilename(urlFilename(rawURL), len(req.inputs)+i))
+	}
+	fetched := s.fetcher.fetchAll(r.Context(), urls, dstPaths, uploaded)
+	for i, rawURL := range urls {
+		dstPath, hash, err := dstPaths[i], fetched[i].hash, fetched[i].err
+		if err == nil {
+			err = s.checkImage(dstPath, rawURL)
+		}
+		if isNoSpace(err) {
+			return req, storeError(err)
+		}
+		if err != nil {
+			requestLogger(r.Context()).Warn("fetch url failed", "url", rawURL, "error", err)
+			req.inputs = append(req.inputs, evalInput{name: rawURL, err: err})
+			continue
+		}
+		req.inputs = append(req.inputs, evalInput{name: rawURL, path: dstPath, hash: hash})
+	}
+	return req, nil
+}
+
+type jsonEvaluateRequest struct {
+	Images []struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	} `json:"images"`
+	Paths              []string           `json:"paths"`
+	Threshold          *float64           `json:"threshold"`
+	Limit              *int               `json:"limit"`
+	MaxTags            int                `json:"max_tags"`
+	CategoryThresholds map[string]float64 `json:"category_thresholds"`
+	Mode               string             `json:"mode"`
+	Model              string             `json:"model"`
+	Ensemble           string             `json:"ensemble"`
+	EnsembleCombine    string             `json:"ensemble_combine"`
+	IncludeAll         bool               `json:"include_all"`
+	IncludePHash       bool               `json:"include_phash"`
+	Summary            bool               `json:"summary"`
+	Histogram          bool               `json:"histogram"`
+	HistogramBuckets   int                `json:"histogram_buckets"`
+	Timeout            json.RawMessage    `json:"timeout"`
+	SplitRating        bool               `json:"split_rating"`
+	Normalize          bool               `json:"normalize"`
+	ExpandImplications bool               `json:"expand_implications"`
+	Round              *int               `json:"round"`
+	Sort               string             `json:"sort"`
+	Ordered            bool               `json:"ordered"`
+	Fields             string             `json:"fields"`
+	CallbackURL        string             `json:"callback_url"`
+	Lang               string             `json:"lang"`
+}
+
+// parseJSONEvaluate handles application/json bodies carrying base64-encoded
+// images. maxUploadBytes applies to the decoded total, so the raw body may be
+// up to a third larger to account for the base64 overhead.
+func (s *server) parseJSONEvaluate(w http.ResponseWriter, r *http.Request, tmpDir string) (*evalRequest, error) {
+	req := &evalRequest{format: negotiateFormat(r.Header.Get("Accept"), "json"), threshold: s.defaultThreshold, limit: s.defaultLimit}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(int(s.maxUploadBytes)))+64*1024)
+	var body jsonEvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return req, badRequest("invalid JSON body or request too large")
+	}
+	if err := s.applyJSONParams(req, &body); err != nil {
+		return req, err
+	}
+
+	if len(body.Images) == 0 && len(body.Paths) == 0 {
+		return req, badRequest("at least one image is required")
+	}
+	if len(body.Images)+len(body.Paths) > s.maxFiles {
+		return req, badRequest(fmt.Sprintf("too many files; maximum is %d", s.maxFiles))
+	}
+	if len(body.Paths) > 0 {
+		if err := s.localPathsAllowed(); err != nil {
+			return req, err
+		}
+	}
+
+	var total int64
+	req.inputs = make([]evalInput, 0, len(body.Images))
+	for i, img := range body.Images {
+		name := strings.TrimSpace(img.Name)
+		if name == "" {
+			name = fmt.Sprintf("image-%d", i)
+		}
+		data, err := base64.StdEncoding.DecodeString(img.Data)
+		if err != nil {
+			return req, badRequest(fmt.Sprintf("image %q is not valid base64", name))
+		}
+		if len(data) == 0 {
+			req.inputs = append(req.inputs, evalInput{name: name, err: emptyFile(name)})
+			continue
+		}
+		if s.maxFileBytes > 0 && int64(len(data)) > s.maxFileBytes {
+			return req, fileTooLarge(name, s.maxFileBytes)
+		}
+		total += int64(len(data))
+		if total > s.maxUploadBytes {
+			return req, badRequest("decoded images exceed the request size limit")
+		}
+
+		dstPath := filepath.Join(tmpDir, tempFilename(name, i))
+		if err := os.WriteFile(dstPath, data, 0o600); err != nil {
+			return req, storeError(err)
+		}
+		if err := s.checkImage(dstPath, name); err != nil {
+			if !isRequestError(err) || isFileTooLarge(err) {
+				return req, err
+			}
+			_ = os.Remove(dstPath)
+			req.inputs = append(req.inputs, evalInput{name: name, err: err})
+			continue
+		}
+		sum := sha256.Sum256(data)
+		req.inputs = append(req.inputs, evalInput{name: name, path: dstPath, hash: hex.EncodeToString(sum[:])})
+	}
+	for i, raw := range body.Paths {
+		in, err := s.storeLocalPath(tmpDir, raw, len(body.Images)+i)
+		if err != nil {
+			return req, err
+		}
+		req.inputs = append(req.inputs, in)
+	}
+	return req, nil
+}
+
+// applyJSONParams copies the tagging parameters of a JSON body onto req,
+// validating them as the multipart form fields are.
+func (s *server) applyJSONParams(req *evalRequest, body *jsonEvaluateRequest) error {
+	var err error
+	if body.Threshold != nil {
+		req.threshold = *body.Threshold
+	}
+	if body.Limit != nil {
+		req.limit = *body.Limit
+	}
+	if err := s.validateParams(req.threshold, req.limit); err != nil {
+		return err
+	}
+	if body.MaxTags != 0 {
+		if req.maxTags, err = parseMaxTags(strconv.Itoa(body.MaxTags)); err != nil {
+			return err
+		}
+	}
+	for category, threshold := range body.CategoryThresholds {
+		if req.categoryThresholds == nil {
+			req.categoryThresholds = make(map[string]float64)
+		}
+		req.categoryThresholds[strings.ToLower(strings.TrimSpace(category))] = threshold
+	}
+	if err := validateCategoryThresholds(req.categoryThresholds); err != nil {
+		return err
+	}
+	if req.mode, err = parseMode(body.Mode); err != nil {
+		return err
+	}
+	if req.model, err = s.resolveModel(body.Model); err != nil {
+		return err
+	}
+	if err := s.applyEnsemble(req, body.Ensemble, body.EnsembleCombine); err != nil {
+		return err
+	}
+	req.includeAll = body.IncludeAll
+	req.includePHash = body.IncludePHash
+	req.summary = body.Summary
+	buckets := ""
+	if body.HistogramBuckets != 0 {
+		buckets = strconv.Itoa(body.HistogramBuckets)
 	}
-	if threshold < 0 || threshold > 1 {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "threshold must be between 0 and 1")
-		return
+	if req.histogramBuckets, err = parseHistogramBuckets(body.Histogram, buckets); err != nil {
+		return err
 	}
-	limit, err := parseIntOrDefault(r.FormValue("limit"), 50)
-	if err != nil || limit < 1 {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "limit must be a positive integer")
-		return
+	if req.timeout, err = s.resolveTimeout(strings.Trim(string(body.Timeout), `"`)); err != nil {
+		return err
 	}
-	if limit > s.maxLimit {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", fmt.Sprintf("limit must be less than or equal to %d", s.maxLimit))
-		return
+	req.splitRating = body.SplitRating
+	req.normalize = body.Normalize
+	req.expandImplications = body.ExpandImplications
+	if body.Round != nil {
+		if req.roundDigits, req.round, err = parseRound(strconv.Itoa(*body.Round)); err != nil {
+			return err
+		}
 	}
-
-	files := r.MultipartForm.File["file"]
-	if len(files) == 0 {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "at least one file is required")
-		return
+	if req.sort, err = parseSort(body.Sort, body.Ordered); err != nil {
+		return err
 	}
-	if len(files) > s.maxFiles {
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", fmt.Sprintf("too many files; maximum is %d", s.maxFiles))
-		return
+	if req.fields, err = parseFields(body.Fields); err != nil {
+		return err
 	}
+	req.lang = normalizeLang(body.Lang)
+	req.callbackURL, err = parseCallbackURL(strings.TrimSpace(body.CallbackURL))
+	return err
+}
 
-	tmpDir, err := os.MkdirTemp("", "autotagger-upload-*")
-	if err != nil {
-		s.writeError(w, format, http.StatusInternalServerError, "InternalError", "failed to create temp dir")
-		return
+// categoryClass maps a tag category to the link color Danbooru uses for it.
+func categoryClass(category string) string {
+	switch category {
+	case "artist":
+		return "text-red-600 hover:text-red-500"
+	case "copyright":
+		return "text-fuchsia-700 hover:text-fuchsia-600"
+	case "character":
+		return "text-green-600 hover:text-green-500"
+	case "meta":
+		return "text-orange-500 hover:text-orange-400"
+	default:
+		return "text-sky-600 hover:text-sky-500"
 	}
-	defer os.RemoveAll(tmpDir)
-
-	paths := make([]string, 0, len(files))
-	origNames := make([]string, 0, len(files))
-	for i, fh := range files {
-		if err := validateUploadedFile(fh, s.maxFileBytes); err != nil {
-			s.writeError(w, format, http.StatusBadRequest, "BadRequest", err.Error())
-			return
-		}
-
-		f, err := fh.Open()
-		if err != nil {
-			s.writeError(w, format, http.StatusBadRequest, "BadRequest", "failed to open upload")
-			return
-		}
+}
 
-		safeName := sanitizeFilename(fh.Filename, i)
-		dstPath := filepath.Join(tmpDir, safeName)
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			_ = f.Close()
-			s.writeError(w, format, http.StatusInternalServerError, "InternalError", "failed to store upload")
-			return
-		}
+// tagText joins the tag names in sorted order, the format Danbooru's tag box
+// accepts.
+func tagText(tags map[string]float64) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
 
-		_, copyErr := io.Copy(dst, f)
-		_ = dst.Close()
-		_ = f.Close()
-		if copyErr != nil {
-			s.writeError(w, format, http.StatusInternalServerError, "InternalError", "failed to read upload")
-			return
+// writeTextResults writes one line per image: the filename, a tab and the
+// tag text, in name order unless sort=score was asked for. Failed images get
+// an empty tag text. With bare set and a single image, only the tag text is
+// written.
+func writeTextResults(w io.Writer, results []prediction, bare bool) error {
+	bw := bufio.NewWriter(w)
+	for _, pred := range results {
+		if bare && len(results) == 1 {
+			fmt.Fprintln(bw, textTagNames(pred))
+			continue
 		}
-
-		paths = append(paths, dstPath)
-		origNames = append(origNames, fh.Filename)
+		fmt.Fprintf(bw, "%s\t%s\n", pred.Filename, textTagNames(pred))
 	}
+	return bw.Flush()
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-	defer cancel()
-	predictions, err := s.workers.predict(ctx, paths, threshold, limit)
-	if err != nil {
-		slog.Error("predict failed", "error", err)
-		switch {
-		case errors.Is(err, context.Canceled):
-			s.writeError(w, format, statusClientClosedRequest, "ClientClosedRequest", "request canceled by client")
-		case errors.Is(err, context.DeadlineExceeded):
-			s.writeError(w, format, http.StatusGatewayTimeout, "GatewayTimeout", "inference timed out")
-		case strings.Contains(strings.ToLower(err.Error()), "worker is not running"):
-			s.writeError(w, format, http.StatusServiceUnavailable, "ServiceUnavailable", "inference worker is not running")
-		default:
-			s.writeError(w, format, http.StatusInternalServerError, "InferenceError", err.Error())
+// writeCSVResults writes filename,tag,score rows sorted by filename and then
+// by descending score. Failed images have no rows.
+func writeCSVResults(w io.Writer, results []prediction, header bool) error {
+	sorted := slices.Clone(results)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].Filename < sorted[b].Filename
+	})
+
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write([]string{"filename", "tag", "score"}); err != nil {
+			return err
 		}
-		return
 	}
-
-	for i := range predictions {
-		if i < len(origNames) {
-			predictions[i].Filename = origNames[i]
+	for _, pred := range sorted {
+		for _, tag := range sortedTagPairs(pred.Tags, nil, nil) {
+			if err := cw.Write([]string{pred.Filename, tag.Name, strconv.FormatFloat(tag.Score, 'f', -1, 64)}); err != nil {
+				return err
+			}
 		}
 	}
-	s.evaluateOK.Store(true)
+	cw.Flush()
+	return cw.Error()
+}
 
-	switch format {
-	case "json":
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(predictions); err != nil {
-			slog.Error("encode json failed", "error", err)
-		}
-	case "html":
-		results, err := buildHTMLResults(paths, predictions)
-		if err != nil {
-			s.writeError(w, format, http.StatusInternalServerError, "InternalError", "failed to render HTML")
-			return
+// sortedTagPairs orders tags by descending score for display.
+func sortedTagPairs(scores map[string]float64, categories, translations map[string]string) []tagPair {
+	tags := make([]tagPair, 0, len(scores))
+	for name, score := range scores {
+		category := categories[name]
+		if category == "" {
+			category = defaultTagCategory
 		}
-		if err := s.evalTmpl.Execute(w, results); err != nil {
-			slog.Error("render evaluate failed", "error", err)
+		display := translations[name]
+		if display == "" {
+			display = name
 		}
-	default:
-		s.writeError(w, format, http.StatusBadRequest, "BadRequest", "format must be html or json")
+		tags = append(tags, tagPair{Name: name, Display: display, Score: score, Category: category})
 	}
+	sort.Slice(tags, func(a, b int) bool {
+		if tags[a].Score != tags[b].Score {
+			return tags[a].Score > tags[b].Score
+		}
+		return tags[a].Name < tags[b].Name
+	})
+	return tags
 }
 
-func buildHTMLResults(paths []string, predictions []prediction) ([]htmlResult, error) {
+// buildHTMLResults prepares the HTML view of each prediction. Only image
+// headers are read here; see htmlResult.ImageData. Images larger than
+// previewMaxDim are previewed as JPEG thumbnails; 0 previews every image as
+// stored. Tagging always uses the full image.
+func buildHTMLResults(paths []string, predictions []prediction, previewMaxDim int) ([]htmlResult, error) {
 	results := make([]htmlResult, 0, len(predictions))
 	for i, pred := range predictions {
 		if i >= len(paths) {
 			break
 		}
-		data, err := os.ReadFile(paths[i])
+		if pred.Error != "" {
+			results = append(results, htmlResult{Filename: pred.Filename, Error: pred.Error})
+			continue
+		}
+		head, err := readFileHead(paths[i], 512)
 		if err != nil {
 			return nil, err
 		}
-		tags := make([]tagPair, 0, len(pred.Tags))
-		tagNames := make([]string, 0, len(pred.Tags))
-		for name, score := range pred.Tags {
-			tags = append(tags, tagPair{Name: name, Score: score})
-			tagNames = append(tagNames, name)
+		result := htmlResult{
+			Filename:   pred.Filename,
+			MimeType:   previewMimeType(head),
+			DurationMS: pred.DurationMS,
+			Tags:       sortedTagPairs(pred.Tags, pred.Categories, pred.Translations),
+			Rating:     sortedTagPairs(pred.Rating, pred.Categories, pred.Translations),
+			TagText:    tagText(pred.Tags),
+			path:       paths[i],
 		}
-		sort.Slice(tags, func(a, b int) bool {
-			return tags[a].Score > tags[b].Score
-		})
-		sort.Strings(tagNames)
-
-		results = append(results, htmlResult{
-			ImageData: base64.StdEncoding.EncodeToString(data),
-			Tags:      tags,
-			TagText:   strings.Join(tagNames, " "),
-		})
+		if w, h, ok := previewSize(paths[i], previewMaxDim); ok {
+			result.MimeType = "image/jpeg"
+			result.thumbWidth, result.thumbHeight = w, h
+		}
+		results = append(results, result)
 	}
 	return results, nil
 }
 
-func (s *server) writeError(w http.ResponseWriter, format string, status int, errName, message string) {
-	if status >= 500 {
-		s.evaluateOK.Store(false)
+// readFileHead returns up to n bytes from the start of the file at path.
+func readFileHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	if format == "json" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(status)
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"error":   errName,
-			"message": message,
-		})
-	} else {
-		w.WriteHeader(status)
-		_ = s.errorTmpl.Execute(w, map[string]string{"Error": errName, "Message": message})
+	defer f.Close()
+	head := make([]byte, n)
+	read, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:read], nil
+}
+
+// previewMimeType sniffs the type of an image for its data: URL. Types
+// http.DetectContentType does not know, such as AVIF, are recognized from
+// their ftyp brand.
+func previewMimeType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		switch string(data[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		}
 	}
+	return http.DetectContentType(data)
+}
 
+// fatalExitDelay is how long the process lives on after a fatal inference
+// error, so that the response reporting it still reaches the client.
+const fatalExitDelay = time.Second
+
+// inferenceFailed records a genuine worker or inference failure. With
+// EXIT_ON_FATAL enabled it fails /healthz and exits shortly after so the
+// orchestrator restarts the process; otherwise the error is only logged and
+// the server keeps serving. A full disk is logged as such and never counts:
+// a restart cannot fix it.
+func (s *server) inferenceFailed(err error) {
+	if isNoSpace(err) {
+		logDiskFull(err)
+		return
+	}
+	if !s.exitOnFatal {
+		return
+	}
+	slog.Error("fatal inference error; exiting", "error", err, "delay", fatalExitDelay.String())
+	s.evaluateOK.Store(false)
+	s.fatalOnce.Do(func() {
+		time.AfterFunc(fatalExitDelay, func() { s.exit(1) })
+	})
 }
 
 const statusClientClosedRequest = 499
@@ -676,6 +2538,14 @@ func parseFloatOrDefault(raw string, def float64) (float64, error) {
 	return strconv.ParseFloat(raw, 64)
 }
 
+func parseBoolOrDefault(raw string, def bool) (bool, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
 func parseIntOrDefault(raw string, def int) (int, error) {
 	raw = strings.TrimSpace(raw)
 	if raw == "" {
@@ -684,6 +2554,43 @@ func parseIntOrDefault(raw string, def int) (int, error) {
 	return strconv.Atoi(raw)
 }
 
+// defaultUploadFields are the multipart field names read for uploads unless
+// UPLOAD_FIELDS says otherwise.
+var defaultUploadFields = []string{"file"}
+
+// uploadedFiles gathers the uploads from every configured field, in field
+// order. A field listed twice is read once.
+func (s *server) uploadedFiles(form *multipart.Form) []*multipart.FileHeader {
+	var files []*multipart.FileHeader
+	seen := make(map[string]bool, len(s.uploadFields))
+	for _, name := range s.uploadFields {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		files = append(files, form.File[name]...)
+	}
+	return files
+}
+
+func nonEmptyValues(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func isJSONRequest(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(mediaType, "application/json")
+}
+
 func isMultipartFormRequest(contentType string) bool {
 	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
@@ -703,11 +2610,40 @@ func validateUploadedFile(fh *multipart.FileHeader, maxFileBytes int64) error {
 		return fmt.Errorf("file %q is empty", fh.Filename)
 	}
 	if maxFileBytes > 0 && fh.Size > maxFileBytes {
-		return fmt.Errorf("file %q exceeds the per-file size limit", fh.Filename)
+		return fmt.Errorf("file %q %w", fh.Filename, errFileTooLarge)
 	}
 	return nil
 }
 
+var errFileTooLarge = errors.New("exceeds the per-file size limit")
+
+// emptyFile fails one input that arrived with no bytes, typically a client
+// bug such as posting a file before it was written. The worker would only
+// fail on it with an opaque error.
+func emptyFile(name string) error {
+	err := badRequest(fmt.Sprintf("file %q is empty (0 bytes)", name))
+	err.code = codeEmptyFile
+	err.details = map[string]string{"filename": name, "bytes": "0"}
+	return err
+}
+
+// fileTooLarge rejects the request because of one oversized file, naming it
+// and the limit so the client knows which upload to shrink.
+func fileTooLarge(name string, maxFileBytes int64) error {
+	mb := strconv.FormatFloat(float64(maxFileBytes)/(1024*1024), 'f', -1, 64)
+	reqErr := badRequest(fmt.Sprintf("file %q exceeds the per-file size limit of %s MB", name, mb))
+	reqErr.code = codeFileTooLarge
+	reqErr.details = map[string]string{"filename": name}
+	return reqErr
+}
+
+// isFileTooLarge reports whether err rejects a file for its size, which
+// fails the whole request rather than just that file.
+func isFileTooLarge(err error) bool {
+	var reqErr *requestError
+	return errors.As(err, &reqErr) && reqErr.code == codeFileTooLarge
+}
+
 func getenvInt(key string, def int) int {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -732,8 +2668,53 @@ func getenvInt64(key string, def int64) int64 {
 	return n
 }
 
+func getenvFloat(key string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func getenvBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// tempFilename prefixes the sanitized name with the input index so that
+// duplicate client filenames never collide in the temp dir. The worker echoes
+// this name back, which is what predictions are matched on.
+func tempFilename(name string, index int) string {
+	return fmt.Sprintf("%d-%s", index, sanitizeFilename(name, index))
+}
+
 func sanitizeFilename(name string, index int) string {
-	base := filepath.Base(strings.TrimSpace(name))
+	// Archive entries may use either separator regardless of the host OS.
+	name = strings.ReplaceAll(strings.TrimSpace(name), `\`, "/")
+	base := filepath.Base(name)
 	if base == "" || base == "." || base == string(filepath.Separator) {
 		return fmt.Sprintf("upload-%d", index)
 	}
@@ -757,7 +2738,25 @@ func main() {
 	default:
 		level = slog.LevelInfo
 	}
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+	logFormat := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT")))
+	logPath := strings.TrimSpace(os.Getenv("LOG_FILE"))
+	var logOut io.Writer = os.Stdout
+	if logPath != "" {
+		lf, err := openLogFile(logPath)
+		if err != nil {
+			slog.Error("open LOG_FILE failed", "path", logPath, "error", err)
+			os.Exit(1)
+		}
+		defer lf.Close()
+		go lf.reopenOnSIGHUP()
+		logOut = lf
+	}
+	logHandler, err := newLogHandler(logFormat, logOut, level)
+	if err != nil {
+		slog.Error("invalid LOG_FORMAT", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(logHandler))
 
 	addr := strings.TrimSpace(os.Getenv("HTTP_ADDR"))
 	if addr == "" {
@@ -773,65 +2772,536 @@ func main() {
 	if scriptPath == "" {
 		scriptPath = "./inference_worker.py"
 	}
+	modelScripts, err := parseModels(os.Getenv("MODELS"))
+	if err != nil {
+		slog.Error("invalid MODELS", "error", err)
+		os.Exit(1)
+	}
+	defaultModel := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_MODEL")))
+	if defaultModel == "" {
+		defaultModel = defaultModelName
+	}
+	if !validModelName(defaultModel) {
+		slog.Error("invalid DEFAULT_MODEL", "name", defaultModel)
+		os.Exit(1)
+	}
+	if _, ok := modelScripts[defaultModel]; ok {
+		slog.Error("MODELS names the default model; DEFAULT_MODEL already answers to it", "name", defaultModel)
+		os.Exit(1)
+	}
 
 	maxInflight := getenvInt("MAX_INFLIGHT", 2)
+	decodeConcurrency := getenvInt("DECODE_CONCURRENCY", runtime.GOMAXPROCS(0))
 	maxUploadMB := getenvInt64("MAX_UPLOAD_MB", 32)
 	maxFileMB := getenvInt64("MAX_FILE_MB", 16)
-	maxFiles := getenvInt("MAX_FILES", 8)
+	maxFiles := getenvInt("MAX_FILES_PER_REQUEST", getenvInt("MAX_FILES", 64))
 	maxLimit := getenvInt("MAX_LIMIT", 200)
-	workerProcesses := getenvInt("WORKER_PROCESSES", getenvInt("GPU_PARALLELISM", 2))
+	threshold, err := parseFloatOrDefault(os.Getenv("DEFAULT_THRESHOLD"), defaultThreshold)
+	if err != nil {
+		slog.Error("invalid DEFAULT_THRESHOLD", "error", err)
+		os.Exit(1)
+	}
+	if threshold < 0 || threshold > 1 {
+		slog.Error("invalid DEFAULT_THRESHOLD", "error", "must be between 0 and 1", "value", threshold)
+		os.Exit(1)
+	}
+	limit, err := parseIntOrDefault(os.Getenv("DEFAULT_LIMIT"), defaultLimit)
+	if err != nil {
+		slog.Error("invalid DEFAULT_LIMIT", "error", err)
+		os.Exit(1)
+	}
+	if limit < 1 || (maxLimit > 0 && limit > maxLimit) {
+		slog.Error("invalid DEFAULT_LIMIT", "error", "must be between 1 and MAX_LIMIT", "value", limit, "max_limit", maxLimit)
+		os.Exit(1)
+	}
+	maxArchiveEntries := getenvInt("MAX_ARCHIVE_ENTRIES", defaultMaxArchiveEntries)
+	maxArchiveMB := getenvInt64("MAX_ARCHIVE_MB", defaultMaxArchiveMB)
+	fetchTimeout := getenvDuration("FETCH_TIMEOUT", defaultFetchTimeout)
+	fetchConcurrency := getenvInt("FETCH_CONCURRENCY", defaultFetchConcurrency)
+	metricsEnabled := getenvBool("METRICS_ENABLED", false)
+	pprofEnabled := getenvBool("PPROF_ENABLED", false)
+	exitOnFatal := getenvBool("EXIT_ON_FATAL", false)
+	cacheSize := getenvInt("CACHE_SIZE", 0)
+	maxImageDim := getenvInt("MAX_IMAGE_DIM", 0)
+	maxPixels := getenvInt64("MAX_PIXELS", defaultMaxPixels)
+	previewMaxDim := max(0, getenvInt("PREVIEW_MAX_DIM", defaultPreviewMaxDim))
+	autoOrient := getenvBool("AUTO_ORIENT", false)
+	validateDecode := getenvBool("VALIDATE_DECODE", false)
+	heicConverter := strings.TrimSpace(os.Getenv("HEIC_CONVERTER"))
+	ffmpegPath := strings.TrimSpace(os.Getenv("FFMPEG_PATH"))
+	animationFrame, err := parseAnimationFrame(os.Getenv("ANIMATION_FRAME"))
+	if err != nil {
+		slog.Error("invalid ANIMATION_FRAME", "error", err)
+		os.Exit(1)
+	}
+	if ffmpegPath != "" {
+		if _, err := exec.LookPath(ffmpegPath); err != nil {
+			slog.Warn("FFMPEG_PATH not found; video uploads will fail", "path", ffmpegPath, "error", err)
+		}
+	}
+	wikiBaseURL, err := parseBaseURL(os.Getenv("WIKI_BASE_URL"), defaultWikiBaseURL)
+	if err != nil {
+		slog.Error("invalid WIKI_BASE_URL", "error", err)
+		os.Exit(1)
+	}
+	searchBaseURL, err := parseBaseURL(os.Getenv("SEARCH_BASE_URL"), defaultSearchBaseURL)
+	if err != nil {
+		slog.Error("invalid SEARCH_BASE_URL", "error", err)
+		os.Exit(1)
+	}
+	scoreBands, err := parseScoreBands(os.Getenv("SCORE_BANDS"))
+	if err != nil {
+		slog.Error("invalid SCORE_BANDS", "error", err)
+		os.Exit(1)
+	}
+	localRoot, err := parseLocalRoot(os.Getenv("LOCAL_PATHS_ROOT"))
+	if err != nil {
+		slog.Error("invalid LOCAL_PATHS_ROOT", "error", err)
+		os.Exit(1)
+	}
+	tempDir := strings.TrimSpace(os.Getenv("TEMP_DIR"))
+	tempDirTTL := getenvDuration("TEMP_DIR_TTL", defaultTempDirTTL)
+	maxJobs := getenvInt("MAX_JOBS", defaultMaxJobs)
+	jobTTL := getenvDuration("JOB_TTL", defaultJobTTL)
+	jobTimeout := getenvDuration("JOB_TIMEOUT", defaultJobTimeout)
+	callbackSecret := os.Getenv("CALLBACK_SECRET")
+	callbackAttempts := getenvInt("CALLBACK_MAX_ATTEMPTS", defaultCallbackAttempts)
+	callbackAllowPrivate := getenvBool("CALLBACK_ALLOW_PRIVATE", false)
+	compression := getenvBool("COMPRESSION_ENABLED", false)
+	if err := prepareTempDir(tempDir); err != nil {
+		slog.Error("create TEMP_DIR failed", "dir", tempDir, "error", err)
+		os.Exit(1)
+	}
+	resultsLog := strings.TrimSpace(os.Getenv("RESULTS_LOG"))
+	resultsBucket := strings.TrimSpace(os.Getenv("RESULTS_S3_BUCKET"))
+	resultsQueueSize := getenvInt("RESULTS_QUEUE_SIZE", defaultResultsQueueSize)
+	var resultsSink resultSink
+	resultsSinkName := ""
+	resultsFlush := defaultResultsFlushInterval
+	switch {
+	case resultsLog != "" && resultsBucket != "":
+		slog.Error("set only one of RESULTS_LOG and RESULTS_S3_BUCKET")
+		os.Exit(1)
+	case resultsLog != "":
+		sink, err := newFileSink(resultsLog)
+		if err != nil {
+			slog.Error("open RESULTS_LOG failed", "path", resultsLog, "error", err)
+			os.Exit(1)
+		}
+		resultsSink, resultsSinkName = sink, "file"
+	case resultsBucket != "":
+		region := strings.TrimSpace(os.Getenv("RESULTS_S3_REGION"))
+		if region == "" {
+			region = strings.TrimSpace(os.Getenv("AWS_REGION"))
+		}
+		sink, err := newS3Sink(resultsBucket, os.Getenv("RESULTS_S3_PREFIX"), region, strings.TrimSpace(os.Getenv("RESULTS_S3_ENDPOINT")), awsCredentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		})
+		if err != nil {
+			slog.Error("configure RESULTS_S3_BUCKET failed", "error", err)
+			os.Exit(1)
+		}
+		resultsSink, resultsSinkName = sink, "s3"
+		resultsFlush = defaultS3FlushInterval
+	}
+	resultsFlush = getenvDuration("RESULTS_FLUSH_INTERVAL", resultsFlush)
+	rateLimitRPS := getenvFloat("RATE_LIMIT_RPS", 0)
+	rateLimitBurst := getenvInt("RATE_LIMIT_BURST", 0)
+	trustProxy := getenvBool("TRUST_PROXY", false)
+	predictTimeout := getenvDuration("PREDICT_TIMEOUT", defaultPredictTimeout)
+	acquireTimeout := getenvDuration("ACQUIRE_TIMEOUT", 0)
+	queueWaitWarn := getenvDuration("QUEUE_WAIT_WARN", defaultQueueWaitWarn)
+	idempotencyEntries := getenvInt("IDEMPOTENCY_CACHE_SIZE", defaultIdempotencyEntries)
+	idempotencyTTL := getenvDuration("IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	shareableResults := getenvBool("SHAREABLE_RESULTS", false)
+	sharedResultsSize := getenvInt("SHARED_RESULTS_SIZE", defaultSharedResults)
+	sharedResultTTL := getenvDuration("SHARED_RESULT_TTL", defaultSharedResultTTL)
+	maxPredictTimeout := getenvDuration("MAX_PREDICT_TIMEOUT", predictTimeout)
+	imageTypes := parseImageTypes(os.Getenv("ALLOWED_IMAGE_TYPES"))
+	if len(imageTypes) == 0 {
+		defaults := defaultImageTypes
+		if ffmpegPath != "" {
+			defaults = append(slices.Clip(defaults), defaultVideoTypes...)
+		}
+		imageTypes = parseImageTypes(strings.Join(defaults, ","))
+	}
+	tagWhitelist, err := loadTagPatterns(os.Getenv("TAG_WHITELIST"))
+	if err != nil {
+		slog.Error("load TAG_WHITELIST failed", "error", err)
+		os.Exit(1)
+	}
+	tagBlacklist, err := loadTagPatterns(os.Getenv("TAG_BLACKLIST"))
+	if err != nil {
+		slog.Error("load TAG_BLACKLIST failed", "error", err)
+		os.Exit(1)
+	}
+	translations, err := loadTagTranslations(os.Getenv("TAG_TRANSLATIONS"))
+	if err != nil {
+		slog.Error("load TAG_TRANSLATIONS failed", "error", err)
+		os.Exit(1)
+	}
+	implications, err := loadTagImplications(os.Getenv("TAG_IMPLICATIONS"))
+	if err != nil {
+		slog.Error("load TAG_IMPLICATIONS failed", "error", err)
+		os.Exit(1)
+	}
+	workerProcesses := getenvInt("WORKER_COUNT", getenvInt("WORKER_PROCESSES", getenvInt("GPU_PARALLELISM", 2)))
+	workerMaxRestarts := getenvInt("WORKER_MAX_RESTARTS", 5)
+	workerRestartBackoff := getenvDuration("WORKER_RESTART_BACKOFF", time.Second)
+	maxConnections := max(0, getenvInt("MAX_CONNECTIONS", 0))
+	logSampleRate := getenvInt("LOG_SAMPLE_RATE", 1)
+	logSlowMS := max(0, getenvInt("LOG_SLOW_MS", 0))
+	workerStartupTimeout := getenvDuration("WORKER_STARTUP_TIMEOUT", defaultWorkerStartupTimeout)
+	workerPingInterval := getenvDuration("WORKER_PING_INTERVAL", defaultWorkerPingInterval)
+	workerPingTimeout := getenvDuration("WORKER_PING_TIMEOUT", pingTimeoutFor(maxPredictTimeout))
+	workerBatchSize := getenvInt("WORKER_BATCH_SIZE", defaultWorkerBatchSize)
+	batchingEnabled := getenvBool("BATCHING_ENABLED", false)
+	batchWait := getenvDuration("BATCH_WAIT", defaultBatchWait)
+	batchMax := getenvInt("BATCH_MAX", defaultBatchMax)
+	predictRetries := getenvInt("PREDICT_RETRIES", defaultPredictRetries)
+	predictRetryBackoff := getenvDuration("PREDICT_RETRY_BACKOFF", defaultPredictRetryBackoff)
+	retryableErrors := defaultRetryableErrors
+	if patterns := splitTagPatterns(os.Getenv("PREDICT_RETRY_ERRORS")); len(patterns) > 0 {
+		retryableErrors = patterns
+	}
+	predictorEnv := "PREDICTOR"
+	if strings.TrimSpace(os.Getenv(predictorEnv)) == "" {
+		predictorEnv = "WORKER_MODE"
+	}
+	workerMode, err := parseWorkerMode(os.Getenv(predictorEnv))
+	if err != nil {
+		slog.Error("invalid "+predictorEnv, "error", err)
+		os.Exit(1)
+	}
+	predictorURL := strings.TrimSpace(os.Getenv("PREDICTOR_URL"))
+	if workerMode == workerModeHTTP && predictorURL == "" {
+		slog.Error("PREDICTOR=http needs PREDICTOR_URL")
+		os.Exit(1)
+	}
+	workerProtocol, err := parseWorkerProtocol(os.Getenv("WORKER_PROTOCOL"))
+	if err != nil {
+		slog.Error("invalid WORKER_PROTOCOL", "error", err)
+		os.Exit(1)
+	}
+	shutdownTimeout := getenvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	workers, err := newWorkerPool(ctx, pythonBin, scriptPath, workerProcesses)
-	if err != nil {
-		slog.Error("start worker pool failed", "error", err)
-		os.Exit(1)
+	// Workers get their own context so that a signal does not kill them
+	// before in-flight requests have drained.
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	startPool := func(script string) (*workerPool, error) {
+		pool, err := newWorkerPool(workerCtx, pythonBin, script, workerProtocol, workerProcesses, workerMaxRestarts, workerRestartBackoff)
+		if err != nil {
+			return nil, err
+		}
+		if err := pool.waitReady(ctx, workerStartupTimeout); err != nil {
+			pool.close()
+			return nil, err
+		}
+		pool.batchSize = workerBatchSize
+		if batchingEnabled {
+			pool.batcher = newMicroBatcher(batchWait, batchMax, func(ctx context.Context, files []string, params predictParams) ([]prediction, error) {
+				return pool.predictChunks(ctx, files, params, nil)
+			})
+		}
+		pool.retry = retryPolicy{attempts: max(predictRetries, 0), backoff: predictRetryBackoff, match: retryableErrors}
+		return pool, nil
+	}
+	var workers *workerPool
+	if workerMode == workerModeProcess {
+		workers, err = startPool(scriptPath)
+		if err != nil {
+			slog.Error("start worker pool failed", "error", err)
+			os.Exit(1)
+		}
+		defer workers.close()
+	}
+	modelPools := make(map[string]*workerPool, len(modelScripts))
+	for name, script := range modelScripts {
+		pool, err := startPool(script)
+		if err != nil {
+			slog.Error("start worker pool failed", "model", name, "error", err)
+			os.Exit(1)
+		}
+		defer pool.close()
+		modelPools[name] = pool
+	}
+
+	app := newServer(workers, maxInflight, maxUploadMB, maxFileMB, maxFiles, maxLimit)
+	app.defaultModel = defaultModel
+	for name, pool := range modelPools {
+		app.addModel(name, pool)
+	}
+	switch workerMode {
+	case workerModeEcho:
+		slog.Warn("PREDICTOR=echo: no model is loaded and every tag is fake")
+		app.predictor = echoPredictor{}
+	case workerModeHTTP:
+		retry := retryPolicy{attempts: max(predictRetries, 0), backoff: predictRetryBackoff, match: retryableErrors}
+		remote, err := newHTTPPredictor(predictorURL, maxInflight, retry)
+		if err != nil {
+			slog.Error("invalid PREDICTOR_URL", "error", err)
+			os.Exit(1)
+		}
+		app.predictor = remote
+	}
+	app.fetcher = newURLFetcher(fetchTimeout, app.maxUploadBytes, fetchConcurrency)
+	app.imageTypes = imageTypes
+	app.exitOnFatal = exitOnFatal
+	app.defaultThreshold = threshold
+	app.defaultLimit = min(limit, app.maxLimit)
+	app.cache = newPredictionCache(cacheSize)
+	app.maxImageDim = maxImageDim
+	app.maxPixels = maxPixels
+	app.previewMaxDim = previewMaxDim
+	app.validateDecode = validateDecode
+	app.logSampler = newLogSampler(logSampleRate, time.Duration(logSlowMS)*time.Millisecond)
+	app.autoOrient = autoOrient
+	app.decodeSem = make(chan struct{}, max(decodeConcurrency, 1))
+	app.heicConverter = heicConverter
+	app.ffmpegPath = ffmpegPath
+	app.animationFrame = animationFrame
+	app.wikiBaseURL = wikiBaseURL
+	app.searchBaseURL = searchBaseURL
+	app.scoreBands = scoreBands
+	app.localRoot = localRoot
+	app.tempDir = tempDir
+	app.jobs = newJobStore(maxJobs, jobTTL)
+	if jobTimeout > 0 {
+		app.jobTimeout = jobTimeout
+	}
+	app.callbacks = newCallbackSender(callbackSecret, callbackAttempts, callbackAllowPrivate)
+	app.compression = compression
+	app.pprof = pprofEnabled
+	if resultsSink != nil {
+		app.results = newResultLog(resultsSink, resultsQueueSize, resultsFlush)
+	}
+	app.apiKeys = parseAPIKeys(os.Getenv("API_KEYS"))
+	if pprofEnabled && len(app.apiKeys) == 0 {
+		slog.Warn("PPROF_ENABLED without API_KEYS exposes /debug/pprof/ to anyone who can reach the server")
+	}
+	app.limiter = newRateLimiter(rateLimitRPS, rateLimitBurst)
+	app.trustProxy = trustProxy
+	app.cors = parseCORSOrigins(os.Getenv("CORS_ALLOW_ORIGINS"))
+	app.tagFilter = newTagFilter(tagWhitelist, tagBlacklist)
+	app.translations = translations
+	app.implications = implications
+	if ratingTags := splitTagPatterns(os.Getenv("RATING_TAGS")); len(ratingTags) > 0 {
+		app.ratingTags = ratingTags
+	}
+	if uploadFields := splitTagPatterns(os.Getenv("UPLOAD_FIELDS")); len(uploadFields) > 0 {
+		app.uploadFields = uploadFields
+	}
+	go app.limiter.evictLoop(ctx, time.Minute)
+	go tempJanitor(ctx, tempDir, tempDirTTL)
+	go app.watchWorkers(ctx, workerPingInterval, workerPingTimeout)
+	if maxArchiveEntries > 0 {
+		app.maxArchiveEntries = maxArchiveEntries
+	}
+	if maxArchiveMB > 0 {
+		app.maxArchiveBytes = maxArchiveMB * 1024 * 1024
+	}
+	app.setPredictTimeout(predictTimeout, maxPredictTimeout)
+	app.acquireTimeout = acquireTimeout
+	app.queueWaitWarn = queueWaitWarn
+	app.idempotency = newIdempotencyStore(idempotencyEntries, idempotencyTTL)
+	if shareableResults {
+		app.shared = newSharedResults(sharedResultsSize, sharedResultTTL)
+	}
+	if metricsEnabled {
+		app.metrics = newMetrics(app)
 	}
-	defer workers.close()
 
 	srv := &http.Server{
 		Addr:              addr,
-		Handler:           newServer(workers, maxInflight, maxUploadMB, maxFileMB, maxFiles, maxLimit).routes(),
+		Handler:           app.routes(),
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       60 * time.Second,
-		WriteTimeout:      6 * time.Minute,
+		WriteTimeout:      app.maxPredictTimeout + time.Minute,
 		IdleTimeout:       60 * time.Second,
 	}
+	tlsCertFile := strings.TrimSpace(os.Getenv("TLS_CERT_FILE"))
+	tlsKeyFile := strings.TrimSpace(os.Getenv("TLS_KEY_FILE"))
+	tlsReloadInterval := getenvDuration("TLS_RELOAD_INTERVAL", defaultTLSReloadInterval)
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		slog.Error("set both TLS_CERT_FILE and TLS_KEY_FILE, or neither")
+		os.Exit(1)
+	}
+	if tlsCertFile != "" {
+		certs, err := newCertReloader(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			slog.Error("load TLS certificate failed", "cert_file", tlsCertFile, "key_file", tlsKeyFile, "error", err)
+			os.Exit(1)
+		}
+		if tlsReloadInterval > 0 {
+			go certs.watch(ctx, tlsReloadInterval)
+		}
+		srv.TLSConfig = newTLSConfig(certs)
+	}
 
+	// Shutdown stops accepting connections and waits for handlers, then
+	// waits for inflight slots and only then stops the workers, all within
+	// SHUTDOWN_TIMEOUT. Workers still running after that are killed.
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		slog.Info("shutting down", "timeout", shutdownTimeout.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			slog.Error("server shutdown failed", "error", err)
 		}
+		if err := app.drain(shutdownCtx); err != nil {
+			slog.Warn("inflight requests did not drain before shutdown timeout", "error", err)
+		}
+		app.predictor.close()
+		if err := workers.wait(shutdownCtx); err != nil {
+			slog.Warn("workers did not exit before shutdown timeout", "error", err)
+		}
+		for name, pool := range modelPools {
+			pool.close()
+			if err := pool.wait(shutdownCtx); err != nil {
+				slog.Warn("workers did not exit before shutdown timeout", "model", name, "error", err)
+			}
+		}
+		if app.results != nil {
+			if err := app.results.close(shutdownCtx); err != nil {
+				slog.Warn("results log did not flush before shutdown timeout", "error", err)
+			}
+		}
+		stopWorkers()
 	}()
 
 	slog.Info(
 		"server listening",
 		"addr", addr,
 		"max_inflight", maxInflight,
+		"acquire_timeout", acquireTimeout.String(),
+		"queue_wait_warn", queueWaitWarn.String(),
+		"models", app.modelNames(),
+		"decode_concurrency", cap(app.decodeSem),
 		"max_upload_mb", maxUploadMB,
 		"max_file_mb", maxFileMB,
 		"max_files", maxFiles,
 		"max_limit", maxLimit,
+		"default_threshold", app.defaultThreshold,
+		"default_limit", app.defaultLimit,
+		"max_archive_entries", app.maxArchiveEntries,
+		"max_archive_mb", app.maxArchiveBytes/(1024*1024),
+		"fetch_timeout", fetchTimeout.String(),
+		"fetch_concurrency", app.fetcher.concurrency,
+		"allowed_image_types", imageTypeList(imageTypes),
+		"metrics_enabled", metricsEnabled,
+		"pprof_enabled", pprofEnabled,
+		"exit_on_fatal", exitOnFatal,
+		"cache_size", cacheSize,
+		"idempotency_cache_size", idempotencyEntries,
+		"idempotency_ttl", idempotencyTTL.String(),
+		"shareable_results", shareableResults,
+		"shared_results_size", sharedResultsSize,
+		"shared_result_ttl", sharedResultTTL.String(),
+		"max_image_dim", maxImageDim,
+		"max_pixels", maxPixels,
+		"preview_max_dim", previewMaxDim,
+		"validate_decode", validateDecode,
+		"auto_orient", autoOrient,
+		"heic_converter", heicConverter,
+		"ffmpeg_path", ffmpegPath,
+		"animation_frame", animationFrame,
+		"wiki_base_url", wikiBaseURL,
+		"search_base_url", searchBaseURL,
+		"score_bands", fmt.Sprintf("%g,%g", scoreBands.High, scoreBands.Medium),
+		"temp_dir", tempDir,
+		"local_paths_root", localRoot,
+		"temp_dir_ttl", tempDirTTL.String(),
+		"max_jobs", app.jobs.maxActive,
+		"job_ttl", app.jobs.ttl.String(),
+		"job_timeout", app.jobTimeout.String(),
+		"callback_signed", callbackSecret != "",
+		"callback_max_attempts", app.callbacks.attempts,
+		"callback_allow_private", callbackAllowPrivate,
+		"compression_enabled", compression,
+		"results_sink", resultsSinkName,
+		"auth_enabled", len(app.apiKeys) > 0,
+		"rate_limit_rps", rateLimitRPS,
+		"rate_limit_burst", rateLimitBurst,
+		"trust_proxy", trustProxy,
+		"cors_enabled", app.cors != nil,
+		"tag_whitelist_patterns", len(tagWhitelist),
+		"tag_blacklist_patterns", len(tagBlacklist),
+		"tag_translation_langs", len(translations),
+		"tag_implications", len(implications),
+		"rating_tags", app.ratingTags,
+		"upload_fields", app.uploadFields,
+		"predict_timeout", app.predictTimeout.String(),
+		"max_predict_timeout", app.maxPredictTimeout.String(),
 		"worker_processes", workerProcesses,
+		"worker_protocol", workerProtocol,
+		"worker_max_restarts", workerMaxRestarts,
+		"worker_restart_backoff", workerRestartBackoff.String(),
+		"worker_startup_timeout", workerStartupTimeout.String(),
+		"worker_ping_interval", workerPingInterval.String(),
+		"worker_ping_timeout", workerPingTimeout.String(),
+		"log_format", cmp.Or(logFormat, "json"),
+		"log_file", logPath,
+		"log_sample_rate", logSampleRate,
+		"log_slow_ms", logSlowMS,
+		"predictor", workerMode,
+		"worker_batch_size", workerBatchSize,
+		"batching_enabled", batchingEnabled,
+		"batch_wait", batchWait.String(),
+		"batch_max", batchMax,
+		"predict_retries", max(predictRetries, 0),
+		"predict_retry_backoff", predictRetryBackoff.String(),
+		"predict_retry_errors", retryableErrors,
+		"shutdown_timeout", shutdownTimeout.String(),
+		"tls_enabled", srv.TLSConfig != nil,
+		"max_connections", maxConnections,
 	)
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("listen failed", "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	if maxConnections > 0 {
+		app.conns = newLimitListener(ln, maxConnections)
+		ln = app.conns
+	}
+	serve := func() error { return srv.Serve(ln) }
+	if srv.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate.
+		serve = func() error { return srv.ServeTLS(ln, "", "") }
+	}
+	if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("server failed", "error", err)
 		os.Exit(1)
 	}
+	<-shutdownDone
 }
 
 const indexHTML = `<!DOCTYPE html>
 <html>
+  <head>
+    <link rel="icon" href="/favicon.ico">
+  </head>
   <body>
     <form action="/evaluate" method="post" enctype="multipart/form-data">
       <input type="file" name="file" multiple>
-      <input type="hidden" name="threshold" min="0" max="1" step="0.1" value="0.01">
-      <input type="hidden" name="limit" value="100">
+      <label>
+        Threshold
+        <input type="range" name="threshold" min="0" max="1" step="0.01" value="{{ .Threshold }}" oninput="this.nextElementSibling.value = this.value">
+        <output>{{ .Threshold }}</output>
+      </label>
+      <label>
+        Limit
+        <input type="number" name="limit" min="1" max="{{ .MaxLimit }}" value="{{ .Limit }}">
+      </label>
       <input type="submit" value="Submit">
     </form>
   </body>
@@ -840,36 +3310,57 @@ const indexHTML = `<!DOCTYPE html>
 const evaluateHTML = `<!DOCTYPE html>
 <html>
   <head>
-    <script src="https://cdn.tailwindcss.com"></script>
+    <link rel="icon" href="/favicon.ico">
+    <link rel="stylesheet" href="/static/app.css">
   </head>
 
   <body class="text-sm m-4 break-all lg:max-w-[960px] lg:mx-auto" style="font-family: system-ui;">
     <h1 class="text-3xl">Results</h1>
-    <a class="text-xs text-sky-600 hover:text-sky-500 mr-4" href="/">&lt; Back</a>
+    <a class="text-xs text-sky-600 hover:text-sky-500 mr-4" href="/?threshold={{ .Threshold }}&limit={{ .Limit }}">&lt; Back</a>
 
     <div class="mt-4">
-      {{ range . }}
+      {{ range .Results }}
+        {{ if .Error }}
+        <div class="p-2 border rounded border-red-300 text-red-600">
+          <p class="font-bold">{{ .Filename }}</p>
+          <p>{{ .Error }}</p>
+        </div>
+        {{ else }}
         <div class="flex flex-col p-2 gap-2 border rounded md:flex-row md:max-h-[80vh]">
           <div class="flex-1 flex items-center justify-center">
-            <img class="max-w-full max-h-full h-auto" src="data:image/jpg;base64,{{ .ImageData }}">
+            <img class="max-w-full max-h-full h-auto" src="data:{{ .MimeType }};base64,{{ .ImageData }}">
           </div>
 
-          <div class="flex-0 overflow-scroll md:pr-2">
+          <div class="overflow-scroll md:pr-2">
+            {{ if .Rating }}
+            <table class="w-full leading-4 mb-2 pb-2 border-b">
+              {{ range .Rating }}
+              <tr>
+                <td class="font-bold mr-4">{{ .Display }}</td>
+                <td class="{{ scoreClass $.ScoreBands .Score }} text-right">{{ printf "%.0f%%" (mul100 .Score) }}</td>
+              </tr>
+              {{ end }}
+            </table>
+            {{ end }}
             <table class="w-full leading-4">
               {{ range .Tags }}
               <tr>
                 <td>
-                  <a class="text-sky-600 hover:text-sky-500" href="https://danbooru.donmai.us/wiki_pages/{{ .Name }}">?</a>
-                  <a class="text-sky-600 hover:text-sky-500 mr-4" href="https://danbooru.donmai.us/posts?tags={{ .Name }}">{{ .Name }}</a>
+                  <a class="text-sky-600 hover:text-sky-500" href="{{ wikiURL $.WikiBaseURL .Name }}">?</a>
+                  <a class="{{ categoryClass .Category }} mr-4" href="{{ searchURL $.SearchBaseURL .Name }}">{{ .Display }}</a>
                 </td>
-                <td class="text-gray-400 text-right">{{ printf "%.0f%%" (mul100 .Score) }}</td>
+                <td class="{{ scoreClass $.ScoreBands .Score }} text-right">{{ printf "%.0f%%" (mul100 .Score) }}</td>
               </tr>
               {{ end }}
             </table>
 
             <textarea class="w-full text-gray-500 mt-2" rows="4">{{ .TagText }}</textarea>
+            {{ if .DurationMS }}
+            <p class="text-xs text-gray-400">tagged in {{ printf "%.0f" .DurationMS }} ms</p>
+            {{ end }}
           </div>
         </div>
+        {{ end }}
       {{ end }}
     </div>
   </body>
@@ -879,6 +3370,7 @@ const errorHTML = `<!DOCTYPE html>
 <html>
   <head>
     <title>{{ .Error }}</title>
+    <link rel="icon" href="/favicon.ico">
   </head>
   <body>
       <h1>{{ .Error }}</h1>
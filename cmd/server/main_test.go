@@ -1,13 +1,64 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
+func TestHandleIndexForm(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/", []string{`name="threshold" min="0" max="1" step="0.01" value="0.1"`, `name="limit" min="1" max="200" value="50"`}},
+		{"/?threshold=0.35&limit=20", []string{`value="0.35"`, `value="20"`}},
+		{"/?threshold=2&limit=500", []string{`value="0.1"`, `value="50"`}},
+		{"/evaluate?threshold=abc&limit=7", []string{`value="0.1"`, `value="7"`}},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if strings.HasPrefix(tc.target, "/evaluate") {
+			s.handleEvaluate(rr, r)
+		} else {
+			s.handleIndex(rr, r)
+		}
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d", tc.target, rr.Code)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Fatalf("GET %s has no %s:\n%s", tc.target, want, rr.Body)
+			}
+		}
+	}
+}
+
 func TestIsMultipartFormRequest(t *testing.T) {
 	t.Parallel()
 
@@ -73,8 +124,8 @@ func TestNewServerAppliesMinimums(t *testing.T) {
 	t.Parallel()
 
 	s := newServer(nil, 0, 0, 0, 0, 0)
-	if cap(s.inflightSem) != 1 {
-		t.Fatalf("inflight cap = %d, want 1", cap(s.inflightSem))
+	if _, limit := s.inflight.stats(); limit != 1 {
+		t.Fatalf("inflight limit = %d, want 1", limit)
 	}
 	if s.maxUploadBytes != 32*1024*1024 {
 		t.Fatalf("maxUploadBytes = %d, want %d", s.maxUploadBytes, 32*1024*1024)
@@ -98,7 +149,7 @@ func TestHandleEvaluateRejectsWrongContentType(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewRequest() error = %v", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", "text/plain")
 
 	rr := httptest.NewRecorder()
 	s.handleEvaluate(rr, req)
@@ -107,3 +158,1036 @@ func TestHandleEvaluateRejectsWrongContentType(t *testing.T) {
 		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
 	}
 }
+
+func TestHandleEvaluateRejectsOversizedFile(t *testing.T) {
+	t.Parallel()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, size := range map[string]int{"small.png": 16, "big.png": 2 << 20} {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("CreateFormFile() error = %v", err)
+		}
+		if _, err := part.Write(bytes.Repeat([]byte{1}, size)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := mw.WriteField("format", "json"); err != nil {
+		t.Fatalf("WriteField() error = %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	newServer(nil, 1, 32, 1, 8, 200).handleEvaluate(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	var got errorBody
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body.Bytes(), err)
+	}
+	if got.Code != codeFileTooLarge || got.Details["filename"] != "big.png" || !strings.Contains(got.Message, "1 MB") {
+		t.Fatalf("error = %v, want big.png named with the 1 MB limit", got)
+	}
+}
+
+func TestHandleEvaluateRejectsTooManyPixels(t *testing.T) {
+	t.Parallel()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "bomb.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile() error = %v", err)
+	}
+	if _, err := part.Write(pngHeader(50000, 50000)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := mw.WriteField("format", "json"); err != nil {
+		t.Fatalf("WriteField() error = %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	newServer(nil, 1, 32, 16, 8, 200).handleEvaluate(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	var got errorBody
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body.Bytes(), err)
+	}
+	if got.Code != codeFileTooLarge || got.Details["filename"] != "bomb.png" || got.Details["width"] != "50000" {
+		t.Fatalf("error = %v, want bomb.png named with its width", got)
+	}
+}
+
+func TestParseEvaluateEmptyFile(t *testing.T) {
+	t.Parallel()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"empty.png", nil}, {"a.png", img.Bytes()}} {
+		part, err := mw.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatalf("CreateFormFile() error = %v", err)
+		}
+		_, _ = part.Write(f.data)
+	}
+	_ = mw.Close()
+	multipartReq := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+	multipartReq.Header.Set("Content-Type", mw.FormDataContentType())
+
+	jsonReq := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(
+		`{"images":[{"name":"empty.png","data":""},{"name":"a.png","data":"`+base64.StdEncoding.EncodeToString(img.Bytes())+`"}]}`))
+	jsonReq.Header.Set("Content-Type", "application/json")
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	for name, r := range map[string]*http.Request{"multipart": multipartReq, "json": jsonReq} {
+		req, _, err := s.parseEvaluate(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("%s: parseEvaluate() error = %v, want the empty file to fail on its own", name, err)
+		}
+		os.RemoveAll(req.dir)
+		if len(req.inputs) != 2 || req.inputs[1].err != nil {
+			t.Fatalf("%s: inputs = %+v, want empty.png failed and a.png stored", name, req.inputs)
+		}
+		var reqErr *requestError
+		if !errors.As(req.inputs[0].err, &reqErr) || reqErr.code != codeEmptyFile || reqErr.details["filename"] != "empty.png" || reqErr.details["bytes"] != "0" {
+			t.Fatalf("%s: empty.png error = %v, want EmptyFile naming it", name, req.inputs[0].err)
+		}
+	}
+}
+
+func TestParseEvaluateDefaults(t *testing.T) {
+	t.Parallel()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.defaultThreshold, s.defaultLimit = 0.35, 12
+
+	multipartBody := func(fields map[string]string) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "a.png")
+		_, _ = part.Write(img.Bytes())
+		for k, v := range fields {
+			_ = mw.WriteField(k, v)
+		}
+		_ = mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req
+	}
+	jsonBody := func(extra string) *http.Request {
+		body := `{"images":[{"name":"a.png","data":"` + base64.StdEncoding.EncodeToString(img.Bytes()) + `"}]` + extra + `}`
+		req := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	tests := []struct {
+		name          string
+		req           *http.Request
+		wantThreshold float64
+		wantLimit     int
+	}{
+		{"multipart defaults", multipartBody(nil), 0.35, 12},
+		{"multipart override", multipartBody(map[string]string{"threshold": "0.5", "limit": "3"}), 0.5, 3},
+		{"json defaults", jsonBody(""), 0.35, 12},
+		{"json override", jsonBody(`,"threshold":0.5,"limit":3`), 0.5, 3},
+	}
+	for _, tc := range tests {
+		req, _, err := s.parseEvaluate(httptest.NewRecorder(), tc.req)
+		if err != nil {
+			t.Fatalf("%s: parseEvaluate() error = %v", tc.name, err)
+		}
+		os.RemoveAll(req.dir)
+		if req.threshold != tc.wantThreshold || req.limit != tc.wantLimit {
+			t.Fatalf("%s: threshold, limit = %v, %d; want %v, %d", tc.name, req.threshold, req.limit, tc.wantThreshold, tc.wantLimit)
+		}
+	}
+}
+
+func TestHandleEvaluateJSONRejectsInvalidImages(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "malformed", body: `{"images":`},
+		{name: "no images", body: `{"images":[]}`},
+		{name: "bad base64", body: `{"images":[{"name":"a.jpg","data":"!!!"}]}`},
+		{name: "empty image", body: `{"images":[{"name":"a.jpg","data":""}]}`},
+		{name: "bad threshold", body: `{"images":[{"name":"a.jpg","data":"AAAA"}],"threshold":2}`},
+	}
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			s.handleEvaluate(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Content-Type = %q, want application/json", ct)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolLeastLoaded(t *testing.T) {
+	t.Parallel()
+
+	busy := &workerClient{}
+	busy.inflight.Store(3)
+	idle := &workerClient{}
+	idle.inflight.Store(1)
+	dead := &workerClient{}
+	dead.closed.Store(true)
+
+	pool := &workerPool{workers: []*workerClient{busy, dead, idle}}
+	if idx, w := pool.leastLoaded(nil); idx != 2 || w != idle {
+		t.Fatalf("leastLoaded() = %d, want 2", idx)
+	}
+	if idx, w := pool.leastLoaded(map[int]bool{2: true}); idx != 0 || w != busy {
+		t.Fatalf("leastLoaded(skip 2) = %d, want 0", idx)
+	}
+	if idx, w := pool.leastLoaded(map[int]bool{0: true, 2: true}); idx != -1 || w != nil {
+		t.Fatalf("leastLoaded(skip all live) = %d, want -1", idx)
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 4, want: 8 * time.Second},
+		{attempt: 10, want: maxWorkerRestartBackoff},
+	}
+	for _, tc := range tests {
+		if got := restartBackoff(time.Second, tc.attempt); got != tc.want {
+			t.Fatalf("restartBackoff(1s, %d) = %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestAlignPredictions(t *testing.T) {
+	t.Parallel()
+
+	files := []string{"/tmp/x/0-a.jpg", "/tmp/x/1-a.jpg", "/tmp/x/2-b.png"}
+	preds := []prediction{
+		{Filename: "2-b.png", Tags: map[string]float64{"cat": 0.9}},
+		{Filename: "0-a.jpg", Tags: map[string]float64{"dog": 0.8}},
+		{Filename: "9-stray.jpg", Tags: map[string]float64{"bird": 0.7}},
+	}
+
+	aligned, unexpected := alignPredictions(files, preds)
+	if len(aligned) != len(files) {
+		t.Fatalf("len(aligned) = %d, want %d", len(aligned), len(files))
+	}
+	if aligned[0].Filename != "0-a.jpg" || aligned[0].Tags["dog"] != 0.8 {
+		t.Fatalf("aligned[0] = %+v, want 0-a.jpg with dog", aligned[0])
+	}
+	if aligned[1].Error == "" {
+		t.Fatalf("aligned[1].Error is empty, want missing prediction error")
+	}
+	if aligned[2].Filename != "2-b.png" || aligned[2].Tags["cat"] != 0.9 {
+		t.Fatalf("aligned[2] = %+v, want 2-b.png with cat", aligned[2])
+	}
+	if len(unexpected) != 1 || unexpected[0] != "9-stray.jpg" {
+		t.Fatalf("unexpected = %v, want [9-stray.jpg]", unexpected)
+	}
+}
+
+// newFakeWorker connects a workerClient to an in-process stand-in for the
+// Python worker: handler gets each line the client writes, in order, and
+// answers by writing response lines to w.
+func newFakeWorker(t *testing.T, handler func(line []byte, w io.Writer)) *workerClient {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	t.Cleanup(func() { reqW.Close(); respW.Close() })
+	wc := &workerClient{stdin: reqW, pending: make(map[uint64]chan workerResponse)}
+	go wc.readStdout(respR)
+	go func() {
+		reader := bufio.NewReader(reqR)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			handler(line, respW)
+		}
+	}()
+	return wc
+}
+
+func TestWorkerClientPredictStream(t *testing.T) {
+	t.Parallel()
+
+	wc := newFakeWorker(t, func(line []byte, w io.Writer) {
+		var req workerRequest
+		if err := json.Unmarshal(line, &req); err != nil || !req.Stream {
+			fmt.Fprintf(w, `{"id":%d,"error":"expected a stream request"}`+"\n", req.ID)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%d,"prediction":{"filename":"1-b.png","tags":{"cat":0.9},"duration_ms":12.5}}`+"\n", req.ID)
+		fmt.Fprintf(w, `{"id":%d,"prediction":{"filename":"0-a.png","tags":{"dog":0.8}}}`+"\n", req.ID)
+		fmt.Fprintf(w, `{"id":%d,"done":true}`+"\n", req.ID)
+	})
+
+	var order []string
+	preds, err := wc.predictStream(context.Background(), []string{"/t/0-a.png", "/t/1-b.png", "/t/2-c.png"}, predictParams{threshold: 0.1, limit: 50}, func(pred prediction) {
+		order = append(order, pred.Filename)
+	})
+	if err != nil {
+		t.Fatalf("predictStream() error = %v", err)
+	}
+	if strings.Join(order, ",") != "1-b.png,0-a.png" {
+		t.Fatalf("callback order = %v, want completion order", order)
+	}
+	if len(preds) != 3 || preds[0].Tags["dog"] != 0.8 || preds[1].Tags["cat"] != 0.9 || preds[1].DurationMS != 12.5 || preds[2].Error == "" {
+		t.Fatalf("predictStream() = %+v, want aligned results with a missing third file", preds)
+	}
+}
+
+func TestWorkerClientFailsSkippedResponses(t *testing.T) {
+	t.Parallel()
+
+	var ids []uint64
+	wc := newFakeWorker(t, func(line []byte, w io.Writer) {
+		var req workerRequest
+		_ = json.Unmarshal(line, &req)
+		if ids = append(ids, req.ID); len(ids) < 2 {
+			return
+		}
+		// The first answer is garbled by a stray print; the second is fine.
+		fmt.Fprintf(w, `loading weights... {"id":%d,"predictions":[]}`+"\n", ids[0])
+		fmt.Fprintf(w, `{"id":%d,"predictions":[{"filename":"b.png","tags":{"cat":0.9}}]}`+"\n", ids[1])
+	})
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := wc.predictStream(context.Background(), []string{"/t/a.png"}, predictParams{}, nil)
+		first <- err
+	}()
+	// Let the first request reach the worker before the second.
+	for {
+		wc.pendingMu.Lock()
+		n := len(wc.pending)
+		wc.pendingMu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	preds, err := wc.predictStream(context.Background(), []string{"/t/b.png"}, predictParams{}, nil)
+	if err != nil || len(preds) != 1 || preds[0].Tags["cat"] != 0.9 {
+		t.Fatalf("second predictStream() = %+v, %v; want b.png tagged", preds, err)
+	}
+	select {
+	case err := <-first:
+		if err == nil || err.Error() != errWorkerDesync.Error() {
+			t.Fatalf("first predictStream() error = %v, want %v", err, errWorkerDesync)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first request still waiting after a later one was answered")
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	t.Parallel()
+
+	live := &workerPool{workers: []*workerClient{{}}, restarting: make([]atomic.Bool, 1)}
+	dead := &workerPool{workers: []*workerClient{{}}, restarting: make([]atomic.Bool, 1)}
+	dead.workers[0].closed.Store(true)
+	loading := &workerPool{workers: []*workerClient{{ready: make(chan struct{})}}, restarting: make([]atomic.Bool, 1)}
+
+	full := newServer(live, 1, 32, 16, 8, 200)
+	full.inflight.tryAcquire()
+
+	tests := []struct {
+		name       string
+		server     *server
+		wantStatus int
+	}{
+		{name: "ready", server: newServer(live, 1, 32, 16, 8, 200), wantStatus: http.StatusOK},
+		{name: "worker down", server: newServer(dead, 1, 32, 16, 8, 200), wantStatus: http.StatusServiceUnavailable},
+		{name: "worker loading", server: newServer(loading, 1, 32, 16, 8, 200), wantStatus: http.StatusServiceUnavailable},
+		{name: "at capacity", server: full, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		tc.server.handleReady(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		if !tc.server.evaluateOK.Load() {
+			t.Fatalf("%s: readyz changed evaluateOK", tc.name)
+		}
+	}
+}
+
+func TestWorkerPoolWaitReady(t *testing.T) {
+	t.Parallel()
+
+	loading := &workerClient{ready: make(chan struct{})}
+	pool := &workerPool{workers: []*workerClient{{}, loading}}
+	if err := pool.waitReady(context.Background(), 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waitReady() while loading error = %v, want deadline exceeded", err)
+	}
+
+	close(loading.ready)
+	if err := pool.waitReady(context.Background(), time.Second); err != nil {
+		t.Fatalf("waitReady() after handshake error = %v", err)
+	}
+
+	loading.closed.Store(true)
+	if err := pool.waitReady(context.Background(), time.Second); err == nil {
+		t.Fatal("waitReady() with an exited worker error = nil, want an error")
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	t.Parallel()
+
+	pool := &workerPool{script: "./inference_worker.py", workers: []*workerClient{{started: time.Now()}, {}}}
+	pool.workers[0].info.Store(&workerInfo{Model: "models/model.pth", Arch: "resnet152", NumClasses: 5000})
+	pool.workers[1].closed.Store(true)
+
+	rr := httptest.NewRecorder()
+	newServer(pool, 1, 32, 16, 8, 200).handleVersion(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var got struct {
+		Build   buildVersion    `json:"build"`
+		Script  string          `json:"script"`
+		Workers []workerVersion `json:"workers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got.Build.GoVersion == "" || got.Script != "./inference_worker.py" || len(got.Workers) != 2 {
+		t.Fatalf("version = %+v", got)
+	}
+	if w := got.Workers[0]; !w.Alive || w.Info == nil || w.Info.Model != "models/model.pth" {
+		t.Fatalf("workers[0] = %+v, want alive with model info", w)
+	}
+	if w := got.Workers[1]; w.Alive || w.Info != nil || w.UptimeSeconds != 0 {
+		t.Fatalf("workers[1] = %+v, want stopped without info", w)
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.setPredictTimeout(time.Minute, 2*time.Minute)
+
+	tests := []struct {
+		raw     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{raw: "", want: time.Minute},
+		{raw: "30s", want: 30 * time.Second},
+		{raw: "1.5", want: 1500 * time.Millisecond},
+		{raw: "1h", want: 2 * time.Minute},
+		{raw: "0", wantErr: true},
+		{raw: "-5s", wantErr: true},
+		{raw: "soon", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := s.resolveTimeout(tc.raw)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("resolveTimeout(%q) error = %v, wantErr %v", tc.raw, err, tc.wantErr)
+		}
+		if !tc.wantErr && got != tc.want {
+			t.Fatalf("resolveTimeout(%q) = %v, want %v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestNewEvaluateResponse(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	req := &evalRequest{}
+	results := []prediction{
+		s.resultFor(req, evalInput{name: "a.png", path: "/tmp/0-a.png"}, prediction{Tags: map[string]float64{"1girl": 0.9}}, true),
+		s.resultFor(req, evalInput{name: "b.png", path: "/tmp/1-b.png"}, prediction{Tags: map[string]float64{}, Error: "OSError: truncated"}, true),
+		s.resultFor(req, evalInput{name: "c.txt", err: badRequest("file \"c.txt\" has unsupported type")}, prediction{}, false),
+	}
+
+	resp := newEvaluateResponse(results)
+	if len(resp.Results) != 1 || resp.Results[0].Filename != "a.png" {
+		t.Fatalf("Results = %+v, want only a.png", resp.Results)
+	}
+	want := []fileError{
+		{Filename: "b.png", Message: "OSError: truncated"},
+		{Filename: "c.txt", Message: `file "c.txt" has unsupported type`},
+	}
+	if !reflect.DeepEqual(resp.Errors, want) {
+		t.Fatalf("Errors = %+v, want %+v", resp.Errors, want)
+	}
+
+	data, err := json.Marshal(newEvaluateResponse(nil))
+	if err != nil || string(data) != `{"results":[],"errors":[]}` {
+		t.Fatalf("empty response = %s, %v", data, err)
+	}
+}
+
+func TestLogTagStats(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	req := &evalRequest{mode: modeThreshold, threshold: 0, limit: 50}
+	results := []prediction{
+		{Filename: "a.png", Tags: map[string]float64{"1girl": 0.9, "solo": 0.8}, Rating: map[string]float64{"rating:g": 0.7}},
+		{Filename: "b.png", Tags: map[string]float64{"cat": 0.6}},
+		{Filename: "c.png", Error: "OSError: truncated"},
+	}
+	logTagStats(log, req, results, 1500*time.Millisecond)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", buf.Bytes(), err)
+	}
+	want := map[string]any{
+		"msg": "tag_stats", "files": 3.0, "failed": 1.0, "tags": 4.0,
+		"mode": modeThreshold, "threshold": 0.0, "limit": 50.0, "inference_ms": 1500.0,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("%s = %v, want %v (record %s)", key, got[key], value, buf.Bytes())
+		}
+	}
+}
+
+func TestBuildHTMLResultsMimeType(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	path := filepath.Join(dir, "0-a.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	results, err := buildHTMLResults([]string{path}, []prediction{{Filename: "a.png", Tags: map[string]float64{"1girl": 0.9}}}, defaultPreviewMaxDim)
+	if err != nil {
+		t.Fatalf("buildHTMLResults() error = %v", err)
+	}
+	if results[0].MimeType != "image/png" {
+		t.Fatalf("MimeType = %q, want image/png", results[0].MimeType)
+	}
+
+	var out strings.Builder
+	if err := newServer(nil, 1, 32, 16, 8, 200).evalTmpl.Execute(&out, evaluatePage{Results: results, WikiBaseURL: defaultWikiBaseURL, SearchBaseURL: defaultSearchBaseURL}); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !strings.Contains(out.String(), `src="data:image/png;base64,`+base64.StdEncoding.EncodeToString(buf.Bytes())+`"`) {
+		t.Fatalf("rendered HTML has no image/png data URL:\n%s", out.String())
+	}
+
+	avif := append([]byte{0, 0, 0, 0x1c}, []byte("ftypavif")...)
+	if got := previewMimeType(avif); got != "image/avif" {
+		t.Fatalf("previewMimeType(avif) = %q, want image/avif", got)
+	}
+}
+
+func TestEvaluateHTMLBaseURLs(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, []byte("png"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	results := []htmlResult{{Filename: "a.png", DurationMS: 41.6, Tags: []tagPair{
+		{Name: "1girl", Score: 0.9},
+		{Name: "re:zero", Score: 0.8},
+		{Name: "d&d", Score: 0.7},
+		{Name: "blue sky/clouds", Score: 0.6},
+		{Name: "初音ミク", Score: 0.5},
+	}, path: path}}
+	page := evaluatePage{
+		Results:       results,
+		WikiBaseURL:   "https://booru.internal/wiki/",
+		SearchBaseURL: "https://booru.internal/posts?tags=",
+		Threshold:     0.35,
+		Limit:         20,
+	}
+	var out strings.Builder
+	if err := newServer(nil, 1, 32, 16, 8, 200).evalTmpl.Execute(&out, page); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	for _, want := range []string{
+		`href="https://booru.internal/wiki/1girl"`,
+		`href="https://booru.internal/posts?tags=1girl"`,
+		`href="https://booru.internal/wiki/re:zero"`,
+		`href="https://booru.internal/posts?tags=re%3Azero"`,
+		`href="https://booru.internal/wiki/d&amp;d"`,
+		`href="https://booru.internal/posts?tags=d%26d"`,
+		`href="https://booru.internal/wiki/blue%20sky%2Fclouds"`,
+		`href="https://booru.internal/posts?tags=blue&#43;sky%2Fclouds"`,
+		`href="https://booru.internal/wiki/%E5%88%9D%E9%9F%B3%E3%83%9F%E3%82%AF"`,
+		`href="https://booru.internal/posts?tags=%E5%88%9D%E9%9F%B3%E3%83%9F%E3%82%AF"`,
+		`tagged in 42 ms`,
+		`href="/?threshold=0.35&limit=20"`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("rendered HTML has no %s:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "danbooru.donmai.us") {
+		t.Fatal("rendered HTML still links to danbooru.donmai.us")
+	}
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"", defaultWikiBaseURL, false},
+		{" https://booru.internal/wiki/ ", "https://booru.internal/wiki/", false},
+		{"booru.internal/wiki/", "", true},
+		{"javascript:alert(1)//", "", true},
+		{"https://", "", true},
+	}
+	for _, tc := range tests {
+		got, err := parseBaseURL(tc.raw, defaultWikiBaseURL)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseBaseURL(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestUniqueInputs(t *testing.T) {
+	t.Parallel()
+
+	inputs := []evalInput{
+		{name: "a.jpg", path: "/tmp/x/0-a.jpg", hash: "h1"},
+		{name: "b.jpg", path: "/tmp/x/1-b.jpg", hash: "h2"},
+		{name: "a-copy.jpg", path: "/tmp/x/2-a-copy.jpg", hash: "h1"},
+		{name: "http://example.com/c.jpg", err: errWorkerNotRunning},
+	}
+
+	unique, tempNameByHash := uniqueInputs(inputs)
+	if len(unique) != 2 || unique[0].path != "/tmp/x/0-a.jpg" || unique[1].path != "/tmp/x/1-b.jpg" {
+		t.Fatalf("unique = %v, want the first copy of each hash", unique)
+	}
+	if got := tempNameByHash[inputs[2].dedupKey()]; got != "0-a.jpg" {
+		t.Fatalf("duplicate maps to %q, want 0-a.jpg", got)
+	}
+}
+
+func TestUploadedFiles(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.uploadFields = []string{"images[]", "file", "images[]"}
+	form := &multipart.Form{File: map[string][]*multipart.FileHeader{
+		"file":     {{Filename: "a.jpg"}},
+		"images[]": {{Filename: "b.jpg"}, {Filename: "c.jpg"}},
+		"other":    {{Filename: "d.jpg"}},
+	}}
+
+	var names []string
+	for _, fh := range s.uploadedFiles(form) {
+		names = append(names, fh.Filename)
+	}
+	if want := []string{"b.jpg", "c.jpg", "a.jpg"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("uploadedFiles() = %v, want %v", names, want)
+	}
+}
+
+func TestWriteTextResults(t *testing.T) {
+	t.Parallel()
+
+	results := []prediction{
+		{Filename: "a.jpg", Tags: map[string]float64{"solo": 0.5, "1girl": 0.9}},
+		{Filename: "b.png", Tags: map[string]float64{}, Error: "broken"},
+	}
+	var buf strings.Builder
+	if err := writeTextResults(&buf, results, true); err != nil {
+		t.Fatalf("writeTextResults() error = %v", err)
+	}
+	if want := "a.jpg\t1girl solo\nb.png\t\n"; buf.String() != want {
+		t.Fatalf("writeTextResults() = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeTextResults(&buf, results[:1], true); err != nil {
+		t.Fatalf("writeTextResults(bare) error = %v", err)
+	}
+	if want := "1girl solo\n"; buf.String() != want {
+		t.Fatalf("writeTextResults(bare) = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriteCSVResults(t *testing.T) {
+	t.Parallel()
+
+	results := []prediction{
+		{Filename: "b.png", Tags: map[string]float64{`say "hi"`: 0.4, "solo": 0.5}},
+		{Filename: "a.jpg", Tags: map[string]float64{"1girl": 0.9, "a,b": 0.9}},
+		{Filename: "c.gif", Tags: map[string]float64{}, Error: "broken"},
+	}
+	var buf strings.Builder
+	if err := writeCSVResults(&buf, results, true); err != nil {
+		t.Fatalf("writeCSVResults() error = %v", err)
+	}
+	want := "filename,tag,score\n" +
+		"a.jpg,1girl,0.9\n" +
+		"a.jpg,\"a,b\",0.9\n" +
+		"b.png,solo,0.5\n" +
+		"b.png,\"say \"\"hi\"\"\",0.4\n"
+	if buf.String() != want {
+		t.Fatalf("writeCSVResults() = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeCSVResults(&buf, results[:1], false); err != nil {
+		t.Fatalf("writeCSVResults(noheader) error = %v", err)
+	}
+	if strings.HasPrefix(buf.String(), "filename,") {
+		t.Fatalf("writeCSVResults(noheader) wrote a header: %q", buf.String())
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: modeThreshold},
+		{raw: "threshold", want: modeThreshold},
+		{raw: " TopK ", want: modeTopK},
+		{raw: "all", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseMode(tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseMode(%q) = %q, %v; want %q, wantErr %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	threshold := &evalRequest{threshold: 0.1, limit: 10, mode: modeThreshold}
+	topk := &evalRequest{threshold: 0.1, limit: 10, mode: modeTopK}
+	if threshold.cacheKey("h") == topk.cacheKey("h") {
+		t.Fatal("cacheKey() is the same for threshold and topk modes")
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	tests := []struct {
+		threshold float64
+		limit     int
+		wantParam string
+	}{
+		{0.1, 50, ""},
+		{0, 200, ""},
+		{1, 1, ""},
+		{-0.1, 50, "threshold"},
+		{1.5, 50, "threshold"},
+		{math.NaN(), 50, "threshold"},
+		{math.Inf(1), 50, "threshold"},
+		{0.1, 0, "limit"},
+		{0.1, 201, "limit"},
+		{0.1, 100000, "limit"},
+	}
+	for _, tc := range tests {
+		err := s.validateParams(tc.threshold, tc.limit)
+		if tc.wantParam == "" {
+			if err != nil {
+				t.Fatalf("validateParams(%v, %d) error = %v", tc.threshold, tc.limit, err)
+			}
+			continue
+		}
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.status != http.StatusBadRequest || reqErr.details["parameter"] != tc.wantParam {
+			t.Fatalf("validateParams(%v, %d) error = %v, want a 400 naming %s", tc.threshold, tc.limit, err, tc.wantParam)
+		}
+	}
+}
+
+func TestFillCategories(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		pred prediction
+		want map[string]string
+	}{
+		{
+			name: "worker sent none",
+			pred: prediction{Tags: map[string]float64{"1girl": 0.9, "solo": 0.8}},
+			want: map[string]string{"1girl": "general", "solo": "general"},
+		},
+		{
+			name: "worker sent some",
+			pred: prediction{Tags: map[string]float64{"1girl": 0.9, "hatsune_miku": 0.8}, Categories: map[string]string{"hatsune_miku": "character"}},
+			want: map[string]string{"1girl": "general", "hatsune_miku": "character"},
+		},
+		{
+			name: "no tags",
+			pred: prediction{Tags: map[string]float64{}},
+			want: map[string]string{},
+		},
+	}
+	for _, tc := range tests {
+		fillCategories(&tc.pred)
+		if !reflect.DeepEqual(tc.pred.Categories, tc.want) {
+			t.Fatalf("%s: categories = %v, want %v", tc.name, tc.pred.Categories, tc.want)
+		}
+	}
+}
+
+func TestResultForCategories(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	pred := prediction{
+		Tags:       map[string]float64{"1girl": 0.9, "smile": 0.4, "hatsune_miku": 0.4, "vocaloid": 0.2},
+		Categories: map[string]string{"hatsune_miku": "character", "vocaloid": "copyright"},
+	}
+	req := &evalRequest{threshold: 0.5, limit: 10, mode: modeThreshold, histogramBuckets: 2, categoryThresholds: map[string]float64{"character": 0.3}}
+	got := s.resultFor(req, evalInput{name: "a.png"}, pred, true)
+
+	want := map[string]string{"1girl": "general", "hatsune_miku": "character"}
+	if !reflect.DeepEqual(got.Categories, want) {
+		t.Fatalf("categories = %v, want %v", got.Categories, want)
+	}
+	if len(got.Tags) != len(want) {
+		t.Fatalf("tags = %v, want only %v", got.Tags, want)
+	}
+	if len(pred.Categories) != 2 {
+		t.Fatalf("resultFor() modified the worker's categories: %v", pred.Categories)
+	}
+}
+
+func TestParseCategoryThresholds(t *testing.T) {
+	t.Parallel()
+
+	got, err := parseCategoryThresholds(map[string][]string{
+		"threshold":           {"0.1"},
+		"threshold_Character": {"0.5"},
+		"threshold_general":   {" 0.35 "},
+	})
+	if err != nil {
+		t.Fatalf("parseCategoryThresholds() error = %v", err)
+	}
+	if len(got) != 2 || got["character"] != 0.5 || got["general"] != 0.35 {
+		t.Fatalf("parseCategoryThresholds() = %v", got)
+	}
+	if _, err := parseCategoryThresholds(map[string][]string{"threshold_meta": {"high"}}); err == nil {
+		t.Fatal("parseCategoryThresholds(non-float) error = nil")
+	}
+	if err := validateCategoryThresholds(map[string]float64{"artist": 1.5}); err == nil {
+		t.Fatal("validateCategoryThresholds(1.5) error = nil")
+	}
+	if err := validateCategoryThresholds(map[string]float64{"artist": math.NaN()}); err == nil {
+		t.Fatal("validateCategoryThresholds(NaN) error = nil")
+	}
+
+	a := &evalRequest{threshold: 0.1, limit: 50, categoryThresholds: got}
+	b := &evalRequest{threshold: 0.1, limit: 50}
+	if a.cacheKey("h") == b.cacheKey("h") {
+		t.Fatal("cacheKey ignores category thresholds")
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 2, 32, 16, 8, 200)
+	s.inflight.tryAcquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.drain(ctx); err == nil {
+		t.Fatal("drain() returned while a request held a slot")
+	}
+
+	s = newServer(nil, 2, 32, 16, 8, 200)
+	s.inflight.tryAcquire()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.inflight.release()
+	}()
+	if err := s.drain(context.Background()); err != nil {
+		t.Fatalf("drain() error = %v", err)
+	}
+	if s.inflight.tryAcquire() {
+		t.Fatal("drain() still hands out slots")
+	}
+}
+
+func TestInferenceFailedExitOnFatal(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		exitOnFatal bool
+		err         error
+		wantExit    bool
+	}{
+		{name: "disabled", err: errors.New("worker crashed")},
+		{name: "enabled", exitOnFatal: true, err: errors.New("worker crashed"), wantExit: true},
+		{name: "disk full", exitOnFatal: true, err: &os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}},
+	}
+	exits := make([]chan int, len(tests))
+	for i, tc := range tests {
+		exits[i] = make(chan int, 2)
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.exitOnFatal = tc.exitOnFatal
+		s.exit = func(code int) { exits[i] <- code }
+		s.inferenceFailed(tc.err)
+		s.inferenceFailed(tc.err)
+		if s.evaluateOK.Load() == tc.wantExit {
+			t.Fatalf("%s: evaluateOK = %v, want %v", tc.name, s.evaluateOK.Load(), !tc.wantExit)
+		}
+	}
+	for i, tc := range tests {
+		if !tc.wantExit {
+			continue
+		}
+		select {
+		case code := <-exits[i]:
+			if code != 1 {
+				t.Fatalf("%s: exit code = %d, want 1", tc.name, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: server did not exit", tc.name)
+		}
+	}
+	// Any other exit was scheduled along with the one above, so by now it
+	// would have happened too; a repeated failure must not exit twice.
+	time.Sleep(50 * time.Millisecond)
+	for i, tc := range tests {
+		if len(exits[i]) != 0 {
+			t.Fatalf("%s: exited %d more times, want none", tc.name, len(exits[i]))
+		}
+	}
+}
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	var seen string
+	handler := s.loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "generated", incoming: "", keep: false},
+		{name: "honored", incoming: "abc-123", keep: true},
+		{name: "unsafe replaced", incoming: "bad id\nInjected: 1", keep: false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.incoming != "" {
+			req.Header.Set("X-Request-ID", tc.incoming)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		got := rr.Header().Get("X-Request-ID")
+		if got == "" || got != seen {
+			t.Fatalf("%s: header %q, context %q, want the same non-empty ID", tc.name, got, seen)
+		}
+		if (got == tc.incoming) != tc.keep {
+			t.Fatalf("%s: request ID = %q, incoming %q", tc.name, got, tc.incoming)
+		}
+	}
+}
+
+func TestWorkerClientCancelsAbandonedRequest(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan workerRequest, 1)
+	canceled := make(chan workerCancel, 1)
+	wc := newFakeWorker(t, func(line []byte, _ io.Writer) {
+		var msg workerCancel
+		if json.Unmarshal(line, &msg) == nil && msg.Cancel != 0 {
+			canceled <- msg
+			return
+		}
+		var req workerRequest
+		_ = json.Unmarshal(line, &req)
+		received <- req
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := wc.predict(ctx, []string{"/t/a.png"}, predictParams{threshold: 0.1, limit: 5})
+		errCh <- err
+	}()
+	req := <-received
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("predict() error = %v, want context.Canceled", err)
+	}
+	select {
+	case msg := <-canceled:
+		if msg.Cancel != req.ID {
+			t.Fatalf("cancel id = %d, want %d", msg.Cancel, req.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never got a cancel message")
+	}
+	wc.pendingMu.Lock()
+	defer wc.pendingMu.Unlock()
+	if len(wc.pending) != 0 {
+		t.Fatalf("pending = %v after cancel, want empty", wc.pending)
+	}
+}
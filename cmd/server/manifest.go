@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// maxManifestBytes bounds a /batch body, which carries URLs, not images.
+const maxManifestBytes = 1 << 20
+
+// batchItem is one entry of a /batch manifest. ID is chosen by the client
+// and comes back on the item's result or error.
+type batchItem struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// batchRequest is a /batch body: the items to fetch and tag, plus the same
+// tagging parameters a JSON /evaluate body takes.
+type batchRequest struct {
+	jsonEvaluateRequest
+	Items []batchItem `json:"items"`
+}
+
+// handleBatch tags the remote images listed in a JSON manifest. Results and
+// errors carry each item's id, so clients correlate them without relying on
+// filenames or order.
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.evaluate(w, r, s.parseBatch)
+}
+
+func (s *server) parseBatch(w http.ResponseWriter, r *http.Request) (*evalRequest, string, error) {
+	if !isJSONRequest(r.Header.Get("Content-Type")) {
+		return nil, "json", badRequest("content type must be application/json")
+	}
+	return s.storeInputs(w, r, "json", s.parseBatchManifest)
+}
+
+// parseBatchManifest fetches every item of the manifest into tmpDir. An
+// item that cannot be fetched or is not an image fails on its own; a
+// manifest with a missing or repeated id fails as a whole.
+func (s *server) parseBatchManifest(w http.ResponseWriter, r *http.Request, tmpDir string) (*evalRequest, error) {
+	// Batch results are keyed by id, which only the JSON formats carry.
+	format := negotiateFormat(r.Header.Get("Accept"), "json")
+	if format != "ndjson" {
+		format = "json"
+	}
+	req := &evalRequest{format: format, threshold: s.defaultThreshold, limit: s.defaultLimit}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxManifestBytes)
+	var body batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return req, badRequest("invalid JSON body or request too large")
+	}
+	if len(body.Images) > 0 || len(body.Paths) > 0 {
+		return req, badRequest("batch items are fetched from url; post images and paths to /evaluate")
+	}
+	if err := s.applyJSONParams(req, &body.jsonEvaluateRequest); err != nil {
+		return req, err
+	}
+	if len(body.Items) == 0 {
+		return req, paramError("items", "at least one item is required")
+	}
+	if len(body.Items) > s.maxFiles {
+		return req, paramError("items", fmt.Sprintf("too many items; maximum is %d", s.maxFiles))
+	}
+	seen := make(map[string]bool, len(body.Items))
+	for i, item := range body.Items {
+		if item.ID == "" {
+			return req, paramError("items", fmt.Sprintf("item %d has no id", i))
+		}
+		if seen[item.ID] {
+			return req, paramError("items", fmt.Sprintf("item id %q is repeated", item.ID))
+		}
+		seen[item.ID] = true
+	}
+
+	urls := make([]string, len(body.Items))
+	dstPaths := make([]string, len(body.Items))
+	for i, item := range body.Items {
+		urls[i] = strings.TrimSpace(item.URL)
+		dstPaths[i] = filepath.Join(tmpDir, tempFilename(urlFilename(urls[i]), i))
+	}
+	fetched := s.fetcher.fetchAll(r.Context(), urls, dstPaths, 0)
+	req.inputs = make([]evalInput, 0, len(body.Items))
+	for i, item := range body.Items {
+		rawURL, dstPath, hash, err := urls[i], dstPaths[i], fetched[i].hash, fetched[i].err
+		if err == nil {
+			err = s.checkImage(dstPath, rawURL)
+		}
+		if isNoSpace(err) {
+			return req, storeError(err)
+		}
+		if err != nil {
+			requestLogger(r.Context()).Warn("fetch url failed", "id", item.ID, "url", rawURL, "error", err)
+			req.inputs = append(req.inputs, evalInput{id: item.ID, name: rawURL, err: err})
+			continue
+		}
+		req.inputs = append(req.inputs, evalInput{id: item.ID, name: rawURL, path: dstPath, hash: hash})
+	}
+	return req, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseBatchRejectsInvalidManifests(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"malformed", `{"items":`},
+		{"no items", `{"items":[]}`},
+		{"missing id", `{"items":[{"url":"https://example.com/a.png"}]}`},
+		{"repeated id", `{"items":[{"id":"x","url":"https://example.com/a.png"},{"id":"x","url":"https://example.com/b.png"}]}`},
+		{"images", `{"items":[{"id":"x","url":"https://example.com/a.png"}],"images":[{"data":"AAAA"}]}`},
+		{"bad threshold", `{"items":[{"id":"x","url":"https://example.com/a.png"}],"threshold":2}`},
+	}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		s.handleBatch(rr, r)
+		if rr.Code != http.StatusBadRequest || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: status = %d, Content-Type = %q; want a JSON 400", tc.name, rr.Code, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	t.Parallel()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(img.Bytes())
+	}))
+	defer ts.Close()
+
+	var requests atomic.Int64
+	s := newServer(&workerPool{workers: []*workerClient{echoWorker(t, &requests)}}, 1, 32, 16, 8, 200)
+	s.fetcher = &urlFetcher{client: ts.Client(), maxBytes: 1 << 20}
+	body := `{"items":[
+		{"id":"first","url":"` + ts.URL + `/a.png"},
+		{"id":"second","url":"` + ts.URL + `/missing.png"},
+		{"id":"third","url":"` + ts.URL + `/b.png"}
+	]}`
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	s.handleBatch(rr, r)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, Content-Type = %q; want a JSON 200: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body)
+	}
+	var got evaluateResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body, err)
+	}
+	if len(got.Results) != 2 || got.Results[0].ID != "first" || got.Results[1].ID != "third" || len(got.Results[1].Tags) == 0 {
+		t.Fatalf("results = %+v, want first and third tagged", got.Results)
+	}
+	if len(got.Errors) != 1 || got.Errors[0].ID != "second" {
+		t.Fatalf("errors = %+v, want second", got.Errors)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("worker saw %d requests, want the two identical images sent once", requests.Load())
+	}
+}
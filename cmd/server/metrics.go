@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors for the server. A nil *metrics is
+// valid and records nothing, which is how METRICS_ENABLED=false is handled.
+type metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	inferenceSeconds prometheus.Histogram
+	queueWaitSeconds prometheus.Histogram
+	predictions      prometheus.Counter
+}
+
+func newMetrics(s *server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "autotagger_http_requests_total",
+			Help: "HTTP requests by path, method and status code.",
+		}, []string{"path", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "autotagger_http_request_duration_seconds",
+			Help:    "HTTP request latency by path.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"path"}),
+		inferenceSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "autotagger_inference_duration_seconds",
+			Help:    "Time spent waiting on the worker for one evaluate request.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}),
+		queueWaitSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "autotagger_queue_wait_seconds",
+			Help:    "Time a request or job waited for an inflight slot, including waits that timed out.",
+			Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}),
+		predictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "autotagger_predictions_total",
+			Help: "Images successfully tagged.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.inferenceSeconds,
+		m.queueWaitSeconds,
+		m.predictions,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_inflight_requests",
+			Help: "Evaluate requests currently holding an inflight slot.",
+		}, func() float64 {
+			inUse, _ := s.inflight.stats()
+			return float64(inUse)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_inflight_capacity",
+			Help: "Maximum number of concurrent evaluate requests.",
+		}, func() float64 {
+			_, limit := s.inflight.stats()
+			return float64(limit)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_queued_requests",
+			Help: "Requests and jobs currently waiting for an inflight slot.",
+		}, func() float64 {
+			count, _ := s.inflight.queued(time.Now())
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_queue_wait_max_seconds",
+			Help: "How long the request waiting longest for an inflight slot has waited so far; 0 when none is queued.",
+		}, func() float64 {
+			_, oldest := s.inflight.queued(time.Now())
+			return oldest.Seconds()
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "autotagger_cache_hits_total",
+			Help: "Prediction cache lookups that skipped the worker.",
+		}, func() float64 { return float64(s.cache.hitCount()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "autotagger_cache_misses_total",
+			Help: "Prediction cache lookups that went to the worker.",
+		}, func() float64 { return float64(s.cache.missCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_cache_entries",
+			Help: "Predictions currently held in the cache.",
+		}, func() float64 { return float64(s.cache.len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_idempotency_entries",
+			Help: "Responses currently held for Idempotency-Key replays.",
+		}, func() float64 { return float64(s.idempotency.len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_open_connections",
+			Help: "Client connections currently open; only tracked with MAX_CONNECTIONS.",
+		}, func() float64 { return float64(s.conns.open()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "autotagger_connections_refused_total",
+			Help: "Connections closed at accept time because MAX_CONNECTIONS were open.",
+		}, func() float64 { return float64(s.conns.refusedCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autotagger_workers_alive",
+			Help: "Worker processes currently running.",
+		}, func() float64 {
+			if s.workers == nil {
+				return 0
+			}
+			return float64(s.workers.aliveCount())
+		}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) observeRequest(path, method string, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	path = metricsPath(path)
+	m.requests.WithLabelValues(path, method, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(path).Observe(elapsed.Seconds())
+}
+
+func (m *metrics) observeInference(elapsed time.Duration, images int) {
+	if m == nil {
+		return
+	}
+	m.inferenceSeconds.Observe(elapsed.Seconds())
+	m.predictions.Add(float64(images))
+}
+
+func (m *metrics) observeQueueWait(wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queueWaitSeconds.Observe(wait.Seconds())
+}
+
+// metricsPath collapses arbitrary request paths onto the known routes so the
+// path label stays low-cardinality.
+func metricsPath(path string) string {
+	switch {
+	case path == "/", path == "/evaluate", path == "/batch", path == "/jobs", path == "/healthz", path == "/readyz", path == "/metrics", path == "/version", path == "/tags", path == "/openapi.json", path == "/admin/reload", path == "/admin/config", path == "/debug/worker":
+		return path
+	case strings.HasPrefix(path, "/jobs/"):
+		return "/jobs/{id}"
+	case strings.HasPrefix(path, "/debug/pprof/"):
+		return "/debug/pprof/"
+	default:
+		return "other"
+	}
+}
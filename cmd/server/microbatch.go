@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchWait = 10 * time.Millisecond
+	defaultBatchMax  = 16
+)
+
+// microBatcher merges small concurrent predictions with the same parameters
+// into one worker request, so single-image requests keep the GPU busy. A
+// batch is sent once it holds maxFiles files or wait after its first caller
+// joined, whichever comes first. Every caller gets back the predictions for
+// its own files in order, just as if it had called the pool directly.
+type microBatcher struct {
+	wait     time.Duration
+	maxFiles int
+	predict  func(ctx context.Context, files []string, params predictParams) ([]prediction, error)
+
+	mu   sync.Mutex
+	open map[string]*microBatch
+	seq  atomic.Uint64
+}
+
+// microBatch is a batch still collecting callers, or in flight once it has
+// left microBatcher.open. ctx is canceled once every caller has gone; the
+// request is sent under the callers' request IDs and the latest of their
+// deadlines.
+type microBatch struct {
+	key        string
+	params     predictParams
+	files      []string
+	names      map[string]bool
+	links      []string
+	callers    []*batchCaller
+	timer      *time.Timer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	waiting    atomic.Int64
+	requestIDs []string
+	deadline   time.Time
+	noDeadline bool
+}
+
+type batchCaller struct {
+	files []string
+	start int
+	preds []prediction
+	err   error
+	done  chan struct{}
+}
+
+func newMicroBatcher(wait time.Duration, maxFiles int, predict func(context.Context, []string, predictParams) ([]prediction, error)) *microBatcher {
+	if wait <= 0 {
+		wait = defaultBatchWait
+	}
+	if maxFiles < 2 {
+		maxFiles = defaultBatchMax
+	}
+	return &microBatcher{wait: wait, maxFiles: maxFiles, predict: predict, open: make(map[string]*microBatch)}
+}
+
+// batchKey identifies the parameters a batch is sent with; only callers
+// with equal keys can share a worker request.
+func batchKey(p predictParams) string {
+	key := fmt.Sprintf("%s|%g|%d", p.mode, p.threshold, p.limit)
+	categories := make([]string, 0, len(p.categoryThresholds))
+	for category := range p.categoryThresholds {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		key += fmt.Sprintf("|%s=%g", category, p.categoryThresholds[category])
+	}
+	return key
+}
+
+// predictFiles adds files to the open batch for params and waits for its
+// predictions. Requests that fill a batch on their own go straight to the
+// pool. A caller that gives up leaves the batch running for the others; the
+// worker request is only canceled once every caller has gone, and a batch
+// still collecting callers is then closed so that no one joins it.
+func (mb *microBatcher) predictFiles(ctx context.Context, files []string, params predictParams) ([]prediction, error) {
+	if len(files) >= mb.maxFiles {
+		return mb.predict(ctx, files, params)
+	}
+	caller := &batchCaller{files: files, done: make(chan struct{})}
+	key := batchKey(params)
+
+	mb.mu.Lock()
+	batch := mb.open[key]
+	if batch != nil && batch.ctx.Err() != nil {
+		mb.discardLocked(batch)
+		batch = nil
+	}
+	if batch != nil && len(batch.files)+len(files) > mb.maxFiles {
+		mb.flushLocked(batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &microBatch{key: key, params: params, names: make(map[string]bool)}
+		batch.ctx, batch.cancel = context.WithCancel(context.Background())
+		mb.open[key] = batch
+		batch.timer = time.AfterFunc(mb.wait, func() {
+			mb.mu.Lock()
+			defer mb.mu.Unlock()
+			if mb.open[key] == batch {
+				mb.flushLocked(batch)
+			}
+		})
+	}
+	if err := mb.join(ctx, batch, caller); err != nil {
+		mb.mu.Unlock()
+		return mb.predict(ctx, files, params)
+	}
+	if len(batch.files) >= mb.maxFiles {
+		mb.flushLocked(batch)
+	}
+	mb.mu.Unlock()
+
+	select {
+	case <-caller.done:
+		return caller.preds, caller.err
+	case <-ctx.Done():
+		mb.mu.Lock()
+		if batch.waiting.Add(-1) == 0 {
+			if mb.open[key] == batch {
+				mb.discardLocked(batch)
+			}
+			batch.cancel()
+		}
+		mb.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// join adds the caller's files to batch. The worker reports predictions by
+// base name, so a file whose name is already in the batch, such as a second
+// client's 0-image.jpg, is sent through a uniquely named symlink next to it.
+// mb.mu must be held.
+func (mb *microBatcher) join(ctx context.Context, batch *microBatch, caller *batchCaller) error {
+	files := make([]string, 0, len(caller.files))
+	var links []string
+	for _, file := range caller.files {
+		name := filepath.Base(file)
+		if batch.names[name] {
+			link := filepath.Join(filepath.Dir(file), fmt.Sprintf("mb%d-%s", mb.seq.Add(1), name))
+			if err := os.Symlink(name, link); err != nil {
+				for _, l := range links {
+					_ = os.Remove(l)
+				}
+				return err
+			}
+			links = append(links, link)
+			file, name = link, filepath.Base(link)
+		}
+		batch.names[name] = true
+		files = append(files, file)
+	}
+	caller.start = len(batch.files)
+	batch.files = append(batch.files, files...)
+	batch.links = append(batch.links, links...)
+	batch.callers = append(batch.callers, caller)
+	batch.waiting.Add(1)
+	if id := requestIDFrom(ctx); id != "" && !slices.Contains(batch.requestIDs, id) {
+		batch.requestIDs = append(batch.requestIDs, id)
+	}
+	if deadline, ok := ctx.Deadline(); !ok {
+		batch.noDeadline = true
+	} else if deadline.After(batch.deadline) {
+		batch.deadline = deadline
+	}
+	return nil
+}
+
+// flushLocked closes batch to new callers and sends it. mb.mu must be held.
+func (mb *microBatcher) flushLocked(batch *microBatch) {
+	delete(mb.open, batch.key)
+	batch.timer.Stop()
+	go mb.run(batch)
+}
+
+// discardLocked closes batch to new callers without sending it, once all
+// of them have gone. mb.mu must be held.
+func (mb *microBatcher) discardLocked(batch *microBatch) {
+	delete(mb.open, batch.key)
+	batch.timer.Stop()
+	for _, link := range batch.links {
+		_ = os.Remove(link)
+	}
+}
+
+// run sends batch to the pool and hands each caller its share of the
+// predictions under the file names it asked for.
+func (mb *microBatcher) run(batch *microBatch) {
+	defer batch.cancel()
+	ctx := batch.ctx
+	if len(batch.requestIDs) > 0 {
+		ctx = withRequestID(ctx, strings.Join(batch.requestIDs, ","))
+	}
+	if !batch.noDeadline && !batch.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, batch.deadline)
+		defer cancel()
+	}
+	preds, err := mb.predict(ctx, batch.files, batch.params)
+	if err == nil && len(preds) != len(batch.files) {
+		err = fmt.Errorf("batch of %d files got %d predictions", len(batch.files), len(preds))
+	}
+	for _, link := range batch.links {
+		_ = os.Remove(link)
+	}
+	for _, caller := range batch.callers {
+		if err != nil {
+			caller.err = err
+		} else {
+			caller.preds = make([]prediction, len(caller.files))
+			for i, file := range caller.files {
+				pred := preds[caller.start+i]
+				pred.Filename = filepath.Base(file)
+				caller.preds[i] = pred
+			}
+		}
+		close(caller.done)
+	}
+}
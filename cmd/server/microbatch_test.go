@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingPredict tags each file with the path it resolves to and records
+// the batches it is sent and their contexts.
+type recordingPredict struct {
+	mu       sync.Mutex
+	batches  [][]string
+	ctxs     []context.Context
+	block    chan struct{}
+	canceled atomic.Bool
+}
+
+func (rp *recordingPredict) predict(ctx context.Context, files []string, params predictParams) ([]prediction, error) {
+	rp.mu.Lock()
+	rp.batches = append(rp.batches, files)
+	rp.ctxs = append(rp.ctxs, ctx)
+	rp.mu.Unlock()
+	if rp.block != nil {
+		select {
+		case <-rp.block:
+		case <-ctx.Done():
+			rp.canceled.Store(true)
+			return nil, ctx.Err()
+		}
+	}
+	preds := make([]prediction, len(files))
+	for i, file := range files {
+		target, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return nil, err
+		}
+		preds[i] = prediction{Filename: filepath.Base(file), Tags: map[string]float64{target: 1}}
+	}
+	return preds, nil
+}
+
+func (rp *recordingPredict) calls() [][]string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.batches
+}
+
+func tempImages(t *testing.T, names ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestMicroBatcherMergesCallers(t *testing.T) {
+	t.Parallel()
+
+	rp := &recordingPredict{}
+	mb := newMicroBatcher(time.Hour, 3, rp.predict)
+	first := tempImages(t, "0-a.png")
+	second := tempImages(t, "0-a.png", "1-b.png")
+
+	var wg sync.WaitGroup
+	results := make([][]prediction, 2)
+	for i, files := range [][]string{first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			preds, err := mb.predictFiles(context.Background(), files, predictParams{threshold: 0.5})
+			if err != nil {
+				t.Errorf("predictFiles() error = %v", err)
+			}
+			results[i] = preds
+		}()
+		// Let the first caller open the batch before the second joins.
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if calls := rp.calls(); len(calls) != 1 || len(calls[0]) != 3 {
+		t.Fatalf("worker calls = %v, want one batch of 3 files", calls)
+	}
+	for i, files := range [][]string{first, second} {
+		if len(results[i]) != len(files) {
+			t.Fatalf("caller %d got %d predictions, want %d", i, len(results[i]), len(files))
+		}
+		for j, file := range files {
+			pred := results[i][j]
+			if pred.Filename != filepath.Base(file) || pred.Tags[file] != 1 {
+				t.Fatalf("caller %d prediction %d = %+v, want %s", i, j, pred, file)
+			}
+		}
+	}
+	links, _ := filepath.Glob(filepath.Join(filepath.Dir(second[0]), "mb*"))
+	if len(links) != 0 {
+		t.Fatalf("batch links left behind: %v", links)
+	}
+}
+
+func TestMicroBatcherSeparatesParams(t *testing.T) {
+	t.Parallel()
+
+	rp := &recordingPredict{}
+	mb := newMicroBatcher(20*time.Millisecond, 8, rp.predict)
+	var wg sync.WaitGroup
+	for _, threshold := range []float64{0.3, 0.5} {
+		files := tempImages(t, "0-a.png")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mb.predictFiles(context.Background(), files, predictParams{threshold: threshold}); err != nil {
+				t.Errorf("predictFiles() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := rp.calls(); len(calls) != 2 {
+		t.Fatalf("worker calls = %v, want one per threshold", calls)
+	}
+
+	// A request as large as a batch skips batching.
+	if _, err := mb.predictFiles(context.Background(), tempImages(t, "0-a.png", "1-b.png", "2-c.png", "3-d.png", "4-e.png", "5-f.png", "6-g.png", "7-h.png"), predictParams{}); err != nil {
+		t.Fatalf("predictFiles() error = %v", err)
+	}
+	if calls := rp.calls(); len(calls) != 3 || len(calls[2]) != 8 {
+		t.Fatalf("worker calls = %v, want the large request sent alone", calls)
+	}
+}
+
+func TestMicroBatcherCallerGivesUp(t *testing.T) {
+	t.Parallel()
+
+	rp := &recordingPredict{block: make(chan struct{})}
+	mb := newMicroBatcher(time.Millisecond, 4, rp.predict)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := mb.predictFiles(ctx, tempImages(t, "0-a.png"), predictParams{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("predictFiles() error = %v, want context.DeadlineExceeded", err)
+	}
+	// With its only caller gone the worker request is canceled rather than
+	// left running.
+	deadline := time.Now().Add(time.Second)
+	for !rp.canceled.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker request not canceled after its caller left; calls = %v", rp.calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMicroBatcherAbandonedBatchIsClosed(t *testing.T) {
+	t.Parallel()
+
+	rp := &recordingPredict{}
+	mb := newMicroBatcher(time.Hour, 2, rp.predict)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := mb.predictFiles(ctx, tempImages(t, "0-a.png"), predictParams{})
+		errCh <- err
+	}()
+	for {
+		mb.mu.Lock()
+		n := len(mb.open)
+		mb.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("predictFiles() error = %v, want context.Canceled", err)
+	}
+	mb.mu.Lock()
+	n := len(mb.open)
+	mb.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d batches still open after their only caller left", n)
+	}
+
+	// A later caller starts a fresh batch instead of joining the canceled one.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := mb.predictFiles(ctx, tempImages(t, "0-b.png"), predictParams{})
+		done <- err
+	}()
+	if _, err := mb.predictFiles(ctx, tempImages(t, "1-c.png"), predictParams{}); err != nil {
+		t.Fatalf("predictFiles() after an abandoned batch error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("predictFiles() after an abandoned batch error = %v", err)
+	}
+	if calls := rp.calls(); len(calls) != 1 || len(calls[0]) != 2 {
+		t.Fatalf("worker calls = %v, want one batch of the later callers", calls)
+	}
+}
+
+func TestMicroBatcherRequestContext(t *testing.T) {
+	t.Parallel()
+
+	rp := &recordingPredict{}
+	mb := newMicroBatcher(time.Hour, 2, rp.predict)
+	soon := time.Now().Add(time.Minute)
+	later := soon.Add(time.Minute)
+	ctxA, cancelA := context.WithDeadline(withRequestID(context.Background(), "req-a"), soon)
+	defer cancelA()
+	ctxB, cancelB := context.WithDeadline(withRequestID(context.Background(), "req-b"), later)
+	defer cancelB()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := mb.predictFiles(ctxA, tempImages(t, "0-a.png"), predictParams{})
+		done <- err
+	}()
+	for {
+		mb.mu.Lock()
+		n := len(mb.open)
+		mb.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := mb.predictFiles(ctxB, tempImages(t, "1-b.png"), predictParams{}); err != nil {
+		t.Fatalf("predictFiles() error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("predictFiles() error = %v", err)
+	}
+
+	rp.mu.Lock()
+	ctx := rp.ctxs[0]
+	rp.mu.Unlock()
+	if id := requestIDFrom(ctx); id != "req-a,req-b" {
+		t.Fatalf("batch request ID = %q, want req-a,req-b", id)
+	}
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(later) {
+		t.Fatalf("batch deadline = %v, %v; want the later caller's %v", deadline, ok, later)
+	}
+}
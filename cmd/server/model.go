@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultModelName is what the predictor configured by PREDICTOR answers
+// to in the model parameter; DEFAULT_MODEL renames it.
+const defaultModelName = "default"
+
+// parseModels parses MODELS, a comma-separated list of name=script pairs
+// such as "anime=./anime_worker.py". Each names an extra worker pool that
+// requests can pick with the model parameter.
+func parseModels(raw string) (map[string]string, error) {
+	models := map[string]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, script, ok := strings.Cut(entry, "=")
+		name, script = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(script)
+		if !ok || script == "" {
+			return nil, fmt.Errorf("%q must be name=script", entry)
+		}
+		if !validModelName(name) {
+			return nil, fmt.Errorf("model name %q must be letters, digits, '-', '_' or '.'", name)
+		}
+		if _, dup := models[name]; dup {
+			return nil, fmt.Errorf("model %q is listed twice", name)
+		}
+		models[name] = script
+	}
+	return models, nil
+}
+
+func validModelName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addModel registers p under name for the model parameter, with its own
+// tag list cache.
+func (s *server) addModel(name string, p predictor) {
+	if s.models == nil {
+		s.models = map[string]predictor{}
+		s.modelVocab = map[string]*vocabCache{}
+	}
+	s.models[name] = p
+	s.modelVocab[name] = &vocabCache{}
+}
+
+// resolveModel validates the model parameter. The default model, named or
+// not, resolves to "" so that it shares cache entries with requests that
+// leave the parameter out.
+func (s *server) resolveModel(raw string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(raw))
+	if name == "" || name == s.defaultModel {
+		return "", nil
+	}
+	if _, ok := s.models[name]; !ok {
+		return "", paramError("model", fmt.Sprintf("unknown model %q; available: %s", raw, strings.Join(s.modelNames(), ", ")))
+	}
+	return name, nil
+}
+
+// modelNames lists the models a request can select, the default first.
+func (s *server) modelNames() []string {
+	names := make([]string, 0, len(s.models))
+	for name := range s.models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{s.defaultModel}, names...)
+}
+
+// predictorFor returns the predictor of a model resolved by resolveModel.
+func (s *server) predictorFor(model string) predictor {
+	if model == "" {
+		return s.predictor
+	}
+	return s.models[model]
+}
+
+// workersFor returns the worker pool behind a resolved model and its tag
+// list cache. The pool is nil when the model is not served by local
+// workers.
+func (s *server) workersFor(model string) (*workerPool, *vocabCache) {
+	if model == "" {
+		return s.workers, &s.vocab
+	}
+	wp, _ := s.models[model].(*workerPool)
+	return wp, s.modelVocab[model]
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseModels(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{raw: "", want: map[string]string{}},
+		{raw: " Anime = ./anime.py , general=./general.py,", want: map[string]string{"anime": "./anime.py", "general": "./general.py"}},
+		{raw: "anime", wantErr: true},
+		{raw: "anime=", wantErr: true},
+		{raw: "=./anime.py", wantErr: true},
+		{raw: "an ime=./anime.py", wantErr: true},
+		{raw: "anime=./a.py,anime=./b.py", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseModels(tc.raw)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("parseModels(%q) error = %v, wantErr %v", tc.raw, err, tc.wantErr)
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("parseModels(%q) = %v, want %v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestHandleEvaluateSelectsModel(t *testing.T) {
+	t.Parallel()
+
+	general, anime := &mockPredictor{}, &mockPredictor{}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = general
+	s.defaultModel = "general"
+	s.addModel("anime", anime)
+
+	tests := []struct {
+		extra      string
+		wantStatus int
+		want       *mockPredictor
+	}{
+		{extra: "", wantStatus: http.StatusOK, want: general},
+		{extra: `,"model":"general"`, wantStatus: http.StatusOK, want: general},
+		{extra: `,"model":"Anime"`, wantStatus: http.StatusOK, want: anime},
+		{extra: `,"model":"photo"`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		before := map[*mockPredictor]int{general: len(general.files), anime: len(anime.files)}
+		rr := httptest.NewRecorder()
+		req := evaluateJSONRequest(t, tc.extra)
+		req.URL.RawQuery = "nocache=1"
+		s.handleEvaluate(rr, req)
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d; body %s", tc.extra, rr.Code, tc.wantStatus, rr.Body)
+		}
+		if tc.want == nil {
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || !strings.Contains(body.Message, "anime") {
+				t.Fatalf("%s: error body %s does not list the models", tc.extra, rr.Body)
+			}
+			continue
+		}
+		for p, n := range before {
+			if got := len(p.files) - n; (p == tc.want) != (got == 1) {
+				t.Fatalf("%s: predictor got %d files; the wrong model was used", tc.extra, got)
+			}
+		}
+	}
+}
+
+func TestModelCacheKeys(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.addModel("anime", &mockPredictor{})
+	var keys []string
+	for _, model := range []string{"", "default", "anime"} {
+		resolved, err := s.resolveModel(model)
+		if err != nil {
+			t.Fatalf("resolveModel(%q) error = %v", model, err)
+		}
+		req := &evalRequest{threshold: 0.1, limit: 5, model: resolved}
+		keys = append(keys, req.cacheKey("hash"))
+	}
+	if keys[0] != keys[1] || keys[0] == keys[2] {
+		t.Fatalf("cache keys = %q; the default model must share one key and other models get their own", keys)
+	}
+}
+
+func TestTagsAndVersionSelectModel(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.addModel("anime", &workerPool{script: "./anime.py"})
+	s.vocab.tags = []vocabTag{{Name: "landscape", Category: "general"}}
+	s.modelVocab["anime"].tags = []vocabTag{{Name: "hatsune_miku", Category: "character"}}
+
+	for query, want := range map[string]string{"": "landscape", "?model=default": "landscape", "?model=anime": "hatsune_miku"} {
+		rr := httptest.NewRecorder()
+		s.handleTags(rr, httptest.NewRequest(http.MethodGet, "/tags"+query, nil))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+			t.Fatalf("/tags%s = %d %s, want %s", query, rr.Code, rr.Body, want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleVersion(rr, httptest.NewRequest(http.MethodGet, "/version?model=anime", nil))
+	var version struct {
+		Model  string   `json:"model"`
+		Models []string `json:"models"`
+		Script string   `json:"script"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if version.Model != "anime" || version.Script != "./anime.py" || !reflect.DeepEqual(version.Models, []string{"default", "anime"}) {
+		t.Fatalf("/version?model=anime = %+v", version)
+	}
+
+	for _, path := range []string{"/tags?model=photo", "/version?model=photo"} {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400", path, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// formatMediaTypes lists the media type of each response format, in the
+// order the server prefers them when an Accept header ranks several equally.
+var formatMediaTypes = []struct {
+	format    string
+	mediaType string
+}{
+	{"html", "text/html"},
+	{"json", "application/json"},
+	{"ndjson", "application/x-ndjson"},
+	{"csv", "text/csv"},
+	{"text", "text/plain"},
+}
+
+// negotiateFormat picks the response format an Accept header asks for. The
+// highest q-value wins; among equal ones an exact media type beats a
+// type/* range, which beats */*, and then the order of formatMediaTypes
+// decides. A */* entry, or no acceptable format at all, yields def.
+func negotiateFormat(accept, def string) string {
+	best, bestQ, bestRank := def, 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q, ok := parseAcceptPart(part)
+		if !ok || q <= 0 {
+			continue
+		}
+		// rank orders equal q-values: 3 exact, 2 type/*, 1 */*.
+		rank, format := 0, ""
+		switch {
+		case mediaType == "*/*":
+			rank, format = 1, def
+		case strings.HasSuffix(mediaType, "/*"):
+			prefix := strings.TrimSuffix(mediaType, "*")
+			for _, f := range formatMediaTypes {
+				if strings.HasPrefix(f.mediaType, prefix) {
+					rank, format = 2, f.format
+					break
+				}
+			}
+		default:
+			for _, f := range formatMediaTypes {
+				if f.mediaType == mediaType {
+					rank, format = 3, f.format
+					break
+				}
+			}
+		}
+		if format == "" {
+			continue
+		}
+		if q > bestQ || (q == bestQ && (rank > bestRank || rank == bestRank && formatPriority(format) < formatPriority(best))) {
+			best, bestQ, bestRank = format, q, rank
+		}
+	}
+	return best
+}
+
+// parseAcceptPart splits one Accept entry into its lowercased media type and
+// q-value, which defaults to 1.
+func parseAcceptPart(part string) (string, float64, bool) {
+	params := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+	if mediaType == "" || !strings.Contains(mediaType, "/") {
+		return "", 0, false
+	}
+	q := 1.0
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return "", 0, false
+		}
+		q = parsed
+	}
+	return mediaType, q, true
+}
+
+func formatPriority(format string) int {
+	for i, f := range formatMediaTypes {
+		if f.format == format {
+			return i
+		}
+	}
+	return len(formatMediaTypes)
+}
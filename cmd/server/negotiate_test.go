@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		accept string
+		def    string
+		want   string
+	}{
+		{"", "html", "html"},
+		{"*/*", "html", "html"},
+		{"*/*", "json", "json"},
+		{"application/json", "html", "json"},
+		{"Application/JSON; charset=utf-8", "html", "json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "json", "html"},
+		{"application/json;q=0.5, text/csv", "html", "csv"},
+		{"text/plain, application/json", "html", "json"},
+		{"text/*", "json", "html"},
+		{"text/*, text/csv", "html", "csv"},
+		{"application/x-ndjson", "html", "ndjson"},
+		{"application/json;q=0, */*", "html", "html"},
+		{"image/png", "html", "html"},
+		{"application/json;q=bogus", "html", "html"},
+	}
+	for _, tc := range tests {
+		if got := negotiateFormat(tc.accept, tc.def); got != tc.want {
+			t.Fatalf("negotiateFormat(%q, %q) = %q, want %q", tc.accept, tc.def, got, tc.want)
+		}
+	}
+}
+
+func TestParseEvaluateAcceptHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		accept string
+		format string
+		want   string
+	}{
+		{"default", "", "", "html"},
+		{"accept json", "application/json", "", "json"},
+		{"accept csv", "text/csv", "", "csv"},
+		{"form overrides", "application/json", "text", "text"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			if tc.format != "" {
+				if err := mw.WriteField("format", tc.format); err != nil {
+					t.Fatalf("WriteField() error = %v", err)
+				}
+			}
+			if err := mw.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("Accept", tc.accept)
+			_, format, _ := newServer(nil, 1, 32, 16, 8, 200).parseEvaluate(httptest.NewRecorder(), r)
+			if format != tc.want {
+				t.Fatalf("format = %q, want %q", format, tc.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader("x"))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	newServer(nil, 1, 32, 16, 8, 200).handleEvaluate(rr, r)
+	if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusBadRequest || ct != "application/json" {
+		t.Fatalf("status = %d, Content-Type = %q; want a JSON 400", rr.Code, ct)
+	}
+	if rr.Header().Get("Vary") != "Accept" {
+		t.Fatalf("Vary = %q, want Accept", rr.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// jsonFieldNames lists the JSON keys a struct type encodes to.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOpenAPISpecMatchesStructs(t *testing.T) {
+	t.Parallel()
+
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	tests := []struct {
+		schema string
+		typ    reflect.Type
+	}{
+		{"Prediction", reflect.TypeOf(prediction{})},
+		{"FileError", reflect.TypeOf(fileError{})},
+		{"EvaluateResponse", reflect.TypeOf(evaluateResponse{})},
+		{"JobStatus", reflect.TypeOf(jobStatus{})},
+		{"VocabTag", reflect.TypeOf(vocabTag{})},
+		{"JSONEvaluateRequest", reflect.TypeOf(jsonEvaluateRequest{})},
+		{"Error", reflect.TypeOf(errorBody{})},
+	}
+	for _, tc := range tests {
+		schema, ok := spec.Components.Schemas[tc.schema]
+		if !ok {
+			t.Fatalf("schema %s is missing", tc.schema)
+		}
+		var got []string
+		for name := range schema.Properties {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if want := jsonFieldNames(tc.typ); !slices.Equal(got, want) {
+			t.Fatalf("schema %s properties = %v, want the fields of %s: %v", tc.schema, got, tc.typ, want)
+		}
+	}
+	for _, path := range []string{"/evaluate", "/batch", "/jobs", "/jobs/{id}", "/tags"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Fatalf("path %s is not documented", path)
+		}
+	}
+}
+
+func TestHandleOpenAPI(t *testing.T) {
+	t.Parallel()
+
+	rr := httptest.NewRecorder()
+	newServer(nil, 1, 32, 16, 8, 200).handleOpenAPI(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, Content-Type = %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !json.Valid(rr.Body.Bytes()) {
+		t.Fatal("body is not valid JSON")
+	}
+}
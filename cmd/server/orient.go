@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation (1-8) of the JPEG read from r,
+// or 1 when the file carries no EXIF orientation.
+func jpegOrientation(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return 0, err
+	}
+	if soi != [2]byte{0xFF, 0xD8} {
+		return 0, errors.New("not a JPEG")
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:2]); err != nil {
+			return 0, err
+		}
+		if marker[0] != 0xFF {
+			return 0, errors.New("malformed JPEG marker")
+		}
+		// Start of scan: EXIF must come before the image data.
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1, nil
+		}
+		if _, err := io.ReadFull(br, marker[2:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			return 0, errors.New("malformed JPEG segment")
+		}
+		if marker[1] != 0xE1 {
+			if _, err := br.Discard(size); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 0, err
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:]), nil
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from IFD0 of a TIFF-format EXIF
+// block, defaulting to 1 when it is missing or malformed.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// SHORT values are stored left-justified in the value field.
+		if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+			return v
+		}
+		return 1
+	}
+	return 1
+}
+
+// orientImage applies an EXIF orientation so that the result displays
+// upright without the tag.
+func orientImage(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	// srcAt maps a destination pixel to the source pixel it shows.
+	var srcAt func(x, y int) (int, int)
+	dw, dh := w, h
+	switch orientation {
+	case 2:
+		srcAt = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3:
+		srcAt = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4:
+		srcAt = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5:
+		dw, dh = h, w
+		srcAt = func(x, y int) (int, int) { return y, x }
+	case 6:
+		dw, dh = h, w
+		srcAt = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7:
+		dw, dh = h, w
+		srcAt = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8:
+		dw, dh = h, w
+		srcAt = func(x, y int) (int, int) { return w - 1 - y, x }
+	default:
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := srcAt(x, y)
+			si := rgba.PixOffset(sx, sy)
+			copy(dst.Pix[dst.PixOffset(x, y):], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// autoOrientImage rewrites the JPEG at path upright if its EXIF orientation
+// says it is rotated or mirrored. Other files are left alone. It reports
+// whether the file was changed.
+func autoOrientImage(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	orientation, err := jpegOrientation(f)
+	if err != nil || orientation == 1 {
+		// Not a JPEG, or nothing to do.
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return false, err
+	}
+	if err := replaceWithJPEG(path, orientImage(src, orientation)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// orientInput turns a stored JPEG input upright according to its EXIF
+// orientation. An image that cannot be rotated is tagged as it is.
+func (s *server) orientInput(ctx context.Context, in *evalInput) {
+	if _, err := autoOrientImage(in.path); err != nil {
+		requestLogger(ctx).Warn("auto-orient failed", "filename", in.name, "error", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// jpegWithOrientation encodes img as JPEG with an EXIF APP1 segment holding
+// the given orientation.
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("jpeg.Encode() error = %v", err)
+	}
+
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(42))
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(8))
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(1))
+	_ = binary.Write(&tiff, binary.BigEndian, []uint16{exifOrientationTag, 3})
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(1))
+	_ = binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(0))
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, enc.Bytes()[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for _, want := range []uint16{1, 3, 6, 8} {
+		got, err := jpegOrientation(bytes.NewReader(jpegWithOrientation(t, img, want)))
+		if err != nil || got != int(want) {
+			t.Fatalf("jpegOrientation() = %d, %v; want %d", got, err, want)
+		}
+	}
+
+	var plain bytes.Buffer
+	_ = jpeg.Encode(&plain, img, nil)
+	if got, err := jpegOrientation(&plain); err != nil || got != 1 {
+		t.Fatalf("jpegOrientation(no EXIF) = %d, %v; want 1", got, err)
+	}
+	if _, err := jpegOrientation(bytes.NewReader([]byte("\x89PNG\r\n"))); err == nil {
+		t.Fatal("jpegOrientation(PNG) succeeded")
+	}
+}
+
+func TestAutoOrientImage(t *testing.T) {
+	t.Parallel()
+
+	// 32x16, red on the left and blue on the right. Orientation 6 means the
+	// camera was turned clockwise, so the upright image is 16x32 with red on top.
+	src := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 16 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, jpegWithOrientation(t, src, 6), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	changed, err := autoOrientImage(path)
+	if err != nil || !changed {
+		t.Fatalf("autoOrientImage() = %v, %v; want true, nil", changed, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	got, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("jpeg.Decode() error = %v", err)
+	}
+	if b := got.Bounds(); b.Dx() != 16 || b.Dy() != 32 {
+		t.Fatalf("bounds = %v, want 16x32", b)
+	}
+	if r, _, b, _ := got.At(8, 4).RGBA(); r < b {
+		t.Fatalf("top pixel is not red")
+	}
+	if r, _, b, _ := got.At(8, 28).RGBA(); b < r {
+		t.Fatalf("bottom pixel is not blue")
+	}
+
+	changed, err = autoOrientImage(path)
+	if err != nil || changed {
+		t.Fatalf("second autoOrientImage() = %v, %v; want false, nil", changed, err)
+	}
+}
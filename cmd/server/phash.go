@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// pHashSize is the side of the grayscale image the DCT runs on; the hash
+// keeps the lowest 8x8 frequencies of it.
+const pHashSize = 32
+
+// perceptualHash computes a 64-bit DCT hash of img in the manner of pHash.
+// It is not bit-compatible with Python's imagehash.phash, which converts to
+// grayscale before downsampling with a Lanczos filter:
+//
+//  1. scale to 32x32 with bilinear filtering, ignoring the aspect ratio,
+//     and convert to luma (0.299 R + 0.587 G + 0.114 B);
+//  2. take the 2D DCT-II of the 32x32 values;
+//  3. keep the top-left 8x8 coefficients, DC term included;
+//  4. set a bit for each coefficient above their median, row by row, the
+//     first one in the most significant bit.
+//
+// Near-identical images differ in a few bits, so clients compare hashes by
+// Hamming distance; up to about 10 of 64 usually means the same picture.
+func perceptualHash(img image.Image) uint64 {
+	small := image.NewRGBA(image.Rect(0, 0, pHashSize, pHashSize))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var luma [pHashSize][pHashSize]float64
+	for y := range pHashSize {
+		for x := range pHashSize {
+			c := small.RGBAAt(x, y)
+			luma[y][x] = 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+		}
+	}
+
+	// Only the first 8 frequencies are kept, so only those are computed:
+	// rows first, then columns.
+	var rows [pHashSize][8]float64
+	for y := range pHashSize {
+		for u := range 8 {
+			rows[y][u] = dct(func(x int) float64 { return luma[y][x] }, u)
+		}
+	}
+	var coeffs [64]float64
+	for v := range 8 {
+		for u := range 8 {
+			coeffs[v*8+u] = dct(func(y int) float64 { return rows[y][u] }, v)
+		}
+	}
+
+	sorted := coeffs
+	sort.Float64s(sorted[:])
+	median := (sorted[31] + sorted[32]) / 2
+	var hash uint64
+	for _, c := range coeffs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// dct returns the k-th unnormalized DCT-II coefficient of the pHashSize
+// values of at. Scaling does not matter: the hash only compares
+// coefficients with their median.
+func dct(at func(int) float64, k int) float64 {
+	sum := 0.0
+	for n := range pHashSize {
+		sum += at(n) * math.Cos(math.Pi/pHashSize*(float64(n)+0.5)*float64(k))
+	}
+	return sum
+}
+
+// hashInput sets in.phash from the stored image. A file that cannot be
+// decoded here is still tagged, only without a hash.
+func hashInput(ctx context.Context, in *evalInput) {
+	f, err := os.Open(in.path)
+	if err != nil {
+		requestLogger(ctx).Warn("phash failed", "filename", in.name, "error", err)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		requestLogger(ctx).Warn("phash failed", "filename", in.name, "error", err)
+		return
+	}
+	in.phash = fmt.Sprintf("%016x", perceptualHash(img))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pattern draws a few overlapping waves at any size, flipped horizontally
+// with mirror.
+func pattern(w, h int, mirror bool) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			u, v := float64(x)/float64(w), float64(y)/float64(h)
+			if mirror {
+				u = 1 - u
+			}
+			c := 128 + 50*math.Sin(7*u+1) + 40*math.Cos(4*v*v+3*u) + 30*math.Sin(11*u*v)
+			img.SetGray(x, y, color.Gray{Y: uint8(c)})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	t.Parallel()
+
+	base := perceptualHash(pattern(256, 256, false))
+	if got := perceptualHash(pattern(256, 256, false)); got != base {
+		t.Fatalf("hash of the same image = %016x, want %016x", got, base)
+	}
+	if d := bits.OnesCount64(base ^ perceptualHash(pattern(97, 97, false))); d > 4 {
+		t.Fatalf("rescaled image differs in %d bits, want at most 4", d)
+	}
+	if d := bits.OnesCount64(base ^ perceptualHash(pattern(256, 256, true))); d < 16 {
+		t.Fatalf("mirrored image differs in %d bits, want at least 16", d)
+	}
+}
+
+func TestPreprocessInputsPHash(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "0-a.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := png.Encode(f, pattern(64, 64, false)); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	f.Close()
+	broken := filepath.Join(dir, "1-b.png")
+	if err := os.WriteFile(broken, []byte("not an image"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	inputs := []evalInput{{name: "a.png", path: path}, {name: "b.png", path: broken}}
+	s.preprocessInputs(context.Background(), inputs, true)
+	if len(inputs[0].phash) != 16 {
+		t.Fatalf("phash = %q, want 16 hex digits", inputs[0].phash)
+	}
+	if inputs[1].phash != "" || inputs[1].err != nil {
+		t.Fatalf("undecodable input = %+v, want no hash and no error", inputs[1])
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Defaults for WORKER_PING_INTERVAL and WORKER_PING_TIMEOUT. The worker
+// answers requests in order, so a ping waits behind everything queued before
+// it; any answer within the timeout counts instead, so the timeout only has
+// to outlast the slowest single chunk. See pingTimeoutFor.
+const (
+	defaultWorkerPingInterval = 30 * time.Second
+	defaultWorkerPingTimeout  = time.Minute
+)
+
+var errPingTimeout = errors.New("worker did not answer the ping")
+
+// pingTimeoutFor returns the default WORKER_PING_TIMEOUT: at least
+// maxPredictTimeout, because a chunk that is not streamed writes nothing until
+// it is done, and a worker busy with one must not look hung while a request
+// is still allowed to be running.
+func pingTimeoutFor(maxPredictTimeout time.Duration) time.Duration {
+	return max(defaultWorkerPingTimeout, maxPredictTimeout)
+}
+
+// ping sends the worker a no-op request and waits for its answer. Workers
+// that predate the command answer with an empty prediction list, which
+// counts just the same. It does not count as in flight, so it never steers
+// requests away from the worker.
+func (wc *workerClient) ping(ctx context.Context) error {
+	if wc.closed.Load() {
+		return errWorkerNotRunning
+	}
+	respCh := make(chan workerResponse, 1)
+	id, err := wc.send(workerRequest{Files: []string{}, Ping: true}, respCh)
+	if err != nil {
+		return err
+	}
+	select {
+	case resp := <-respCh:
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		wc.forget(id)
+		return ctx.Err()
+	}
+}
+
+// unresponsive pings every live worker that has loaded its model and returns
+// the indexes of those that neither answered the ping nor wrote anything
+// else within timeout. A busy worker answers the ping only after the
+// requests queued before it, but keeps answering those meanwhile, so it is
+// not reported. A worker that exits meanwhile is left to the supervisor and
+// is not reported either: this only catches workers that are running but
+// stuck. A worker whose previous ping is still outstanding, for instance
+// because its stdin is full, is not pinged again.
+func (wp *workerPool) unresponsive(ctx context.Context, timeout time.Duration) []int {
+	wp.mu.RLock()
+	workers := append([]*workerClient(nil), wp.workers...)
+	wp.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hung := make([]bool, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		if w == nil || w.closed.Load() || !w.loaded() {
+			continue
+		}
+		if !w.pinging.CompareAndSwap(false, true) {
+			hung[i] = true
+			continue
+		}
+		wg.Add(1)
+		done := make(chan error, 1)
+		go func() {
+			done <- w.ping(ctx)
+			w.pinging.Store(false)
+		}()
+		go func() {
+			defer wg.Done()
+			select {
+			case err := <-done:
+				hung[i] = errors.Is(err, context.DeadlineExceeded)
+			case <-ctx.Done():
+				hung[i] = ctx.Err() == context.DeadlineExceeded
+			}
+		}()
+	}
+	wg.Wait()
+
+	since := time.Now().Add(-timeout).UnixNano()
+	var idx []int
+	for i, h := range hung {
+		if h && !workers[i].closed.Load() && workers[i].lastOutput.Load() < since {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// watchWorkers pings the workers every interval until ctx is done and keeps
+// workerResponsive up to date for the health probes. Unlike a crash, a hung
+// worker never exits, so without this /healthz would report it healthy
+// forever. A non-positive interval disables it.
+func (s *server) watchWorkers(ctx context.Context, interval, timeout time.Duration) {
+	if interval <= 0 || s.workers == nil {
+		return
+	}
+	if timeout <= 0 {
+		timeout = pingTimeoutFor(s.maxPredictTimeout)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		hung := s.workers.unresponsive(ctx, timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		s.setWorkerResponsive(hung, timeout)
+	}
+}
+
+// setWorkerResponsive records the outcome of one round of pings, logging
+// only when it changes.
+func (s *server) setWorkerResponsive(hung []int, timeout time.Duration) {
+	responsive := len(hung) == 0
+	if s.workerResponsive.Swap(responsive) == responsive {
+		return
+	}
+	if responsive {
+		slog.Info("workers responsive again")
+		return
+	}
+	slog.Error("worker unresponsive", "workers", hung, "timeout", timeout.String(), "error", errPingTimeout)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stuckWorker reads requests but never answers, like a worker deadlocked in
+// inference.
+func stuckWorker(t *testing.T) *workerClient {
+	t.Helper()
+	return newFakeWorker(t, func([]byte, io.Writer) {})
+}
+
+func TestWorkerPoolUnresponsive(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	dead := &workerClient{}
+	dead.closed.Store(true)
+	pool := &workerPool{workers: []*workerClient{echoWorker(t, &requests), stuckWorker(t), dead}}
+
+	for range 2 {
+		if got := pool.unresponsive(context.Background(), 50*time.Millisecond); !reflect.DeepEqual(got, []int{1}) {
+			t.Fatalf("unresponsive() = %v, want [1]", got)
+		}
+	}
+	if requests.Load() != 2 {
+		t.Fatalf("echo worker got %d pings, want 2", requests.Load())
+	}
+}
+
+func TestWorkerPoolUnresponsiveBusyWorker(t *testing.T) {
+	t.Parallel()
+
+	// The worker answers in order and takes 20ms per request, so a ping
+	// queued behind ten requests is answered long after the timeout.
+	type queued struct {
+		id uint64
+		w  io.Writer
+	}
+	queue := make(chan queued, 16)
+	var received atomic.Int64
+	busy := newFakeWorker(t, func(line []byte, w io.Writer) {
+		var req workerRequest
+		_ = json.Unmarshal(line, &req)
+		received.Add(1)
+		queue <- queued{req.ID, w}
+	})
+	go func() {
+		for req := range queue {
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprintf(req.w, `{"id":%d,"predictions":[]}`+"\n", req.id)
+		}
+	}()
+	for range 10 {
+		go func() { _, _ = busy.predict(context.Background(), []string{"/t/a.png"}, predictParams{}) }()
+	}
+	for received.Load() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	pool := &workerPool{workers: []*workerClient{busy, stuckWorker(t)}}
+	if got := pool.unresponsive(context.Background(), 100*time.Millisecond); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("unresponsive() = %v, want only the stuck worker [1]", got)
+	}
+}
+
+func TestHealthWorkerUnresponsive(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = &mockPredictor{}
+	probe := func(path string) (int, string) {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code, strings.TrimSpace(rr.Body.String())
+	}
+
+	s.setWorkerResponsive([]int{0}, time.Second)
+	if code, body := probe("/healthz"); code != http.StatusInternalServerError || !strings.Contains(body, "worker_unresponsive") {
+		t.Fatalf("/healthz = %d %s, want 500 worker_unresponsive", code, body)
+	}
+	if code, body := probe("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "worker_unresponsive") {
+		t.Fatalf("/readyz = %d %s, want 503 worker_unresponsive", code, body)
+	}
+
+	s.setWorkerResponsive(nil, time.Second)
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz after recovery = %d, want 200", code)
+	}
+	if code, _ := probe("/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz after recovery = %d, want 200", code)
+	}
+}
+
+func TestPingTimeoutFor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		maxPredict time.Duration
+		want       time.Duration
+	}{
+		{0, defaultWorkerPingTimeout},
+		{30 * time.Second, defaultWorkerPingTimeout},
+		{5 * time.Minute, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := pingTimeoutFor(tt.maxPredict); got != tt.want {
+			t.Errorf("pingTimeoutFor(%v) = %v, want %v", tt.maxPredict, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofRoutes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		apiKeys    string
+		wantStatus int
+		wantPprof  bool
+	}{
+		{name: "disabled", wantStatus: http.StatusOK},
+		{name: "enabled", enabled: true, wantStatus: http.StatusOK, wantPprof: true},
+		{name: "enabled with keys", enabled: true, apiKeys: "alpha", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.pprof = tc.enabled
+		s.apiKeys = parseAPIKeys(tc.apiKeys)
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		if got := strings.Contains(rr.Body.String(), "goroutine"); got != tc.wantPprof {
+			t.Fatalf("%s: served pprof index = %v, want %v", tc.name, got, tc.wantPprof)
+		}
+	}
+}
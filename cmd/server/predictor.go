@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Predictors selected by PREDICTOR, or by its older name WORKER_MODE.
+const (
+	workerModeProcess = "process"
+	workerModeEcho    = "echo"
+	workerModeHTTP    = "http"
+)
+
+func parseWorkerMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "", workerModeProcess:
+		return workerModeProcess, nil
+	case workerModeEcho, workerModeHTTP:
+		return mode, nil
+	default:
+		return "", errors.New("must be process, echo or http")
+	}
+}
+
+// predictor tags stored files for the server. workerPool spreads requests
+// over the Python workers, each a workerClient; echoPredictor fakes them
+// for PREDICTOR=echo, and httpPredictor sends the images to a remote
+// inference service. The worker-specific endpoints, such as reload and
+// /debug/worker, still go through server.workers and are unavailable
+// without a pool.
+type predictor interface {
+	// predictStream returns one prediction per file, in order, calling
+	// onPrediction, if set, for each file as soon as it is tagged.
+	predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error)
+	// alive reports whether predictions can currently be made.
+	alive() bool
+	// close stops the predictor; later predictions fail.
+	close()
+}
+
+var (
+	_ predictor = (*workerPool)(nil)
+	_ predictor = (*workerClient)(nil)
+	_ predictor = echoPredictor{}
+	_ predictor = (*httpPredictor)(nil)
+)
+
+func (wp *workerPool) alive() bool { return wp.anyAlive() }
+
+func (wc *workerClient) alive() bool { return !wc.closed.Load() }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockPredictor records the calls it gets and answers each file with one
+// tag named after it, or fails with err.
+type mockPredictor struct {
+	err  error
+	down bool
+
+	mu     sync.Mutex
+	files  []string
+	params predictParams
+}
+
+func (m *mockPredictor) predictStream(ctx context.Context, files []string, params predictParams, onPrediction func(prediction)) ([]prediction, error) {
+	m.mu.Lock()
+	m.files = append(m.files, files...)
+	m.params = params
+	m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	preds := make([]prediction, 0, len(files))
+	for _, file := range files {
+		name := filepath.Base(file)
+		pred := prediction{Filename: name, Tags: map[string]float64{"tag_" + name: 0.9}}
+		if onPrediction != nil {
+			onPrediction(pred)
+		}
+		preds = append(preds, pred)
+	}
+	return preds, nil
+}
+
+func (m *mockPredictor) alive() bool { return !m.down }
+
+func (m *mockPredictor) close() { m.down = true }
+
+func evaluateJSONRequest(t *testing.T, extra string) *http.Request {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	body := `{"images":[{"name":"a.png","data":"` + base64.StdEncoding.EncodeToString(img.Bytes()) + `"}]` + extra + `}`
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestHandleEvaluateWithMockPredictor(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockPredictor{}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = mock
+
+	rr := httptest.NewRecorder()
+	s.handleEvaluate(rr, evaluateJSONRequest(t, `,"threshold":0.4,"limit":7,"mode":"topk"`))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rr.Code, rr.Body)
+	}
+	want := predictParams{threshold: 0.4, limit: 7, mode: modeTopK}
+	if len(mock.files) != 1 || mock.params.threshold != want.threshold || mock.params.limit != want.limit || mock.params.mode != want.mode {
+		t.Fatalf("predictor got files %v, params %+v; want one file with %+v", mock.files, mock.params, want)
+	}
+	var resp evaluateResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", rr.Body, err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Filename != "a.png" || resp.Results[0].Tags["tag_"+filepath.Base(mock.files[0])] != 0.9 {
+		t.Fatalf("results = %+v, want a.png with the mock's tag", resp.Results)
+	}
+}
+
+func TestHandleEvaluatePredictorErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   errorCode
+	}{
+		{"restarting", errWorkerRestarting, http.StatusServiceUnavailable, codeWorkerRestarting},
+		{"not running", errWorkerNotRunning, http.StatusServiceUnavailable, codeWorkerUnavailable},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout, codeGatewayTimeout},
+		{"worker error", errors.New("CUDA error: device-side assert"), http.StatusInternalServerError, codeInferenceError},
+	}
+	for _, tc := range tests {
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.predictor = &mockPredictor{err: tc.err}
+		rr := httptest.NewRecorder()
+		s.handleEvaluate(rr, evaluateJSONRequest(t, ""))
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		var got errorBody
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got.Code != tc.wantCode {
+			t.Fatalf("%s: body = %s, want code %s", tc.name, rr.Body, tc.wantCode)
+		}
+	}
+}
+
+func TestHealthFollowsPredictor(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockPredictor{}
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = mock
+	for _, tc := range []struct {
+		name string
+		down bool
+		want int
+	}{
+		{"alive", false, http.StatusOK},
+		{"closed", true, http.StatusServiceUnavailable},
+	} {
+		mock.down = tc.down
+		rr := httptest.NewRecorder()
+		s.handleReady(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rr.Code != tc.want {
+			t.Fatalf("%s: readyz status = %d, want %d", tc.name, rr.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The worker protocol frames each JSON message either as one line
+// (protocolLines) or as a 4-byte big-endian length followed by the payload
+// (protocolFramed). Framing has no line length limit and does not depend on
+// the JSON never containing a raw newline. The worker reads the same
+// WORKER_PROTOCOL variable, which it inherits from the server.
+const (
+	protocolLines  = "lines"
+	protocolFramed = "framed"
+)
+
+const (
+	// maxLineBytes is the longest response line the lines protocol accepts.
+	maxLineBytes = 16 * 1024 * 1024
+	// maxFrameBytes rejects a length prefix that can only come from a
+	// corrupted stream before anything is allocated for it.
+	maxFrameBytes = 1 << 30
+)
+
+// parseWorkerProtocol validates WORKER_PROTOCOL; empty means protocolLines.
+func parseWorkerProtocol(raw string) (string, error) {
+	switch protocol := strings.ToLower(strings.TrimSpace(raw)); protocol {
+	case "", protocolLines:
+		return protocolLines, nil
+	case protocolFramed:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unknown worker protocol %q; use lines or framed", raw)
+	}
+}
+
+// encodeMessage frames one JSON message for the worker.
+func encodeMessage(protocol string, data []byte) []byte {
+	if protocol == protocolFramed {
+		msg := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(msg, uint32(len(data)))
+		return append(msg, data...)
+	}
+	return append(data, '\n')
+}
+
+// messageReader returns a function yielding the worker's messages one at a
+// time. It returns io.EOF once the stream ends cleanly; any other error means
+// the stream can no longer be followed.
+func messageReader(protocol string, r io.Reader) func() ([]byte, error) {
+	if protocol == protocolFramed {
+		br := bufio.NewReader(r)
+		var header [4]byte
+		return func() ([]byte, error) {
+			if _, err := io.ReadFull(br, header[:]); err != nil {
+				return nil, err
+			}
+			n := binary.BigEndian.Uint32(header[:])
+			if n > maxFrameBytes {
+				return nil, fmt.Errorf("worker frame of %d bytes exceeds the %d byte limit", n, maxFrameBytes)
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(br, data); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			return data, nil
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	return func() ([]byte, error) {
+		if scanner.Scan() {
+			return scanner.Bytes(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseWorkerProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"", protocolLines, false},
+		{"lines", protocolLines, false},
+		{" Framed ", protocolFramed, false},
+		{"binary", "", true},
+	}
+	for _, tc := range tests {
+		got, err := parseWorkerProtocol(tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseWorkerProtocol(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	// The framed payloads would break the lines protocol: one holds a raw
+	// newline and one is longer than its line limit.
+	large := `{"id":3,"error":"` + strings.Repeat("x", maxLineBytes+1) + `"}`
+	messages := []string{`{"id":1}`, "{\"id\":2,\n\"done\":true}", large}
+
+	var stream bytes.Buffer
+	for _, msg := range messages {
+		stream.Write(encodeMessage(protocolFramed, []byte(msg)))
+	}
+	next := messageReader(protocolFramed, &stream)
+	for i, want := range messages {
+		got, err := next()
+		if err != nil || string(got) != want {
+			t.Fatalf("framed message %d = %.40q, %v; want %.40q", i, got, err, want)
+		}
+	}
+	if _, err := next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("framed read after the last message error = %v, want io.EOF", err)
+	}
+
+	stream.Reset()
+	stream.Write(encodeMessage(protocolLines, []byte(`{"id":1}`)))
+	stream.Write(encodeMessage(protocolLines, []byte(large)))
+	next = messageReader(protocolLines, &stream)
+	if got, err := next(); err != nil || string(got) != `{"id":1}` {
+		t.Fatalf("line message = %q, %v", got, err)
+	}
+	if _, err := next(); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("overlong line error = %v, want a read error", err)
+	}
+}
+
+func TestMessageReaderRejectsCorruptFrames(t *testing.T) {
+	t.Parallel()
+
+	huge := make([]byte, 4)
+	binary.BigEndian.PutUint32(huge, maxFrameBytes+1)
+	if _, err := messageReader(protocolFramed, bytes.NewReader(huge))(); err == nil {
+		t.Fatal("frame over maxFrameBytes was accepted")
+	}
+
+	truncated := encodeMessage(protocolFramed, []byte(`{"id":1}`))
+	_, err := messageReader(protocolFramed, bytes.NewReader(truncated[:8]))()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated frame error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
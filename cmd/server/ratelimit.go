@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitClients bounds the limiter's memory. When it is reached, idle
+// buckets are evicted early; clients beyond it are limited as one group.
+const maxRateLimitClients = 65536
+
+// rateLimiter is a per-client token bucket. A nil limiter allows everything,
+// which is how RATE_LIMIT_RPS=0 is handled.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rps))
+	}
+	return &rateLimiter{
+		rate:    rps,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token for key. When none is available it returns how long
+// until one will be.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	b, ok := rl.clients[key]
+	if !ok {
+		if len(rl.clients) >= maxRateLimitClients {
+			rl.evictIdleLocked(now)
+		}
+		if len(rl.clients) >= maxRateLimitClients {
+			key = "overflow"
+			b = rl.clients[key]
+		}
+	}
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.clients[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// evictIdleLocked drops buckets that have refilled completely; they carry no
+// state a fresh bucket would not.
+func (rl *rateLimiter) evictIdleLocked(now time.Time) {
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, b := range rl.clients {
+		if now.Sub(b.last) >= full {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+func (rl *rateLimiter) len() int {
+	if rl == nil {
+		return 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.clients)
+}
+
+// evictLoop periodically drops idle buckets until ctx is done.
+func (rl *rateLimiter) evictLoop(ctx context.Context, interval time.Duration) {
+	if rl == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.mu.Lock()
+			rl.evictIdleLocked(rl.now())
+			rl.mu.Unlock()
+		}
+	}
+}
+
+// clientIP identifies the caller for rate limiting. Behind a trusted proxy
+// it uses the last X-Forwarded-For entry, the one the proxy itself appended;
+// earlier entries are client-supplied and easy to spoof.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestFormat guesses the response format before the body is parsed, from
+// a format query parameter or the Accept header, defaulting to JSON for JSON
+// bodies and HTML otherwise.
+func requestFormat(r *http.Request) string {
+	if isJSONRequest(r.Header.Get("Content-Type")) {
+		return errorFormat(negotiateFormat(r.Header.Get("Accept"), "json"))
+	}
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json", "ndjson", "zip":
+		return "json"
+	case "html":
+		return "html"
+	}
+	return errorFormat(negotiateFormat(r.Header.Get("Accept"), "html"))
+}
+
+// errorFormat is the format an error is written in for a response format;
+// ndjson clients get a plain JSON error.
+func errorFormat(format string) string {
+	if format == "ndjson" {
+		return "json"
+	}
+	return format
+}
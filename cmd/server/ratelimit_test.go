@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(2, 3)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("a"); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, wait := rl.allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("allow() after burst = %v, %v, want false, 500ms", ok, wait)
+	}
+	if ok, _ := rl.allow("b"); !ok {
+		t.Fatal("a different client shares the exhausted bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.allow("a"); !ok {
+		t.Fatal("bucket did not refill after 500ms at 2 rps")
+	}
+
+	now = now.Add(time.Hour)
+	rl.mu.Lock()
+	rl.evictIdleLocked(now)
+	rl.mu.Unlock()
+	if rl.len() != 0 {
+		t.Fatalf("len() after eviction = %d, want 0", rl.len())
+	}
+}
+
+func TestNilRateLimiterAllows(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(0, 10)
+	if ok, _ := rl.allow("a"); !ok || rl != nil {
+		t.Fatal("RATE_LIMIT_RPS=0 should disable the limiter")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", nil)
+	req.RemoteAddr = "10.0.0.5:4321"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+
+	if got := clientIP(req, false); got != "10.0.0.5" {
+		t.Fatalf("clientIP(untrusted) = %q, want 10.0.0.5", got)
+	}
+	if got := clientIP(req, true); got != "203.0.113.7" {
+		t.Fatalf("clientIP(trusted) = %q, want 203.0.113.7", got)
+	}
+}
+
+func TestHandleEvaluateRateLimited(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.limiter = newRateLimiter(1, 1)
+	s.limiter.allow("192.0.2.1")
+
+	for _, tc := range []struct {
+		target      string
+		wantContent string
+	}{
+		{target: "/evaluate?format=json", wantContent: "application/json"},
+		{target: "/evaluate", wantContent: ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		rr := httptest.NewRecorder()
+		s.handleEvaluate(rr, req)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s: status = %d, want 429", tc.target, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s: missing Retry-After", tc.target)
+		}
+		if tc.wantContent != "" && rr.Header().Get("Content-Type") != tc.wantContent {
+			t.Fatalf("%s: Content-Type = %q, want %q", tc.target, rr.Header().Get("Content-Type"), tc.wantContent)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+// defaultRatingTags matches the rating tags emitted by the bundled model.
+var defaultRatingTags = []string{"rating:*"}
+
+// splitRating copies the tags matching any of patterns into pred.Rating.
+// With remove set they are also dropped from pred.Tags. pred's maps are
+// replaced, never modified.
+func splitRating(pred prediction, patterns []string, remove bool) prediction {
+	if len(patterns) == 0 {
+		return pred
+	}
+	var rating map[string]float64
+	var tags map[string]float64
+	if remove {
+		tags = make(map[string]float64, len(pred.Tags))
+	}
+	for name, score := range pred.Tags {
+		matched := false
+		for _, pattern := range patterns {
+			if globMatch(pattern, name) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			if rating == nil {
+				rating = make(map[string]float64)
+			}
+			rating[name] = score
+		} else if remove {
+			tags[name] = score
+		}
+	}
+	pred.Rating = rating
+	if remove {
+		pred.Tags = tags
+	}
+	return pred
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSplitRating(t *testing.T) {
+	t.Parallel()
+
+	pred := prediction{Tags: map[string]float64{"1girl": 0.9, "rating:g": 0.7, "rating:s": 0.2}}
+
+	kept := splitRating(pred, defaultRatingTags, false)
+	if len(kept.Rating) != 2 || kept.Rating["rating:g"] != 0.7 {
+		t.Fatalf("Rating = %v, want both rating tags", kept.Rating)
+	}
+	if len(kept.Tags) != 3 {
+		t.Fatalf("Tags = %v, want rating tags kept without split_rating", kept.Tags)
+	}
+
+	split := splitRating(pred, []string{"rating:g", "rating:s"}, true)
+	if len(split.Tags) != 1 || split.Tags["1girl"] != 0.9 || len(split.Rating) != 2 {
+		t.Fatalf("split = %+v, want rating tags moved out of Tags", split)
+	}
+	if len(pred.Tags) != 3 {
+		t.Fatal("splitRating modified its input")
+	}
+
+	none := splitRating(prediction{Tags: map[string]float64{"solo": 0.5}}, defaultRatingTags, true)
+	if none.Rating != nil {
+		t.Fatalf("Rating = %v, want nil when no rating tag matched", none.Rating)
+	}
+}
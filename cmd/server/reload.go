@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const defaultReloadTimeout = 5 * time.Minute
+
+var errReloadInProgress = errors.New("reload already in progress")
+
+// reload replaces every live worker with a fresh process, one slot at a
+// time, so the new model is loaded from disk without dropping capacity. Each
+// replacement is swapped in under the pool lock only after it has answered
+// the startup handshake; the old worker stops taking requests and is closed
+// once its in-flight requests finish or drainTimeout passes. Slots that are
+// down or restarting are skipped, since a restart loads the new model anyway.
+func (wp *workerPool) reload(ctx context.Context, drainTimeout time.Duration) error {
+	if !wp.reloadMu.TryLock() {
+		return errReloadInProgress
+	}
+	defer wp.reloadMu.Unlock()
+
+	wp.mu.RLock()
+	n := len(wp.workers)
+	wp.mu.RUnlock()
+	for idx := 0; idx < n; idx++ {
+		old := wp.get(idx)
+		if old.closed.Load() || wp.restarting[idx].Load() {
+			slog.Warn("skipping reload of worker that is not running", "index", idx)
+			continue
+		}
+
+		fresh, err := newWorkerClient(wp.ctx, wp.pythonBin, wp.script, wp.protocol)
+		if err != nil {
+			return fmt.Errorf("start worker %d: %w", idx, err)
+		}
+		select {
+		case <-fresh.ready:
+		case <-ctx.Done():
+			fresh.close()
+			return fmt.Errorf("worker %d did not load its model: %w", idx, ctx.Err())
+		}
+		if fresh.closed.Load() {
+			return fmt.Errorf("worker %d exited while loading its model", idx)
+		}
+
+		wp.mu.Lock()
+		swapped := wp.workers[idx] == old
+		if swapped {
+			wp.workers[idx] = fresh
+		}
+		wp.mu.Unlock()
+		if !swapped {
+			// The supervisor replaced a crashed worker meanwhile.
+			fresh.close()
+			continue
+		}
+		slog.Info("worker reloaded", "index", idx, "pid", fresh.cmd.Process.Pid)
+		go retireWorker(old, drainTimeout)
+	}
+	return nil
+}
+
+// retireWorker closes a worker that no longer receives requests once the
+// ones it is serving have finished, or after timeout.
+func retireWorker(w *workerClient, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for w.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	w.close()
+}
+
+// reloadModels reloads the default pool and then every pool listed in
+// MODELS, dropping the tag lists and cached predictions of the old models.
+// It stops at the first pool that fails.
+func (s *server) reloadModels(ctx context.Context) error {
+	names := append([]string{""}, s.modelNames()[1:]...)
+	for _, name := range names {
+		wp, vc := s.workersFor(name)
+		if wp == nil {
+			continue
+		}
+		err := wp.reload(ctx, s.maxPredictTimeout)
+		if !errors.Is(err, errReloadInProgress) {
+			// Even a failed reload may have swapped some workers to the new
+			// model, whose tags the cached predictions no longer reflect.
+			vc.reset()
+			s.cache.reset()
+		}
+		if err != nil {
+			if name != "" {
+				err = fmt.Errorf("model %s: %w", name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// handleReload starts fresh workers with the models currently on disk and
+// swaps them in, then reports what the new workers loaded. Like every admin
+// endpoint it is only available when API_KEYS is set.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.apiKeys) == 0 {
+		s.writeError(w, "json", http.StatusForbidden, codeForbidden, "admin endpoints require API_KEYS to be set")
+		return
+	}
+	if s.workers == nil {
+		s.writeError(w, "json", http.StatusServiceUnavailable, codeWorkerUnavailable, "no worker pool")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), defaultReloadTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.reloadModels(ctx)
+	switch {
+	case errors.Is(err, errReloadInProgress):
+		s.writeError(w, "json", http.StatusConflict, codeConflict, err.Error())
+		return
+	case err != nil:
+		requestLogger(r.Context()).Error("reload failed", "error", err)
+		s.writeError(w, "json", http.StatusInternalServerError, codeReloadFailed, err.Error())
+		return
+	}
+	requestLogger(r.Context()).Info("reload finished", "elapsed_ms", time.Since(start).Milliseconds())
+
+	var models map[string][]workerVersion
+	for _, name := range s.modelNames()[1:] {
+		if wp, _ := s.workersFor(name); wp != nil {
+			if models == nil {
+				models = map[string][]workerVersion{}
+			}
+			models[name] = wp.versions()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status  string                     `json:"status"`
+		Workers []workerVersion            `json:"workers"`
+		Models  map[string][]workerVersion `json:"models,omitempty"`
+	}{
+		Status:  "reloaded",
+		Workers: s.workers.versions(),
+		Models:  models,
+	})
+}
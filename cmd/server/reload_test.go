@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleReloadRequiresAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	rr := httptest.NewRecorder()
+	s.handleReload(rr, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleReloadClearsCache(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.apiKeys = parseAPIKeys("secret")
+	// A pool without workers reloads successfully without starting any.
+	s.workers = &workerPool{}
+	mock := &mockPredictor{}
+	s.predictor = mock
+	s.cache = newPredictionCache(8)
+
+	evaluate := func() {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		s.handleEvaluate(rr, evaluateJSONRequest(t, ""))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("evaluate status = %d, body %s", rr.Code, rr.Body)
+		}
+	}
+	evaluate()
+	evaluate()
+	if len(mock.files) != 1 {
+		t.Fatalf("predictor called for %d files before reload, want 1", len(mock.files))
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleReload(rr, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("reload status = %d, body %s", rr.Code, rr.Body)
+	}
+	if s.cache.len() != 0 {
+		t.Fatalf("cache holds %d entries after reload, want 0", s.cache.len())
+	}
+	evaluate()
+	if len(mock.files) != 2 {
+		t.Fatalf("predictor called for %d files, want the cached image predicted again after reload", len(mock.files))
+	}
+}
+
+func TestHandleReloadReloadsEveryModel(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.apiKeys = parseAPIKeys("secret")
+	s.workers = &workerPool{}
+	s.defaultModel = "general"
+	anime := &workerPool{}
+	s.addModel("anime", anime)
+	s.modelVocab["anime"].tags = []vocabTag{{Name: "old_tag"}}
+
+	rr := httptest.NewRecorder()
+	s.handleReload(rr, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("reload status = %d, body %s", rr.Code, rr.Body)
+	}
+	if s.modelVocab["anime"].tags != nil {
+		t.Fatal("anime tag list survived the reload")
+	}
+	if !strings.Contains(rr.Body.String(), `"models":{"anime":[]}`) {
+		t.Fatalf("reload body = %s, want the anime pool listed", rr.Body)
+	}
+
+	// A pool that is already reloading fails the whole reload.
+	anime.reloadMu.Lock()
+	defer anime.reloadMu.Unlock()
+	rr = httptest.NewRecorder()
+	s.handleReload(rr, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("reload status = %d, want %d", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestWorkerPoolReloadInProgress(t *testing.T) {
+	t.Parallel()
+
+	wp := &workerPool{}
+	wp.reloadMu.Lock()
+	defer wp.reloadMu.Unlock()
+	if err := wp.reload(context.Background(), 0); !errors.Is(err, errReloadInProgress) {
+		t.Fatalf("reload() error = %v, want errReloadInProgress", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultResultsQueueSize     = 1024
+	defaultResultsFlushInterval = time.Second
+	maxResultsBatch             = 1000
+	resultsWriteTimeout         = 30 * time.Second
+)
+
+// resultRecord is one line of the results log: a tagged file and where it
+// came from.
+type resultRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	JobID     string    `json:"job_id,omitempty"`
+	prediction
+}
+
+// MarshalJSON flattens the prediction into the record. Without it the
+// embedded prediction's MarshalJSON would encode the record, dropping the
+// time and ids. The log always keeps tags as a map, whatever the request's
+// sort order.
+func (rec resultRecord) MarshalJSON() ([]byte, error) {
+	type plain prediction
+	return json.Marshal(struct {
+		Time      time.Time `json:"time"`
+		RequestID string    `json:"request_id,omitempty"`
+		JobID     string    `json:"job_id,omitempty"`
+		plain
+	}{rec.Time, rec.RequestID, rec.JobID, plain(rec.prediction)})
+}
+
+// resultSink stores batches of result records. Its methods are only called
+// from the resultLog goroutine.
+type resultSink interface {
+	write(ctx context.Context, records []resultRecord) error
+	close() error
+}
+
+// resultLog hands result records to a sink in the background. record never
+// blocks: when the queue is full, records are dropped and counted.
+type resultLog struct {
+	sink     resultSink
+	queue    chan resultRecord
+	interval time.Duration
+	dropped  atomic.Int64
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newResultLog(sink resultSink, queueSize int, interval time.Duration) *resultLog {
+	if queueSize < 1 {
+		queueSize = defaultResultsQueueSize
+	}
+	if interval <= 0 {
+		interval = defaultResultsFlushInterval
+	}
+	rl := &resultLog{
+		sink:     sink,
+		queue:    make(chan resultRecord, queueSize),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go rl.run()
+	return rl
+}
+
+// record queues one record per result.
+func (rl *resultLog) record(ctx context.Context, jobID string, results []prediction) {
+	now := time.Now().UTC()
+	requestID := requestIDFrom(ctx)
+	dropped := 0
+	for _, pred := range results {
+		select {
+		case rl.queue <- resultRecord{Time: now, RequestID: requestID, JobID: jobID, prediction: pred}:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		total := rl.dropped.Add(int64(dropped))
+		requestLogger(ctx).Warn("results log queue full; records dropped", "dropped", dropped, "dropped_total", total)
+	}
+}
+
+func (rl *resultLog) run() {
+	defer close(rl.done)
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+
+	batch := make([]resultRecord, 0, maxResultsBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resultsWriteTimeout)
+		defer cancel()
+		if err := rl.sink.write(ctx, batch); err != nil {
+			slog.Error("write results log failed", "records", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case rec := <-rl.queue:
+			batch = append(batch, rec)
+			if len(batch) >= maxResultsBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-rl.stop:
+			for {
+				select {
+				case rec := <-rl.queue:
+					batch = append(batch, rec)
+					if len(batch) >= maxResultsBatch {
+						flush()
+					}
+				default:
+					flush()
+					if err := rl.sink.close(); err != nil {
+						slog.Error("close results log failed", "error", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes out queued records and closes the sink, giving up when ctx
+// is done.
+func (rl *resultLog) close(ctx context.Context) error {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+	select {
+	case <-rl.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recordResults adds a finished batch to the results log, if one is
+// configured.
+func (s *server) recordResults(ctx context.Context, jobID string, results []prediction) {
+	if s.results != nil {
+		s.results.record(ctx, jobID, results)
+	}
+}
+
+// encodeRecords renders records as JSON lines.
+func encodeRecords(records []resultRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fileSink appends records to a local file.
+type fileSink struct {
+	f *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (fs *fileSink) write(_ context.Context, records []resultRecord) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	_, err = fs.f.Write(data)
+	return err
+}
+
+func (fs *fileSink) close() error {
+	return fs.f.Close()
+}
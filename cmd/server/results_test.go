@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultLogFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	sink, err := newFileSink(path)
+	if err != nil {
+		t.Fatalf("newFileSink() error = %v", err)
+	}
+	rl := newResultLog(sink, 16, time.Hour)
+	ctx := withRequestID(context.Background(), "req-1")
+	rl.record(ctx, "job-1", []prediction{
+		{Filename: "a.jpg", Tags: map[string]float64{"1girl": 0.9}},
+		{Filename: "b.jpg", Error: "decode failed"},
+	})
+	if err := rl.close(context.Background()); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	var got []resultRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec resultRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", scanner.Text(), err)
+		}
+		got = append(got, rec)
+	}
+	if len(got) != 2 {
+		t.Fatalf("records = %d, want 2", len(got))
+	}
+	if got[0].Filename != "a.jpg" || got[0].Tags["1girl"] != 0.9 || got[0].RequestID != "req-1" || got[0].JobID != "job-1" || got[0].Time.IsZero() {
+		t.Fatalf("first record = %+v", got[0])
+	}
+	if got[1].Error != "decode failed" {
+		t.Fatalf("second record error = %q, want decode failed", got[1].Error)
+	}
+}
+
+type blockingSink struct {
+	writing chan int
+	release chan struct{}
+}
+
+func (bs *blockingSink) write(_ context.Context, records []resultRecord) error {
+	bs.writing <- len(records)
+	<-bs.release
+	return nil
+}
+
+func (bs *blockingSink) close() error { return nil }
+
+func TestResultLogDropsWhenFull(t *testing.T) {
+	t.Parallel()
+
+	sink := &blockingSink{writing: make(chan int, 4), release: make(chan struct{})}
+	rl := newResultLog(sink, 1, 10*time.Millisecond)
+	rl.record(context.Background(), "", []prediction{{Filename: "a.jpg"}})
+	<-sink.writing
+
+	rl.record(context.Background(), "", []prediction{{Filename: "b.jpg"}, {Filename: "c.jpg"}, {Filename: "d.jpg"}})
+	if got := rl.dropped.Load(); got != 2 {
+		t.Fatalf("dropped = %d, want 2", got)
+	}
+	close(sink.release)
+	if err := rl.close(context.Background()); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	if n := <-sink.writing; n != 1 {
+		t.Fatalf("final batch = %d records, want 1", n)
+	}
+}
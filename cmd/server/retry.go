@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPredictRetries      = 1
+	defaultPredictRetryBackoff = 500 * time.Millisecond
+)
+
+// defaultRetryableErrors are worker error substrings that usually clear up on
+// a second try, chiefly a GPU that was briefly short of memory.
+var defaultRetryableErrors = []string{
+	"CUDA out of memory",
+	"CUBLAS_STATUS_ALLOC_FAILED",
+	"CUDNN_STATUS_ALLOC_FAILED",
+}
+
+// retryPolicy says how often a request the worker rejected with a transient
+// error is sent again. The zero value never retries.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	match    []string
+}
+
+// retryable reports whether err came from the worker and contains one of the
+// configured substrings, compared case-insensitively, or is a remote
+// predictor that could not be reached. Timeouts, cancellations and dead
+// workers are handled by the pool's failover, not here.
+func (p retryPolicy) retryable(err error) bool {
+	if errors.Is(err, errPredictorUnavailable) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errWorkerNotRunning) || errors.Is(err, errWorkerRestarting) || errors.Is(err, errWorkerDesync) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range p.match {
+		if strings.Contains(msg, strings.ToLower(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is the wait before retry number attempt, doubling from backoff.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	return p.backoff << (attempt - 1)
+}
+
+// predictWithRetry runs predict under the pool's retry policy.
+func (wp *workerPool) predictWithRetry(ctx context.Context, files []string, onPrediction func(prediction), predict func(func(prediction)) ([]prediction, error)) ([]prediction, error) {
+	return wp.retry.do(ctx, files, onPrediction, predict)
+}
+
+// do runs predict and sends the request again while it keeps failing with a
+// retryable error. onPrediction, when set, only sees each file once even if
+// an earlier attempt already streamed it.
+func (p retryPolicy) do(ctx context.Context, files []string, onPrediction func(prediction), predict func(func(prediction)) ([]prediction, error)) ([]prediction, error) {
+	if onPrediction != nil && p.attempts > 0 {
+		seen := make(map[string]bool, len(files))
+		inner := onPrediction
+		onPrediction = func(pred prediction) {
+			if !seen[pred.Filename] {
+				seen[pred.Filename] = true
+				inner(pred)
+			}
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		predictions, err := predict(onPrediction)
+		if err == nil || attempt > p.attempts || !p.retryable(err) {
+			return predictions, err
+		}
+		delay := p.delay(attempt)
+		requestLogger(ctx).Warn("retrying prediction after transient worker error",
+			"attempt", attempt, "max_retries", p.attempts, "files", len(files), "backoff_ms", delay.Milliseconds(), "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	t.Parallel()
+
+	p := retryPolicy{attempts: 1, match: defaultRetryableErrors}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("CUDA out of memory. Tried to allocate 2.00 GiB"), true},
+		{errors.New("RuntimeError: cuda OUT OF MEMORY"), true},
+		{errors.New("cannot identify image file"), false},
+		{errWorkerNotRunning, false},
+		{errWorkerDesync, false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		if got := p.retryable(tc.err); got != tc.want {
+			t.Fatalf("retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if (retryPolicy{}).retryable(errors.New("CUDA out of memory")) {
+		t.Fatal("retryable() with no patterns = true")
+	}
+}
+
+// fakeRetryWorker answers each request with the next of errs, or with a
+// prediction for the request's first file once errs run out.
+func fakeRetryWorker(t *testing.T, errs ...string) (*workerClient, *int) {
+	t.Helper()
+	calls := new(int)
+	wc := newFakeWorker(t, func(line []byte, w io.Writer) {
+		var req workerRequest
+		_ = json.Unmarshal(line, &req)
+		*calls++
+		if len(errs) > 0 {
+			fmt.Fprintf(w, `{"id":%d,"error":%q}`+"\n", req.ID, errs[0])
+			errs = errs[1:]
+			return
+		}
+		fmt.Fprintf(w, `{"id":%d,"predictions":[{"filename":"a.png","tags":{"cat":0.9}}]}`+"\n", req.ID)
+	})
+	return wc, calls
+}
+
+func TestWorkerPoolRetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		errs      []string
+		attempts  int
+		wantErr   bool
+		wantCalls int
+	}{
+		{"recovers", []string{"CUDA out of memory"}, 2, false, 2},
+		{"gives up", []string{"CUDA out of memory", "CUDA out of memory"}, 1, true, 2},
+		{"not retryable", []string{"cannot identify image file"}, 2, true, 1},
+		{"disabled", []string{"CUDA out of memory"}, 0, true, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			wc, calls := fakeRetryWorker(t, tc.errs...)
+			pool := &workerPool{
+				workers: []*workerClient{wc},
+				retry:   retryPolicy{attempts: tc.attempts, backoff: time.Millisecond, match: defaultRetryableErrors},
+			}
+			preds, err := pool.predict(context.Background(), []string{"/t/a.png"}, predictParams{})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("predict() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && (len(preds) != 1 || preds[0].Tags["cat"] != 0.9) {
+				t.Fatalf("predict() = %+v", preds)
+			}
+			if *calls != tc.wantCalls {
+				t.Fatalf("worker saw %d requests, want %d", *calls, tc.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultS3FlushInterval = time.Minute
+
+// awsCredentials are the static keys used to sign S3 requests.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3Sink uploads each batch of records as its own JSON lines object, since
+// S3 objects cannot be appended to. Keys are
+// <prefix>/YYYY/MM/DD/<time>-<random>.jsonl.
+type s3Sink struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	creds    awsCredentials
+	now      func() time.Time
+}
+
+// newS3Sink builds a sink for bucket. With an empty endpoint it talks to AWS
+// using virtual-hosted URLs; a custom endpoint, such as MinIO, is addressed
+// path-style.
+func newS3Sink(bucket, prefix, region, endpoint string, creds awsCredentials) (*s3Sink, error) {
+	if bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	var u *url.URL
+	if endpoint == "" {
+		u = &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com"}
+	} else {
+		var err error
+		u, err = url.Parse(strings.TrimRight(endpoint, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+		u.Path += "/" + bucket
+	}
+	return &s3Sink{
+		client:   &http.Client{Timeout: resultsWriteTimeout},
+		endpoint: u,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		region:   region,
+		creds:    creds,
+		now:      time.Now,
+	}, nil
+}
+
+func (ss *s3Sink) objectKey(t time.Time) (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	t = t.UTC()
+	name := t.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(b[:]) + ".jsonl"
+	return path.Join(ss.prefix, t.Format("2006/01/02"), name), nil
+}
+
+func (ss *s3Sink) write(ctx context.Context, records []resultRecord) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	now := ss.now()
+	key, err := ss.objectKey(now)
+	if err != nil {
+		return err
+	}
+	u := *ss.endpoint
+	u.Path += "/" + key
+	u.RawPath = awsEscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	sum := sha256.Sum256(data)
+	signV4(req, hex.EncodeToString(sum[:]), ss.creds, ss.region, "s3", now)
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("put s3://%s/%s: status %d: %s", ss.bucket, key, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (ss *s3Sink) close() error {
+	return nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set. Requests must not carry a
+// query string.
+func signV4(req *http.Request, payloadHash string, creds awsCredentials, region, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	names := []string{"host"}
+	for name, vals := range req.Header {
+		name = strings.ToLower(name)
+		trimmed := make([]string, len(vals))
+		for i, v := range vals {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[name] = strings.Join(trimmed, ",")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath percent-encodes everything in p except unreserved
+// characters and slashes, as SigV4 expects.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// modeAll asks the worker for every tag score, with no threshold or limit.
+// Clients select it with include_all or histogram; it is not a mode value.
+const modeAll = "all"
+
+const (
+	defaultHistogramBuckets = 10
+	maxHistogramBuckets     = 100
+	maxRoundDigits          = 10
+)
+
+// parseHistogramBuckets reads the histogram bucket count: 0 when no
+// histogram is wanted, defaultHistogramBuckets when only enabled.
+func parseHistogramBuckets(enabled bool, raw string) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if !enabled && raw == "" {
+		return 0, nil
+	}
+	if raw == "" {
+		return defaultHistogramBuckets, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 2 || n > maxHistogramBuckets {
+		return 0, badRequest(fmt.Sprintf("histogram_buckets must be an integer between 2 and %d", maxHistogramBuckets))
+	}
+	return n, nil
+}
+
+// parseMaxTags reads the max_tags cap; 0 when there is none.
+func parseMaxTags(raw string) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, paramError("max_tags", "max_tags must be a positive integer")
+	}
+	return n, nil
+}
+
+// capTags keeps the n best-scoring tags of pred. It runs after implications
+// and the rating split, which can add tags beyond the worker's limit, and
+// drops the categories and implied entries of the tags it removes.
+func capTags(pred *prediction, n int) {
+	if n <= 0 || len(pred.Tags) <= n {
+		return
+	}
+	kept := orderedTags(pred.Tags, sortScore)[:n]
+	tags := make(map[string]float64, n)
+	for _, tag := range kept {
+		tags[tag.Name] = tag.Score
+	}
+	for name := range pred.Categories {
+		if _, ok := tags[name]; !ok {
+			delete(pred.Categories, name)
+		}
+	}
+	implied := pred.Implied[:0]
+	for _, name := range pred.Implied {
+		if _, ok := tags[name]; ok {
+			implied = append(implied, name)
+		}
+	}
+	if len(implied) == 0 {
+		implied = nil
+	}
+	pred.Implied = implied
+	pred.Tags = tags
+}
+
+// scoreHistogram counts scores into n equal-width buckets over [0, 1]. The
+// last bucket includes 1.
+func scoreHistogram(tags map[string]float64, n int) []int {
+	counts := make([]int, n)
+	for _, score := range tags {
+		i := int(score * float64(n))
+		if i >= n {
+			i = n - 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		counts[i]++
+	}
+	return counts
+}
+
+// trimScores turns a full score dump back into what the request asked for:
+// the histogram if requested, and every score only with include_all.
+// Otherwise the request's mode, thresholds and limit are applied here, as
+// the worker would have.
+func trimScores(pred prediction, req *evalRequest) prediction {
+	if req.histogramBuckets > 0 {
+		pred.Histogram = scoreHistogram(pred.Tags, req.histogramBuckets)
+	}
+	if req.includeAll {
+		return pred
+	}
+
+	pairs := make([]tagPair, 0, len(pred.Tags))
+	for tag, score := range pred.Tags {
+		if req.mode != modeTopK {
+			threshold := req.threshold
+			category := pred.Categories[tag]
+			if category == "" {
+				category = defaultTagCategory
+			}
+			if t, ok := req.categoryThresholds[category]; ok {
+				threshold = t
+			}
+			if score < threshold {
+				continue
+			}
+		}
+		pairs = append(pairs, tagPair{Name: tag, Score: score})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Score != pairs[j].Score {
+			return pairs[i].Score > pairs[j].Score
+		}
+		return pairs[i].Name < pairs[j].Name
+	})
+	if len(pairs) > req.limit {
+		pairs = pairs[:req.limit]
+	}
+
+	tags := make(map[string]float64, len(pairs))
+	var categories map[string]string
+	for _, p := range pairs {
+		tags[p.Name] = p.Score
+		if category, ok := pred.Categories[p.Name]; ok {
+			if categories == nil {
+				categories = make(map[string]string, len(pairs))
+			}
+			categories[p.Name] = category
+		}
+	}
+	pred.Tags = tags
+	pred.Categories = categories
+	return pred
+}
+
+// parseRound reads the round parameter, the number of decimals to keep in
+// scores. ok is false when scores keep full precision.
+func parseRound(raw string) (digits int, ok bool, err error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 || n > maxRoundDigits {
+		return 0, false, badRequest(fmt.Sprintf("round must be an integer between 0 and %d", maxRoundDigits))
+	}
+	return n, true, nil
+}
+
+// adjustScores rescales tags in place so the top score is 1 when the
+// request asks to normalize, then rounds them if it asks to round. It runs
+// after thresholds and limits have been applied.
+func adjustScores(tags map[string]float64, req *evalRequest) {
+	if req.normalize {
+		top := 0.0
+		for _, score := range tags {
+			top = max(top, score)
+		}
+		if top > 0 {
+			for tag, score := range tags {
+				tags[tag] = score / top
+			}
+		}
+	}
+	if req.round {
+		scale := math.Pow(10, float64(req.roundDigits))
+		for tag, score := range tags {
+			tags[tag] = math.Round(score*scale) / scale
+		}
+	}
+}
+
+// scoreBands are the lower bounds of the high and medium confidence bands
+// the HTML page colors scores by; anything below Medium is low.
+type scoreBands struct {
+	High   float64
+	Medium float64
+}
+
+var defaultScoreBands = scoreBands{High: 0.7, Medium: 0.35}
+
+// parseScoreBands reads SCORE_BANDS, "high,medium" such as "0.7,0.35".
+func parseScoreBands(raw string) (scoreBands, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return defaultScoreBands, nil
+	}
+	high, medium, ok := strings.Cut(raw, ",")
+	if !ok {
+		return scoreBands{}, fmt.Errorf("score bands must be two comma-separated numbers, got %q", raw)
+	}
+	var bands scoreBands
+	var err error
+	if bands.High, err = strconv.ParseFloat(strings.TrimSpace(high), 64); err != nil || !validThreshold(bands.High) {
+		return scoreBands{}, fmt.Errorf("high band %q must be between 0 and 1", high)
+	}
+	if bands.Medium, err = strconv.ParseFloat(strings.TrimSpace(medium), 64); err != nil || !validThreshold(bands.Medium) {
+		return scoreBands{}, fmt.Errorf("medium band %q must be between 0 and 1", medium)
+	}
+	if bands.Medium > bands.High {
+		return scoreBands{}, fmt.Errorf("medium band %g is above the high band %g", bands.Medium, bands.High)
+	}
+	return bands, nil
+}
+
+// scoreClass maps a score to the text color of its confidence band.
+func scoreClass(bands scoreBands, score float64) string {
+	switch {
+	case score >= bands.High:
+		return "text-green-600 font-bold"
+	case score >= bands.Medium:
+		return "text-amber-600"
+	default:
+		return "text-gray-400"
+	}
+}
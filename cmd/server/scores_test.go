@@ -0,0 +1,212 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestScoreHistogram(t *testing.T) {
+	t.Parallel()
+
+	tags := map[string]float64{"a": 0, "b": 0.05, "c": 0.5, "d": 0.99, "e": 1}
+	if got, want := scoreHistogram(tags, 4), []int{2, 0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scoreHistogram() = %v, want %v", got, want)
+	}
+}
+
+func TestTrimScores(t *testing.T) {
+	t.Parallel()
+
+	dump := prediction{
+		Tags:       map[string]float64{"1girl": 0.9, "solo": 0.6, "hatsune_miku": 0.4, "smile": 0.2, "blush": 0.01},
+		Categories: map[string]string{"1girl": "general", "solo": "general", "hatsune_miku": "character", "smile": "general", "blush": "general"},
+	}
+
+	tests := []struct {
+		name     string
+		req      *evalRequest
+		wantTags []string
+	}{
+		{
+			name:     "threshold and limit",
+			req:      &evalRequest{threshold: 0.3, limit: 2, mode: modeThreshold, histogramBuckets: 2},
+			wantTags: []string{"1girl", "solo"},
+		},
+		{
+			name:     "category threshold",
+			req:      &evalRequest{threshold: 0.5, limit: 10, mode: modeThreshold, histogramBuckets: 2, categoryThresholds: map[string]float64{"character": 0.3}},
+			wantTags: []string{"1girl", "hatsune_miku", "solo"},
+		},
+		{
+			name:     "topk ignores threshold",
+			req:      &evalRequest{threshold: 0.95, limit: 4, mode: modeTopK, histogramBuckets: 2},
+			wantTags: []string{"1girl", "hatsune_miku", "smile", "solo"},
+		},
+		{
+			name:     "include all",
+			req:      &evalRequest{threshold: 0.95, limit: 1, mode: modeThreshold, includeAll: true},
+			wantTags: []string{"1girl", "blush", "hatsune_miku", "smile", "solo"},
+		},
+	}
+	for _, tc := range tests {
+		got := trimScores(dump, tc.req)
+		names := make([]string, 0, len(got.Tags))
+		for name := range got.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.wantTags) {
+			t.Fatalf("%s: tags = %v, want %v", tc.name, names, tc.wantTags)
+		}
+		if len(got.Categories) > len(got.Tags) {
+			t.Fatalf("%s: categories %v kept for dropped tags", tc.name, got.Categories)
+		}
+		if tc.req.histogramBuckets > 0 && !reflect.DeepEqual(got.Histogram, []int{3, 2}) {
+			t.Fatalf("%s: histogram = %v, want [3 2]", tc.name, got.Histogram)
+		}
+	}
+	if len(dump.Tags) != 5 {
+		t.Fatal("trimScores() modified the shared prediction")
+	}
+}
+
+func TestParseHistogramBuckets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		enabled bool
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{want: 0},
+		{enabled: true, want: defaultHistogramBuckets},
+		{raw: "20", want: 20},
+		{raw: "1", wantErr: true},
+		{enabled: true, raw: "x", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseHistogramBuckets(tc.enabled, tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseHistogramBuckets(%v, %q) = %d, %v; want %d, wantErr %v", tc.enabled, tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestCapTags(t *testing.T) {
+	t.Parallel()
+
+	for _, raw := range []string{"0", "-2", "many"} {
+		if _, err := parseMaxTags(raw); err == nil {
+			t.Fatalf("parseMaxTags(%q) error = nil, want an error", raw)
+		}
+	}
+	if n, err := parseMaxTags(""); err != nil || n != 0 {
+		t.Fatalf("parseMaxTags(\"\") = %d, %v; want 0, nil", n, err)
+	}
+
+	// The request's limit was 2; implications brought in animal_ears.
+	pred := prediction{
+		Tags:       map[string]float64{"cat_ears": 0.9, "animal_ears": 0.9, "solo": 0.4},
+		Categories: map[string]string{"cat_ears": "general", "animal_ears": "general", "solo": "general"},
+		Implied:    []string{"animal_ears"},
+	}
+	capTags(&pred, 0)
+	if len(pred.Tags) != 3 {
+		t.Fatalf("capTags(0) kept %v, want every tag", pred.Tags)
+	}
+	capTags(&pred, 1)
+	if want := map[string]float64{"animal_ears": 0.9}; !reflect.DeepEqual(pred.Tags, want) {
+		t.Fatalf("tags = %v, want %v", pred.Tags, want)
+	}
+	if len(pred.Categories) != 1 || !reflect.DeepEqual(pred.Implied, []string{"animal_ears"}) {
+		t.Fatalf("categories = %v, implied = %v; want only animal_ears", pred.Categories, pred.Implied)
+	}
+}
+
+func TestAdjustScores(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		req  evalRequest
+		want map[string]float64
+	}{
+		{"unchanged", evalRequest{}, map[string]float64{"a": 0.8123456789, "b": 0.4}},
+		{"round", evalRequest{round: true, roundDigits: 3}, map[string]float64{"a": 0.812, "b": 0.4}},
+		{"normalize", evalRequest{normalize: true}, map[string]float64{"a": 1, "b": 0.4 / 0.8123456789}},
+		{"both", evalRequest{normalize: true, round: true, roundDigits: 2}, map[string]float64{"a": 1, "b": 0.49}},
+	}
+	for _, tc := range tests {
+		tags := map[string]float64{"a": 0.8123456789, "b": 0.4}
+		adjustScores(tags, &tc.req)
+		for tag, want := range tc.want {
+			if math.Abs(tags[tag]-want) > 1e-12 {
+				t.Fatalf("%s: adjustScores() = %v, want %v", tc.name, tags, tc.want)
+			}
+		}
+	}
+}
+
+func TestParseRound(t *testing.T) {
+	t.Parallel()
+
+	if _, ok, err := parseRound(""); ok || err != nil {
+		t.Fatalf("parseRound(\"\") ok = %v, err = %v; want false, nil", ok, err)
+	}
+	if digits, ok, err := parseRound("4"); !ok || err != nil || digits != 4 {
+		t.Fatalf("parseRound(\"4\") = %d, %v, %v; want 4, true, nil", digits, ok, err)
+	}
+	for _, raw := range []string{"-1", "11", "x"} {
+		if _, _, err := parseRound(raw); !isRequestError(err) {
+			t.Fatalf("parseRound(%q) error = %v, want a request error", raw, err)
+		}
+	}
+}
+
+func TestParseScoreBands(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		want    scoreBands
+		wantErr bool
+	}{
+		{"", defaultScoreBands, false},
+		{"0.9, 0.5", scoreBands{High: 0.9, Medium: 0.5}, false},
+		{"0.5,0.5", scoreBands{High: 0.5, Medium: 0.5}, false},
+		{"0.5,0.9", scoreBands{}, true},
+		{"0.9", scoreBands{}, true},
+		{"1.5,0.5", scoreBands{}, true},
+		{"0.9,abc", scoreBands{}, true},
+	}
+	for _, tc := range tests {
+		got, err := parseScoreBands(tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseScoreBands(%q) = %v, %v; want %v, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestScoreClass(t *testing.T) {
+	t.Parallel()
+
+	bands := scoreBands{High: 0.8, Medium: 0.4}
+	tests := []struct {
+		score float64
+		want  string
+	}{
+		{0.95, "text-green-600 font-bold"},
+		{0.8, "text-green-600 font-bold"},
+		{0.5, "text-amber-600"},
+		{0.4, "text-amber-600"},
+		{0.1, "text-gray-400"},
+	}
+	for _, tc := range tests {
+		if got := scoreClass(bands, tc.score); got != tc.want {
+			t.Fatalf("scoreClass(%g) = %q, want %q", tc.score, got, tc.want)
+		}
+	}
+}
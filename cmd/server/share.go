@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSharedResults   = 100
+	defaultSharedResultTTL = 24 * time.Hour
+)
+
+// sharedResults keeps rendered HTML result pages under random tokens so a
+// reviewer can pass a link to /results/{token} around. The token is the only
+// credential: the page is served without an API key. Pages expire after ttl,
+// and once capacity pages are kept the one closest to expiry makes room. A
+// nil store is valid and keeps nothing.
+type sharedResults struct {
+	mu       sync.Mutex
+	pages    map[string]sharedPage
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+type sharedPage struct {
+	page    evaluatePage
+	expires time.Time
+}
+
+func newSharedResults(capacity int, ttl time.Duration) *sharedResults {
+	if capacity < 1 || ttl <= 0 {
+		return nil
+	}
+	return &sharedResults{
+		pages:    make(map[string]sharedPage, capacity),
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// put stores page and returns its token. The previews are encoded now,
+// since the request's uploads are removed once it returns.
+func (sr *sharedResults) put(page evaluatePage) (string, error) {
+	page, err := keepPreviews(page)
+	if err != nil {
+		return "", err
+	}
+	token, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	now := sr.now()
+	for t, p := range sr.pages {
+		if !now.Before(p.expires) {
+			delete(sr.pages, t)
+		}
+	}
+	if len(sr.pages) >= sr.capacity {
+		oldest := ""
+		for t, p := range sr.pages {
+			if oldest == "" || p.expires.Before(sr.pages[oldest].expires) {
+				oldest = t
+			}
+		}
+		delete(sr.pages, oldest)
+	}
+	sr.pages[token] = sharedPage{page: page, expires: now.Add(sr.ttl)}
+	return token, nil
+}
+
+// keepPreviews returns a copy of page whose results carry their encoded
+// previews instead of reading them from disk.
+func keepPreviews(page evaluatePage) (evaluatePage, error) {
+	results := make([]htmlResult, len(page.Results))
+	for i, result := range page.Results {
+		if result.path != "" {
+			data, err := result.ImageData()
+			if err != nil {
+				return page, err
+			}
+			result.imageData = data
+			result.path = ""
+		}
+		results[i] = result
+	}
+	page.Results = results
+	return page, nil
+}
+
+func (sr *sharedResults) get(token string) (evaluatePage, bool) {
+	if sr == nil {
+		return evaluatePage{}, false
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	p, ok := sr.pages[token]
+	if !ok || !sr.now().Before(p.expires) {
+		return evaluatePage{}, false
+	}
+	return p.page, true
+}
+
+func (sr *sharedResults) len() int {
+	if sr == nil {
+		return 0
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return len(sr.pages)
+}
+
+// handleSharedResult serves GET /results/{token}.
+func (s *server) handleSharedResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, ok := s.shared.get(strings.TrimPrefix(r.URL.Path, "/results/"))
+	if !ok {
+		s.writeError(w, "html", http.StatusNotFound, codeNotFound, "result not found or expired")
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := s.evalTmpl.Execute(w, page); err != nil {
+		requestLogger(r.Context()).Error("render shared result failed", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedResults(t *testing.T) {
+	t.Parallel()
+
+	if newSharedResults(0, time.Hour) != nil || newSharedResults(1, 0) != nil {
+		t.Fatal("newSharedResults() without capacity or TTL != nil")
+	}
+	now := time.Unix(1000, 0)
+	sr := newSharedResults(2, time.Minute)
+	sr.now = func() time.Time { return now }
+
+	first, err := sr.put(evaluatePage{Limit: 1})
+	if err != nil {
+		t.Fatalf("put() error = %v", err)
+	}
+	now = now.Add(time.Second)
+	second, _ := sr.put(evaluatePage{Limit: 2})
+	third, _ := sr.put(evaluatePage{Limit: 3})
+	if _, ok := sr.get(first); ok || sr.len() != 2 {
+		t.Fatalf("first page kept past capacity; %d pages", sr.len())
+	}
+	if page, ok := sr.get(second); !ok || page.Limit != 2 {
+		t.Fatalf("get(second) = %+v, %v; want the second page", page, ok)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := sr.get(third); ok {
+		t.Fatal("get() after the TTL found the page")
+	}
+	var nilStore *sharedResults
+	if _, ok := nilStore.get(third); ok || nilStore.len() != 0 {
+		t.Fatal("nil store found a page")
+	}
+}
+
+func TestHandleEvaluateShareableResult(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = &mockPredictor{}
+	s.shared = newSharedResults(4, time.Hour)
+	s.apiKeys = parseAPIKeys("secret")
+	handler := s.routes()
+
+	var img, body bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "a.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile() error = %v", err)
+	}
+	_, _ = part.Write(img.Bytes())
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/evaluate", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/results/") {
+		t.Fatalf("status = %d, Location = %q; want a 303 to /results/", rr.Code, location)
+	}
+
+	// The link works without the API key.
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, location, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "</html>") {
+		t.Fatalf("GET %s = %d, want the results page", location, rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/results/unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("GET /results/unknown = %d, want 404", rr.Code)
+	}
+}
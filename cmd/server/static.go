@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// staticFiles holds the favicon and any CSS/JS the HTML pages reference.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// staticCacheControl lets browsers and proxies keep assets for a day; the
+// ETag makes revalidation after that a 304.
+const staticCacheControl = "public, max-age=86400"
+
+type staticAsset struct {
+	data []byte
+	etag string
+}
+
+// staticAssets is staticFiles keyed by path under static/, with an ETag
+// derived from each file's contents since embedded files have no mtime.
+var staticAssets = loadStaticAssets(staticFiles)
+
+func loadStaticAssets(fsys fs.FS) map[string]staticAsset {
+	assets := map[string]staticAsset{}
+	err := fs.WalkDir(fsys, "static", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		assets[strings.TrimPrefix(path, "static/")] = staticAsset{
+			data: data,
+			etag: `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return assets
+}
+
+// handleStatic serves /static/ and /favicon.ico from the embedded assets.
+func (s *server) handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	if r.URL.Path == "/favicon.ico" {
+		name = "favicon.ico"
+	}
+	asset, ok := staticAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", staticCacheControl)
+	w.Header().Set("ETag", asset.etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.data))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHandleStatic(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.apiKeys = parseAPIKeys("secret")
+	handler := s.routes()
+
+	favicon, ok := staticAssets["favicon.ico"]
+	if !ok {
+		t.Fatal("favicon.ico is not embedded")
+	}
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{name: "favicon", method: http.MethodGet, path: "/favicon.ico", wantStatus: http.StatusOK},
+		{name: "under static", method: http.MethodGet, path: "/static/favicon.ico", wantStatus: http.StatusOK},
+		{name: "head", method: http.MethodHead, path: "/favicon.ico", wantStatus: http.StatusOK},
+		{name: "revalidate", method: http.MethodGet, path: "/favicon.ico", ifNoneMatch: favicon.etag, wantStatus: http.StatusNotModified},
+		{name: "stale etag", method: http.MethodGet, path: "/favicon.ico", ifNoneMatch: `"stale"`, wantStatus: http.StatusOK},
+		{name: "missing", method: http.MethodGet, path: "/static/missing.js", wantStatus: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, path: "/favicon.ico", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		if got := rr.Header().Get("Cache-Control"); got != staticCacheControl {
+			t.Fatalf("%s: Cache-Control = %q, want %q", tc.name, got, staticCacheControl)
+		}
+		if got := rr.Header().Get("ETag"); got != favicon.etag {
+			t.Fatalf("%s: ETag = %q, want %q", tc.name, got, favicon.etag)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "image/vnd.microsoft.icon" && got != "image/x-icon" {
+			t.Fatalf("%s: Content-Type = %q, want an icon type", tc.name, got)
+		}
+		if tc.method == http.MethodGet && rr.Body.Len() != len(favicon.data) {
+			t.Fatalf("%s: body is %d bytes, want %d", tc.name, rr.Body.Len(), len(favicon.data))
+		}
+	}
+}
+
+func TestAppCSSCoversTemplateClasses(t *testing.T) {
+	t.Parallel()
+
+	css, ok := staticAssets["app.css"]
+	if !ok {
+		t.Fatal("app.css is not embedded")
+	}
+	if !strings.Contains(evaluateHTML, `href="/static/app.css"`) || strings.Contains(evaluateHTML, "cdn.") {
+		t.Fatal("evaluate template does not load the embedded stylesheet alone")
+	}
+
+	classes := []string{}
+	for _, m := range regexp.MustCompile(`class="([^"]*)"`).FindAllStringSubmatch(evaluateHTML, -1) {
+		classes = append(classes, strings.Fields(regexp.MustCompile(`{{[^}]*}}`).ReplaceAllString(m[1], ""))...)
+	}
+	for _, category := range []string{"artist", "copyright", "character", "meta", "general"} {
+		classes = append(classes, strings.Fields(categoryClass(category))...)
+	}
+	bands := defaultScoreBands
+	for _, score := range []float64{1, bands.Medium, 0} {
+		classes = append(classes, strings.Fields(scoreClass(bands, score))...)
+	}
+	escaper := strings.NewReplacer(":", `\:`, "[", `\[`, "]", `\]`)
+	for _, class := range classes {
+		if !strings.Contains(string(css.data), "."+escaper.Replace(class)+" ") &&
+			!strings.Contains(string(css.data), "."+escaper.Replace(class)+":hover ") {
+			t.Errorf("class %q is not defined in app.css", class)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sort"
+
+// tagSummary is one tag of a batch summary: how many images it was returned
+// for and its mean score over those images.
+type tagSummary struct {
+	Name      string  `json:"name"`
+	Count     int     `json:"count"`
+	MeanScore float64 `json:"mean_score"`
+}
+
+// summaryResponse is the body of format=summary: the summary instead of the
+// per-image results.
+type summaryResponse struct {
+	Images  int          `json:"images"`
+	Summary []tagSummary `json:"summary"`
+	Errors  []fileError  `json:"errors"`
+}
+
+// summarizeTags aggregates the tags of the successful results, most frequent
+// first. Ties go to the higher mean score, then to the name.
+func summarizeTags(results []prediction) []tagSummary {
+	byName := make(map[string]*tagSummary)
+	for _, pred := range results {
+		if pred.Error != "" {
+			continue
+		}
+		for name, score := range pred.Tags {
+			sum, ok := byName[name]
+			if !ok {
+				sum = &tagSummary{Name: name}
+				byName[name] = sum
+			}
+			sum.Count++
+			// MeanScore holds the total until every image is counted.
+			sum.MeanScore += score
+		}
+	}
+	summary := make([]tagSummary, 0, len(byName))
+	for _, sum := range byName {
+		sum.MeanScore /= float64(sum.Count)
+		summary = append(summary, *sum)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		a, b := summary[i], summary[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.MeanScore != b.MeanScore {
+			return a.MeanScore > b.MeanScore
+		}
+		return a.Name < b.Name
+	})
+	return summary
+}
+
+// newSummaryResponse builds the format=summary body for results.
+func newSummaryResponse(results []prediction) summaryResponse {
+	resp := newEvaluateResponse(results)
+	return summaryResponse{Images: len(resp.Results), Summary: summarizeTags(results), Errors: resp.Errors}
+}
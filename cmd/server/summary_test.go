@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeTags(t *testing.T) {
+	t.Parallel()
+
+	results := []prediction{
+		{Filename: "a.png", Tags: map[string]float64{"solo": 0.9, "smile": 0.5}},
+		{Filename: "b.png", Tags: map[string]float64{"solo": 0.7, "blush": 0.6}},
+		{Filename: "c.png", Tags: map[string]float64{}, Error: "worker returned no prediction for this file"},
+		{Filename: "d.png", Tags: map[string]float64{"smile": 0.3, "blush": 0.8}},
+	}
+	// Every tag appears twice, so the mean score decides.
+	want := []tagSummary{
+		{Name: "solo", Count: 2, MeanScore: 0.8},
+		{Name: "blush", Count: 2, MeanScore: 0.7},
+		{Name: "smile", Count: 2, MeanScore: 0.4},
+	}
+	got := summarizeTags(results)
+	if len(got) != len(want) {
+		t.Fatalf("summarizeTags() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].Count != want[i].Count || math.Abs(got[i].MeanScore-want[i].MeanScore) > 1e-9 {
+			t.Fatalf("summarizeTags()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := summarizeTags(nil); len(got) != 0 {
+		t.Fatalf("summarizeTags(nil) = %+v, want empty", got)
+	}
+}
+
+func TestHandleEvaluateSummary(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	s.predictor = &mockPredictor{}
+	rr := httptest.NewRecorder()
+	s.handleEvaluate(rr, evaluateJSONRequest(t, `,"summary":true`))
+	var resp evaluateResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rr.Code, rr.Body)
+	}
+	if len(resp.Summary) != 1 || resp.Summary[0].Count != 1 || len(resp.Results) != 1 {
+		t.Fatalf("response = %+v, want one result and its tag in the summary", resp)
+	}
+	if !reflect.DeepEqual(newSummaryResponse(resp.Results).Summary, resp.Summary) {
+		t.Fatal("format=summary and summary=1 disagree")
+	}
+}
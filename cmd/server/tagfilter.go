@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tagFilter drops tags from predictions before they are returned. A tag is
+// kept when it matches the allow list (if one is set) and no deny pattern.
+// A nil filter keeps everything.
+type tagFilter struct {
+	allow []string
+	deny  []string
+}
+
+func newTagFilter(allow, deny []string) *tagFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &tagFilter{allow: allow, deny: deny}
+}
+
+func (f *tagFilter) keep(tag string) bool {
+	if f == nil {
+		return true
+	}
+	for _, pattern := range f.deny {
+		if globMatch(pattern, tag) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, pattern := range f.allow {
+		if globMatch(pattern, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTags returns pred with only the tags f keeps. The input maps are not
+// modified.
+func filterTags(pred prediction, f *tagFilter) prediction {
+	if f == nil {
+		return pred
+	}
+	tags := make(map[string]float64, len(pred.Tags))
+	var categories map[string]string
+	if pred.Categories != nil {
+		categories = make(map[string]string, len(pred.Categories))
+	}
+	for name, score := range pred.Tags {
+		if !f.keep(name) {
+			continue
+		}
+		tags[name] = score
+		if category, ok := pred.Categories[name]; ok {
+			categories[name] = category
+		}
+	}
+	pred.Tags = tags
+	pred.Categories = categories
+	return pred
+}
+
+// globMatch reports whether name matches pattern, where * matches any run of
+// characters and ? any single character. Unlike path.Match, / is not special,
+// since tags may contain it.
+func globMatch(pattern, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	pi, ni := 0, 0
+	star, mark := -1, 0
+	for ni < len(n) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == n[ni]):
+			pi++
+			ni++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ni
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			ni = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// loadTagPatterns reads a TAG_WHITELIST/TAG_BLACKLIST value: either the path
+// of a file with one pattern per line (# starts a comment) or a
+// comma-separated list of patterns.
+func loadTagPatterns(raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(raw)
+	if err != nil || !info.Mode().IsRegular() {
+		return splitTagPatterns(raw), nil
+	}
+
+	f, err := os.Open(raw)
+	if err != nil {
+		return nil, fmt.Errorf("open tag list: %w", err)
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		patterns = append(patterns, splitTagPatterns(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read tag list %s: %w", raw, err)
+	}
+	return patterns, nil
+}
+
+func splitTagPatterns(raw string) []string {
+	var patterns []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
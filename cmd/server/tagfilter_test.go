@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"rating:*", "rating:g", true},
+		{"rating:*", "1girl", false},
+		{"*_hair", "long_hair", true},
+		{"*_hair", "hair_ornament", false},
+		{"?girl", "1girl", true},
+		{"?girl", "10girls", false},
+		{"a*b*c", "axxbyyc", true},
+		{"*", "/\\/\\/\\", true},
+		{"solo", "solo", true},
+		{"solo", "solo_focus", false},
+	}
+	for _, tc := range tests {
+		if got := globMatch(tc.pattern, tc.name); got != tc.want {
+			t.Fatalf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFilterTags(t *testing.T) {
+	t.Parallel()
+
+	pred := prediction{
+		Filename:   "a.jpg",
+		Tags:       map[string]float64{"1girl": 0.9, "long_hair": 0.8, "rating:e": 0.7, "solo": 0.6},
+		Categories: map[string]string{"1girl": "general", "rating:e": "general"},
+	}
+	tests := []struct {
+		name   string
+		filter *tagFilter
+		want   []string
+	}{
+		{name: "nil keeps all", filter: nil, want: []string{"1girl", "long_hair", "rating:e", "solo"}},
+		{name: "blacklist", filter: newTagFilter(nil, []string{"rating:*"}), want: []string{"1girl", "long_hair", "solo"}},
+		{name: "whitelist", filter: newTagFilter([]string{"*_hair", "1girl"}, nil), want: []string{"1girl", "long_hair"}},
+		{name: "blacklist wins", filter: newTagFilter([]string{"*"}, []string{"solo"}), want: []string{"1girl", "long_hair", "rating:e"}},
+	}
+	for _, tc := range tests {
+		got := filterTags(pred, tc.filter)
+		names := make([]string, 0, len(got.Tags))
+		for name := range got.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Fatalf("%s: tags = %v, want %v", tc.name, names, tc.want)
+		}
+		for name := range got.Categories {
+			if _, ok := got.Tags[name]; !ok {
+				t.Fatalf("%s: category left for filtered tag %q", tc.name, name)
+			}
+		}
+	}
+	if len(pred.Tags) != 4 {
+		t.Fatal("filterTags modified its input")
+	}
+}
+
+func TestLoadTagPatterns(t *testing.T) {
+	t.Parallel()
+
+	got, err := loadTagPatterns(" rating:*, ,solo ")
+	if err != nil || !reflect.DeepEqual(got, []string{"rating:*", "solo"}) {
+		t.Fatalf("loadTagPatterns(list) = %v, %v", got, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# sensitive\nrating:e\n\nloli, shota # inline\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	got, err = loadTagPatterns(path)
+	if err != nil || !reflect.DeepEqual(got, []string{"rating:e", "loli", "shota"}) {
+		t.Fatalf("loadTagPatterns(file) = %v, %v", got, err)
+	}
+}
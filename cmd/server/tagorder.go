@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Tag orders a request may ask for with sort.
+const (
+	sortScore = "score"
+	sortName  = "name"
+)
+
+// parseSort validates the sort parameter. An empty value keeps the default
+// output: a tags map in JSON and names in alphabetical order in text.
+// ordered=1 is shorthand for sort=score; an explicit sort wins.
+func parseSort(raw string, ordered bool) (string, error) {
+	switch order := strings.ToLower(strings.TrimSpace(raw)); order {
+	case "":
+		if ordered {
+			return sortScore, nil
+		}
+		return "", nil
+	case sortScore, sortName:
+		return order, nil
+	default:
+		return "", paramError("sort", "sort must be name or score")
+	}
+}
+
+// parseFields validates the fields parameter, the keys kept in each entry
+// of the ordered tags array: "name", "score" or "name,score". Asking for
+// fields implies an ordered array, by score unless sort says otherwise; an
+// empty value keeps the default output.
+func parseFields(raw string) (string, error) {
+	var name, score bool
+	for _, field := range strings.Split(raw, ",") {
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "":
+		case "name":
+			name = true
+		case "score":
+			score = true
+		default:
+			return "", paramError("fields", "fields must be name, score or name,score")
+		}
+	}
+	switch {
+	case name && score:
+		return "name,score", nil
+	case name:
+		return "name", nil
+	case score:
+		return "score", nil
+	}
+	return "", nil
+}
+
+// tagScore is one entry of the ordered tags array sent when the request
+// asks for a sort order.
+type tagScore struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// orderedTags lists tags by descending score, or by name for sortName.
+// Equal scores fall back to the name so the order is stable.
+func orderedTags(tags map[string]float64, order string) []tagScore {
+	out := make([]tagScore, 0, len(tags))
+	for name, score := range tags {
+		out = append(out, tagScore{Name: name, Score: score})
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if order != sortName && out[a].Score != out[b].Score {
+			return out[a].Score > out[b].Score
+		}
+		return out[a].Name < out[b].Name
+	})
+	return out
+}
+
+// MarshalJSON encodes tags as a map unless the request asked for a sort
+// order or fields. JSON objects are unordered, so an ordered result is an
+// array of {name, score} instead, projected onto the requested fields.
+func (p prediction) MarshalJSON() ([]byte, error) {
+	type plain prediction
+	if p.tagOrder == "" && p.tagFields == "" {
+		return json.Marshal(plain(p))
+	}
+	order := p.tagOrder
+	if order == "" {
+		order = sortScore
+	}
+	tags := orderedTags(p.Tags, order)
+	if p.tagFields == "" || p.tagFields == "name,score" {
+		return json.Marshal(struct {
+			plain
+			Tags []tagScore `json:"tags"`
+		}{plain(p), tags})
+	}
+	projected := make([]map[string]any, len(tags))
+	for i, tag := range tags {
+		if p.tagFields == "name" {
+			projected[i] = map[string]any{"name": tag.Name}
+		} else {
+			projected[i] = map[string]any{"score": tag.Score}
+		}
+	}
+	return json.Marshal(struct {
+		plain
+		Tags []map[string]any `json:"tags"`
+	}{plain(p), projected})
+}
+
+// textTagNames returns the tag names for text output: alphabetical, as
+// Danbooru's tag box takes them, unless sort=score was asked for.
+func textTagNames(pred prediction) string {
+	if pred.tagOrder != sortScore {
+		return tagText(pred.Tags)
+	}
+	names := make([]string, 0, len(pred.Tags))
+	for _, tag := range orderedTags(pred.Tags, sortScore) {
+		names = append(names, tag.Name)
+	}
+	return strings.Join(names, " ")
+}
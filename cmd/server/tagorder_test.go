@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		ordered bool
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "", ordered: true, want: sortScore},
+		{raw: "name", want: sortName},
+		{raw: "name", ordered: true, want: sortName},
+		{raw: " Score ", want: sortScore},
+		{raw: "random", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseSort(tc.raw, tc.ordered)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseSort(%q, %v) = %q, %v; want %q, error %v", tc.raw, tc.ordered, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "name", want: "name"},
+		{raw: " Score", want: "score"},
+		{raw: "score,name", want: "name,score"},
+		{raw: "name,category", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseFields(tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("parseFields(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestPredictionTagFields(t *testing.T) {
+	t.Parallel()
+
+	tags := map[string]float64{"solo": 0.9, "smile": 0.4, "blush": 0.7}
+	tests := []struct {
+		order, fields string
+		want          string
+	}{
+		{"", "name", `{"filename":"a.png","tags":[{"name":"solo"},{"name":"blush"},{"name":"smile"}]}`},
+		{sortName, "name", `{"filename":"a.png","tags":[{"name":"blush"},{"name":"smile"},{"name":"solo"}]}`},
+		{"", "score", `{"filename":"a.png","tags":[{"score":0.9},{"score":0.7},{"score":0.4}]}`},
+		{"", "name,score", `{"filename":"a.png","tags":[{"name":"solo","score":0.9},{"name":"blush","score":0.7},{"name":"smile","score":0.4}]}`},
+	}
+	for _, tc := range tests {
+		data, err := json.Marshal(prediction{Filename: "a.png", Tags: tags, tagOrder: tc.order, tagFields: tc.fields})
+		if err != nil {
+			t.Fatalf("%q/%q: Marshal() error = %v", tc.order, tc.fields, err)
+		}
+		if string(data) != tc.want {
+			t.Fatalf("%q/%q: json = %s, want %s", tc.order, tc.fields, data, tc.want)
+		}
+	}
+}
+
+func TestPredictionTagOrder(t *testing.T) {
+	t.Parallel()
+
+	tags := map[string]float64{"solo": 0.9, "1girl": 0.9, "smile": 0.4, "blush": 0.7}
+	tests := []struct {
+		order    string
+		wantJSON string
+		wantText string
+	}{
+		{"", `{"filename":"a.png","tags":{"1girl":0.9,"blush":0.7,"smile":0.4,"solo":0.9}}`, "1girl blush smile solo"},
+		{sortName, `{"filename":"a.png","tags":[{"name":"1girl","score":0.9},{"name":"blush","score":0.7},{"name":"smile","score":0.4},{"name":"solo","score":0.9}]}`, "1girl blush smile solo"},
+		{sortScore, `{"filename":"a.png","tags":[{"name":"1girl","score":0.9},{"name":"solo","score":0.9},{"name":"blush","score":0.7},{"name":"smile","score":0.4}]}`, "1girl solo blush smile"},
+	}
+	for _, tc := range tests {
+		pred := prediction{Filename: "a.png", Tags: tags, tagOrder: tc.order}
+		data, err := json.Marshal(pred)
+		if err != nil {
+			t.Fatalf("%q: Marshal() error = %v", tc.order, err)
+		}
+		if string(data) != tc.wantJSON {
+			t.Fatalf("%q: json = %s, want %s", tc.order, data, tc.wantJSON)
+		}
+		var buf bytes.Buffer
+		if err := writeTextResults(&buf, []prediction{pred}, true); err != nil {
+			t.Fatalf("%q: writeTextResults() error = %v", tc.order, err)
+		}
+		if got := buf.String(); got != tc.wantText+"\n" {
+			t.Fatalf("%q: text = %q, want %q", tc.order, got, tc.wantText)
+		}
+	}
+}
+
+func TestResultRecordKeepsTagMap(t *testing.T) {
+	t.Parallel()
+
+	rec := resultRecord{RequestID: "r1", prediction: prediction{Filename: "a.png", Tags: map[string]float64{"solo": 0.9}, tagOrder: sortScore}}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	want := `{"time":"0001-01-01T00:00:00Z","request_id":"r1","filename":"a.png","tags":{"solo":0.9}}`
+	if string(data) != want {
+		t.Fatalf("json = %s, want %s", data, want)
+	}
+}
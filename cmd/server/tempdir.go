@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	uploadDirPattern   = "autotagger-upload-*"
+	defaultTempDirTTL  = time.Hour
+	minJanitorInterval = time.Minute
+)
+
+// prepareTempDir creates TEMP_DIR if it does not exist. An empty dir means
+// the OS default, which is left alone.
+func prepareTempDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	return os.MkdirAll(dir, 0o700)
+}
+
+// sweepUploadDirs removes upload directories under base last modified more
+// than ttl before now. Requests remove their own directory when they finish,
+// so anything this old was left behind by a crash or panic.
+func sweepUploadDirs(base string, ttl time.Duration, now time.Time) (int, error) {
+	if base == "" {
+		base = os.TempDir()
+	}
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return 0, err
+	}
+	prefix := strings.TrimSuffix(uploadDirPattern, "*")
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < ttl {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(base, entry.Name())); err != nil {
+			slog.Warn("remove stale upload dir failed", "dir", entry.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// tempJanitor sweeps stale upload directories every half TTL until ctx is
+// done. A non-positive ttl disables it.
+func tempJanitor(ctx context.Context, base string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(ttl/2, minJanitorInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := sweepUploadDirs(base, ttl, time.Now())
+			if err != nil {
+				slog.Warn("temp dir sweep failed", "error", err)
+				continue
+			}
+			slog.Info("temp dir sweep", "removed", removed)
+		}
+	}
+}
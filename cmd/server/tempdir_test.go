@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepUploadDirs(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	for _, name := range []string{"autotagger-upload-old", "autotagger-upload-new", "unrelated-old"} {
+		dir := filepath.Join(base, name)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if name != "autotagger-upload-new" {
+			if err := os.Chtimes(dir, old, old); err != nil {
+				t.Fatalf("Chtimes() error = %v", err)
+			}
+		}
+	}
+
+	removed, err := sweepUploadDirs(base, time.Hour, now)
+	if err != nil || removed != 1 {
+		t.Fatalf("sweepUploadDirs() = %d, %v; want 1, nil", removed, err)
+	}
+	for name, want := range map[string]bool{"autotagger-upload-old": false, "autotagger-upload-new": true, "unrelated-old": true} {
+		_, err := os.Stat(filepath.Join(base, name))
+		if exists := err == nil; exists != want {
+			t.Fatalf("%s exists = %v, want %v", name, exists, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// transcodedTypes are the image types the worker cannot read. When
+// ALLOWED_IMAGE_TYPES lets them in, they are rewritten as PNG before
+// anything else looks at them.
+var transcodedTypes = map[string]bool{"image/tiff": true, "image/bmp": true}
+
+// sniffImageType is http.DetectContentType plus TIFF, which it does not
+// recognize.
+func sniffImageType(head []byte) string {
+	if len(head) >= 4 && (string(head[:4]) == "II*\x00" || string(head[:4]) == "MM\x00*") {
+		return "image/tiff"
+	}
+	return http.DetectContentType(head)
+}
+
+// convertRasterUpload rewrites an allowed TIFF or BMP upload as PNG in
+// place and reports whether it did. Scans often arrive as multi-page TIFFs;
+// those are rejected rather than tagged by their first page alone.
+func (s *server) convertRasterUpload(path, name string) (bool, error) {
+	head, err := readFileHead(path, 512)
+	if err != nil {
+		return false, fmt.Errorf("failed to read upload: %w", err)
+	}
+	mimeType := sniffImageType(head)
+	if !transcodedTypes[mimeType] || !s.imageTypes[mimeType] {
+		return false, nil
+	}
+	if mimeType == "image/tiff" {
+		pages, err := tiffPageCount(path)
+		if err != nil {
+			return false, unsupportedImage(name, mimeType, fmt.Sprintf("file %q is not a readable TIFF", name))
+		}
+		if pages > 1 {
+			return false, unsupportedImage(name, mimeType, fmt.Sprintf("file %q is a TIFF with %d pages; upload each page as its own image", name, pages))
+		}
+	}
+
+	s.decodeSem <- struct{}{}
+	defer func() { <-s.decodeSem }()
+	if err := transcodeToPNG(path); err != nil {
+		return false, unsupportedImage(name, mimeType, fmt.Sprintf("file %q is not a decodable image", name))
+	}
+	return true, nil
+}
+
+// transcodeToPNG decodes the image at path with the registered decoders and
+// overwrites it with the PNG encoding.
+func transcodeToPNG(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".png"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tiffPageCount follows the chain of image file directories of the TIFF at
+// path. tiff.Decode only reads the first one.
+func tiffPageCount(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var header [8]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return 0, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(header[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+	offset := int64(order.Uint32(header[4:]))
+	pages := 0
+	seen := make(map[int64]bool)
+	for offset != 0 {
+		if seen[offset] || pages >= 10000 {
+			return 0, tiff.FormatError("IFD chain loops")
+		}
+		seen[offset] = true
+		var count [2]byte
+		if _, err := f.ReadAt(count[:], offset); err != nil {
+			return 0, err
+		}
+		var next [4]byte
+		if _, err := f.ReadAt(next[:], offset+2+int64(order.Uint16(count[:]))*12); err != nil {
+			return 0, err
+		}
+		pages++
+		offset = int64(order.Uint32(next[:]))
+	}
+	return pages, nil
+}
+
+// unsupportedImage rejects one input with the type it was detected as.
+func unsupportedImage(name, mimeType, message string) error {
+	reqErr := badRequest(message)
+	reqErr.code = codeUnsupportedFile
+	reqErr.details = map[string]string{"filename": name, "mime_type": mimeType}
+	return reqErr
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func TestConvertRasterUpload(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	var tiffBuf, bmpBuf bytes.Buffer
+	if err := tiff.Encode(&tiffBuf, img, nil); err != nil {
+		t.Fatalf("tiff.Encode() error = %v", err)
+	}
+	if err := bmp.Encode(&bmpBuf, img); err != nil {
+		t.Fatalf("bmp.Encode() error = %v", err)
+	}
+	// Chain an empty second directory onto the TIFF to make it two pages.
+	multi := bytes.Clone(tiffBuf.Bytes())
+	ifd := binary.LittleEndian.Uint32(multi[4:])
+	next := ifd + 2 + uint32(binary.LittleEndian.Uint16(multi[ifd:]))*12
+	binary.LittleEndian.PutUint32(multi[next:], uint32(len(multi)))
+	multi = append(multi, make([]byte, 6)...)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		allowed       string
+		wantConverted bool
+		wantErr       bool
+	}{
+		{name: "scan.tiff", data: tiffBuf.Bytes(), allowed: "tiff", wantConverted: true},
+		{name: "paint.bmp", data: bmpBuf.Bytes(), allowed: "bmp", wantConverted: true},
+		{name: "pages.tiff", data: multi, allowed: "tiff", wantErr: true},
+		{name: "disabled.tiff", data: tiffBuf.Bytes(), allowed: "jpeg,png"},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(t.TempDir(), tc.name)
+		if err := os.WriteFile(path, tc.data, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		s := newServer(nil, 1, 32, 16, 8, 200)
+		s.imageTypes = parseImageTypes(tc.allowed)
+		converted, err := s.convertRasterUpload(path, tc.name)
+		var reqErr *requestError
+		if tc.wantErr {
+			if !errors.As(err, &reqErr) || reqErr.code != codeUnsupportedFile {
+				t.Fatalf("%s: convertRasterUpload() error = %v, want UnsupportedFile", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || converted != tc.wantConverted {
+			t.Fatalf("%s: convertRasterUpload() = %v, %v; want %v, nil", tc.name, converted, err, tc.wantConverted)
+		}
+		if tc.wantConverted {
+			head, _ := readFileHead(path, 512)
+			if got := sniffImageType(head); got != "image/png" {
+				t.Fatalf("%s: converted type = %s, want image/png", tc.name, got)
+			}
+		}
+		// An allowed original passes checkImage even without PNG on the
+		// list; a disabled one is rejected under its own type.
+		if err := os.WriteFile(path, tc.data, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := s.checkImage(path, tc.name); (err == nil) != tc.wantConverted {
+			t.Fatalf("%s: checkImage() error = %v", tc.name, err)
+		}
+	}
+}
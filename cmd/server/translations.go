@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tagTranslations maps a language code to display names keyed by canonical
+// tag name, as loaded from TAG_TRANSLATIONS:
+//
+//	{"ja": {"1girl": "女の子一人", "hatsune_miku": "初音ミク"}}
+type tagTranslations map[string]map[string]string
+
+// loadTagTranslations reads the TAG_TRANSLATIONS file. An empty path loads
+// nothing. Language codes are lowercased.
+func loadTagTranslations(path string) (tagTranslations, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	t := make(tagTranslations, len(raw))
+	for lang, names := range raw {
+		t[normalizeLang(lang)] = names
+	}
+	return t, nil
+}
+
+// normalizeLang lowercases a language code and uses - as its separator.
+func normalizeLang(lang string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(lang)), "_", "-")
+}
+
+// names returns the display names for lang, falling back from a regional
+// code such as pt-br to its base language.
+func (t tagTranslations) names(lang string) map[string]string {
+	if names, ok := t[lang]; ok {
+		return names
+	}
+	base, _, _ := strings.Cut(lang, "-")
+	return t[base]
+}
+
+// translate fills pred.Translations with the display name of every tag and
+// rating tag in lang. Tags without a translation keep their canonical name.
+func (t tagTranslations) translate(pred *prediction, lang string) {
+	names := t.names(lang)
+	pred.Translations = make(map[string]string, len(pred.Tags)+len(pred.Rating))
+	for _, scores := range []map[string]float64{pred.Tags, pred.Rating} {
+		for tag := range scores {
+			name, ok := names[tag]
+			if !ok || name == "" {
+				name = tag
+			}
+			pred.Translations[tag] = name
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadTagTranslations(t *testing.T) {
+	t.Parallel()
+
+	if got, err := loadTagTranslations(""); got != nil || err != nil {
+		t.Fatalf("loadTagTranslations(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "translations.json")
+	if err := os.WriteFile(path, []byte(`{"JA": {"1girl": "女の子一人"}, "pt_BR": {"cat": "gato"}}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	got, err := loadTagTranslations(path)
+	if err != nil {
+		t.Fatalf("loadTagTranslations() error = %v", err)
+	}
+	want := tagTranslations{"ja": {"1girl": "女の子一人"}, "pt-br": {"cat": "gato"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loadTagTranslations() = %v, want %v", got, want)
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"ja": ["1girl"]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := loadTagTranslations(broken); err == nil {
+		t.Fatal("loadTagTranslations() accepted a list of tags")
+	}
+}
+
+func TestTagTranslationsTranslate(t *testing.T) {
+	t.Parallel()
+
+	tr := tagTranslations{"ja": {"1girl": "女の子一人", "general": "全年齢"}}
+	tests := []struct {
+		lang string
+		want map[string]string
+	}{
+		{"ja", map[string]string{"1girl": "女の子一人", "solo": "solo", "general": "全年齢"}},
+		{"ja-jp", map[string]string{"1girl": "女の子一人", "solo": "solo", "general": "全年齢"}},
+		{"fr", map[string]string{"1girl": "1girl", "solo": "solo", "general": "general"}},
+	}
+	for _, tc := range tests {
+		pred := prediction{Tags: map[string]float64{"1girl": 0.9, "solo": 0.8}, Rating: map[string]float64{"general": 0.7}}
+		tr.translate(&pred, tc.lang)
+		if !reflect.DeepEqual(pred.Translations, tc.want) {
+			t.Fatalf("translate(%q) = %v, want %v", tc.lang, pred.Translations, tc.want)
+		}
+	}
+
+	// Without a TAG_TRANSLATIONS file every tag keeps its canonical name.
+	pred := prediction{Tags: map[string]float64{"1girl": 0.9}}
+	tagTranslations(nil).translate(&pred, "ja")
+	if pred.Translations["1girl"] != "1girl" {
+		t.Fatalf("translate() without translations = %v", pred.Translations)
+	}
+}
+
+func TestEvaluateHTMLTranslations(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, []byte("png"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	pred := prediction{Filename: "a.png", Tags: map[string]float64{"hatsune_miku": 0.9}, Translations: map[string]string{"hatsune_miku": "初音ミク"}}
+	results, err := buildHTMLResults([]string{path}, []prediction{pred}, defaultPreviewMaxDim)
+	if err != nil {
+		t.Fatalf("buildHTMLResults() error = %v", err)
+	}
+	var out strings.Builder
+	page := evaluatePage{Results: results, WikiBaseURL: defaultWikiBaseURL, SearchBaseURL: defaultSearchBaseURL}
+	if err := newServer(nil, 1, 32, 16, 8, 200).evalTmpl.Execute(&out, page); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	for _, want := range []string{`>初音ミク</a>`, `wiki_pages/hatsune_miku"`, `tags=hatsune_miku"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("rendered HTML has no %s:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// workerInfo is the model metadata a worker reports in its startup
+// handshake.
+type workerInfo struct {
+	Model      string `json:"model"`
+	Arch       string `json:"arch,omitempty"`
+	NumClasses int    `json:"num_classes,omitempty"`
+	Device     string `json:"device,omitempty"`
+}
+
+// defaultWorkerStartupTimeout bounds how long startup waits for the workers
+// to load their model; see workerPool.waitReady.
+const defaultWorkerStartupTimeout = 5 * time.Minute
+
+// handshake asks the worker for its model metadata and caches the answer.
+// The worker only reads stdin once the model is loaded, so the answer is
+// also its ready signal: ready is closed once it arrives, or once the worker
+// fails to answer. Workers that predate the handshake answer with an empty
+// prediction list and are left without info.
+func (wc *workerClient) handshake() {
+	defer close(wc.ready)
+	respCh := make(chan workerResponse, 1)
+	if _, err := wc.send(workerRequest{Files: []string{}, Info: true}, respCh); err != nil {
+		slog.Warn("worker handshake failed", "error", err)
+		return
+	}
+
+	resp := <-respCh
+	switch {
+	case resp.Error != "":
+		slog.Warn("worker handshake failed", "error", resp.Error)
+	case resp.Info != nil:
+		wc.info.Store(resp.Info)
+		slog.Info("worker ready", "pid", wc.cmd.Process.Pid, "model", resp.Info.Model, "arch", resp.Info.Arch, "device", resp.Info.Device)
+	}
+}
+
+// loaded reports whether the worker has answered its handshake. A client
+// built without newWorkerClient has no handshake and counts as loaded.
+func (wc *workerClient) loaded() bool {
+	if wc.ready == nil {
+		return true
+	}
+	select {
+	case <-wc.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+type workerVersion struct {
+	Index         int         `json:"index"`
+	PID           int         `json:"pid,omitempty"`
+	Alive         bool        `json:"alive"`
+	UptimeSeconds float64     `json:"uptime_seconds"`
+	Info          *workerInfo `json:"info,omitempty"`
+}
+
+func (wp *workerPool) versions() []workerVersion {
+	if wp == nil {
+		return []workerVersion{}
+	}
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	versions := make([]workerVersion, 0, len(wp.workers))
+	for i, w := range wp.workers {
+		v := workerVersion{Index: i, Alive: !w.closed.Load(), Info: w.info.Load()}
+		if w.cmd != nil && w.cmd.Process != nil {
+			v.PID = w.cmd.Process.Pid
+		}
+		if v.Alive {
+			v.UptimeSeconds = time.Since(w.started).Seconds()
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+type buildVersion struct {
+	GoVersion string `json:"go_version"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func readBuildVersion() buildVersion {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildVersion{Version: "unknown"}
+	}
+	v := buildVersion{GoVersion: info.GoVersion, Version: info.Main.Version}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			v.Revision = setting.Value
+		case "vcs.time":
+			v.Time = setting.Value
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+// handleVersion reports the running build and, for the model selected by
+// the model query parameter, the worker script and what each worker said
+// about its model when it started. models lists every selectable model.
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	model, err := s.resolveModel(r.URL.Query().Get("model"))
+	if err != nil {
+		s.writeRequestError(w, "json", err)
+		return
+	}
+	pool, _ := s.workersFor(model)
+	script := ""
+	if pool != nil {
+		script = pool.script
+	}
+	if model == "" {
+		model = s.defaultModel
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Build   buildVersion    `json:"build"`
+		Model   string          `json:"model"`
+		Models  []string        `json:"models"`
+		Script  string          `json:"script"`
+		Workers []workerVersion `json:"workers"`
+	}{
+		Build:   readBuildVersion(),
+		Model:   model,
+		Models:  s.modelNames(),
+		Script:  script,
+		Workers: pool.versions(),
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var errNoVocab = errors.New("worker does not support listing tags")
+
+// vocabTag is one label of the model's vocabulary.
+type vocabTag struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// vocab asks the worker for the model's full tag list.
+func (wc *workerClient) vocab(ctx context.Context) ([]vocabTag, error) {
+	if wc.closed.Load() {
+		return nil, errWorkerNotRunning
+	}
+	wc.inflight.Add(1)
+	defer wc.inflight.Add(-1)
+
+	respCh := make(chan workerResponse, 1)
+	id, err := wc.send(workerRequest{RequestID: requestIDFrom(ctx), Files: []string{}, Vocab: true}, respCh)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respCh:
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		// Workers that predate the command answer with an empty prediction list.
+		if resp.Vocab == nil {
+			return nil, errNoVocab
+		}
+		for i := range resp.Vocab {
+			if resp.Vocab[i].Category == "" {
+				resp.Vocab[i].Category = defaultTagCategory
+			}
+		}
+		return resp.Vocab, nil
+	case <-ctx.Done():
+		wc.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// vocab asks the least loaded live worker for the tag list.
+func (wp *workerPool) vocab(ctx context.Context) ([]vocabTag, error) {
+	_, w := wp.leastLoaded(nil)
+	if w == nil {
+		if wp.anyRestarting() {
+			return nil, errWorkerRestarting
+		}
+		return nil, errWorkerNotRunning
+	}
+	return w.vocab(ctx)
+}
+
+// vocabCache holds the tag list once a worker has reported it. Every worker
+// runs the same model, so one answer serves until the workers are reloaded.
+type vocabCache struct {
+	mu   sync.Mutex
+	tags []vocabTag
+}
+
+func (vc *vocabCache) get(ctx context.Context, wp *workerPool) ([]vocabTag, error) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.tags != nil {
+		return vc.tags, nil
+	}
+	if wp == nil {
+		return nil, errWorkerNotRunning
+	}
+	tags, err := wp.vocab(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vc.tags = tags
+	return tags, nil
+}
+
+func (vc *vocabCache) reset() {
+	vc.mu.Lock()
+	vc.tags = nil
+	vc.mu.Unlock()
+}
+
+// filterVocab keeps the tags in category, if given, whose names start with
+// prefix.
+func filterVocab(tags []vocabTag, category, prefix string) []vocabTag {
+	out := make([]vocabTag, 0, len(tags))
+	for _, tag := range tags {
+		if category != "" && tag.Category != category {
+			continue
+		}
+		if !strings.HasPrefix(tag.Name, prefix) {
+			continue
+		}
+		out = append(out, tag)
+	}
+	return out
+}
+
+// handleTags lists the vocabulary of the model selected by the model query
+// parameter, optionally narrowed by the category and prefix parameters.
+func (s *server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	model, err := s.resolveModel(query.Get("model"))
+	if err != nil {
+		s.writeRequestError(w, "json", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.predictTimeout)
+	defer cancel()
+	pool, cache := s.workersFor(model)
+	tags, err := cache.get(ctx, pool)
+	if err != nil {
+		if errors.Is(err, errNoVocab) {
+			s.writeError(w, "json", http.StatusNotImplemented, codeNotImplemented, err.Error())
+			return
+		}
+		s.writePredictError(ctx, w, "json", err)
+		return
+	}
+
+	category := strings.ToLower(strings.TrimSpace(query.Get("category")))
+	tags = filterVocab(tags, category, query.Get("prefix"))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Count int        `json:"count"`
+		Tags  []vocabTag `json:"tags"`
+	}{
+		Count: len(tags),
+		Tags:  tags,
+	})
+}
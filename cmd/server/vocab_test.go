@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleTags(t *testing.T) {
+	t.Parallel()
+
+	s := newServer(nil, 1, 32, 16, 8, 200)
+	rr := httptest.NewRecorder()
+	s.handleTags(rr, httptest.NewRequest(http.MethodGet, "/tags", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status without workers = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	s.vocab.tags = []vocabTag{
+		{Name: "1girl", Category: "general"},
+		{Name: "hatsune_miku", Category: "character"},
+		{Name: "hat", Category: "general"},
+		{Name: "unknown_tag", Category: defaultTagCategory},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"1girl", "hatsune_miku", "hat", "unknown_tag"}},
+		{"?category=general", []string{"1girl", "hat", "unknown_tag"}},
+		{"?category=Character", []string{"hatsune_miku"}},
+		{"?prefix=hat", []string{"hatsune_miku", "hat"}},
+		{"?category=general&prefix=hat", []string{"hat"}},
+		{"?category=meta", []string{}},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		s.handleTags(rr, httptest.NewRequest(http.MethodGet, "/tags"+tc.query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want %d", tc.query, rr.Code, http.StatusOK)
+		}
+		var got struct {
+			Count int        `json:"count"`
+			Tags  []vocabTag `json:"tags"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%q: Unmarshal() error = %v", tc.query, err)
+		}
+		if got.Count != len(tc.want) || len(got.Tags) != len(tc.want) {
+			t.Fatalf("%q: got %+v, want %v", tc.query, got, tc.want)
+		}
+		for i, name := range tc.want {
+			if got.Tags[i].Name != name {
+				t.Fatalf("%q: tags[%d] = %q, want %q", tc.query, i, got.Tags[i].Name, name)
+			}
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	s.handleTags(rr, httptest.NewRequest(http.MethodPost, "/tags", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+	s.vocab.reset()
+	if s.vocab.tags != nil {
+		t.Fatal("reset() kept the cached tags")
+	}
+}
@@ -3,49 +3,263 @@
 import json
 import logging
 import os
+import queue
+import struct
 import sys
+import threading
 from pathlib import Path
 
-from autotagger import Autotagger
+from autotagger import Autotagger, PredictionCancelled
+from autotagger.autotagger import MODEL_NAME
 
 
 logging.basicConfig(level=logging.INFO, format="%(asctime)s %(levelname)s %(message)s")
 
+# stdout carries the protocol; send stray prints from libraries to stderr so
+# they cannot corrupt a response line.
+PROTOCOL_OUT = sys.stdout
+sys.stdout = sys.stderr
+
+# "lines" sends one JSON message per line; "framed" prefixes each message with
+# its length as a 4-byte big-endian integer.
+FRAMED = os.getenv("WORKER_PROTOCOL", "lines") == "framed"
+
 
 def build_tagger() -> Autotagger:
     model_path = os.getenv("MODEL_PATH", "models/model.pth")
     return Autotagger(model_path)
 
 
-def predict_files(tagger: Autotagger, files: list[str], threshold: float, limit: int):
+def load_categories() -> dict[str, str]:
+    path = Path(os.getenv("TAG_CATEGORIES", "data/tag_categories.json"))
+    if not path.is_file():
+        return {}
+    with path.open("r", encoding="utf-8") as categories_file:
+        categories = json.load(categories_file)
+    logging.info("Loaded %d tag categories from %s", len(categories), path)
+    return categories
+
+
+def build_result(name: str, tags: dict[str, float], categories: dict[str, str], seconds=None):
+    result = {"filename": name, "tags": tags}
+    if seconds is not None:
+        result["duration_ms"] = round(seconds * 1000, 1)
+    if categories:
+        result["categories"] = {tag: categories[tag] for tag in tags if tag in categories}
+    return result
+
+
+def apply_category_thresholds(tags: dict[str, float], threshold: float, limit: int, category_thresholds: dict[str, float], categories: dict[str, str]):
+    kept = [
+        (tag, score)
+        for tag, score in tags.items()
+        if score >= category_thresholds.get(categories.get(tag, "general"), threshold)
+    ]
+    kept.sort(key=lambda pair: pair[1], reverse=True)
+    return dict(kept[:limit])
+
+
+def error_result(name: str, err: Exception):
+    return {"filename": name, "tags": {}, "error": f"{type(err).__name__}: {err}"}
+
+
+def predict_files(tagger: Autotagger, files: list[str], threshold: float, limit: int, categories: dict[str, str], category_thresholds=None, on_result=None, should_stop=None):
     names = [Path(path).name for path in files]
-    predictions = tagger.predict(files, threshold=threshold, limit=limit)
-    return [{"filename": name, "tags": tags} for name, tags in zip(names, predictions)]
+    errors = {}
+
+    def finish(tags):
+        if category_thresholds:
+            tags = apply_category_thresholds(tags, threshold, limit, category_thresholds, categories)
+        return tags
+
+    # With per-category thresholds the model is run at the lowest of them and
+    # without a limit; each tag is then held to its own category's threshold
+    # and the limit is applied afterwards.
+    run_threshold, run_limit = threshold, limit
+    if category_thresholds:
+        run_threshold = min([threshold, *category_thresholds.values()])
+        run_limit = len(tagger.vocab)
+
+    # A file that cannot be loaded gets its own error result; the rest of the
+    # batch is still tagged.
+    def on_error(index, err):
+        logging.warning("file=%s failed: %s", names[index], err)
+        errors[index] = error_result(names[index], err)
+        if on_result is not None:
+            on_result(errors[index])
+
+    timings = {}
+    callback = None
+    if on_result is not None:
+        callback = lambda index, tags: on_result(build_result(names[index], finish(tags), categories, timings.get(index)))
+    predictions = tagger.predict(files, threshold=run_threshold, limit=run_limit, on_result=callback, on_error=on_error, timings=timings, should_stop=should_stop)
+    return [
+        errors[index] if index in errors else build_result(name, finish(tags), categories, timings.get(index))
+        for index, (name, tags) in enumerate(zip(names, predictions))
+    ]
+
+
+def worker_info(tagger: Autotagger):
+    return {
+        "model": str(tagger.model_path),
+        "arch": MODEL_NAME,
+        "num_classes": len(tagger.vocab),
+        "device": tagger.device.type,
+    }
+
+
+def worker_vocab(tagger: Autotagger, categories: dict[str, str]):
+    return [
+        {"name": tag, "category": categories[tag]} if tag in categories else {"name": tag}
+        for tag in tagger.vocab
+    ]
+
+
+def read_requests():
+    if not FRAMED:
+        for line in sys.stdin:
+            line = line.strip()
+            if line:
+                yield line
+        return
+    stdin = sys.stdin.buffer
+    while True:
+        header = stdin.read(4)
+        if len(header) < 4:
+            return
+        (size,) = struct.unpack(">I", header)
+        payload = stdin.read(size)
+        if len(payload) < size:
+            return
+        yield payload.decode("utf-8")
+
+
+class Cancellations:
+    """Request IDs the server gave up on. The server sends {"cancel": id}
+    when a client disconnects or times out; a request is only aborted between
+    batches, and still gets an error response."""
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._ids = set()
+
+    def add(self, request_id) -> None:
+        with self._lock:
+            self._ids.add(request_id)
+
+    def take(self, request_id) -> bool:
+        """Reports whether request_id was canceled, forgetting it and any
+        older ID: the server numbers requests in increasing order, so a cancel
+        that arrived after its request finished can be dropped here."""
+        with self._lock:
+            canceled = request_id in self._ids
+            if isinstance(request_id, int):
+                self._ids = {i for i in self._ids if isinstance(i, int) and i > request_id}
+            return canceled
+
+    def __contains__(self, request_id) -> bool:
+        with self._lock:
+            return request_id in self._ids
+
+
+def start_reader(cancellations: Cancellations) -> queue.Queue:
+    """Reads stdin on a thread so that a cancel message is seen while the main
+    loop is busy tagging. Requests are queued in order, then None at EOF."""
+    requests = queue.Queue()
+
+    def run():
+        for line in read_requests():
+            try:
+                msg = json.loads(line)
+            except ValueError:
+                msg = None
+            if isinstance(msg, dict) and "cancel" in msg:
+                cancellations.add(msg["cancel"])
+                continue
+            requests.put(line)
+        requests.put(None)
+
+    threading.Thread(target=run, daemon=True).start()
+    return requests
+
+
+def write_response(res) -> None:
+    data = json.dumps(res, ensure_ascii=False)
+    if FRAMED:
+        payload = data.encode("utf-8")
+        PROTOCOL_OUT.buffer.write(struct.pack(">I", len(payload)) + payload)
+    else:
+        PROTOCOL_OUT.write(data + "\n")
+    PROTOCOL_OUT.flush()
 
 
 def main() -> int:
     tagger = build_tagger()
+    categories = load_categories()
+    cancellations = Cancellations()
+    requests = start_reader(cancellations)
 
-    for line in sys.stdin:
-        line = line.strip()
-        if not line:
-            continue
-
-        req_id = None
+    for line in iter(requests.get, None):
+        head = {"id": None}
+        request_id = None
         try:
             req = json.loads(line)
-            req_id = req.get("id")
+            head["id"] = req.get("id")
+            request_id = req.get("request_id")
+            if request_id:
+                head["request_id"] = request_id
+            if cancellations.take(head["id"]):
+                raise PredictionCancelled("canceled before it started")
+            should_stop = lambda: head["id"] in cancellations
+            if req.get("info"):
+                write_response({**head, "info": worker_info(tagger)})
+                continue
+            if req.get("vocab"):
+                write_response({**head, "vocab": worker_vocab(tagger, categories)})
+                continue
+            if req.get("ping"):
+                # Health check from the server: answering at all is the point.
+                write_response({**head, "predictions": []})
+                continue
+
             files = req.get("files", [])
             threshold = float(req.get("threshold", 0.1))
             limit = int(req.get("limit", 50))
+            category_thresholds = {
+                str(category): float(value)
+                for category, value in (req.get("category_thresholds") or {}).items()
+            }
+            mode = req.get("mode") or "threshold"
+            if mode == "topk":
+                # Exactly `limit` tags by score, however low they are.
+                threshold, category_thresholds = 0.0, {}
+            elif mode == "all":
+                # Every score, for calibration; the server trims the result.
+                threshold, limit, category_thresholds = 0.0, len(tagger.vocab), {}
+            elif mode != "threshold":
+                raise ValueError(f"unknown mode {mode!r}")
+            logging.info("request_id=%s files=%d mode=%s threshold=%s limit=%d", request_id, len(files), mode, threshold, limit)
 
-            predictions = predict_files(tagger, files, threshold, limit)
-            res = {"id": req_id, "predictions": predictions}
+            if req.get("stream"):
+                # Each file is sent as soon as its batch finishes; the final
+                # line only marks the request complete.
+                predict_files(
+                    tagger, files, threshold, limit, categories, category_thresholds,
+                    on_result=lambda result: write_response({**head, "prediction": result}),
+                    should_stop=should_stop,
+                )
+                res = {**head, "done": True}
+            else:
+                predictions = predict_files(tagger, files, threshold, limit, categories, category_thresholds, should_stop=should_stop)
+                res = {**head, "predictions": predictions}
+        except PredictionCancelled as e:
+            logging.info("request_id=%s %s", request_id, e)
+            res = {**head, "error": f"{type(e).__name__}: {e}"}
         except Exception as e:
-            res = {"id": req_id, "error": f"{type(e).__name__}: {e}"}
+            logging.exception("request_id=%s failed", request_id)
+            res = {**head, "error": f"{type(e).__name__}: {e}"}
 
-        sys.stdout.write(json.dumps(res, ensure_ascii=False) + "\n")
-        sys.stdout.flush()
+        write_response(res)
 
     return 0
 